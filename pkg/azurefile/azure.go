@@ -27,6 +27,7 @@ import (
 	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2022-07-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
 
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -165,6 +166,29 @@ func getKubeConfig(kubeconfig string, enableWindowsHostProcess bool) (config *re
 	return config, err
 }
 
+// updateSubnetsServiceEndpoints enables storage service endpoint on the subnets of vnetResourceIDs,
+// SubnetsClient only manages subnets in the network resource subscription of the cluster
+func (d *Driver) updateSubnetsServiceEndpoints(ctx context.Context, vnetResourceIDs []string) error {
+	networkSubsID := d.cloud.SubscriptionID
+	if len(d.cloud.NetworkResourceSubscriptionID) > 0 {
+		networkSubsID = d.cloud.NetworkResourceSubscriptionID
+	}
+	for _, vnetResourceID := range vnetResourceIDs {
+		subsID, vnetResourceGroup, vnetName, subnetName, err := parseSubnetResourceID(vnetResourceID)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(subsID, networkSubsID) {
+			klog.Warningf("skip updating service endpoints of subnet(%s) since it's not in subscription(%s), storage service endpoint should be enabled on the subnet manually", vnetResourceID, networkSubsID)
+			continue
+		}
+		if err := d.updateSubnetServiceEndpoints(ctx, vnetResourceGroup, vnetName, subnetName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Driver) updateSubnetServiceEndpoints(ctx context.Context, vnetResourceGroup, vnetName, subnetName string) error {
 	if d.cloud.SubnetsClient == nil {
 		return fmt.Errorf("SubnetsClient is nil")
@@ -232,6 +256,105 @@ func (d *Driver) updateSubnetServiceEndpoints(ctx context.Context, vnetResourceG
 	return nil
 }
 
+// updateAccountVirtualNetworkRules adds vnetResourceIDs into the virtual network rules of storage account,
+// rules already in the account are skipped, it's a no-op if all the rules already exist
+func (d *Driver) updateAccountVirtualNetworkRules(ctx context.Context, subsID, resourceGroup, accountName string, vnetResourceIDs ...string) error {
+	if d.cloud.StorageAccountClient == nil {
+		return fmt.Errorf("StorageAccountClient is nil")
+	}
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	if resourceGroup == "" {
+		resourceGroup = d.cloud.ResourceGroup
+	}
+
+	lockKey := subsID + resourceGroup + accountName
+	d.subnetLockMap.LockEntry(lockKey)
+	defer d.subnetLockMap.UnlockEntry(lockKey)
+
+	account, rerr := d.cloud.StorageAccountClient.GetProperties(ctx, subsID, resourceGroup, accountName)
+	if rerr != nil {
+		return fmt.Errorf("failed to get properties of storage account(%s) rg(%s): %v", accountName, resourceGroup, rerr.Error())
+	}
+	networkRuleSet := &storage.NetworkRuleSet{DefaultAction: storage.DefaultActionAllow}
+	if account.AccountProperties != nil && account.AccountProperties.NetworkRuleSet != nil {
+		networkRuleSet = account.AccountProperties.NetworkRuleSet
+	}
+	var virtualNetworkRules []storage.VirtualNetworkRule
+	if networkRuleSet.VirtualNetworkRules != nil {
+		virtualNetworkRules = *networkRuleSet.VirtualNetworkRules
+	}
+	existingRules := make(map[string]bool)
+	for _, rule := range virtualNetworkRules {
+		existingRules[strings.ToLower(pointer.StringDeref(rule.VirtualNetworkResourceID, ""))] = true
+	}
+	var addedRules []string
+	for _, vnetResourceID := range vnetResourceIDs {
+		if existingRules[strings.ToLower(vnetResourceID)] {
+			klog.V(4).Infof("virtual network rule(%s) is already in storage account(%s)", vnetResourceID, accountName)
+			continue
+		}
+		existingRules[strings.ToLower(vnetResourceID)] = true
+		addedRules = append(addedRules, vnetResourceID)
+		virtualNetworkRules = append(virtualNetworkRules, storage.VirtualNetworkRule{
+			VirtualNetworkResourceID: pointer.String(vnetResourceID),
+			Action:                   storage.ActionAllow,
+		})
+	}
+	if len(addedRules) == 0 {
+		return nil
+	}
+	networkRuleSet.VirtualNetworkRules = &virtualNetworkRules
+	parameters := storage.AccountUpdateParameters{
+		AccountPropertiesUpdateParameters: &storage.AccountPropertiesUpdateParameters{
+			NetworkRuleSet: networkRuleSet,
+		},
+	}
+	if rerr := d.cloud.StorageAccountClient.Update(ctx, subsID, resourceGroup, accountName, parameters); rerr != nil {
+		return fmt.Errorf("failed to add virtual network rules(%v) to storage account(%s) rg(%s): %v", addedRules, accountName, resourceGroup, rerr.Error())
+	}
+	klog.V(2).Infof("virtual network rules(%v) are appended in storage account(%s)", addedRules, accountName)
+	return nil
+}
+
+// parseSubnetResourceIDs parses comma separated subnet resource IDs in subnetTemplate format,
+// duplicate IDs(case insensitive) are removed
+func parseSubnetResourceIDs(ids string) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if _, _, _, _, err := parseSubnetResourceID(id); err != nil {
+			return nil, err
+		}
+		if !seen[strings.ToLower(id)] {
+			seen[strings.ToLower(id)] = true
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
+// parseSubnetResourceID returns <subsID, vnetResourceGroup, vnetName, subnetName> of a subnet resource ID, e.g.
+// /subscriptions/xxx/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet
+func parseSubnetResourceID(id string) (string, string, string, string, error) {
+	segments := strings.Split(strings.TrimPrefix(id, "/"), "/")
+	if len(segments) != 10 || !strings.EqualFold(segments[0], "subscriptions") || !strings.EqualFold(segments[2], "resourceGroups") ||
+		!strings.EqualFold(segments[4], "providers") || !strings.EqualFold(segments[5], "Microsoft.Network") ||
+		!strings.EqualFold(segments[6], "virtualNetworks") || !strings.EqualFold(segments[8], "subnets") {
+		return "", "", "", "", fmt.Errorf("invalid subnet resource ID(%s), should be in %s format", id, subnetTemplate)
+	}
+	for _, v := range []string{segments[1], segments[3], segments[7], segments[9]} {
+		if v == "" {
+			return "", "", "", "", fmt.Errorf("invalid subnet resource ID(%s), should be in %s format", id, subnetTemplate)
+		}
+	}
+	return segments[1], segments[3], segments[7], segments[9], nil
+}
+
 // inClusterConfig is copied from https://github.com/kubernetes/client-go/blob/b46677097d03b964eab2d67ffbb022403996f4d4/rest/config.go#L507-L541
 // When using Windows HostProcess containers, the path "/var/run/secrets/kubernetes.io/serviceaccount/" is under host, not container.
 // Then the token and ca.crt files would be not found.
@@ -20,6 +20,8 @@ limitations under the License.
 package azurefile
 
 import (
+	"fmt"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -35,6 +37,11 @@ func CleanupMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMoun
 	return nil
 }
 
+// getDiskFormat returns the filesystem type of the disk
+func getDiskFormat(m *mount.SafeFormatAndMount, disk string) (string, error) {
+	return "", fmt.Errorf("GetDiskFormat is not supported on darwin")
+}
+
 func preparePublishPath(path string, m *mount.SafeFormatAndMount) error {
 	return nil
 }
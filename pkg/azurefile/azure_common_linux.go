@@ -37,6 +37,11 @@ func CleanupMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMoun
 	return mount.CleanupMountPoint(target, m.Interface, true /*extensiveMountPointCheck*/)
 }
 
+// getDiskFormat returns the filesystem type of the disk
+func getDiskFormat(m *mount.SafeFormatAndMount, disk string) (string, error) {
+	return m.GetDiskFormat(disk)
+}
+
 func preparePublishPath(path string, m *mount.SafeFormatAndMount) error {
 	return nil
 }
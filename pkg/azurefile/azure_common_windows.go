@@ -64,6 +64,11 @@ func removeDir(path string, m *mount.SafeFormatAndMount) error {
 	return fmt.Errorf("could not cast to csi proxy class")
 }
 
+// getDiskFormat returns the filesystem type of the disk
+func getDiskFormat(m *mount.SafeFormatAndMount, disk string) (string, error) {
+	return "", fmt.Errorf("GetDiskFormat is not supported on windows")
+}
+
 // preparePublishPath - In case of windows, the publish code path creates a soft link
 // from global stage path to the publish path. But kubelet creates the directory in advance.
 // We work around this issue by deleting the publish path then recreating the link.
@@ -26,10 +26,13 @@ import (
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2022-07-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/pointer"
 
 	"sigs.k8s.io/azurefile-csi-driver/test/utils/testutil"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/subnetclient/mocksubnetclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 
@@ -314,6 +317,170 @@ func TestUpdateSubnetServiceEndpoints(t *testing.T) {
 	}
 }
 
+func TestUpdateAccountVirtualNetworkRules(t *testing.T) {
+	vnetResourceID := "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/fake-vnet/subnets/fake-subnet"
+	existingRuleID := "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/other-vnet/subnets/other-subnet"
+
+	secondRuleID := "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/fake-vnet/subnets/second-subnet"
+
+	testCases := []struct {
+		name            string
+		account         storage.Account
+		vnetResourceIDs []string
+		getErr          *retry.Error
+		expectUpdate    bool
+		expectedRules   []string
+		expectedErr     error
+	}{
+		{
+			name: "[success] virtual network rule already exists",
+			account: storage.Account{
+				AccountProperties: &storage.AccountProperties{
+					NetworkRuleSet: &storage.NetworkRuleSet{
+						DefaultAction: storage.DefaultActionDeny,
+						VirtualNetworkRules: &[]storage.VirtualNetworkRule{
+							{VirtualNetworkResourceID: pointer.String(strings.ToUpper(vnetResourceID)), Action: storage.ActionAllow},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "[success] virtual network rule is added",
+			account: storage.Account{
+				AccountProperties: &storage.AccountProperties{
+					NetworkRuleSet: &storage.NetworkRuleSet{
+						DefaultAction: storage.DefaultActionDeny,
+						VirtualNetworkRules: &[]storage.VirtualNetworkRule{
+							{VirtualNetworkResourceID: pointer.String(existingRuleID), Action: storage.ActionAllow},
+						},
+					},
+				},
+			},
+			expectUpdate:  true,
+			expectedRules: []string{existingRuleID, vnetResourceID},
+		},
+		{
+			name:          "[success] network rule set is nil",
+			account:       storage.Account{},
+			expectUpdate:  true,
+			expectedRules: []string{vnetResourceID},
+		},
+		{
+			name: "[success] rules of multiple subnets are added in one update",
+			account: storage.Account{
+				AccountProperties: &storage.AccountProperties{
+					NetworkRuleSet: &storage.NetworkRuleSet{
+						DefaultAction: storage.DefaultActionDeny,
+						VirtualNetworkRules: &[]storage.VirtualNetworkRule{
+							{VirtualNetworkResourceID: pointer.String(existingRuleID), Action: storage.ActionAllow},
+						},
+					},
+				},
+			},
+			vnetResourceIDs: []string{vnetResourceID, secondRuleID},
+			expectUpdate:    true,
+			expectedRules:   []string{existingRuleID, vnetResourceID, secondRuleID},
+		},
+		{
+			name: "[success] rules of multiple subnets are deduplicated",
+			account: storage.Account{
+				AccountProperties: &storage.AccountProperties{
+					NetworkRuleSet: &storage.NetworkRuleSet{
+						DefaultAction: storage.DefaultActionDeny,
+						VirtualNetworkRules: &[]storage.VirtualNetworkRule{
+							{VirtualNetworkResourceID: pointer.String(vnetResourceID), Action: storage.ActionAllow},
+						},
+					},
+				},
+			},
+			vnetResourceIDs: []string{strings.ToUpper(vnetResourceID), secondRuleID, strings.ToLower(secondRuleID)},
+			expectUpdate:    true,
+			expectedRules:   []string{vnetResourceID, secondRuleID},
+		},
+		{
+			name: "[success] rules of multiple subnets already exist",
+			account: storage.Account{
+				AccountProperties: &storage.AccountProperties{
+					NetworkRuleSet: &storage.NetworkRuleSet{
+						VirtualNetworkRules: &[]storage.VirtualNetworkRule{
+							{VirtualNetworkResourceID: pointer.String(vnetResourceID), Action: storage.ActionAllow},
+							{VirtualNetworkResourceID: pointer.String(secondRuleID), Action: storage.ActionAllow},
+						},
+					},
+				},
+			},
+			vnetResourceIDs: []string{secondRuleID, vnetResourceID},
+		},
+		{
+			name:        "[fail] get account properties failed",
+			getErr:      retry.NewError(false, fmt.Errorf("account not found")),
+			expectedErr: fmt.Errorf("failed to get properties of storage account(account) rg(rg): %v", fmt.Errorf("Retriable: false, RetryAfter: 0s, HTTPStatusCode: 0, RawError: account not found")),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewFakeDriver()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+			d.cloud = &azureprovider.Cloud{StorageAccountClient: mockStorageAccountsClient}
+
+			mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), "subsID", "rg", "account").Return(tc.account, tc.getErr).Times(1)
+			if tc.expectUpdate {
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), "subsID", "rg", "account", gomock.Any()).
+					DoAndReturn(func(_ context.Context, _, _, _ string, parameters storage.AccountUpdateParameters) *retry.Error {
+						var rules []string
+						for _, rule := range *parameters.AccountPropertiesUpdateParameters.NetworkRuleSet.VirtualNetworkRules {
+							rules = append(rules, pointer.StringDeref(rule.VirtualNetworkResourceID, ""))
+						}
+						assert.Equal(t, tc.expectedRules, rules)
+						return nil
+					}).Times(1)
+			}
+
+			vnetResourceIDs := tc.vnetResourceIDs
+			if len(vnetResourceIDs) == 0 {
+				vnetResourceIDs = []string{vnetResourceID}
+			}
+			err := d.updateAccountVirtualNetworkRules(context.TODO(), "subsID", "rg", "account", vnetResourceIDs...)
+			assert.Equal(t, tc.expectedErr, err)
+		})
+	}
+}
+
+func TestParseSubnetResourceIDs(t *testing.T) {
+	subnet1 := "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet1"
+	subnet2 := "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet2"
+	tests := []struct {
+		ids         string
+		expected    []string
+		expectedErr bool
+	}{
+		{ids: "", expected: nil},
+		{ids: subnet1, expected: []string{subnet1}},
+		{ids: subnet1 + ", " + subnet2 + "," + strings.ToUpper(subnet1) + ",", expected: []string{subnet1, subnet2}},
+		{ids: subnet1 + ",subnet2", expectedErr: true},
+		{ids: "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/", expectedErr: true},
+		{ids: "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account/subnets/subnet", expectedErr: true},
+	}
+
+	for _, test := range tests {
+		result, err := parseSubnetResourceIDs(test.ids)
+		if test.expectedErr {
+			assert.Error(t, err, test.ids)
+			continue
+		}
+		assert.NoError(t, err, test.ids)
+		assert.Equal(t, test.expected, result, test.ids)
+	}
+
+	subsID, vnetResourceGroup, vnetName, subnetName, err := parseSubnetResourceID(subnet2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"subsID", "rg", "vnet", "subnet2"}, []string{subsID, vnetResourceGroup, vnetName, subnetName})
+}
+
 func TestGetKubeConfig(t *testing.T) {
 	// skip for now as this is very flaky on Windows
 	skipIfTestingOnWindows(t)
@@ -19,20 +19,34 @@ package azurefile
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azfile/directory"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azfile/service"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azfile/share"
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
 	"github.com/Azure/azure-storage-file-go/azfile"
+	azure2 "github.com/Azure/go-autorest/autorest/azure"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pborman/uuid"
 	"github.com/rubiojr/go-vhd/vhd"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
@@ -43,6 +57,7 @@ import (
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume/util"
 	mount "k8s.io/mount-utils"
+	"k8s.io/utils/pointer"
 
 	csicommon "sigs.k8s.io/azurefile-csi-driver/pkg/csi-common"
 	"sigs.k8s.io/azurefile-csi-driver/pkg/mounter"
@@ -64,23 +79,57 @@ const (
 	fileMode           = "file_mode"
 	dirMode            = "dir_mode"
 	actimeo            = "actimeo"
+	vers               = "vers"
 	mfsymlinks         = "mfsymlinks"
+	noMfsymlinks       = "nomfsymlinks"
+	gidOption          = "gid"
 	defaultFileMode    = "0777"
 	defaultDirMode     = "0777"
 	defaultActimeo     = "30"
+	// attribute cache of read-only mount could be kept much longer since metadata would not be changed by the mount
+	defaultReadOnlyActimeo = "600"
 
 	// See https://docs.microsoft.com/en-us/rest/api/storageservices/naming-and-referencing-shares--directories--files--and-metadata#share-names
 	fileShareNameMinLength = 3
 	fileShareNameMaxLength = 63
+	// length of hash-derived suffix appended to a share name shorter than fileShareNameMinLength
+	shareNamePaddingLength = 8
 
 	minimumPremiumShareSize = 100 // GB
 	// Minimum size of Azure Premium Files is 100GiB
 	// See https://docs.microsoft.com/en-us/azure/storage/files/storage-files-planning#provisioned-shares
 	defaultAzureFileQuota = 100
 	minimumAccountQuota   = 100 // GB
+	// Max provisioned capacity of all file shares in a storage account
+	// See https://learn.microsoft.com/en-us/azure/storage/files/storage-files-scale-targets#storage-account-scale-targets
+	standardAccountCapacityLimit = 5 * 1024 * 1024 // GB
+	premiumAccountCapacityLimit  = 100 * 1024      // GB
 
 	// key of snapshot name in metadata
 	snapshotNameKey = "initiator"
+	// tag of the driver version which last created or resized file share on the storage account
+	driverVersionTag = "driverVersion"
+	// key of max share quota(GiB) in file share metadata
+	maxShareQuotaKey = "maxsharequota"
+	// key of retain share policy in file share metadata, file share is not deleted in DeleteVolume if it's retainSharePolicyRetain
+	retainSharePolicyKey    = "retainsharepolicy"
+	retainSharePolicyDelete = "delete"
+	retainSharePolicyRetain = "retain"
+	// key of the volume ID in metadata of file share created for an ephemeral inline volume,
+	// only the ephemeral volume which created the file share could delete it
+	ephemeralVolumeMetadataKey = "ephemeralvolume"
+	// file next to the target path of an ephemeral inline volume recording the volume attributes of a file share to be deleted
+	ephemeralVolumeStateFile = "azurefile-ephemeral.json"
+	// key of deleteAccountWhenEmpty in file share metadata, the storage account created by the driver is deleted
+	// in DeleteVolume when its last file share is deleted
+	deleteAccountWhenEmptyKey = "deleteaccountwhenempty"
+	// tag of the driver name on storage accounts created by the driver, consts.CreatedByTag is shared by all azure components
+	accountCreatedByDriverTag = "k8s-azure-created-by-csi-driver"
+	// keys of share soft delete state of the storage account in volume context returned by ControllerGetVolume
+	shareDeleteRetentionPolicyEnabledKey = "sharedeleteretentionpolicyenabled"
+	shareDeleteRetentionDaysKey          = "sharedeleteretentiondays"
+	// share soft delete state is unknown when the storage account is inaccessible
+	unknownValue = "unknown"
 
 	shareNameField                    = "sharename"
 	accessTierField                   = "accesstier"
@@ -93,6 +142,7 @@ const (
 	fsTypeField                       = "fstype"
 	protocolField                     = "protocol"
 	matchTagsField                    = "matchtags"
+	accountTagSelectorField           = "accounttagselector"
 	tagsField                         = "tags"
 	storageAccountField               = "storageaccount"
 	storageAccountTypeField           = "storageaccounttype"
@@ -110,6 +160,7 @@ const (
 	useSecretCacheField               = "usesecretcache"
 	getAccountKeyFromSecretField      = "getaccountkeyfromsecret"
 	disableDeleteRetentionPolicyField = "disabledeleteretentionpolicy"
+	restoreFromSoftDeleteField        = "restorefromsoftdelete"
 	allowBlobPublicAccessField        = "allowblobpublicaccess"
 	storageEndpointSuffixField        = "storageendpointsuffix"
 	fsGroupChangePolicyField          = "fsgroupchangepolicy"
@@ -117,6 +168,8 @@ const (
 	podNamespaceField                 = "csi.storage.k8s.io/pod.namespace"
 	mountOptionsField                 = "mountoptions"
 	mountPermissionsField             = "mountpermissions"
+	diskMountOptionsField             = "diskmountoptions"
+	proxyMountField                   = "proxymount"
 	falseValue                        = "false"
 	trueValue                         = "true"
 	defaultSecretAccountName          = "azurestorageaccountname"
@@ -135,31 +188,68 @@ const (
 	vnetResourceGroupField            = "vnetresourcegroup"
 	vnetNameField                     = "vnetname"
 	subnetNameField                   = "subnetname"
+	subnetResourceIDsField            = "subnetresourceids"
 	shareNamePrefixField              = "sharenameprefix"
 	requireInfraEncryptionField       = "requireinfraencryption"
 	enableMultichannelField           = "enablemultichannel"
 	premium                           = "premium"
 	selectRandomMatchingAccountField  = "selectrandommatchingaccount"
 	accountQuotaField                 = "accountquota"
+	maxShareQuotaField                = "maxsharequota"
+	dryRunField                       = "dryrun"
+	retainSharePolicyField            = "retainsharepolicy"
+	deleteAccountWhenEmptyField       = "deleteaccountwhenempty"
+	retainField                       = "retain"
+	initMarkerField                   = "initmarker"
+	keyVaultURLField                  = "keyvaulturl"
+	keyVaultSecretNameField           = "keyvaultsecretname"
 
 	accountNotProvisioned = "StorageAccountIsNotProvisioned"
 	// this is a workaround fix for 429 throttling issue, will update cloud provider for better fix later
 	tooManyRequests   = "TooManyRequests"
 	shareBeingDeleted = "The specified share is being deleted"
 	clientThrottled   = "client throttled"
+	// returned when another snapshot operation on the share is in progress
+	shareSnapshotOperationInProgress = "ShareSnapshotOperationInProgress"
 	// accountLimitExceed returned by different API
 	accountLimitExceedManagementAPI = "TotalSharesProvisionedCapacityExceedsAccountLimit"
 	accountLimitExceedDataPlaneAPI  = "specified share does not exist"
 
+	// returned when the request is denied by Azure Policy, e.g. account creation in a disallowed location
+	requestDisallowedByPolicy = "RequestDisallowedByPolicy"
+
+	// returned when snapshots of a share are created too frequently
+	snapshotOperationRateExceeded = "SnapshotOperationRateExceeded"
+
+	// returned by mount.cifs(linux) and New-SmbGlobalMapping(windows) when the account key is wrong
+	mountPermissionDenied = "mount error(13)"
+	mountAccessDenied     = "Access is denied"
+	mountLogonFailure     = "logon failure"
+	// comma separated mount errors treated as transient by default, e.g. EAGAIN, EHOSTDOWN
+	defaultTransientMountErrors = "mount error(11),mount error(112),Resource temporarily unavailable,Host is down"
+	// default interval and timeout of retrying mount on transient mount errors
+	defaultTransientMountRetryInterval = 1 * time.Second
+	defaultTransientMountRetryTimeout  = 2 * time.Minute
+	// returned by data plane API when the account key is wrong
+	authenticationFailed = "ErrorCode=AuthenticationFailed"
+
 	fileShareNotFound  = "ErrorCode=ShareNotFound"
 	statusCodeNotFound = "StatusCode=404"
 	httpCodeNotFound   = "HTTPStatusCode: 404"
 
-	// define different sleep time when hit throttling
-	accountOpThrottlingSleepSec = 16
-	fileOpThrottlingSleepSec    = 180
+	// define different default sleep time when hit throttling
+	defaultAccountOpThrottlingSleepSec = 16
+	defaultFileOpThrottlingSleepSec    = 180
+	// random jitter ratio of throttling sleep time, so that throttled callers would not retry at the same time
+	throttlingSleepJitter = 0.25
+
+	// allowed range of share delete retention days on storage account
+	minShareDeleteRetentionDays = 1
+	maxShareDeleteRetentionDays = 365
 
 	defaultAccountNamePrefix = "f"
+	// generated account name is truncated to 23 characters, leave at least 8 random characters after the prefix
+	maxAccountNamePrefixLength = 15
 
 	defaultNamespace = "default"
 
@@ -179,17 +269,54 @@ const (
 
 	FSGroupChangeNone = "None"
 
+	// policies of handling an existing mount whose mount options are different from the requested ones
+	mountOptionsMismatchIgnore  = "ignore"
+	mountOptionsMismatchRemount = "remount"
+	mountOptionsMismatchError   = "error"
+
+	// policies of handling a file share whose ShareQuota returned by GetFileShare is nil
+	nilShareQuotaError     = "error"
+	nilShareQuotaDefault   = "default"
+	nilShareQuotaDataPlane = "dataplane"
+
+	// sources of storage account key when account key is not provided in request secrets
+	accountKeySourceSecret           = "secret"
+	accountKeySourceWorkloadIdentity = "workloadidentity"
+	accountKeySourceClusterIdentity  = "clusteridentity"
+
 	waitForCopyInterval = 5 * time.Second
 	waitForCopyTimeout  = 3 * time.Minute
+
+	defaultAccountKeyTTL = 3 * time.Minute
+	// max time of an account key lookup shared by concurrent callers
+	accountKeyLookupTimeout = 2 * time.Minute
+	// max time of deleting a partially created vhd disk file
+	diskFileCleanupTimeout = 30 * time.Second
+
+	// default retry options of data plane file pipeline
+	defaultDataPlaneMaxTries      = 3
+	defaultDataPlaneTryTimeout    = 3 * time.Second
+	defaultDataPlaneRetryDelay    = 1 * time.Second
+	defaultDataPlaneMaxRetryDelay = 3 * time.Second
+
+	defaultShareBeingDeletedTimeoutInSeconds = 300
+	shareBeingDeletedPollInterval            = 10 * time.Second
 )
 
 var (
-	supportedFsTypeList              = []string{cifs, smb, nfs, ext4, ext3, ext2, xfs}
-	supportedProtocolList            = []string{smb, nfs}
-	supportedDiskFsTypeList          = []string{ext4, ext3, ext2, xfs}
-	supportedFSGroupChangePolicyList = []string{FSGroupChangeNone, string(v1.FSGroupChangeAlways), string(v1.FSGroupChangeOnRootMismatch)}
-
-	retriableErrors = []string{accountNotProvisioned, tooManyRequests, shareBeingDeleted, clientThrottled}
+	supportedFsTypeList     = []string{cifs, smb, nfs, ext4, ext3, ext2, xfs}
+	supportedProtocolList   = []string{smb, nfs}
+	supportedDiskFsTypeList = []string{ext4, ext3, ext2, xfs}
+	// smb protocol versions and their aliases accepted by mount.cifs, except the insecure 1.0
+	supportedSMBVersList                    = []string{"2.0", "2.1", "3", "3.0", "3.02", "3.0.2", "3.1.1", "3.11", "default"}
+	supportedDiskMountOptionList            = []string{"noatime", "nodiratime", "relatime", "lazytime", "discard", "nodiscard", "commit=<seconds>"}
+	defaultDiskMountOptions                 = []string{"noatime"}
+	supportedFSGroupChangePolicyList        = []string{FSGroupChangeNone, string(v1.FSGroupChangeAlways), string(v1.FSGroupChangeOnRootMismatch)}
+	supportedMountOptionsMismatchPolicyList = []string{mountOptionsMismatchIgnore, mountOptionsMismatchRemount, mountOptionsMismatchError}
+	supportedNilShareQuotaPolicyList        = []string{nilShareQuotaError, nilShareQuotaDefault, nilShareQuotaDataPlane}
+	defaultAccountKeySources                = []string{accountKeySourceSecret, accountKeySourceWorkloadIdentity, accountKeySourceClusterIdentity}
+
+	retriableErrors = []string{accountNotProvisioned, tooManyRequests, shareBeingDeleted, clientThrottled, shareSnapshotOperationInProgress, snapshotOperationRateExceeded}
 )
 
 // DriverOptions defines driver parameters specified in driver deployment
@@ -203,6 +330,7 @@ type DriverOptions struct {
 	AllowEmptyCloudConfig                  bool
 	AllowInlineVolumeKeyAccessWithIdentity bool
 	EnableVHDDiskFeature                   bool
+	EnableProxyMount                       bool
 	EnableVolumeMountGroup                 bool
 	EnableGetVolumeStats                   bool
 	AppendMountErrorHelpLink               bool
@@ -217,6 +345,48 @@ type DriverOptions struct {
 	VolStatsCacheExpireInMinutes           int
 	PrintVolumeStatsCallLogs               bool
 	SasTokenExpirationMinutes              int
+	MountStatsRefreshIntervalInSeconds     int
+	ShareSnapshotMinIntervalInSeconds      int
+	DefaultFileMode                        string
+	DefaultDirMode                         string
+	DefaultVers                            string
+	DefaultActimeo                         string
+	DefaultReadOnlyActimeo                 string
+	SecretAccountKeyNames                  string
+	ShareBeingDeletedTimeoutInSeconds      int
+	CloneTimeout                           time.Duration
+	AllowedAccounts                        string
+	StrictVolumeIDParsing                  bool
+	ValidateStaticVolumeID                 bool
+	MaxConcurrentDiskNodeOperations        int
+	MaxConcurrentShareNodeOperations       int
+	EnableDryRun                           bool
+	MountOptionsMismatchPolicy             string
+	NilShareQuotaPolicy                    string
+	MaxConcurrentResizeOperations          int
+	AccountKeyTTL                          time.Duration
+	AccountKeyCheckIntervalInSeconds       int
+	EnableShareGC                          bool
+	ShareGCInterval                        time.Duration
+	ShareGCGracePeriod                     time.Duration
+	ClusterID                              string
+	DataPlaneMaxTries                      int
+	DataPlaneTryTimeout                    time.Duration
+	DataPlaneRetryDelay                    time.Duration
+	DataPlaneMaxRetryDelay                 time.Duration
+	TransientMountErrors                   string
+	TransientMountRetryInterval            time.Duration
+	TransientMountRetryTimeout             time.Duration
+	MaxVHDDiskSizeGiB                      int64
+	AccountOpThrottlingSleepSec            int
+	FileOpThrottlingSleepSec               int
+	AccountKeySources                      string
+	SerializeAccountCreation               bool
+	DefaultSecretNamespace                 string
+	AccountNamePrefix                      string
+	NFSAccountNamePrefix                   string
+	ReadinessAddress                       string
+	CentralSecretNamespace                 string
 }
 
 // Driver implements all interfaces of CSI drivers
@@ -231,6 +401,7 @@ type Driver struct {
 	allowEmptyCloudConfig                  bool
 	allowInlineVolumeKeyAccessWithIdentity bool
 	enableVHDDiskFeature                   bool
+	enableProxyMount                       bool
 	enableGetVolumeStats                   bool
 	enableVolumeMountGroup                 bool
 	appendMountErrorHelpLink               bool
@@ -247,31 +418,130 @@ type Driver struct {
 	volLockMap *lockMap
 	// only for nfs feature
 	subnetLockMap *lockMap
+	// lock of storage account selection and creation per resource group <subsID/resourceGroup, "">
+	accountLockMap *lockMap
 	// a map storing all volumes with ongoing operations so that additional operations
 	// for that same volume (as defined by VolumeID) return an Aborted error
 	volumeLocks *volumeLocks
 	// a map storing all volumes created by this driver <volumeName, accountName>
 	volMap sync.Map
+	// reclaim file shares whose persistent volumes no longer exist on accounts in volMap
+	enableShareGC      bool
+	shareGCInterval    time.Duration
+	shareGCGracePeriod time.Duration
+	// a map storing location of accounts in volMap <accountName, shareGCAccount>
+	shareGCAccountMap sync.Map
+	// a map storing when file shares are first observed as orphaned <account/share, time.Time>
+	shareGCOrphanedMap sync.Map
+	// id of this cluster recorded in file share metadata, only file shares with the same id are reclaimed by share gc
+	clusterID string
 	// a timed cache storing all account name and keys retrieved by this driver <accountName, accountkey>
 	accountCacheMap azcache.Resource
+	// deduplicate concurrent account key lookups <subsID/resourceGroup/accountName>
+	accountKeyGroup singleflight.Group
 	// a map storing all secret names created by this driver <secretCacheKey, "">
 	secretCacheMap azcache.Resource
+	// a size bounded timed cache storing account keys read from k8s secrets <secretNamespace/secretName, accountKey>
+	secretKeyCache *secretKeyCache
 	// a map storing all volumes using data plane API <volumeID, "">
 	dataPlaneAPIVolMap sync.Map
+	// a map storing all volumes using custom storage endpoint suffix <volumeID, storageEndpointSuffix>
+	storageEndpointSuffixVolMap sync.Map
 	// a timed cache storing all storage accounts that are using data plane API temporarily
 	dataPlaneAPIAccountCache azcache.Resource
 	// a timed cache storing account search history (solve account list throttling issue)
 	accountSearchCache azcache.Resource
 	// a timed cache storing whether skipMatchingTag is added or removed recently
 	skipMatchingTagCache azcache.Resource
+	// a timed cache storing storage accounts which reached the total provisioned capacity limit recently <accountName, "">
+	accountLimitExceededCache azcache.Resource
+	// a timed cache storing whether driverVersionTag is updated recently <subsID/resourceGroup/accountName, "">
+	driverVersionTagCache azcache.Resource
 	// a timed cache when resize file share failed due to account limit exceeded
 	resizeFileShareFailureCache azcache.Resource
 	// a timed cache storing volume stats <volumeID, volumeStats>
 	volStatsCache azcache.Resource
+	// a timed cache storing protocol of file shares created by the driver <account/share, storage.EnabledProtocols>
+	shareProtocolCache azcache.Resource
+	// a timed cache storing share delete retention policy of storage accounts <subsID/resourceGroup/accountName, *storage.DeleteRetentionPolicy>
+	shareDeleteRetentionPolicyCache azcache.Resource
+	// a size bounded timed cache storing shares with snapshot created recently <account/share, expireAt>
+	shareSnapshotRateLimitCache *shareSnapshotRateLimitCache
+	// minimum interval between two snapshots of the same share, 0 means no limit
+	shareSnapshotMinIntervalInSeconds int
+	// driver level default values of smb mount options <option, value>, overridden by mountOptions in storage class
+	defaultMountOptions map[string]string
+	// default actimeo of read-only smb mount, overridden by mountOptions in storage class
+	readOnlyActimeo string
+	// prioritized data key names of account key in k8s secret
+	secretAccountKeyNames []string
+	// max wait time for the deletion of a share with the same name before creating the share
+	shareBeingDeletedTimeoutInSeconds int
+	shareBeingDeletedPollInterval     time.Duration
+	// storage accounts the driver is allowed to operate on <lower case accountName, "">, empty means no restriction
+	allowedAccounts map[string]string
+	// reject malformed volume IDs with InvalidArgument instead of best-effort parsing
+	strictVolumeIDParsing bool
+	// check the file share in volume id exists before attaching or mounting
+	validateStaticVolumeID bool
+	// limit concurrent node operations on vhd disk volumes and file share volumes separately, nil means no limit
+	diskNodeOperationLimiter  *operationLimiter
+	shareNodeOperationLimiter *operationLimiter
+	// limit concurrent file share resize operations in ControllerExpandVolume, nil means no limit
+	resizeOperationLimiter *operationLimiter
+	// allow CreateVolume to only validate parameters without provisioning when dryrun parameter is set
+	enableDryRun bool
+	// how to handle an existing staging mount whose mount options are different from the requested ones
+	mountOptionsMismatchPolicy string
+	// how to handle a file share whose ShareQuota returned by GetFileShare is nil
+	nilShareQuotaPolicy string
 	// sas expiry time for azcopy in volume clone
 	sasTokenExpirationMinutes int
+	// max wait time for azcopy to copy the source share in volume clone
+	cloneTimeout time.Duration
+	// interval to refresh mount I/O metrics, 0 means disabled
+	mountStatsRefreshIntervalInSeconds int
+	// interval to revalidate cached account keys, 0 means disabled
+	accountKeyCheckIntervalInSeconds int
+	// a map storing all volumes staged on this node <mountPath, volumeID>
+	mountStatsVolMap sync.Map
 	// azcopy for provide exec mock for ut
 	azcopy *fileutil.Azcopy
+	// storage endpoint suffix resolved from cloud environment, only resolved once
+	storageEndpointSuffix     string
+	storageEndpointSuffixOnce sync.Once
+	// retry options of data plane file pipeline, e.g. vhd disk creation
+	dataPlaneRetryOptions azfile.RetryOptions
+	// mount errors which are retried in NodeStageVolume, other mount errors are returned immediately
+	transientMountErrors []string
+	// interval and timeout of retrying mount on transient mount errors
+	transientMountRetryInterval time.Duration
+	transientMountRetryTimeout  time.Duration
+	// maximum size of vhd disk created in CreateVolume, zero means no limit
+	maxVHDDiskSizeGiB int64
+	// base sleep time when storage account and file share operations are throttled
+	accountOpThrottlingSleepSec int
+	fileOpThrottlingSleepSec    int
+	// get account key stored in key vault if keyVaultURL is specified
+	keyVaultClient keyVaultClient
+	// get account key with workload identity of the driver, nil if workload identity is not configured
+	workloadIdentityClient workloadIdentityClient
+	// prioritized sources of account key if it's not provided in request secrets
+	accountKeySources []string
+	// serialize storage account selection and creation in the same resource group
+	serializeAccountCreation bool
+	// namespace of account key secret if neither secretNamespace nor pvc namespace is specified
+	defaultSecretNamespace string
+	// namespace of account key secret shared by all pvc namespaces if secretNamespace is not specified, empty means disabled
+	centralSecretNamespace string
+	// prefix of storage account name created by this driver
+	accountNamePrefix string
+	// prefix of storage account name created by this driver for nfs file share
+	nfsAccountNamePrefix string
+	// address of http server serving /readyz, empty means disabled
+	readinessAddress string
+	// a timed cache storing result of the last cloud connectivity check <key, *cloudConnectivityResult>
+	cloudConnectivityCache azcache.Resource
 }
 
 // NewDriver Creates a NewCSIDriver object. Assumes vendor version is equal to driver version &
@@ -288,6 +558,7 @@ func NewDriver(options *DriverOptions) *Driver {
 	driver.allowEmptyCloudConfig = options.AllowEmptyCloudConfig
 	driver.allowInlineVolumeKeyAccessWithIdentity = options.AllowInlineVolumeKeyAccessWithIdentity
 	driver.enableVHDDiskFeature = options.EnableVHDDiskFeature
+	driver.enableProxyMount = options.EnableProxyMount
 	driver.enableVolumeMountGroup = options.EnableVolumeMountGroup
 	driver.enableGetVolumeStats = options.EnableGetVolumeStats
 	driver.appendMountErrorHelpLink = options.AppendMountErrorHelpLink
@@ -300,8 +571,107 @@ func NewDriver(options *DriverOptions) *Driver {
 	driver.appendNoShareSockOption = options.AppendNoShareSockOption
 	driver.printVolumeStatsCallLogs = options.PrintVolumeStatsCallLogs
 	driver.sasTokenExpirationMinutes = options.SasTokenExpirationMinutes
+	driver.mountStatsRefreshIntervalInSeconds = options.MountStatsRefreshIntervalInSeconds
+	driver.accountKeyCheckIntervalInSeconds = options.AccountKeyCheckIntervalInSeconds
+	driver.enableShareGC = options.EnableShareGC
+	driver.shareGCInterval = options.ShareGCInterval
+	if driver.shareGCInterval <= 0 {
+		driver.shareGCInterval = defaultShareGCInterval
+	}
+	driver.shareGCGracePeriod = options.ShareGCGracePeriod
+	if driver.shareGCGracePeriod <= 0 {
+		driver.shareGCGracePeriod = defaultShareGCGracePeriod
+	}
+	driver.clusterID = options.ClusterID
+	driver.shareSnapshotMinIntervalInSeconds = options.ShareSnapshotMinIntervalInSeconds
+	driver.dataPlaneRetryOptions = newDataPlaneRetryOptions(options.DataPlaneMaxTries, options.DataPlaneTryTimeout, options.DataPlaneRetryDelay, options.DataPlaneMaxRetryDelay)
+	driver.defaultMountOptions = map[string]string{
+		fileMode: options.DefaultFileMode,
+		dirMode:  options.DefaultDirMode,
+		vers:     options.DefaultVers,
+		actimeo:  options.DefaultActimeo,
+	}
+	if options.DefaultVers != "" && !isSupportedSMBVers(options.DefaultVers) {
+		klog.Warningf("default smb protocol version(%s) is not supported, supported versions: %v, vers is negotiated by mount.cifs instead", options.DefaultVers, supportedSMBVersList)
+		driver.defaultMountOptions[vers] = ""
+	}
+	driver.readOnlyActimeo = options.DefaultReadOnlyActimeo
+	if driver.readOnlyActimeo == "" {
+		driver.readOnlyActimeo = defaultReadOnlyActimeo
+	}
+	driver.secretAccountKeyNames = parseSecretAccountKeyNames(options.SecretAccountKeyNames)
+	driver.shareBeingDeletedTimeoutInSeconds = options.ShareBeingDeletedTimeoutInSeconds
+	if driver.shareBeingDeletedTimeoutInSeconds <= 0 {
+		driver.shareBeingDeletedTimeoutInSeconds = defaultShareBeingDeletedTimeoutInSeconds
+	}
+	driver.shareBeingDeletedPollInterval = shareBeingDeletedPollInterval
+	driver.allowedAccounts = parseAllowedAccounts(options.AllowedAccounts)
+	driver.transientMountErrors = parseTransientMountErrors(options.TransientMountErrors)
+	driver.transientMountRetryInterval = options.TransientMountRetryInterval
+	if driver.transientMountRetryInterval <= 0 {
+		driver.transientMountRetryInterval = defaultTransientMountRetryInterval
+	}
+	driver.transientMountRetryTimeout = options.TransientMountRetryTimeout
+	if driver.transientMountRetryTimeout <= 0 {
+		driver.transientMountRetryTimeout = defaultTransientMountRetryTimeout
+	}
+	driver.maxVHDDiskSizeGiB = options.MaxVHDDiskSizeGiB
+	driver.accountOpThrottlingSleepSec = options.AccountOpThrottlingSleepSec
+	if driver.accountOpThrottlingSleepSec <= 0 {
+		driver.accountOpThrottlingSleepSec = defaultAccountOpThrottlingSleepSec
+	}
+	driver.fileOpThrottlingSleepSec = options.FileOpThrottlingSleepSec
+	if driver.fileOpThrottlingSleepSec <= 0 {
+		driver.fileOpThrottlingSleepSec = defaultFileOpThrottlingSleepSec
+	}
+	driver.accountKeySources = parseAccountKeySources(options.AccountKeySources)
+	driver.serializeAccountCreation = options.SerializeAccountCreation
+	driver.defaultSecretNamespace = options.DefaultSecretNamespace
+	if driver.defaultSecretNamespace == "" {
+		driver.defaultSecretNamespace = defaultNamespace
+	}
+	driver.centralSecretNamespace = options.CentralSecretNamespace
+	driver.accountNamePrefix = options.AccountNamePrefix
+	if driver.accountNamePrefix == "" {
+		driver.accountNamePrefix = defaultAccountNamePrefix
+	} else if !isSupportedAccountNamePrefix(driver.accountNamePrefix) {
+		klog.Fatalf("account name prefix(%s) can only contain lowercase letters and numbers, and length should be less than %d", driver.accountNamePrefix, maxAccountNamePrefixLength+1)
+	}
+	driver.nfsAccountNamePrefix = options.NFSAccountNamePrefix
+	if driver.nfsAccountNamePrefix == "" {
+		driver.nfsAccountNamePrefix = driver.accountNamePrefix
+	} else if !isSupportedAccountNamePrefix(driver.nfsAccountNamePrefix) {
+		klog.Fatalf("nfs account name prefix(%s) can only contain lowercase letters and numbers, and length should be less than %d", driver.nfsAccountNamePrefix, maxAccountNamePrefixLength+1)
+	}
+	driver.readinessAddress = options.ReadinessAddress
+	driver.strictVolumeIDParsing = options.StrictVolumeIDParsing
+	driver.validateStaticVolumeID = options.ValidateStaticVolumeID
+	driver.diskNodeOperationLimiter = newOperationLimiter(options.MaxConcurrentDiskNodeOperations)
+	driver.shareNodeOperationLimiter = newOperationLimiter(options.MaxConcurrentShareNodeOperations)
+	driver.resizeOperationLimiter = newOperationLimiter(options.MaxConcurrentResizeOperations)
+	driver.enableDryRun = options.EnableDryRun
+	driver.mountOptionsMismatchPolicy = strings.ToLower(options.MountOptionsMismatchPolicy)
+	if driver.mountOptionsMismatchPolicy == "" {
+		driver.mountOptionsMismatchPolicy = mountOptionsMismatchIgnore
+	} else if !isSupportedMountOptionsMismatchPolicy(driver.mountOptionsMismatchPolicy) {
+		klog.Warningf("mount options mismatch policy(%s) is not supported, supported list: %v, use %s instead", options.MountOptionsMismatchPolicy, supportedMountOptionsMismatchPolicyList, mountOptionsMismatchIgnore)
+		driver.mountOptionsMismatchPolicy = mountOptionsMismatchIgnore
+	}
+	driver.nilShareQuotaPolicy = strings.ToLower(options.NilShareQuotaPolicy)
+	if driver.nilShareQuotaPolicy == "" {
+		driver.nilShareQuotaPolicy = nilShareQuotaError
+	} else if !isSupportedNilShareQuotaPolicy(driver.nilShareQuotaPolicy) {
+		klog.Warningf("nil share quota policy(%s) is not supported, supported list: %v, use %s instead", options.NilShareQuotaPolicy, supportedNilShareQuotaPolicyList, nilShareQuotaError)
+		driver.nilShareQuotaPolicy = nilShareQuotaError
+	}
+	driver.cloneTimeout = options.CloneTimeout
+	if driver.cloneTimeout <= 0 {
+		driver.cloneTimeout = waitForCopyTimeout
+	}
+	registerDriverMetrics()
 	driver.volLockMap = newLockMap()
 	driver.subnetLockMap = newLockMap()
+	driver.accountLockMap = newLockMap()
 	driver.volumeLocks = newVolumeLocks()
 	driver.azcopy = &fileutil.Azcopy{}
 
@@ -323,9 +693,27 @@ func NewDriver(options *DriverOptions) *Driver {
 		klog.Fatalf("%v", err)
 	}
 
-	if driver.accountCacheMap, err = azcache.NewTimedCache(3*time.Minute, getter, false); err != nil {
+	if driver.accountLimitExceededCache, err = azcache.NewTimedCache(time.Duration(options.SkipMatchingTagCacheExpireInMinutes)*time.Minute, getter, false); err != nil {
+		klog.Fatalf("%v", err)
+	}
+
+	if driver.driverVersionTagCache, err = azcache.NewTimedCache(time.Duration(options.SkipMatchingTagCacheExpireInMinutes)*time.Minute, getter, false); err != nil {
+		klog.Fatalf("%v", err)
+	}
+
+	accountKeyTTL := options.AccountKeyTTL
+	if accountKeyTTL <= 0 {
+		accountKeyTTL = defaultAccountKeyTTL
+	}
+	if driver.accountCacheMap, err = azcache.NewTimedCache(accountKeyTTL, getter, false); err != nil {
 		klog.Fatalf("%v", err)
 	}
+	// keys read from secrets should not outlive cached account keys, otherwise rotated keys are picked up later than accountKeyTTL
+	secretKeyCacheTTL := defaultSecretKeyCacheTTL
+	if accountKeyTTL < secretKeyCacheTTL {
+		secretKeyCacheTTL = accountKeyTTL
+	}
+	driver.secretKeyCache = newSecretKeyCache(secretKeyCacheTTL, defaultSecretKeyCacheSize)
 
 	if driver.dataPlaneAPIAccountCache, err = azcache.NewTimedCache(10*time.Minute, getter, false); err != nil {
 		klog.Fatalf("%v", err)
@@ -342,6 +730,21 @@ func NewDriver(options *DriverOptions) *Driver {
 		klog.Fatalf("%v", err)
 	}
 
+	if driver.shareDeleteRetentionPolicyCache, err = azcache.NewTimedCache(10*time.Minute, getter, false); err != nil {
+		klog.Fatalf("%v", err)
+	}
+
+	if driver.shareProtocolCache, err = azcache.NewTimedCache(24*time.Hour, getter, false); err != nil {
+		klog.Fatalf("%v", err)
+	}
+
+	if driver.cloudConnectivityCache, err = azcache.NewTimedCache(cloudConnectivityCacheTTL, getter, false); err != nil {
+		klog.Fatalf("%v", err)
+	}
+
+	// cache is disabled when there is no limit on snapshot frequency
+	driver.shareSnapshotRateLimitCache = newShareSnapshotRateLimitCache(time.Duration(driver.shareSnapshotMinIntervalInSeconds)*time.Second, defaultShareSnapshotRateLimitCacheSize)
+
 	return &driver
 }
 
@@ -364,19 +767,56 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 	// todo: set backoff from cloud provider config
 	d.fileClient = newAzureFileClient(&d.cloud.Environment, &retry.Backoff{Steps: 1})
 
+	if kvClient, err := newAzureKeyVaultClient(d.cloud.UserAssignedIdentityID); err != nil {
+		klog.Warningf("failed to create key vault client: %v", err)
+	} else {
+		d.keyVaultClient = kvClient
+	}
+
+	if wiClient, err := newAzureWorkloadIdentityClient(d.cloud.Environment.ResourceManagerEndpoint); err != nil {
+		klog.V(2).Infof("workload identity is not configured: %v", err)
+	} else {
+		d.workloadIdentityClient = wiClient
+	}
+
 	d.mounter, err = mounter.NewSafeMounter(d.enableWindowsHostProcess)
 	if err != nil {
 		klog.Fatalf("Failed to get safe mounter. Error: %v", err)
 	}
 
+	if d.mountStatsRefreshIntervalInSeconds > 0 && runtime.GOOS == "linux" {
+		registerMountStatsMetrics()
+		klog.V(2).Infof("refresh mount stats metrics every %d seconds", d.mountStatsRefreshIntervalInSeconds)
+		go wait.Until(d.updateMountStatsMetrics, time.Duration(d.mountStatsRefreshIntervalInSeconds)*time.Second, wait.NeverStop)
+	}
+
+	if d.accountKeyCheckIntervalInSeconds > 0 {
+		klog.V(2).Infof("revalidate cached account keys every %d seconds", d.accountKeyCheckIntervalInSeconds)
+		go wait.Until(d.revalidateAccountKeys, time.Duration(d.accountKeyCheckIntervalInSeconds)*time.Second, wait.NeverStop)
+	}
+
+	d.resolveShareGCClusterID(context.Background())
+	if d.enableShareGC {
+		klog.V(2).Infof("reclaim orphaned file shares every %v, grace period: %v", d.shareGCInterval, d.shareGCGracePeriod)
+		go wait.Until(d.gcOrphanedShares, d.shareGCInterval, wait.NeverStop)
+	}
+
+	if d.readinessAddress != "" {
+		d.serveReadiness(d.readinessAddress)
+	}
+
 	// Initialize default library driver
 	d.AddControllerServiceCapabilities(
 		[]csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 			csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 		})
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -391,12 +831,13 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 	nodeCap := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 	}
 	if d.enableVolumeMountGroup {
 		nodeCap = append(nodeCap, csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP)
 	}
 	if d.enableGetVolumeStats {
-		nodeCap = append(nodeCap, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS)
+		nodeCap = append(nodeCap, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS, csi.NodeServiceCapability_RPC_VOLUME_CONDITION)
 	}
 	d.AddNodeServiceCapabilities(nodeCap)
 
@@ -408,38 +849,152 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 
 // getFileShareQuota return (-1, nil) means file share does not exist
 func (d *Driver) getFileShareQuota(ctx context.Context, subsID, resourceGroupName, accountName, fileShareName string, secrets map[string]string) (int, error) {
+	quota, _, err := d.getFileShareQuotaAndProtocol(ctx, subsID, resourceGroupName, accountName, fileShareName, secrets)
+	return quota, err
+}
+
+// getFileShareQuotaAndProtocol returns quota and protocol of file share, (-1, "", nil) means file share does not exist,
+// protocol is empty if it's unknown since it's only available from management API
+func (d *Driver) getFileShareQuotaAndProtocol(ctx context.Context, subsID, resourceGroupName, accountName, fileShareName string, secrets map[string]string) (int, storage.EnabledProtocols, error) {
 	if len(secrets) > 0 {
 		accountName, accountKey, err := getStorageAccount(secrets)
 		if err != nil {
-			return -1, err
+			return -1, "", err
 		}
 		fileClient, err := d.fileClient.getFileSvcClient(accountName, accountKey)
 		if err != nil {
-			return -1, err
+			return -1, "", err
 		}
 		share := fileClient.GetShareReference(fileShareName)
 		exists, err := share.Exists()
 		if err != nil {
-			return -1, err
+			return -1, "", err
 		}
 		if !exists {
-			return -1, nil
+			return -1, "", nil
 		}
-		return share.Properties.Quota, nil
+		return share.Properties.Quota, "", nil
 	}
 
 	fileShare, err := d.cloud.GetFileShare(ctx, subsID, resourceGroupName, accountName, fileShareName)
 	if err != nil {
 		if strings.Contains(err.Error(), "ShareNotFound") {
-			return -1, nil
+			return -1, "", nil
 		}
-		return -1, err
+		return -1, "", err
 	}
 
+	protocol := storage.EnabledProtocolsSMB
+	if fileShare.FileShareProperties != nil && fileShare.FileShareProperties.EnabledProtocols != "" {
+		protocol = fileShare.FileShareProperties.EnabledProtocols
+	}
 	if fileShare.FileShareProperties == nil || fileShare.FileShareProperties.ShareQuota == nil {
-		return -1, fmt.Errorf("FileShareProperties or FileShareProperties.ShareQuota is nil")
+		switch d.nilShareQuotaPolicy {
+		case nilShareQuotaDefault:
+			klog.Warningf("ShareQuota of file share(%s) on account(%s) is nil, use default quota(%d GiB)", fileShareName, accountName, defaultAzureFileQuota)
+			return defaultAzureFileQuota, protocol, nil
+		case nilShareQuotaDataPlane:
+			klog.Warningf("ShareQuota of file share(%s) on account(%s) is nil, query quota via data plane API", fileShareName, accountName)
+			accountKey, err := d.cloud.GetStorageAccesskey(ctx, subsID, accountName, resourceGroupName, false)
+			if err != nil {
+				return -1, "", fmt.Errorf("FileShareProperties.ShareQuota is nil and failed to get account key of %s: %w", accountName, err)
+			}
+			quota, err := d.getFileShareQuota(ctx, subsID, resourceGroupName, accountName, fileShareName, createStorageAccountSecret(accountName, accountKey))
+			return quota, protocol, err
+		}
+		return -1, "", fmt.Errorf("FileShareProperties or FileShareProperties.ShareQuota is nil")
+	}
+	return int(*fileShare.FileShareProperties.ShareQuota), protocol, nil
+}
+
+// getShareDeleteRetentionPolicy returns the share delete retention policy(soft delete) of the storage account,
+// nil policy means the retention policy is not set on the account
+func (d *Driver) getShareDeleteRetentionPolicy(ctx context.Context, subsID, resourceGroupName, accountName string) (*storage.DeleteRetentionPolicy, error) {
+	cacheKey := fmt.Sprintf("%s/%s/%s", subsID, resourceGroupName, accountName)
+	cache, err := d.shareDeleteRetentionPolicyCache.Get(cacheKey, azcache.CacheReadTypeDefault)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		return cache.(*storage.DeleteRetentionPolicy), nil
+	}
+
+	if d.cloud.FileClient == nil {
+		return nil, fmt.Errorf("file client is nil")
+	}
+	properties, err := d.cloud.FileClient.WithSubscriptionID(subsID).GetServiceProperties(ctx, resourceGroupName, accountName)
+	if err != nil {
+		return nil, err
+	}
+	policy := &storage.DeleteRetentionPolicy{Enabled: pointer.Bool(false)}
+	if properties.FileServicePropertiesProperties != nil && properties.FileServicePropertiesProperties.ShareDeleteRetentionPolicy != nil {
+		policy = properties.FileServicePropertiesProperties.ShareDeleteRetentionPolicy
+	}
+	d.shareDeleteRetentionPolicyCache.Set(cacheKey, policy)
+	return policy, nil
+}
+
+// EnableDeleteRetentionPolicy enables share delete retention policy(soft delete) on the storage account with the given retention days,
+// it's the reverse of disableDeleteRetentionPolicy in storage class
+func (d *Driver) EnableDeleteRetentionPolicy(ctx context.Context, subsID, resourceGroupName, accountName string, days int) error {
+	if days < minShareDeleteRetentionDays || days > maxShareDeleteRetentionDays {
+		return fmt.Errorf("share delete retention days(%d) should be in range [%d, %d]", days, minShareDeleteRetentionDays, maxShareDeleteRetentionDays)
+	}
+	if d.cloud.FileClient == nil {
+		return fmt.Errorf("file client is nil")
+	}
+	prop, err := d.cloud.FileClient.WithSubscriptionID(subsID).GetServiceProperties(ctx, resourceGroupName, accountName)
+	if err != nil {
+		return err
+	}
+	if prop.FileServicePropertiesProperties == nil {
+		return fmt.Errorf("FileServicePropertiesProperties of account(%s), subscription(%s), resource group(%s) is nil", accountName, subsID, resourceGroupName)
+	}
+	prop.FileServicePropertiesProperties.ProtocolSettings = nil
+	prop.FileServicePropertiesProperties.Cors = nil
+	klog.V(2).Infof("enable ShareDeleteRetentionPolicy with %d days on account(%s), subscription(%s), resource group(%s)", days, accountName, subsID, resourceGroupName)
+	prop.FileServicePropertiesProperties.ShareDeleteRetentionPolicy = &storage.DeleteRetentionPolicy{Enabled: pointer.Bool(true), Days: pointer.Int32(int32(days))}
+	if _, err := d.cloud.FileClient.WithSubscriptionID(subsID).SetServiceProperties(ctx, resourceGroupName, accountName, prop); err != nil {
+		return err
+	}
+	return d.shareDeleteRetentionPolicyCache.Delete(fmt.Sprintf("%s/%s/%s", subsID, resourceGroupName, accountName))
+}
+
+// checkFileShareCompatibility returns error describing the mismatch between properties of an existing file share and the requested share options
+func checkFileShareCompatibility(properties *storage.FileShareProperties, shareOptions *fileclient.ShareOptions) error {
+	if quota := int(pointer.Int32Deref(properties.ShareQuota, 0)); quota < shareOptions.RequestGiB {
+		return fmt.Errorf("its capacity %d is smaller than %d", quota, shareOptions.RequestGiB)
+	}
+
+	protocol := properties.EnabledProtocols
+	if protocol == "" {
+		protocol = storage.EnabledProtocolsSMB
+	}
+	requestProtocol := shareOptions.Protocol
+	if requestProtocol == "" {
+		requestProtocol = storage.EnabledProtocolsSMB
+	}
+	if !strings.EqualFold(string(protocol), string(requestProtocol)) {
+		return fmt.Errorf("its protocol %s is different from %s", protocol, requestProtocol)
+	}
+	if shareOptions.AccessTier != "" && !strings.EqualFold(string(properties.AccessTier), shareOptions.AccessTier) {
+		return fmt.Errorf("its access tier %s is different from %s", properties.AccessTier, shareOptions.AccessTier)
+	}
+	if shareOptions.RootSquash != "" && !strings.EqualFold(string(properties.RootSquash), shareOptions.RootSquash) {
+		return fmt.Errorf("its root squash type %s is different from %s", properties.RootSquash, shareOptions.RootSquash)
+	}
+	if value, ok := shareOptions.Metadata[maxShareQuotaKey]; ok {
+		var existing string
+		for k, v := range properties.Metadata {
+			if strings.EqualFold(k, maxShareQuotaKey) {
+				existing = pointer.StringDeref(v, "")
+			}
+		}
+		if existing != pointer.StringDeref(value, "") {
+			return fmt.Errorf("its %s %q is different from %q", maxShareQuotaKey, existing, pointer.StringDeref(value, ""))
+		}
 	}
-	return int(*fileShare.FileShareProperties.ShareQuota), nil
+	return nil
 }
 
 // get file share info according to volume id, e.g.
@@ -473,14 +1028,28 @@ func GetFileShareInfo(id string) (string, string, string, string, string, string
 }
 
 // check whether mountOptions contains file_mode, dir_mode, vers, if not, append default mode
-func appendDefaultMountOptions(mountOptions []string, appendNoShareSockOption, appendClosetimeoOption bool) []string {
+// driverDefaults overrides the hardcoded default values, empty value in driverDefaults is ignored
+// gid=fsGroup is appended if fsGroup is not empty and gid is not in mountOptions, so files are owned by fsGroup without recursive chown
+// readOnlyActimeo overrides the default actimeo of read-only mount if it's not empty
+func appendDefaultMountOptions(mountOptions []string, appendNoShareSockOption, appendClosetimeoOption bool, driverDefaults map[string]string, fsGroup, readOnlyActimeo string) []string {
 	var defaultMountOptions = map[string]string{
 		fileMode:   defaultFileMode,
 		dirMode:    defaultDirMode,
 		actimeo:    defaultActimeo,
 		mfsymlinks: "",
 	}
+	for k, v := range driverDefaults {
+		if v != "" {
+			defaultMountOptions[k] = v
+		}
+	}
 
+	if readOnlyActimeo != "" {
+		defaultMountOptions[actimeo] = readOnlyActimeo
+	}
+	if fsGroup != "" {
+		defaultMountOptions[gidOption] = fsGroup
+	}
 	if appendClosetimeoOption {
 		defaultMountOptions["sloppy,closetimeo=0"] = ""
 	}
@@ -490,21 +1059,42 @@ func appendDefaultMountOptions(mountOptions []string, appendNoShareSockOption, a
 
 	// stores the mount options already included in mountOptions
 	included := make(map[string]bool)
+	allMountOptions := make([]string, 0, len(mountOptions))
 
 	for _, mountOption := range mountOptions {
+		// mount option could contain comma separated options, e.g. "dir_mode=0777,nomfsymlinks"
+		var options []string
+		for _, option := range strings.Split(mountOption, ",") {
+			switch strings.ToLower(strings.TrimSpace(option)) {
+			case noMfsymlinks, mfsymlinks + "=false":
+				// mfsymlinks is disabled explicitly, the option itself is not a valid cifs mount option
+				included[mfsymlinks] = true
+				continue
+			case mfsymlinks + "=true":
+				included[mfsymlinks] = true
+				option = mfsymlinks
+			}
+			options = append(options, option)
+		}
+		if len(options) == 0 {
+			continue
+		}
+		mountOption = strings.Join(options, ",")
+		// match the whole option name of key=value or bare key option,
+		// e.g. versioning=x should not be regarded as vers, nomfsymlinks should not be regarded as mfsymlinks
+		optionName := strings.TrimSpace(strings.SplitN(mountOption, "=", 2)[0])
 		for k := range defaultMountOptions {
-			if strings.HasPrefix(mountOption, k) {
+			if optionName == k || mountOption == k {
 				included[k] = true
 			}
 		}
 		// actimeo would set both acregmax and acdirmax, so we only need to check one of them
-		if strings.Contains(mountOption, "acregmax") || strings.Contains(mountOption, "acdirmax") {
+		if optionName == "acregmax" || optionName == "acdirmax" {
 			included[actimeo] = true
 		}
+		allMountOptions = append(allMountOptions, mountOption)
 	}
 
-	allMountOptions := mountOptions
-
 	for k, v := range defaultMountOptions {
 		if _, isIncluded := included[k]; !isIncluded {
 			if v != "" {
@@ -524,20 +1114,25 @@ func getStorageAccount(secrets map[string]string) (string, string, error) {
 		return "", "", fmt.Errorf("unexpected: getStorageAccount secrets is nil")
 	}
 
-	var accountName, accountKey string
+	accountName, err := getStorageAccountName(secrets)
+	if err != nil {
+		return "", "", err
+	}
+	// secret field names of account key <value, field name>
+	var accountKeyFields [][2]string
 	for k, v := range secrets {
-		v = strings.TrimSpace(v)
 		switch strings.ToLower(k) {
-		case "accountname":
-			accountName = v
-		case defaultSecretAccountName: // for compatibility with built-in azurefile plugin
-			accountName = v
-		case "accountkey":
-			accountKey = v
-		case defaultSecretAccountKey: // for compatibility with built-in azurefile plugin
-			accountKey = v
+		// azurestorageaccountkey is for compatibility with built-in azurefile plugin
+		case "accountkey", defaultSecretAccountKey:
+			if value := normalizeAccountKey(v); value != "" {
+				accountKeyFields = append(accountKeyFields, [2]string{value, k})
+			}
 		}
 	}
+	accountKey, conflicts := getUniqueSecretValue(accountKeyFields, func(a, b string) bool { return a == b })
+	if len(conflicts) > 0 {
+		return "", "", fmt.Errorf("secret fields(%s) have conflicting account keys", strings.Join(conflicts, ", "))
+	}
 
 	if accountName == "" {
 		return "", "", fmt.Errorf("could not find accountname or azurestorageaccountname field in secrets")
@@ -545,30 +1140,102 @@ func getStorageAccount(secrets map[string]string) (string, string, error) {
 	if accountKey == "" {
 		return "", "", fmt.Errorf("could not find accountkey or azurestorageaccountkey field in secrets")
 	}
-	accountName = strings.TrimSpace(accountName)
 
 	klog.V(4).Infof("got storage account(%s) from secret", accountName)
 	return accountName, accountKey, nil
 }
 
+// getStorageAccountName returns account name in secrets without requiring account key, e.g. for nfs volumes
+func getStorageAccountName(secrets map[string]string) (string, error) {
+	// secret field names of account name <value, field name>
+	var accountNameFields [][2]string
+	for k, v := range secrets {
+		switch strings.ToLower(k) {
+		// azurestorageaccountname is for compatibility with built-in azurefile plugin
+		case "accountname", defaultSecretAccountName:
+			if value := strings.TrimSpace(v); value != "" {
+				accountNameFields = append(accountNameFields, [2]string{value, k})
+			}
+		}
+	}
+	// storage account name is case insensitive
+	accountName, conflicts := getUniqueSecretValue(accountNameFields, strings.EqualFold)
+	if len(conflicts) > 0 {
+		return "", fmt.Errorf("secret fields(%s) have conflicting account names", strings.Join(conflicts, ", "))
+	}
+	return accountName, nil
+}
+
+// getUniqueSecretValue returns the value of secret fields <value, field name> (value of the first field name in order),
+// sorted field names are returned instead if the fields have different values according to equal
+func getUniqueSecretValue(fields [][2]string, equal func(a, b string) bool) (string, []string) {
+	sort.Slice(fields, func(i, j int) bool { return fields[i][1] < fields[j][1] })
+	var value string
+	for _, field := range fields {
+		if value != "" && !equal(field[0], value) {
+			names := make([]string, 0, len(fields))
+			for _, f := range fields {
+				names = append(names, f[1])
+			}
+			return "", names
+		}
+		if value == "" {
+			value = field[0]
+		}
+	}
+	return value, nil
+}
+
 // File share names can contain only lowercase letters, numbers, and hyphens,
 // and must begin and end with a letter or a number,
 // and must be from 3 through 63 characters long.
 // The name cannot contain two consecutive hyphens.
 //
+// shareNamePrefix (if not empty) is prepended to the volume name, and it is always kept
+// when the combined name is truncated to satisfy the length limit.
+//
 // See https://docs.microsoft.com/en-us/rest/api/storageservices/naming-and-referencing-shares--directories--files--and-metadata#share-names
-func getValidFileShareName(volumeName string) string {
+func getValidFileShareName(volumeName, shareNamePrefix string) string {
+	prefix := strings.TrimSuffix(strings.ToLower(shareNamePrefix), "-")
 	fileShareName := strings.ToLower(volumeName)
+	if prefix != "" {
+		fileShareName = prefix + "-" + fileShareName
+	}
+	fileShareName = truncateFileShareName(fileShareName)
+	if len(fileShareName) > 0 && len(fileShareName) < fileShareNameMinLength && checkShareNameBeginAndEnd(fileShareName) {
+		// pad short name with a suffix derived from the name itself, so that the share name is still readable and idempotent
+		paddedName := padFileShareName(fileShareName)
+		klog.V(2).Infof("the requested volume name (%q) with prefix (%q) is too short, so it is padded as (%q)", volumeName, shareNamePrefix, paddedName)
+		return paddedName
+	}
+	if len(fileShareName) < fileShareNameMinLength || !checkShareNameBeginAndEnd(fileShareName) {
+		generatePrefix := "pvc-file"
+		if prefix != "" && checkShareNameBeginAndEnd(prefix) {
+			generatePrefix = prefix
+		}
+		fileShareName = truncateFileShareName(util.GenerateVolumeName(generatePrefix, uuid.NewUUID().String(), fileShareNameMaxLength))
+		klog.Warningf("the requested volume name (%q) with prefix (%q) is invalid, so it is regenerated as (%q)", volumeName, shareNamePrefix, fileShareName)
+	}
+	return fileShareName
+}
+
+// padFileShareName appends a hash-derived suffix to a share name shorter than fileShareNameMinLength,
+// e.g. "aq" is padded as "aq-xxxxxxxx", the same name is always padded with the same suffix
+func padFileShareName(fileShareName string) string {
+	hash := sha256.Sum256([]byte(fileShareName))
+	return fileShareName + "-" + hex.EncodeToString(hash[:])[:shareNamePaddingLength]
+}
+
+// truncateFileShareName removes consecutive hyphens, truncates the name to fileShareNameMaxLength
+// and then removes trailing hyphens
+func truncateFileShareName(fileShareName string) string {
+	for strings.Contains(fileShareName, "--") {
+		fileShareName = strings.ReplaceAll(fileShareName, "--", "-")
+	}
 	if len(fileShareName) > fileShareNameMaxLength {
 		fileShareName = fileShareName[0:fileShareNameMaxLength]
 	}
-	if !checkShareNameBeginAndEnd(fileShareName) || len(fileShareName) < fileShareNameMinLength {
-		fileShareName = util.GenerateVolumeName("pvc-file", uuid.NewUUID().String(), fileShareNameMaxLength)
-		klog.Warningf("the requested volume name (%q) is invalid, so it is regenerated as (%q)", volumeName, fileShareName)
-	}
-	fileShareName = strings.Replace(fileShareName, "--", "-", -1)
-
-	return strings.ToLower(fileShareName)
+	return strings.TrimRight(fileShareName, "-")
 }
 
 func checkShareNameBeginAndEnd(fileShareName string) bool {
@@ -585,16 +1252,67 @@ func checkShareNameBeginAndEnd(fileShareName string) bool {
 
 // get snapshot name according to snapshot id, e.g.
 // input: "rg#f5713de20cde511e8ba4900#csivolumename#diskname#2019-08-22T07:17:53.0000000Z"
-// output: 2019-08-22T07:17:53.0000000Z (last element)
+// output: 2019-08-22T07:17:53.0000000Z (last element normalized by normalizeSnapshotTime)
 func getSnapshot(id string) (string, error) {
 	segments := strings.Split(id, separator)
 	if len(segments) < 5 {
 		return "", fmt.Errorf("error parsing volume id: %q, should at least contain four #", id)
 	}
-	return segments[len(segments)-1], nil
+	return normalizeSnapshotTime(segments[len(segments)-1])
+}
+
+// normalizeSnapshotTime converts snapshot time with any fractional-second precision or time zone offset,
+// e.g. 2019-08-22T07:17:53Z, 2019-08-22T07:17:53.12Z, into the 7-digit UTC format of azure file share snapshot
+func normalizeSnapshotTime(snapshot string) (string, error) {
+	t, err := time.Parse(time.RFC3339Nano, snapshot)
+	if err != nil {
+		return "", fmt.Errorf("invalid snapshot time(%s), should be in %s format", snapshot, snapshotTimeFormat)
+	}
+	return t.UTC().Format(snapshotTimeFormat), nil
+}
+
+// getStorageEndPointSuffix returns the effective storage endpoint suffix,
+// override (e.g. storageEndpointSuffix in storage class) takes precedence over the suffix of cloud environment,
+// the suffix of cloud environment is resolved only once and then cached
+func (d *Driver) getStorageEndPointSuffix(override string) string {
+	if strings.TrimSpace(override) != "" {
+		return override
+	}
+	d.storageEndpointSuffixOnce.Do(func() {
+		var cloudName string
+		if d.cloud != nil {
+			if d.cloud.Environment.StorageEndpointSuffix != "" {
+				d.storageEndpointSuffix = d.cloud.Environment.StorageEndpointSuffix
+				return
+			}
+			cloudName = d.cloud.Environment.Name
+			if cloudName == "" {
+				cloudName = d.cloud.Cloud
+			}
+		}
+		d.storageEndpointSuffix = getDefaultStorageEndPointSuffix(cloudName)
+		klog.Warningf("storage endpoint suffix is empty in cloud environment(%s), use default suffix(%s)", cloudName, d.storageEndpointSuffix)
+	})
+	return d.storageEndpointSuffix
+}
+
+// getDefaultStorageEndPointSuffix returns the well-known storage endpoint suffix of cloud environment,
+// e.g. core.chinacloudapi.cn for AzureChinaCloud, suffix of public cloud is returned for unknown cloud
+func getDefaultStorageEndPointSuffix(cloudName string) string {
+	if cloudName != "" {
+		if env, err := azure2.EnvironmentFromName(cloudName); err == nil && env.StorageEndpointSuffix != "" {
+			return env.StorageEndpointSuffix
+		}
+		klog.Warningf("could not get storage endpoint suffix of cloud environment(%s), use %s", cloudName, defaultStorageEndPointSuffix)
+	}
+	return defaultStorageEndPointSuffix
 }
 
-func getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string) (*azfile.FileURL, error) {
+func getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, retryOptions azfile.RetryOptions) (*azfile.FileURL, error) {
+	if storageEndpointSuffix == "" {
+		klog.Warningf("storage endpoint suffix is empty, use %s for file(%s) on share(%s) in account(%s)", defaultStorageEndPointSuffix, diskName, fileShareName, accountName)
+		storageEndpointSuffix = defaultStorageEndPointSuffix
+	}
 	credential, err := azfile.NewSharedKeyCredential(accountName, accountKey)
 	if err != nil {
 		return nil, fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
@@ -606,46 +1324,255 @@ func getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, d
 	if u == nil {
 		return nil, fmt.Errorf("parse fileURLTemplate error: url is nil")
 	}
-	po := azfile.PipelineOptions{
-		// Set RetryOptions to control how HTTP request are retried when retryable failures occur
-		Retry: azfile.RetryOptions{
-			Policy:        azfile.RetryPolicyExponential, // Use exponential backoff as opposed to linear
-			MaxTries:      3,                             // Try at most 3 times to perform the operation (set to 1 to disable retries)
-			TryTimeout:    time.Second * 3,               // Maximum time allowed for any single try
-			RetryDelay:    time.Second * 1,               // Backoff amount for each retry (exponential or linear)
-			MaxRetryDelay: time.Second * 3,               // Max delay between retries
-		},
-	}
+	// RetryOptions control how HTTP request are retried when retryable failures occur
+	po := azfile.PipelineOptions{Retry: retryOptions}
 	fileURL := azfile.NewFileURL(*u, azfile.NewPipeline(credential, po))
 	return &fileURL, nil
 }
 
-func createDisk(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, diskSizeBytes int64) error {
+// newDataPlaneRetryOptions returns exponential retry options of data plane file pipeline,
+// zero or negative value falls back to the default one
+func newDataPlaneRetryOptions(maxTries int, tryTimeout, retryDelay, maxRetryDelay time.Duration) azfile.RetryOptions {
+	if maxTries <= 0 {
+		maxTries = defaultDataPlaneMaxTries
+	}
+	if tryTimeout <= 0 {
+		tryTimeout = defaultDataPlaneTryTimeout
+	}
+	if retryDelay <= 0 {
+		retryDelay = defaultDataPlaneRetryDelay
+	}
+	if maxRetryDelay <= 0 {
+		maxRetryDelay = defaultDataPlaneMaxRetryDelay
+	}
+	return azfile.RetryOptions{
+		Policy:        azfile.RetryPolicyExponential, // Use exponential backoff as opposed to linear
+		MaxTries:      int32(maxTries),               // Try at most maxTries times to perform the operation (set to 1 to disable retries)
+		TryTimeout:    tryTimeout,                    // Maximum time allowed for any single try
+		RetryDelay:    retryDelay,                    // Backoff amount for each retry (exponential or linear)
+		MaxRetryDelay: maxRetryDelay,                 // Max delay between retries
+	}
+}
+
+func createDisk(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, diskSizeBytes int64, retryOptions azfile.RetryOptions) error {
+	if diskSizeBytes <= vhd.VHD_HEADER_SIZE {
+		return fmt.Errorf("disk size(%d) should be larger than vhd header size(%d)", diskSizeBytes, vhd.VHD_HEADER_SIZE)
+	}
+	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName, retryOptions)
+	if err != nil {
+		return err
+	}
+	if fileURL == nil {
+		return fmt.Errorf("getFileURL(%s,%s,%s,%s) return empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName)
+	}
+	return writeVHDDisk(ctx, &azureDiskFile{fileURL: fileURL}, diskName, diskSizeBytes)
+}
+
+// diskFile is the file operations used to create and resize a vhd disk file on file share
+type diskFile interface {
+	Create(ctx context.Context, size int64) error
+	GetSize(ctx context.Context) (int64, error)
+	Resize(ctx context.Context, size int64) error
+	UploadRange(ctx context.Context, offset int64, data []byte) error
+	DownloadRange(ctx context.Context, offset, count int64) ([]byte, error)
+	Delete(ctx context.Context) error
+}
+
+// newDiskFile returns the vhd disk file on file share with data plane API, it's a variable so that unit tests could replace it
+var newDiskFile = func(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, retryOptions azfile.RetryOptions) (diskFile, error) {
+	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName, retryOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &azureDiskFile{fileURL: fileURL}, nil
+}
+
+// azureDiskFile implements diskFile with data plane API
+type azureDiskFile struct {
+	fileURL *azfile.FileURL
+}
+
+func (f *azureDiskFile) Create(ctx context.Context, size int64) error {
+	_, err := f.fileURL.Create(ctx, size, azfile.FileHTTPHeaders{}, azfile.Metadata{})
+	return err
+}
+
+func (f *azureDiskFile) GetSize(ctx context.Context) (int64, error) {
+	resp, err := f.fileURL.GetProperties(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return resp.ContentLength(), nil
+}
+
+func (f *azureDiskFile) Resize(ctx context.Context, size int64) error {
+	_, err := f.fileURL.Resize(ctx, size)
+	return err
+}
+
+func (f *azureDiskFile) UploadRange(ctx context.Context, offset int64, data []byte) error {
+	_, err := f.fileURL.UploadRange(ctx, offset, bytes.NewReader(data), nil)
+	return err
+}
+
+func (f *azureDiskFile) DownloadRange(ctx context.Context, offset, count int64) ([]byte, error) {
+	resp, err := f.fileURL.Download(ctx, offset, count, false)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.Body(azfile.RetryReaderOptions{})
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func (f *azureDiskFile) Delete(ctx context.Context) error {
+	_, err := f.fileURL.Delete(ctx)
+	return err
+}
+
+// writeVHDDisk creates a fixed vhd disk file with diskSizeBytes, the partially created file is deleted on failure
+// so that it would not consume file share quota and retries start from a clean state
+func writeVHDDisk(ctx context.Context, file diskFile, diskName string, diskSizeBytes int64) error {
 	vhdHeader := vhd.CreateFixedHeader(uint64(diskSizeBytes), &vhd.VHDOptions{})
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.BigEndian, vhdHeader); nil != err {
 		return fmt.Errorf("failed to write VHDHeader(%+v): %v", vhdHeader, err)
 	}
 	headerBytes := buf.Bytes()
-	start := diskSizeBytes - int64(len(headerBytes))
-	end := diskSizeBytes - 1
+	start := diskSizeBytes - vhd.VHD_HEADER_SIZE
 
-	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
-	if err != nil {
+	if err := file.Create(ctx, diskSizeBytes); err != nil {
 		return err
 	}
-	if fileURL == nil {
-		return fmt.Errorf("getFileURL(%s,%s,%s,%s) return empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName)
+	// delete the half-created file if the vhd footer is not written correctly, otherwise it could not be mounted
+	deleteDiskFile := func(cause error) error {
+		// ctx may be already canceled(e.g. CreateVolume timeout), cleanup is best-effort with its own timeout
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), diskFileCleanupTimeout)
+		defer cancel()
+		if err := file.Delete(cleanupCtx); err != nil {
+			klog.Errorf("failed to delete partially created disk file(%s): %v", diskName, err)
+		} else {
+			klog.V(2).Infof("partially created disk file(%s) is deleted", diskName)
+		}
+		return cause
 	}
-	if _, err = fileURL.Create(ctx, diskSizeBytes, azfile.FileHTTPHeaders{}, azfile.Metadata{}); err != nil {
-		return err
+	if err := file.UploadRange(ctx, start, headerBytes[:vhd.VHD_HEADER_SIZE]); err != nil {
+		return deleteDiskFile(fmt.Errorf("failed to upload vhd footer of disk(%s): %v", diskName, err))
+	}
+	footer, err := file.DownloadRange(ctx, start, vhd.VHD_HEADER_SIZE)
+	if err != nil {
+		return deleteDiskFile(fmt.Errorf("failed to download vhd footer of disk(%s): %v", diskName, err))
+	}
+	if err := verifyVHDFooter(footer, diskSizeBytes); err != nil {
+		return deleteDiskFile(fmt.Errorf("failed to verify vhd footer of disk(%s): %v", diskName, err))
+	}
+	return nil
+}
+
+// resizeVHDDisk grows the fixed vhd disk file on file share to diskSizeBytes and writes the vhd footer at the end of the file,
+// the data of the old disk is kept and the filesystem inside should be expanded on the node afterwards.
+// It's safe to retry after a partial failure, return false if the disk is already resized
+func resizeVHDDisk(ctx context.Context, file diskFile, diskName string, diskSizeBytes int64) (bool, error) {
+	size, err := file.GetSize(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get size of disk(%s): %v", diskName, err)
+	}
+	start := diskSizeBytes - vhd.VHD_HEADER_SIZE
+	if size > diskSizeBytes {
+		klog.V(2).Infof("disk(%s) size(%d) is already larger than %d, skip resizing", diskName, size, diskSizeBytes)
+		return false, nil
+	}
+	if size == diskSizeBytes {
+		if footer, err := file.DownloadRange(ctx, start, vhd.VHD_HEADER_SIZE); err == nil && verifyVHDFooter(footer, diskSizeBytes) == nil {
+			klog.V(2).Infof("disk(%s) is already resized to %d, skip resizing", diskName, diskSizeBytes)
+			return false, nil
+		}
+	}
+
+	vhdHeader := vhd.CreateFixedHeader(uint64(diskSizeBytes), &vhd.VHDOptions{})
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, vhdHeader); nil != err {
+		return false, fmt.Errorf("failed to write VHDHeader(%+v): %v", vhdHeader, err)
+	}
+	if size < diskSizeBytes {
+		if err := file.Resize(ctx, diskSizeBytes); err != nil {
+			return false, fmt.Errorf("failed to resize disk(%s) from %d to %d: %v", diskName, size, diskSizeBytes, err)
+		}
+	}
+	if err := file.UploadRange(ctx, start, buf.Bytes()[:vhd.VHD_HEADER_SIZE]); err != nil {
+		return false, fmt.Errorf("failed to upload vhd footer of disk(%s): %v", diskName, err)
+	}
+	footer, err := file.DownloadRange(ctx, start, vhd.VHD_HEADER_SIZE)
+	if err != nil {
+		return false, fmt.Errorf("failed to download vhd footer of disk(%s): %v", diskName, err)
+	}
+	if err := verifyVHDFooter(footer, diskSizeBytes); err != nil {
+		return false, fmt.Errorf("failed to verify vhd footer of disk(%s): %v", diskName, err)
 	}
-	if _, err = fileURL.UploadRange(ctx, end-start, bytes.NewReader(headerBytes[:vhd.VHD_HEADER_SIZE]), nil); err != nil {
+	return true, nil
+}
+
+// verifyVHDFooter checks cookie, checksum and disk size of a fixed vhd footer
+func verifyVHDFooter(footer []byte, diskSizeBytes int64) error {
+	if len(footer) != vhd.VHD_HEADER_SIZE {
+		return fmt.Errorf("unexpected footer size(%d), expected %d", len(footer), vhd.VHD_HEADER_SIZE)
+	}
+	var header vhd.VHDHeader
+	if err := binary.Read(bytes.NewReader(footer), binary.BigEndian, &header); err != nil {
 		return err
 	}
+	if cookie := hex.EncodeToString(header.Cookie[:]); cookie != vhd.VHD_COOKIE {
+		return fmt.Errorf("unexpected cookie(%s), expected %s", cookie, vhd.VHD_COOKIE)
+	}
+	// checksum is the one's complement of the sum of all bytes in the footer excluding the checksum field
+	var sum uint32
+	for _, b := range footer {
+		sum += uint32(b)
+	}
+	for _, b := range header.Checksum {
+		sum -= uint32(b)
+	}
+	if checksum := binary.BigEndian.Uint32(header.Checksum[:]); checksum != ^sum {
+		return fmt.Errorf("unexpected checksum(%x), expected %x", checksum, ^sum)
+	}
+	if size := binary.BigEndian.Uint64(header.CurrentSize[:]); size != uint64(diskSizeBytes) {
+		return fmt.Errorf("unexpected disk size(%d), expected %d", size, diskSizeBytes)
+	}
 	return nil
 }
 
+// resizeDiskFile grows the fixed vhd file on diskPath to diskSizeBytes and moves the vhd footer to the end of the file,
+// return false if the file is already large enough, e.g. it's resized by ControllerExpandVolume
+func resizeDiskFile(diskPath string, diskSizeBytes int64) (bool, error) {
+	info, err := os.Stat(diskPath)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() >= diskSizeBytes {
+		klog.V(2).Infof("disk file(%s) size(%d) is already larger than or equal to %d, skip resizing", diskPath, info.Size(), diskSizeBytes)
+		return false, nil
+	}
+
+	vhdHeader := vhd.CreateFixedHeader(uint64(diskSizeBytes), &vhd.VHDOptions{})
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, vhdHeader); nil != err {
+		return false, fmt.Errorf("failed to write VHDHeader(%+v): %v", vhdHeader, err)
+	}
+
+	f, err := os.OpenFile(diskPath, os.O_WRONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if err := f.Truncate(diskSizeBytes); err != nil {
+		return false, err
+	}
+	if _, err := f.WriteAt(buf.Bytes()[:vhd.VHD_HEADER_SIZE], diskSizeBytes-vhd.VHD_HEADER_SIZE); err != nil {
+		return false, err
+	}
+	return true, f.Sync()
+}
+
 func IsCorruptedDir(dir string) bool {
 	_, pathErr := mount.PathExists(dir)
 	return pathErr != nil && mount.IsCorruptedMnt(pathErr)
@@ -656,14 +1583,19 @@ func IsCorruptedDir(dir string) bool {
 func (d *Driver) GetAccountInfo(ctx context.Context, volumeID string, secrets, reqContext map[string]string) (string, string, string, string, string, string, error) {
 	rgName, accountName, fileShareName, diskName, secretNamespace, subsID, err := GetFileShareInfo(volumeID)
 	if err != nil {
+		if d.strictVolumeIDParsing {
+			return "", "", "", "", "", "", err
+		}
 		// ignore volumeID parsing error
 		klog.Warningf("parsing volumeID(%s) return with error: %v", volumeID, err)
 		err = nil
 	}
 
-	var protocol, accountKey, secretName, pvcNamespace string
+	var protocol, fsType, accountKey, secretName, pvcNamespace, keyVaultURL, keyVaultSecretName string
 	// getAccountKeyFromSecret indicates whether get account key only from k8s secret
 	var getAccountKeyFromSecret, getLatestAccountKey bool
+	// storeAccountKey is false means account key is not stored in k8s secret by CreateVolume
+	storeAccountKey := true
 
 	for k, v := range reqContext {
 		switch strings.ToLower(k) {
@@ -677,18 +1609,28 @@ func (d *Driver) GetAccountInfo(ctx context.Context, volumeID string, secrets, r
 			if strings.EqualFold(v, trueValue) {
 				getAccountKeyFromSecret = true
 			}
+		case storeAccountKeyField:
+			if strings.EqualFold(v, falseValue) {
+				storeAccountKey = false
+			}
 		case shareNameField:
 			fileShareName = v
 		case diskNameField:
 			diskName = v
 		case protocolField:
 			protocol = v
+		case fsTypeField:
+			fsType = v
 		case secretNameField:
 			secretName = v
 		case secretNamespaceField:
 			secretNamespace = v
 		case pvcNamespaceKey:
 			pvcNamespace = v
+		case keyVaultURLField:
+			keyVaultURL = v
+		case keyVaultSecretNameField:
+			keyVaultSecretName = v
 		case getLatestAccountKeyField:
 			if getLatestAccountKey, err = strconv.ParseBool(v); err != nil {
 				return rgName, accountName, accountKey, fileShareName, diskName, subsID, fmt.Errorf("invalid %s: %s in volume context", getLatestAccountKeyField, v)
@@ -702,18 +1644,26 @@ func (d *Driver) GetAccountInfo(ctx context.Context, volumeID string, secrets, r
 	if subsID == "" {
 		subsID = d.cloud.SubscriptionID
 	}
-	if protocol == nfs && fileShareName != "" {
-		// nfs protocol does not need account key, return directly
+	if getEffectiveProtocol(protocol, fsType) == nfs {
+		// nfs protocol does not need account key, only resolve account name and return directly
+		if len(secrets) > 0 {
+			var account string
+			account, err = getStorageAccountName(secrets)
+			if account != "" {
+				accountName = account
+			}
+		} else if accountName == "" && secretName != "" && d.cloud.KubeClient != nil {
+			secretNamespace = d.getSecretNamespace(secretNamespace, pvcNamespace)
+			if name, _, secretErr := d.GetStorageAccountFromSecret(ctx, secretName, secretNamespace); secretErr != nil {
+				klog.Warningf("GetStorageAccountFromSecret(%s, %s) failed with error: %v", secretName, secretNamespace, secretErr)
+			} else if name != "" {
+				accountName = name
+			}
+		}
 		return rgName, accountName, accountKey, fileShareName, diskName, subsID, err
 	}
 
-	if secretNamespace == "" {
-		if pvcNamespace == "" {
-			secretNamespace = defaultNamespace
-		} else {
-			secretNamespace = pvcNamespace
-		}
-	}
+	secretNamespace = d.getSecretNamespace(secretNamespace, pvcNamespace)
 
 	if len(secrets) == 0 {
 		// read account key from cache first
@@ -723,24 +1673,39 @@ func (d *Driver) GetAccountInfo(ctx context.Context, volumeID string, secrets, r
 		}
 		if cache != nil {
 			accountKey = cache.(string)
+		} else if keyVaultURL != "" {
+			accountKey, err = d.getAccountKeyFromKeyVault(ctx, accountName, keyVaultURL, keyVaultSecretName)
 		} else {
 			if secretName == "" && accountName != "" {
 				secretName = fmt.Sprintf(secretNameTemplate, accountName)
 			}
 			if secretName != "" {
-				var name string
-				name, accountKey, err = d.GetStorageAccountFromSecret(ctx, secretName, secretNamespace)
-				if name != "" {
-					accountName = name
-				}
-				if err != nil {
-					klog.Warningf("GetStorageAccountFromSecret(%s, %s) failed with error: %v", secretName, secretNamespace, err)
-					if !getAccountKeyFromSecret && d.cloud.StorageAccountClient != nil && accountName != "" {
-						klog.V(2).Infof("use cluster identity to get account key from (%s, %s, %s)", subsID, rgName, accountName)
-						accountKey, err = d.cloud.GetStorageAccesskey(ctx, subsID, accountName, rgName, getLatestAccountKey)
-						if err != nil {
-							klog.Errorf("GetStorageAccesskey(%s, %s, %s) failed with error: %v", subsID, rgName, accountName, err)
-						}
+				if getAccountKeyFromSecret || accountName == "" {
+					// account key is only read from k8s secret, or account name is only available in k8s secret
+					var name string
+					name, accountKey, err = d.getStorageAccountFromSecret(ctx, secretName, secretNamespace, accountName)
+					if name != "" {
+						accountName = name
+					}
+					if err != nil {
+						klog.Warningf("GetStorageAccountFromSecret(%s, %s) failed with error: %v", secretName, secretNamespace, err)
+					}
+				} else {
+					// the same precedence of account key sources as GetStorageAccesskey
+					sources := d.accountKeySources
+					if d.cloud.StorageAccountClient == nil {
+						sources = removeAccountKeySource(sources, accountKeySourceClusterIdentity)
+					}
+					if !storeAccountKey && (d.cloud.StorageAccountClient != nil || d.workloadIdentityClient != nil) {
+						// there is no secret if account key is not stored
+						sources = removeAccountKeySource(sources, accountKeySourceSecret)
+						klog.V(2).Infof("account key is not stored in secret(%s) since %s is false, get account key of (%s, %s, %s) from %v, this costs one ListKeys ARM call per mount when account key is not cached",
+							secretName, storeAccountKeyField, subsID, rgName, accountName, sources)
+					}
+					accountOptions := &azure.AccountOptions{Name: accountName, SubscriptionID: subsID, ResourceGroup: rgName, GetLatestAccountKey: getLatestAccountKey}
+					accountKey, err = d.getAccountKeyFromSources(ctx, accountOptions, secretName, secretNamespace, sources)
+					if err != nil {
+						klog.Errorf("getAccountKeyFromSources(%s, %s, %s) failed with error: %v", subsID, rgName, accountName, err)
 					}
 				}
 			}
@@ -774,16 +1739,67 @@ func isSupportedProtocol(protocol string) bool {
 	return false
 }
 
-func isSupportedShareAccessTier(accessTier string) bool {
-	if accessTier == "" {
-		return true
-	}
-	for _, tier := range storage.PossibleShareAccessTierValues() {
-		if accessTier == string(tier) {
-			return true
+// validateProtocolFsType checks whether protocol and fsType in storage class could be used together:
+// disk fsType(ext4, ext3, ext2, xfs) requires a vhd disk and could only be used with nfs protocol on an existing vhd disk(diskName),
+// cifs/smb fsType could not be used with nfs protocol and vice versa
+func validateProtocolFsType(protocol, fsType, diskName string) error {
+	if isDiskFsType(fsType) {
+		if diskName != "" && !strings.HasSuffix(diskName, vhdSuffix) {
+			return fmt.Errorf("fsType(%s) requires a vhd disk, diskName(%s) should end with %s", fsType, diskName, vhdSuffix)
+		}
+		if protocol == nfs && diskName == "" {
+			return fmt.Errorf("fsType(%s) is not supported with protocol(%s) unless diskName of an existing vhd disk is set", fsType, protocol)
 		}
+		return nil
 	}
-	return false
+	if protocol == nfs && (fsType == cifs || fsType == smb) {
+		return fmt.Errorf("fsType(%s) is not supported with protocol(%s)", fsType, protocol)
+	}
+	if protocol == smb && fsType == nfs {
+		return fmt.Errorf("fsType(%s) is not supported with protocol(%s)", fsType, protocol)
+	}
+	if strings.HasSuffix(diskName, vhdSuffix) && fsType != "" {
+		return fmt.Errorf("vhd disk(%s) requires fsType to be one of %v, current fsType: %s", diskName, supportedDiskFsTypeList, fsType)
+	}
+	return nil
+}
+
+// normalizeSkuName returns the sku name in canonical casing, e.g. premium_lrs is normalized as Premium_LRS,
+// unknown sku name is returned as is
+func normalizeSkuName(sku string) string {
+	for _, v := range storage.PossibleSkuNameValues() {
+		if strings.EqualFold(sku, string(v)) {
+			return string(v)
+		}
+	}
+	return sku
+}
+
+func isPremiumSku(sku string) bool {
+	return strings.HasPrefix(strings.ToLower(sku), premium)
+}
+
+// getSupportedSkuNames returns the sku names of storage account which support the protocol
+func getSupportedSkuNames(protocol string) []string {
+	var result []string
+	for _, v := range storage.PossibleSkuNameValues() {
+		if protocol != nfs || isPremiumSku(string(v)) {
+			result = append(result, string(v))
+		}
+	}
+	return result
+}
+
+func isSupportedShareAccessTier(accessTier string) bool {
+	if accessTier == "" {
+		return true
+	}
+	for _, tier := range storage.PossibleShareAccessTierValues() {
+		if accessTier == string(tier) {
+			return true
+		}
+	}
+	return false
 }
 
 func isSupportedAccountAccessTier(accessTier string) bool {
@@ -822,10 +1838,135 @@ func isSupportedFSGroupChangePolicy(policy string) bool {
 	return false
 }
 
+func isSupportedSMBVers(smbVers string) bool {
+	for _, v := range supportedSMBVersList {
+		if smbVers == v {
+			return true
+		}
+	}
+	return false
+}
+
+// useProxyMount returns whether the share should be mounted on the proxy-mount path next to
+// the staging path and then bind mounted onto the staging path, proxyMount in volume context
+// overrides the driver default, vhd disk volume is always mounted through the proxy-mount path
+func (d *Driver) useProxyMount(proxyMountValue, fsType string) (bool, error) {
+	useProxy := d.enableProxyMount
+	if proxyMountValue != "" {
+		switch strings.ToLower(proxyMountValue) {
+		case trueValue:
+			useProxy = true
+		case falseValue:
+			useProxy = false
+		default:
+			return false, fmt.Errorf("invalid %s: %s, should be true or false", proxyMountField, proxyMountValue)
+		}
+	}
+	if isDiskFsType(fsType) {
+		if proxyMountValue != "" && !useProxy {
+			return false, fmt.Errorf("%s could not be false with vhd disk volume(fsType: %s)", proxyMountField, fsType)
+		}
+		return true, nil
+	}
+	return useProxy, nil
+}
+
+// validateSMBVers returns error if smb protocol version(vers) in mount options is not supported,
+// vers is negotiated by mount.cifs if not specified
+func validateSMBVers(mountOptions []string) error {
+	for _, mountOption := range mountOptions {
+		for _, option := range strings.Split(mountOption, ",") {
+			kv := strings.SplitN(option, "=", 2)
+			if strings.TrimSpace(kv[0]) != vers {
+				continue
+			}
+			var smbVers string
+			if len(kv) == 2 {
+				smbVers = strings.TrimSpace(kv[1])
+			}
+			if !isSupportedSMBVers(smbVers) {
+				return fmt.Errorf("smb protocol version(%s=%s) is not supported, supported versions: %v", vers, smbVers, supportedSMBVersList)
+			}
+		}
+	}
+	return nil
+}
+
+func isSupportedDiskMountOption(option string) bool {
+	for _, v := range supportedDiskMountOptionList {
+		if option == v {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDiskMountOptions parses comma separated mount options of vhd disk loopback mount, only options in
+// supportedDiskMountOptionList are allowed, defaultDiskMountOptions is returned if diskMountOptions is empty
+func parseDiskMountOptions(diskMountOptions, fsType string) ([]string, error) {
+	var options []string
+	for _, option := range strings.Split(diskMountOptions, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if value, found := strings.CutPrefix(option, "commit="); found {
+			// commit interval is only supported by ext3/ext4 journal
+			if _, err := strconv.ParseUint(value, 10, 32); err != nil || (fsType != ext3 && fsType != ext4) {
+				return nil, fmt.Errorf("disk mount option(%s) is not supported with fsType(%s), commit should be a non-negative integer in seconds on ext3 or ext4", option, fsType)
+			}
+		} else if !isSupportedDiskMountOption(option) {
+			return nil, fmt.Errorf("disk mount option(%s) is not supported, supported options: %v", option, supportedDiskMountOptionList)
+		}
+		options = append(options, option)
+	}
+	if len(options) == 0 {
+		return defaultDiskMountOptions, nil
+	}
+	return options, nil
+}
+
+func isSupportedMountOptionsMismatchPolicy(policy string) bool {
+	for _, v := range supportedMountOptionsMismatchPolicyList {
+		if policy == v {
+			return true
+		}
+	}
+	return false
+}
+
+func isSupportedNilShareQuotaPolicy(policy string) bool {
+	for _, v := range supportedNilShareQuotaPolicyList {
+		if policy == v {
+			return true
+		}
+	}
+	return false
+}
+
 // CreateFileShare creates a file share
+// if the share with the same name is being deleted, wait until the deletion completes or shareBeingDeletedTimeoutInSeconds elapses
 func (d *Driver) CreateFileShare(ctx context.Context, accountOptions *azure.AccountOptions, shareOptions *fileclient.ShareOptions, secrets map[string]string) error {
+	var err error
+	timeout := time.Duration(d.shareBeingDeletedTimeoutInSeconds) * time.Second
+	pollErr := wait.PollUntilContextTimeout(ctx, d.shareBeingDeletedPollInterval, timeout, true, func(context.Context) (bool, error) {
+		err = d.createFileShare(ctx, accountOptions, shareOptions, secrets)
+		if isShareBeingDeletedError(err) {
+			klog.Warningf("CreateFileShare(%s) on account(%s) failed with error(%v), waiting for the deletion to complete", shareOptions.Name, accountOptions.Name, err)
+			return false, nil
+		}
+		return true, err
+	})
+	if pollErr != nil && isShareBeingDeletedError(err) {
+		return fmt.Errorf("file share(%s) on account(%s) is still being deleted after %v: %v", shareOptions.Name, accountOptions.Name, timeout, err)
+	}
+	return pollErr
+}
+
+func (d *Driver) createFileShare(ctx context.Context, accountOptions *azure.AccountOptions, shareOptions *fileclient.ShareOptions, secrets map[string]string) error {
 	return wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
 		var err error
+		start := time.Now()
 		if len(secrets) > 0 {
 			accountName, accountKey, rerr := getStorageAccount(secrets)
 			if rerr != nil {
@@ -835,19 +1976,160 @@ func (d *Driver) CreateFileShare(ctx context.Context, accountOptions *azure.Acco
 		} else {
 			_, err = d.cloud.FileClient.WithSubscriptionID(accountOptions.SubscriptionID).CreateFileShare(ctx, accountOptions.ResourceGroup, accountOptions.Name, shareOptions, "")
 		}
+		observeFileShareOperation("create_file_share", start, err)
+		if isShareBeingDeletedError(err) {
+			// share being deleted has a dedicated wait budget in CreateFileShare
+			return true, err
+		}
 		if isRetriableError(err) {
 			klog.Warningf("CreateFileShare(%s) on account(%s) failed with error(%v), waiting for retrying", shareOptions.Name, accountOptions.Name, err)
-			sleepIfThrottled(err, fileOpThrottlingSleepSec)
+			d.sleepIfFileOpThrottled(err)
 			return false, nil
 		}
 		return true, err
 	})
 }
 
+// RestoreFileShare restores the latest soft deleted file share with the name in shareOptions in the delete retention period
+// and reapplies the requested metadata on it, only the file share created by this driver is restored,
+// return false if there is no such soft deleted file share
+func (d *Driver) RestoreFileShare(ctx context.Context, subsID, resourceGroup, accountName, accountKey, storageEndpointSuffix string, shareOptions *fileclient.ShareOptions) (bool, error) {
+	shareName := shareOptions.Name
+	shares, err := d.cloud.FileClient.WithSubscriptionID(subsID).ListFileShare(ctx, resourceGroup, accountName, "", deletedSharesExpand)
+	if err != nil {
+		return false, fmt.Errorf("failed to list deleted file shares on account(%s): %v", accountName, err)
+	}
+	var deletedShare *storage.FileShareItem
+	for i := range shares {
+		share := &shares[i]
+		if pointer.StringDeref(share.Name, "") != shareName || share.FileShareProperties == nil ||
+			!pointer.BoolDeref(share.FileShareProperties.Deleted, false) || pointer.StringDeref(share.FileShareProperties.Version, "") == "" {
+			continue
+		}
+		if deletedShare == nil || (share.DeletedTime != nil && deletedShare.DeletedTime != nil && share.DeletedTime.After(deletedShare.DeletedTime.Time)) {
+			deletedShare = share
+		}
+	}
+	if deletedShare == nil {
+		klog.V(2).Infof("there is no soft deleted file share(%s) on account(%s)", shareName, accountName)
+		return false, nil
+	}
+	version := pointer.StringDeref(deletedShare.Version, "")
+
+	// protocol, access tier and root squash could not be changed on the restored file share, check them before restoring,
+	// quota is resized and metadata is reapplied after restoring
+	restoreOptions := *shareOptions
+	restoreOptions.RequestGiB = 0
+	restoreOptions.Metadata = nil
+	if err := checkFileShareCompatibility(deletedShare.FileShareProperties, &restoreOptions); err != nil {
+		return false, status.Errorf(codes.AlreadyExists, "soft deleted file share(%s) version(%s) on account(%s) could not be restored, %v", shareName, version, accountName, err)
+	}
+
+	metadata, err := getDeletedFileShareMetadata(ctx, accountName, accountKey, storageEndpointSuffix, shareName, version)
+	if err != nil {
+		return false, fmt.Errorf("failed to get metadata of soft deleted file share(%s) version(%s) on account(%s): %v", shareName, version, accountName, err)
+	}
+	if !d.isFileShareCreatedByDriver(metadata) {
+		klog.Warningf("soft deleted file share(%s) version(%s) on account(%s) is not created by %s, skip restoring it", shareName, version, accountName, d.Name)
+		return false, nil
+	}
+
+	klog.V(2).Infof("begin to restore soft deleted file share(%s) version(%s) on account(%s)", shareName, version, accountName)
+	start := time.Now()
+	err = restoreDeletedFileShare(ctx, accountName, accountKey, storageEndpointSuffix, shareName, version)
+	observeFileShareOperation("restore_file_share", start, err)
+	if err != nil {
+		return false, fmt.Errorf("failed to restore file share(%s) version(%s) on account(%s): %v", shareName, version, accountName, err)
+	}
+	// metadata of the soft deleted file share is stale, e.g. retain policy or max share quota may be different in the request
+	if err := setFileShareMetadataWithKey(ctx, accountName, accountKey, storageEndpointSuffix, shareName, shareOptions.Metadata); err != nil {
+		return true, fmt.Errorf("failed to set metadata of restored file share(%s) on account(%s): %v", shareName, accountName, err)
+	}
+	return true, nil
+}
+
+// isFileShareCreatedByDriver returns true if the file share metadata has the fingerprint of this driver,
+// file share created in another cluster is not regarded as created by this driver if cluster id is known
+func (d *Driver) isFileShareCreatedByDriver(metadata map[string]string) bool {
+	if metadata[createdByMetadataKey] != d.Name {
+		return false
+	}
+	clusterID := metadata[clusterIDMetadataKey]
+	return clusterID == "" || d.clusterID == "" || clusterID == d.clusterID
+}
+
+// getDeletedFileShareMetadata returns the metadata of a soft deleted file share version with data plane API with lower case keys,
+// it's a variable so that unit tests could replace it
+var getDeletedFileShareMetadata = func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName, version string) (map[string]string, error) {
+	credential, err := service.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
+	}
+	serviceClient, err := service.NewClientWithSharedKeyCredential(fmt.Sprintf("https://%s.file.%s/", accountName, storageEndpointSuffix), credential, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service client(%s): %v", accountName, err)
+	}
+	pager := serviceClient.NewListSharesPager(&service.ListSharesOptions{
+		Include: service.ListSharesInclude{Deleted: true, Metadata: true},
+		Prefix:  pointer.String(shareName),
+	})
+	for pager.More() {
+		resp, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range resp.Shares {
+			if item == nil || pointer.StringDeref(item.Name, "") != shareName || pointer.StringDeref(item.Version, "") != version {
+				continue
+			}
+			metadata := make(map[string]string, len(item.Metadata))
+			for k, v := range item.Metadata {
+				metadata[strings.ToLower(k)] = pointer.StringDeref(v, "")
+			}
+			return metadata, nil
+		}
+	}
+	return nil, fmt.Errorf("soft deleted file share(%s) version(%s) is not found", shareName, version)
+}
+
+// setFileShareMetadataWithKey replaces the metadata of a file share with data plane API,
+// it's a variable so that unit tests could replace it
+var setFileShareMetadataWithKey = func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName string, metadata map[string]*string) error {
+	credential, err := service.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
+	}
+	serviceClient, err := service.NewClientWithSharedKeyCredential(fmt.Sprintf("https://%s.file.%s/", accountName, storageEndpointSuffix), credential, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create service client(%s): %v", accountName, err)
+	}
+	_, err = serviceClient.NewShareClient(shareName).SetMetadata(ctx, &share.SetMetadataOptions{Metadata: metadata})
+	return err
+}
+
+// restoreDeletedFileShare restores a soft deleted file share version with data plane API,
+// it's a variable so that unit tests could replace it
+var restoreDeletedFileShare = func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName, version string) error {
+	credential, err := service.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
+	}
+	serviceClient, err := service.NewClientWithSharedKeyCredential(fmt.Sprintf("https://%s.file.%s/", accountName, storageEndpointSuffix), credential, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create service client(%s): %v", accountName, err)
+	}
+	_, err = serviceClient.RestoreShare(ctx, shareName, version, nil)
+	return err
+}
+
 // DeleteFileShare deletes a file share using storage account name and key
 func (d *Driver) DeleteFileShare(ctx context.Context, subsID, resourceGroup, accountName, shareName string, secrets map[string]string) error {
+	if err := validateDeleteFileShareParams(resourceGroup, accountName, shareName, secrets); err != nil {
+		return err
+	}
 	return wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
 		var err error
+		start := time.Now()
 		if len(secrets) > 0 {
 			accountName, accountKey, rerr := getStorageAccount(secrets)
 			if rerr != nil {
@@ -857,14 +2139,11 @@ func (d *Driver) DeleteFileShare(ctx context.Context, subsID, resourceGroup, acc
 		} else {
 			err = d.cloud.DeleteFileShare(ctx, subsID, resourceGroup, accountName, shareName)
 		}
+		observeFileShareOperation("delete_file_share", start, err)
 
-		if err != nil {
-			if strings.Contains(err.Error(), statusCodeNotFound) ||
-				strings.Contains(err.Error(), httpCodeNotFound) ||
-				strings.Contains(err.Error(), fileShareNotFound) {
-				klog.Warningf("DeleteFileShare(%s) on account(%s) failed with error(%v), return as success", shareName, accountName, err)
-				return true, nil
-			}
+		if isNotFoundError(err) {
+			klog.Warningf("DeleteFileShare(%s) on account(%s) failed with error(%v), return as success", shareName, accountName, err)
+			return true, nil
 		}
 
 		if isRetriableError(err) {
@@ -881,10 +2160,27 @@ func (d *Driver) DeleteFileShare(ctx context.Context, subsID, resourceGroup, acc
 	})
 }
 
+// validateDeleteFileShareParams returns InvalidArgument if the file share to delete could not be located,
+// management API needs resource group and account name while data plane API needs account name and key in secrets
+func validateDeleteFileShareParams(resourceGroup, accountName, shareName string, secrets map[string]string) error {
+	if shareName == "" {
+		return status.Error(codes.InvalidArgument, "file share name is empty")
+	}
+	if len(secrets) > 0 {
+		return nil
+	}
+	if resourceGroup == "" || accountName == "" {
+		return status.Errorf(codes.InvalidArgument, "could not delete file share(%s) without account key in secrets, resource group(%s) and account name(%s) are required, "+
+			"resource group could be specified in volume handle(<rg>#<account>#<share>) or resourceGroup of cloud config", shareName, resourceGroup, accountName)
+	}
+	return nil
+}
+
 // ResizeFileShare resizes a file share
 func (d *Driver) ResizeFileShare(ctx context.Context, subsID, resourceGroup, accountName, shareName string, sizeGiB int, secrets map[string]string) error {
 	return wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
 		var err error
+		start := time.Now()
 		if len(secrets) > 0 {
 			accountName, accountKey, rerr := getStorageAccount(secrets)
 			if rerr != nil {
@@ -894,15 +2190,97 @@ func (d *Driver) ResizeFileShare(ctx context.Context, subsID, resourceGroup, acc
 		} else {
 			err = d.cloud.ResizeFileShare(ctx, subsID, resourceGroup, accountName, shareName, sizeGiB)
 		}
+		observeFileShareOperation("resize_file_share", start, err)
 		if isRetriableError(err) {
 			klog.Warningf("ResizeFileShare(%s) on account(%s) with new size(%d) failed with error(%v), waiting for retrying", shareName, accountName, sizeGiB, err)
-			sleepIfThrottled(err, fileOpThrottlingSleepSec)
+			if len(secrets) == 0 && isThrottlingError(err) {
+				klog.Warningf("switch to use data plane API instead for account %s since it's throttled", accountName)
+				d.dataPlaneAPIAccountCache.Set(accountName, "")
+				return true, err
+			}
+			d.sleepIfFileOpThrottled(err)
 			return false, nil
 		}
 		return true, err
 	})
 }
 
+// checkFileShareProtocol returns error if the protocol of file share is different from expectedProtocol,
+// the check is skipped if either protocol is unknown
+func checkFileShareProtocol(accountName, shareName string, protocol, expectedProtocol storage.EnabledProtocols) error {
+	if protocol == "" || expectedProtocol == "" {
+		return nil
+	}
+	if !strings.EqualFold(string(protocol), string(expectedProtocol)) {
+		return fmt.Errorf("protocol(%s) of file share(%s) on account(%s) is different from expected protocol(%s)", protocol, shareName, accountName, expectedProtocol)
+	}
+	return nil
+}
+
+// getShareProtocolCacheKey returns the key of shareProtocolCache
+func getShareProtocolCacheKey(accountName, shareName string) string {
+	return accountName + "/" + shareName
+}
+
+// getFileShareMetadata returns the value of key in file share metadata
+func (d *Driver) getFileShareMetadata(ctx context.Context, subsID, resourceGroupName, accountName, fileShareName, key string, secrets map[string]string) (string, error) {
+	metadata, err := d.getAllFileShareMetadata(ctx, subsID, resourceGroupName, accountName, fileShareName, secrets)
+	if err != nil {
+		return "", err
+	}
+	return metadata[key], nil
+}
+
+// getAllFileShareMetadata returns all metadata of file share with lower case keys
+func (d *Driver) getAllFileShareMetadata(ctx context.Context, subsID, resourceGroupName, accountName, fileShareName string, secrets map[string]string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if len(secrets) > 0 {
+		accountName, accountKey, err := getStorageAccount(secrets)
+		if err != nil {
+			return nil, err
+		}
+		fileClient, err := d.fileClient.getFileSvcClient(accountName, accountKey)
+		if err != nil {
+			return nil, err
+		}
+		share := fileClient.GetShareReference(fileShareName)
+		if err := share.FetchAttributes(nil); err != nil {
+			return nil, err
+		}
+		for k, v := range share.Metadata {
+			metadata[strings.ToLower(k)] = v
+		}
+		return metadata, nil
+	}
+	fileShare, err := d.cloud.GetFileShare(ctx, subsID, resourceGroupName, accountName, fileShareName)
+	if err != nil {
+		return nil, err
+	}
+	if fileShare.FileShareProperties != nil {
+		for k, v := range fileShare.FileShareProperties.Metadata {
+			metadata[strings.ToLower(k)] = pointer.StringDeref(v, "")
+		}
+	}
+	return metadata, nil
+}
+
+// getFileShareMaxQuota returns the max quota in GiB recorded in file share metadata, 0 means no limit
+func (d *Driver) getFileShareMaxQuota(ctx context.Context, subsID, resourceGroupName, accountName, fileShareName string, secrets map[string]string) (int, error) {
+	value, err := d.getFileShareMetadata(ctx, subsID, resourceGroupName, accountName, fileShareName, maxShareQuotaKey, secrets)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return 0, nil
+	}
+	maxQuota, err := strconv.Atoi(value)
+	if err != nil {
+		klog.Warningf("ignore invalid %s(%s) in metadata of file share(%s) on account(%s)", maxShareQuotaKey, value, fileShareName, accountName)
+		return 0, nil
+	}
+	return maxQuota, nil
+}
+
 // CopyFileShare copies a fileshare in the same storage account
 func (d *Driver) copyFileShare(ctx context.Context, req *csi.CreateVolumeRequest, accountKey string, shareOptions *fileclient.ShareOptions, storageEndpointSuffix string) error {
 	if shareOptions.Protocol == storage.EnabledProtocolsNFS {
@@ -912,7 +2290,7 @@ func (d *Driver) copyFileShare(ctx context.Context, req *csi.CreateVolumeRequest
 	if req.GetVolumeContentSource() != nil && req.GetVolumeContentSource().GetVolume() != nil {
 		sourceVolumeID = req.GetVolumeContentSource().GetVolume().GetVolumeId()
 	}
-	resourceGroupName, accountName, srcFileShareName, _, _, _, err := GetFileShareInfo(sourceVolumeID) //nolint:dogsled
+	resourceGroupName, accountName, srcFileShareName, srcDiskName, _, srcSubsID, err := GetFileShareInfo(sourceVolumeID)
 	if err != nil {
 		return status.Error(codes.NotFound, err.Error())
 	}
@@ -920,6 +2298,23 @@ func (d *Driver) copyFileShare(ctx context.Context, req *csi.CreateVolumeRequest
 	if srcFileShareName == "" || dstFileShareName == "" {
 		return fmt.Errorf("srcFileShareName(%s) or dstFileShareName(%s) is empty", srcFileShareName, dstFileShareName)
 	}
+	if d.cloud.FileClient != nil {
+		srcFileShare, err := d.cloud.FileClient.WithSubscriptionID(srcSubsID).GetFileShare(ctx, resourceGroupName, accountName, srcFileShareName, "")
+		if err != nil {
+			return status.Errorf(codes.NotFound, "failed to get source file share(%s) on account(%s): %v", srcFileShareName, accountName, err)
+		}
+		srcProtocol := storage.EnabledProtocolsSMB
+		if srcFileShare.FileShareProperties != nil && srcFileShare.FileShareProperties.EnabledProtocols != "" {
+			srcProtocol = srcFileShare.FileShareProperties.EnabledProtocols
+		}
+		dstProtocol := storage.EnabledProtocolsSMB
+		if shareOptions.Protocol != "" {
+			dstProtocol = shareOptions.Protocol
+		}
+		if srcProtocol != dstProtocol {
+			return status.Errorf(codes.InvalidArgument, "protocol(%s) of source volume(%s) does not match protocol(%s) of target volume", srcProtocol, sourceVolumeID, dstProtocol)
+		}
+	}
 
 	klog.V(2).Infof("generate sas token for account(%s)", accountName)
 	accountSasToken, genErr := generateSASToken(accountName, accountKey, storageEndpointSuffix, d.sasTokenExpirationMinutes)
@@ -927,10 +2322,17 @@ func (d *Driver) copyFileShare(ctx context.Context, req *csi.CreateVolumeRequest
 		return genErr
 	}
 
-	timeAfter := time.After(waitForCopyTimeout)
+	timeAfter := time.After(d.cloneTimeout)
 	timeTick := time.Tick(waitForCopyInterval)
 	srcPath := fmt.Sprintf("https://%s.file.%s/%s%s", accountName, storageEndpointSuffix, srcFileShareName, accountSasToken)
 	dstPath := fmt.Sprintf("https://%s.file.%s/%s%s", accountName, storageEndpointSuffix, dstFileShareName, accountSasToken)
+	copyArgs := []string{"copy", srcPath, dstPath, "--recursive", "--check-length=false"}
+	if strings.HasSuffix(srcDiskName, vhdSuffix) {
+		// only copy the vhd disk file of the source volume
+		srcPath = fmt.Sprintf("https://%s.file.%s/%s/%s%s", accountName, storageEndpointSuffix, srcFileShareName, srcDiskName, accountSasToken)
+		dstPath = fmt.Sprintf("https://%s.file.%s/%s/%s%s", accountName, storageEndpointSuffix, dstFileShareName, srcDiskName, accountSasToken)
+		copyArgs = []string{"copy", srcPath, dstPath, "--check-length=false"}
+	}
 
 	jobState, percent, err := d.azcopy.GetAzcopyJob(dstFileShareName)
 	klog.V(2).Infof("azcopy job status: %s, copy percent: %s%%, error: %v", jobState, percent, err)
@@ -948,7 +2350,7 @@ func (d *Driver) copyFileShare(ctx context.Context, req *csi.CreateVolumeRequest
 				return err
 			case fileutil.AzcopyJobNotFound:
 				klog.V(2).Infof("copy fileshare %s to %s", srcFileShareName, dstFileShareName)
-				out, copyErr := exec.Command("azcopy", "copy", srcPath, dstPath, "--recursive", "--check-length=false").CombinedOutput()
+				out, copyErr := exec.Command("azcopy", copyArgs...).CombinedOutput()
 				if copyErr != nil {
 					klog.Warningf("CopyFileShare(%s, %s, %s) failed with error(%v): %v", resourceGroupName, accountName, dstFileShareName, copyErr, string(out))
 				} else {
@@ -957,7 +2359,8 @@ func (d *Driver) copyFileShare(ctx context.Context, req *csi.CreateVolumeRequest
 				return copyErr
 			}
 		case <-timeAfter:
-			return fmt.Errorf("timeout waiting for copy fileshare %s to %s succeed", srcFileShareName, dstFileShareName)
+			// azcopy job may still be running, CreateVolume would be retried to wait for it
+			return status.Errorf(codes.DeadlineExceeded, "timeout waiting for copy fileshare %s to %s succeed", srcFileShareName, dstFileShareName)
 		}
 	}
 }
@@ -977,6 +2380,147 @@ func (d *Driver) GetTotalAccountQuota(ctx context.Context, subsID, resourceGroup
 	return totalQuotaGB, int32(len(fileshares)), nil
 }
 
+// searchAccountByTags returns a storage account in the allowed account list of the resource group which has all of requiredTags
+// and matches accountOptions with the same checks as account selection of EnsureStorageAccount, the first matching account
+// in alphabetical order is returned unless PickRandomMatchingAccount is set, empty account name is returned if there is no matching account
+func (d *Driver) searchAccountByTags(ctx context.Context, accountOptions *azure.AccountOptions, requiredTags map[string]string) (string, error) {
+	if d.cloud.StorageAccountClient == nil {
+		return "", fmt.Errorf("StorageAccountClient is nil")
+	}
+	subsID := accountOptions.SubscriptionID
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	resourceGroup := accountOptions.ResourceGroup
+	if resourceGroup == "" {
+		resourceGroup = d.cloud.ResourceGroup
+	}
+
+	accounts, rerr := d.cloud.StorageAccountClient.ListByResourceGroup(ctx, subsID, resourceGroup)
+	if rerr != nil {
+		return "", rerr.Error()
+	}
+	var matchingAccounts []string
+	for _, account := range accounts {
+		if account.Name == nil || account.Sku == nil || !d.isAllowedAccount(*account.Name) {
+			continue
+		}
+		if _, ok := account.Tags[azure.SkipMatchingTag]; ok {
+			klog.V(2).Infof("found %s tag on account(%s), skip matching", azure.SkipMatchingTag, *account.Name)
+			continue
+		}
+		if d.isAccountLimitExceeded(*account.Name) {
+			klog.V(2).Infof("account(%s) reached the account limit recently, skip matching", *account.Name)
+			continue
+		}
+		if !isTagsMatched(account.Tags, requiredTags) || !d.isAccountMatched(ctx, subsID, resourceGroup, account, accountOptions) {
+			continue
+		}
+		matchingAccounts = append(matchingAccounts, *account.Name)
+	}
+	if len(matchingAccounts) == 0 {
+		klog.V(2).Infof("no storage account matches tags(%v) in resource group(%s)", requiredTags, resourceGroup)
+		return "", nil
+	}
+	sort.Strings(matchingAccounts)
+	index := 0
+	if accountOptions.PickRandomMatchingAccount {
+		index = rand.Intn(len(matchingAccounts))
+	}
+	klog.V(2).Infof("found storage account(%s) matching tags(%v), matching accounts: %v", matchingAccounts[index], requiredTags, matchingAccounts)
+	return matchingAccounts[index], nil
+}
+
+// isAccountMatched returns true if the existing storage account satisfies accountOptions, e.g. sku, kind, location,
+// virtual network rules, private endpoint, https only, access tier and file service properties
+func (d *Driver) isAccountMatched(ctx context.Context, subsID, resourceGroup string, account storage.Account, accountOptions *azure.AccountOptions) bool {
+	location := accountOptions.Location
+	if location == "" {
+		location = d.cloud.Location
+	}
+	if accountOptions.Type != "" && !strings.EqualFold(string(account.Sku.Name), accountOptions.Type) {
+		return false
+	}
+	if accountOptions.Kind != "" && !strings.EqualFold(string(account.Kind), accountOptions.Kind) {
+		return false
+	}
+	if location != "" && !strings.EqualFold(pointer.StringDeref(account.Location, ""), location) {
+		return false
+	}
+	if !azure.AreVNetRulesEqual(account, accountOptions) {
+		return false
+	}
+
+	var props storage.AccountProperties
+	if account.AccountProperties != nil {
+		props = *account.AccountProperties
+	}
+	if accountOptions.EnableHTTPSTrafficOnly && !pointer.BoolDeref(props.EnableHTTPSTrafficOnly, false) {
+		return false
+	}
+	if accountOptions.EnableLargeFileShare != nil {
+		lfsEnabled := props.LargeFileSharesState == storage.LargeFileSharesStateEnabled
+		if *accountOptions.EnableLargeFileShare != lfsEnabled {
+			return false
+		}
+	}
+	if pointer.BoolDeref(accountOptions.AllowBlobPublicAccess, true) != pointer.BoolDeref(props.AllowBlobPublicAccess, true) {
+		return false
+	}
+	requireInfraEncryption := false
+	if props.Encryption != nil {
+		requireInfraEncryption = pointer.BoolDeref(props.Encryption.RequireInfrastructureEncryption, false)
+	}
+	if pointer.BoolDeref(accountOptions.RequireInfrastructureEncryption, false) != requireInfraEncryption {
+		return false
+	}
+	if pointer.BoolDeref(accountOptions.AllowSharedKeyAccess, true) != pointer.BoolDeref(props.AllowSharedKeyAccess, true) {
+		return false
+	}
+	if accountOptions.AccessTier != "" && accountOptions.AccessTier != string(props.AccessTier) {
+		return false
+	}
+	if accountOptions.CreatePrivateEndpoint != nil {
+		hasPrivateEndpoint := props.PrivateEndpointConnections != nil && len(*props.PrivateEndpointConnections) > 0
+		if *accountOptions.CreatePrivateEndpoint != hasPrivateEndpoint {
+			return false
+		}
+	}
+
+	if accountOptions.DisableFileServiceDeleteRetentionPolicy == nil && accountOptions.IsMultichannelEnabled == nil {
+		return true
+	}
+	prop, err := d.cloud.FileClient.WithSubscriptionID(subsID).GetServiceProperties(ctx, resourceGroup, *account.Name)
+	if err != nil {
+		klog.Warningf("GetServiceProperties(%s) under resource group(%s) failed with %v", *account.Name, resourceGroup, err)
+		return false
+	}
+	var fileProps storage.FileServicePropertiesProperties
+	if prop.FileServicePropertiesProperties != nil {
+		fileProps = *prop.FileServicePropertiesProperties
+	}
+	if accountOptions.DisableFileServiceDeleteRetentionPolicy != nil {
+		// share delete retention policy is enabled by default
+		retentionEnabled := true
+		if fileProps.ShareDeleteRetentionPolicy != nil {
+			retentionEnabled = pointer.BoolDeref(fileProps.ShareDeleteRetentionPolicy.Enabled, true)
+		}
+		if *accountOptions.DisableFileServiceDeleteRetentionPolicy == retentionEnabled {
+			return false
+		}
+	}
+	if accountOptions.IsMultichannelEnabled != nil {
+		multichannelEnabled := false
+		if fileProps.ProtocolSettings != nil && fileProps.ProtocolSettings.Smb != nil && fileProps.ProtocolSettings.Smb.Multichannel != nil {
+			multichannelEnabled = pointer.BoolDeref(fileProps.ProtocolSettings.Smb.Multichannel.Enabled, false)
+		}
+		if *accountOptions.IsMultichannelEnabled != multichannelEnabled {
+			return false
+		}
+	}
+	return true
+}
+
 // RemoveStorageAccountTag remove tag from storage account
 func (d *Driver) RemoveStorageAccountTag(ctx context.Context, subsID, resourceGroup, account, key string) error {
 	// search in cache first
@@ -997,11 +2541,195 @@ func (d *Driver) RemoveStorageAccountTag(ctx context.Context, subsID, resourceGr
 	return nil
 }
 
+// deleteAccountIfEmpty deletes the storage account created by the driver if there is no file share or share snapshot on it,
+// the account is kept if it's not created by the driver, has private endpoint connections or any check fails
+func (d *Driver) deleteAccountIfEmpty(ctx context.Context, subsID, resourceGroup, accountName string) error {
+	if d.cloud.StorageAccountClient == nil || d.cloud.FileClient == nil {
+		return fmt.Errorf("storage account client or file client is nil")
+	}
+	lockKey := subsID + resourceGroup + accountName
+	d.volLockMap.LockEntry(lockKey)
+	defer d.volLockMap.UnlockEntry(lockKey)
+
+	account, rerr := d.cloud.StorageAccountClient.GetProperties(ctx, subsID, resourceGroup, accountName)
+	if rerr != nil {
+		if isNotFoundError(rerr.Error()) {
+			return nil
+		}
+		return rerr.Error()
+	}
+	if pointer.StringDeref(account.Tags[accountCreatedByDriverTag], "") != d.Name {
+		klog.V(2).Infof("skip deleting account(%s) rg(%s) since it's not created by the driver", accountName, resourceGroup)
+		return nil
+	}
+	if account.Kind != storage.KindFileStorage {
+		// blob containers, queues and tables on the account are not checked
+		klog.V(2).Infof("skip deleting account(%s) rg(%s) since account kind(%s) supports other storage services than file", accountName, resourceGroup, account.Kind)
+		return nil
+	}
+	if account.AccountProperties != nil && account.PrivateEndpointConnections != nil && len(*account.PrivateEndpointConnections) > 0 {
+		klog.V(2).Infof("skip deleting account(%s) rg(%s) since it has private endpoint connections", accountName, resourceGroup)
+		return nil
+	}
+	isEmpty, err := d.isAccountEmpty(ctx, subsID, resourceGroup, accountName)
+	if err != nil || !isEmpty {
+		return err
+	}
+
+	// prevent the account from being selected by CreateVolume, then check again in case a file share is created in between
+	tags := map[string]*string{azure.SkipMatchingTag: pointer.String("")}
+	for k, v := range account.Tags {
+		tags[k] = v
+	}
+	if rerr := d.cloud.StorageAccountClient.Update(ctx, subsID, resourceGroup, accountName, storage.AccountUpdateParameters{Tags: tags}); rerr != nil {
+		return rerr.Error()
+	}
+	d.removeAccountFromCache(accountName)
+	if isEmpty, err = d.isAccountEmpty(ctx, subsID, resourceGroup, accountName); err != nil || !isEmpty {
+		// restore the original tags
+		if account.Tags == nil {
+			account.Tags = map[string]*string{}
+		}
+		if rerr := d.cloud.StorageAccountClient.Update(ctx, subsID, resourceGroup, accountName, storage.AccountUpdateParameters{Tags: account.Tags}); rerr != nil {
+			klog.Warningf("failed to restore tags of account(%s) rg(%s): %v", accountName, resourceGroup, rerr.Error())
+		}
+		return err
+	}
+
+	klog.V(2).Infof("deleting empty storage account(%s) under subsID(%s) rg(%s)", accountName, subsID, resourceGroup)
+	if rerr := d.cloud.StorageAccountClient.Delete(ctx, subsID, resourceGroup, accountName); rerr != nil {
+		return rerr.Error()
+	}
+	klog.V(2).Infof("empty storage account(%s) under subsID(%s) rg(%s) is deleted successfully", accountName, subsID, resourceGroup)
+	return nil
+}
+
+// isAccountEmpty returns true if there is no file share or share snapshot on the storage account
+func (d *Driver) isAccountEmpty(ctx context.Context, subsID, resourceGroup, accountName string) (bool, error) {
+	shares, err := d.cloud.FileClient.WithSubscriptionID(subsID).ListFileShare(ctx, resourceGroup, accountName, "", snapshotsExpand)
+	if err != nil {
+		return false, err
+	}
+	if len(shares) > 0 {
+		klog.V(2).Infof("skip deleting account(%s) rg(%s) since there are %d file shares or snapshots on it", accountName, resourceGroup, len(shares))
+		return false, nil
+	}
+	return true, nil
+}
+
+// isAccountLimitExceeded returns true if creating file share on the storage account failed with account limit exceeded recently
+func (d *Driver) isAccountLimitExceeded(accountName string) bool {
+	cache, err := d.accountLimitExceededCache.Get(accountName, azcache.CacheReadTypeDefault)
+	return err == nil && cache != nil
+}
+
+// removeAccountFromCache removes the storage account from caches so that it would not be selected by CreateVolume
+func (d *Driver) removeAccountFromCache(accountName string) {
+	for _, key := range d.accountSearchCache.GetStore().ListKeys() {
+		if cache, err := d.accountSearchCache.Get(key, azcache.CacheReadTypeDefault); err == nil && cache != nil && cache.(string) == accountName {
+			_ = d.accountSearchCache.Delete(key)
+		}
+	}
+	d.volMap.Range(func(key, value interface{}) bool {
+		if value.(string) == accountName {
+			d.volMap.Delete(key)
+		}
+		return true
+	})
+	d.shareGCAccountMap.Delete(accountName)
+	if err := d.accountCacheMap.Delete(accountName); err != nil {
+		klog.Warningf("failed to delete account(%s) from accountCacheMap: %v", accountName, err)
+	}
+}
+
+// getSecretNamespace returns the namespace of account key secret, secretNamespace specified in storage class or volume attributes takes precedence,
+// then central secret namespace if configured, then pvc namespace, default secret namespace is used if none of them is available
+func (d *Driver) getSecretNamespace(secretNamespace, pvcNamespace string) string {
+	if secretNamespace != "" {
+		return secretNamespace
+	}
+	if d.centralSecretNamespace != "" {
+		return d.centralSecretNamespace
+	}
+	if pvcNamespace != "" {
+		return pvcNamespace
+	}
+	return d.defaultSecretNamespace
+}
+
+// getAccountNamePrefix returns the prefix of storage account name created for file share with protocol
+func (d *Driver) getAccountNamePrefix(protocol string) string {
+	if protocol == nfs {
+		return d.nfsAccountNamePrefix
+	}
+	return d.accountNamePrefix
+}
+
+// tagAccountWithDriverVersion sets driverVersionTag on storage account with current driver version,
+// tag update is skipped if it's done on the account recently to avoid throttling
+func (d *Driver) tagAccountWithDriverVersion(ctx context.Context, subsID, resourceGroup, account string) error {
+	if d.cloud.StorageAccountClient == nil {
+		return fmt.Errorf("storage account client is nil")
+	}
+	cacheKey := fmt.Sprintf("%s/%s/%s", subsID, resourceGroup, account)
+	cache, err := d.driverVersionTagCache.Get(cacheKey, azcache.CacheReadTypeDefault)
+	if err != nil {
+		return err
+	}
+	if cache != nil {
+		klog.V(6).Infof("skip updating tag(%s) on account(%s) subsID(%s) resourceGroup(%s) since tag is updated in a short time", driverVersionTag, account, subsID, resourceGroup)
+		return nil
+	}
+	defer d.driverVersionTagCache.Set(cacheKey, "")
+
+	result, rerr := d.cloud.StorageAccountClient.GetProperties(ctx, subsID, resourceGroup, account)
+	if rerr != nil {
+		return rerr.Error()
+	}
+	if pointer.StringDeref(result.Tags[driverVersionTag], "") == d.Version {
+		return nil
+	}
+	tags := make(map[string]*string, len(result.Tags)+1)
+	for k, v := range result.Tags {
+		tags[k] = v
+	}
+	tags[driverVersionTag] = pointer.String(d.Version)
+	klog.V(2).Infof("update tag(%s: %s) on account(%s) subsID(%s), resourceGroup(%s)", driverVersionTag, d.Version, account, subsID, resourceGroup)
+	if rerr := d.cloud.StorageAccountClient.Update(ctx, subsID, resourceGroup, account, storage.AccountUpdateParameters{Tags: tags}); rerr != nil {
+		return rerr.Error()
+	}
+	return nil
+}
+
+// revalidateAccountKeys evicts cached account keys which are rejected by data plane API(e.g. rotated keys),
+// so that the latest account key is fetched on next use instead of failing the mount
+func (d *Driver) revalidateAccountKeys() {
+	for _, accountName := range d.accountCacheMap.GetStore().ListKeys() {
+		cache, err := d.accountCacheMap.Get(accountName, azcache.CacheReadTypeDefault)
+		if err != nil || cache == nil {
+			continue
+		}
+		err = d.fileClient.validateAccountKey(accountName, cache.(string))
+		if !isAccountKeyInvalidError(err) {
+			if err != nil {
+				klog.V(4).Infof("failed to revalidate account key of account(%s): %v", accountName, err)
+			}
+			continue
+		}
+		klog.Warningf("cached account key of account(%s) is invalid, evict it from cache: %v", accountName, err)
+		if err := d.accountCacheMap.Delete(accountName); err != nil {
+			klog.Warningf("failed to delete account(%s) from accountCacheMap: %v", accountName, err)
+		}
+		d.secretKeyCache.deleteAccount(accountName)
+	}
+}
+
 // GetStorageAccesskey get Azure storage account key from
 //  1. secrets (if not empty)
-//  2. use k8s client identity to read from k8s secret
-//  3. use cluster identity to get from storage account directly
-func (d *Driver) GetStorageAccesskey(ctx context.Context, accountOptions *azure.AccountOptions, secrets map[string]string, secretName, secretNamespace string) (string, error) {
+//  2. key vault (if keyVaultURL is not empty)
+//  3. use k8s client identity to read from k8s secret
+//  4. use cluster identity to get from storage account directly
+func (d *Driver) GetStorageAccesskey(ctx context.Context, accountOptions *azure.AccountOptions, secrets map[string]string, secretName, secretNamespace, keyVaultURL, keyVaultSecretName string) (string, error) {
 	if len(secrets) > 0 {
 		_, accountKey, err := getStorageAccount(secrets)
 		return accountKey, err
@@ -1017,39 +2745,474 @@ func (d *Driver) GetStorageAccesskey(ctx context.Context, accountOptions *azure.
 		return cache.(string), nil
 	}
 
-	// read from k8s secret first
+	// concurrent callers looking up the same account key from the same sources share one in-flight lookup
+	flightKey := strings.Join([]string{accountOptions.SubscriptionID, accountOptions.ResourceGroup, accountName,
+		secretName, secretNamespace, keyVaultURL, keyVaultSecretName, strconv.FormatBool(accountOptions.GetLatestAccountKey)}, "/")
+	ch := d.accountKeyGroup.DoChan(flightKey, func() (interface{}, error) {
+		// the lookup is shared by other callers, it should not be canceled with the context of the first caller
+		lookupCtx, cancel := context.WithTimeout(context.Background(), accountKeyLookupTimeout)
+		defer cancel()
+
+		// the account key may be cached by a lookup which completed just now
+		cache, err := d.accountCacheMap.Get(accountName, azcache.CacheReadTypeDefault)
+		if err != nil {
+			return "", err
+		}
+		if cache != nil {
+			return cache.(string), nil
+		}
+
+		var accountKey string
+		if keyVaultURL != "" {
+			// account key is only stored in key vault, do not fall back to k8s secret or cluster identity
+			accountKey, err = d.getAccountKeyFromKeyVault(lookupCtx, accountName, keyVaultURL, keyVaultSecretName)
+		} else {
+			accountKey, err = d.getAccountKeyFromSources(lookupCtx, accountOptions, secretName, secretNamespace, d.accountKeySources)
+		}
+
+		// errors are not cached, the next caller would retry
+		if err == nil && accountKey != "" {
+			d.accountCacheMap.Set(accountName, accountKey)
+		}
+		return accountKey, err
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(string), res.Err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// getAccountKeyFromSources tries the account key sources in order (accountKeySources, or a subset of it),
+// returns the key from the first source which succeeds
+func (d *Driver) getAccountKeyFromSources(ctx context.Context, accountOptions *azure.AccountOptions, secretName, secretNamespace string, sources []string) (string, error) {
+	accountName := accountOptions.Name
+	var accountKey string
 	if secretName == "" {
 		secretName = fmt.Sprintf(secretNameTemplate, accountName)
 	}
-	_, accountKey, err := d.GetStorageAccountFromSecret(ctx, secretName, secretNamespace)
-	if err != nil {
-		klog.V(2).Infof("could not get account(%s) key from secret(%s), error: %v, use cluster identity to get account key instead", accountOptions.Name, secretName, err)
-		accountKey, err = d.cloud.GetStorageAccesskey(ctx, accountOptions.SubscriptionID, accountName, accountOptions.ResourceGroup, accountOptions.GetLatestAccountKey)
-	}
-
-	if err == nil && accountKey != "" {
-		d.accountCacheMap.Set(accountName, accountKey)
+	noSourceErr := fmt.Errorf("no available source to get account(%s) key, sources: %v", accountName, sources)
+	err := noSourceErr
+	for _, source := range sources {
+		switch source {
+		case accountKeySourceSecret:
+			// secret could not be read without KubeClient
+			if d.cloud.KubeClient == nil {
+				if err == noSourceErr {
+					err = fmt.Errorf("could not get account key from secret(%s): KubeClient is nil", secretName)
+				}
+				continue
+			}
+			if _, accountKey, err = d.getStorageAccountFromSecret(ctx, secretName, secretNamespace, accountName); err == nil && accountKey == "" {
+				err = fmt.Errorf("account key is empty in secret(%s/%s)", secretNamespace, secretName)
+			}
+			if err != nil {
+				accountKeyFallbackCount.WithLabelValues(accountName).Inc()
+			}
+		case accountKeySourceWorkloadIdentity:
+			if d.workloadIdentityClient == nil {
+				continue
+			}
+			accountKey, err = d.workloadIdentityClient.GetStorageAccountKey(ctx, accountOptions.SubscriptionID, accountOptions.ResourceGroup, accountName, accountOptions.GetLatestAccountKey)
+		case accountKeySourceClusterIdentity:
+			accountKey, err = d.cloud.GetStorageAccesskey(ctx, accountOptions.SubscriptionID, accountName, accountOptions.ResourceGroup, accountOptions.GetLatestAccountKey)
+		default:
+			continue
+		}
+		if err == nil {
+			klog.V(2).Infof("got account(%s) key from %s", accountName, source)
+			return accountKey, nil
+		}
+		klog.Warningf("could not get account(%s) key from %s, error: %v", accountName, source, err)
 	}
-	return accountKey, err
+	return "", err
 }
 
 // GetStorageAccountFromSecret get storage account key from k8s secret
 // return <accountName, accountKey, error>
 func (d *Driver) GetStorageAccountFromSecret(ctx context.Context, secretName, secretNamespace string) (string, string, error) {
+	return d.getStorageAccountFromSecret(ctx, secretName, secretNamespace, "")
+}
+
+// getStorageAccountFromSecret gets storage account key from k8s secret of accountName, accountName in secret takes precedence.
+// account key is only cached with a resolved account name, so that it could be evicted when the key is rotated
+func (d *Driver) getStorageAccountFromSecret(ctx context.Context, secretName, secretNamespace, accountName string) (string, string, error) {
 	if d.cloud.KubeClient == nil {
 		return "", "", fmt.Errorf("could not get account key from secret(%s): KubeClient is nil", secretName)
 	}
+	if accountName, accountKey, found := d.secretKeyCache.get(secretNamespace, secretName); found {
+		klog.V(6).Infof("get account(%s) key from cache of secret(%s/%s)", accountName, secretNamespace, secretName)
+		return accountName, accountKey, nil
+	}
 
 	secret, err := d.cloud.KubeClient.CoreV1().Secrets(secretNamespace).Get(ctx, secretName, metav1.GetOptions{})
 	if err != nil {
 		return "", "", fmt.Errorf("could not get secret(%v): %v", secretName, err)
 	}
 
-	accountName := strings.TrimSpace(string(secret.Data[defaultSecretAccountName][:]))
-	accountKey := strings.TrimSpace(string(secret.Data[defaultSecretAccountKey][:]))
+	if name := strings.TrimSpace(string(secret.Data[defaultSecretAccountName][:])); name != "" {
+		accountName = name
+	}
+	var accountKey string
+	for _, keyName := range d.getSecretAccountKeyNames() {
+		if accountKey = normalizeAccountKey(string(secret.Data[keyName][:])); accountKey != "" {
+			klog.V(6).Infof("get account key from data key(%s) of secret(%s/%s)", keyName, secretNamespace, secretName)
+			break
+		}
+	}
+	if accountKey != "" && accountName != "" {
+		d.secretKeyCache.set(secretNamespace, secretName, accountName, accountKey)
+	}
 	return accountName, accountKey, nil
 }
 
+// getSecretAccountKeyNames returns prioritized data key names of account key in k8s secret
+func (d *Driver) getSecretAccountKeyNames() []string {
+	if len(d.secretAccountKeyNames) == 0 {
+		return []string{defaultSecretAccountKey}
+	}
+	return d.secretAccountKeyNames
+}
+
+// parseSecretAccountKeyNames parses comma separated data key names of account key in k8s secret,
+// returns []string{defaultSecretAccountKey} if names is empty
+func parseSecretAccountKeyNames(names string) []string {
+	var result []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			result = append(result, name)
+		}
+	}
+	if len(result) == 0 {
+		return []string{defaultSecretAccountKey}
+	}
+	return result
+}
+
+// parseAccountKeySources parses comma separated account key sources, unsupported sources are ignored,
+// returns defaultAccountKeySources if no supported source is specified
+func parseAccountKeySources(sources string) []string {
+	var result []string
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		if source == "" {
+			continue
+		}
+		if !isSupportedAccountKeySource(source) {
+			klog.Warningf("account key source(%s) is not supported, supported list: %v", source, defaultAccountKeySources)
+			continue
+		}
+		result = append(result, source)
+	}
+	if len(result) == 0 {
+		return defaultAccountKeySources
+	}
+	return result
+}
+
+// removeAccountKeySource returns account key sources without the specified source
+func removeAccountKeySource(sources []string, source string) []string {
+	result := make([]string, 0, len(sources))
+	for _, v := range sources {
+		if v != source {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func isSupportedAccountKeySource(source string) bool {
+	for _, v := range defaultAccountKeySources {
+		if source == v {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAllowedAccounts parses comma separated storage account names, account names are case insensitive
+func parseAllowedAccounts(accounts string) map[string]string {
+	result := make(map[string]string)
+	for _, account := range strings.Split(accounts, ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			result[strings.ToLower(account)] = ""
+		}
+	}
+	return result
+}
+
+// ephemeralFileShare is the file share of an ephemeral inline volume mounted by NodePublishVolume
+type ephemeralFileShare struct {
+	accountName string
+	shareName   string
+	// file share is deleted in NodeUnpublishVolume if retain is false and it's created by this ephemeral volume
+	retain bool
+	owned  bool
+}
+
+// getEffectiveProtocol returns the protocol of a volume, nfs is inferred from fsType if protocol is not set (compatible with "fsType: nfs")
+func getEffectiveProtocol(protocol, fsType string) string {
+	if strings.EqualFold(protocol, nfs) || (protocol == "" && strings.EqualFold(fsType, nfs)) {
+		return nfs
+	}
+	return protocol
+}
+
+// isEphemeralVolume returns true if the volume is a CSI ephemeral inline volume declared in pod spec
+func isEphemeralVolume(context map[string]string) bool {
+	return strings.EqualFold(getValueInMap(context, ephemeralField), trueValue)
+}
+
+// getEphemeralVolumeMountOptions appends mountOptions in volume attributes of ephemeral inline volume to mountFlags
+func getEphemeralVolumeMountOptions(mountFlags []string, mountOptions string) []string {
+	var options []string
+	for _, option := range strings.Split(mountOptions, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	return util.JoinMountOptions(mountFlags, options)
+}
+
+// ensureEphemeralFileShare creates the file share of an ephemeral inline volume if it does not exist
+// since there is no CreateVolume call for ephemeral inline volume, nfs and disk volumes are not created
+func (d *Driver) ensureEphemeralFileShare(ctx context.Context, volumeID string, context map[string]string) (*ephemeralFileShare, error) {
+	retain := true
+	if v := getValueInMap(context, retainField); v != "" {
+		if !strings.EqualFold(v, trueValue) && !strings.EqualFold(v, falseValue) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s in volume attributes", retainField, v)
+		}
+		retain = strings.EqualFold(v, trueValue)
+	}
+	protocol := getEffectiveProtocol(getValueInMap(context, protocolField), getValueInMap(context, fsTypeField))
+	if d.fileClient == nil || protocol == nfs || isDiskFsType(getValueInMap(context, fsTypeField)) {
+		return nil, nil
+	}
+
+	_, accountName, accountKey, fileShareName, _, _, err := d.GetAccountInfo(ctx, volumeID, nil, context)
+	if err != nil || accountName == "" || accountKey == "" || fileShareName == "" {
+		// NodeStageVolume reports the error
+		klog.Warningf("skip creating file share of ephemeral volume(%s) since account info is not complete, error: %v", volumeID, err)
+		return nil, nil
+	}
+
+	d.fileClient.StorageEndpointSuffix = d.getStorageEndPointSuffix(getValueInMap(context, storageEndpointSuffixField))
+	metadata := map[string]*string{ephemeralVolumeMetadataKey: pointer.String(volumeID)}
+	created, err := d.fileClient.createFileShare(accountName, accountKey, fileShareName, defaultAzureFileQuota, metadata)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "create file share(%s) on account(%s) for ephemeral volume(%s) failed with %v", fileShareName, accountName, volumeID, err)
+	}
+	owned := created
+	if !created && !retain {
+		// the file share may be created by a previous NodePublishVolume call of the same volume
+		existingMetadata, err := d.fileClient.getFileShareMetadata(accountName, accountKey, fileShareName)
+		if err != nil {
+			klog.Warningf("failed to get metadata of file share(%s) on account(%s), the file share is not deleted with ephemeral volume(%s): %v", fileShareName, accountName, volumeID, err)
+		}
+		owned = err == nil && existingMetadata[ephemeralVolumeMetadataKey] == volumeID
+	}
+	return &ephemeralFileShare{accountName: accountName, shareName: fileShareName, retain: retain, owned: owned}, nil
+}
+
+// getEphemeralVolumeStatePath returns the path of ephemeral volume state file of targetPath
+func getEphemeralVolumeStatePath(targetPath string) string {
+	return filepath.Join(filepath.Dir(targetPath), ephemeralVolumeStateFile)
+}
+
+// saveEphemeralVolumeState records the volume attributes of an ephemeral inline volume so that its file share
+// could be deleted in NodeUnpublishVolume after driver restart, account key is not recorded
+func saveEphemeralVolumeState(targetPath string, context map[string]string) error {
+	data, err := json.Marshal(context)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getEphemeralVolumeStatePath(targetPath), data, 0600)
+}
+
+// deleteEphemeralFileShare deletes the file share recorded in ephemeral volume state file of targetPath,
+// the file share is kept if it's not created by this volume or still mounted by others
+func (d *Driver) deleteEphemeralFileShare(ctx context.Context, volumeID, targetPath string) error {
+	statePath := getEphemeralVolumeStatePath(targetPath)
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var context map[string]string
+	if err := json.Unmarshal(data, &context); err != nil {
+		klog.Warningf("ignore invalid ephemeral volume state file(%s): %v", statePath, err)
+		return os.Remove(statePath)
+	}
+	if d.fileClient == nil {
+		return fmt.Errorf("file client is nil")
+	}
+
+	_, accountName, accountKey, fileShareName, _, _, err := d.GetAccountInfo(ctx, volumeID, nil, context)
+	if err != nil {
+		return err
+	}
+	storageEndpointSuffix := d.getStorageEndPointSuffix(getValueInMap(context, storageEndpointSuffixField))
+	d.fileClient.StorageEndpointSuffix = storageEndpointSuffix
+	metadata, err := d.fileClient.getFileShareMetadata(accountName, accountKey, fileShareName)
+	if err != nil && !isNotFoundError(err) {
+		return err
+	}
+	if err == nil {
+		if metadata[ephemeralVolumeMetadataKey] != volumeID {
+			klog.V(2).Infof("keep file share(%s) on account(%s) since it's not created by ephemeral volume(%s)", fileShareName, accountName, volumeID)
+			return os.Remove(statePath)
+		}
+		hasHandles, err := hasOpenHandles(ctx, accountName, accountKey, storageEndpointSuffix, fileShareName)
+		if err != nil {
+			return err
+		}
+		if hasHandles {
+			klog.Warningf("keep file share(%s) on account(%s) of ephemeral volume(%s) since it's still in use by others", fileShareName, accountName, volumeID)
+			return os.Remove(statePath)
+		}
+		klog.V(2).Infof("deleting file share(%s) on account(%s) of ephemeral volume(%s)", fileShareName, accountName, volumeID)
+		if err := d.fileClient.deleteFileShare(accountName, accountKey, fileShareName); err != nil && !isNotFoundError(err) {
+			return err
+		}
+	}
+	return os.Remove(statePath)
+}
+
+// hasOpenHandles returns true if there is any open handle on the file share, e.g. the file share is mounted by others,
+// it's a variable so that unit tests could replace it
+var hasOpenHandles = func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName string) (bool, error) {
+	credential, err := service.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return false, fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
+	}
+	serviceClient, err := service.NewClientWithSharedKeyCredential(fmt.Sprintf("https://%s.file.%s/", accountName, storageEndpointSuffix), credential, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create service client(%s): %v", accountName, err)
+	}
+	resp, err := serviceClient.NewShareClient(shareName).NewRootDirectoryClient().ListHandles(ctx, &directory.ListHandlesOptions{
+		MaxResults: pointer.Int32(1),
+		Recursive:  pointer.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.Handles) > 0, nil
+}
+
+// parseTransientMountErrors parses comma separated mount error codes or messages,
+// returns the default transient mount errors if mountErrors is empty
+func parseTransientMountErrors(mountErrors string) []string {
+	if strings.TrimSpace(mountErrors) == "" {
+		mountErrors = defaultTransientMountErrors
+	}
+	var result []string
+	for _, e := range strings.Split(mountErrors, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			result = append(result, strings.ToLower(e))
+		}
+	}
+	return result
+}
+
+// isTransientMountError returns true if the mount failure could be recovered by retrying, e.g. the server is temporarily unreachable
+func (d *Driver) isTransientMountError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, v := range d.transientMountErrors {
+		if strings.Contains(strings.ToLower(err.Error()), v) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedAccount returns true if the driver is allowed to operate on the storage account
+// empty accountName is always allowed since it's resolved by the driver later
+func (d *Driver) isAllowedAccount(accountName string) bool {
+	if len(d.allowedAccounts) == 0 || accountName == "" {
+		return true
+	}
+	_, ok := d.allowedAccounts[strings.ToLower(accountName)]
+	return ok
+}
+
+// getNodeOperationLimiter returns the limiter of node operations on vhd disk volume or file share volume
+func (d *Driver) getNodeOperationLimiter(isDiskVolume bool) *operationLimiter {
+	if isDiskVolume {
+		return d.diskNodeOperationLimiter
+	}
+	return d.shareNodeOperationLimiter
+}
+
+// validateVolumeID returns InvalidArgument error if volumeID is malformed in strict volume ID parsing mode,
+// malformed volumeID is tolerated in lenient mode and left to best-effort parsing
+func (d *Driver) validateVolumeID(volumeID string) error {
+	if !d.strictVolumeIDParsing {
+		return nil
+	}
+	_, accountName, fileShareName, _, _, _, err := GetFileShareInfo(volumeID)
+	if err == nil && (accountName == "" || fileShareName == "") {
+		err = fmt.Errorf("storage account or file share name is empty in volume id: %q", volumeID)
+	}
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid volume id(%s): %v", volumeID, err)
+	}
+	return nil
+}
+
+// ValidateVolumeID checks that the file share of static provisioned volume exists, so that a typo in volume handle
+// or volume context is reported before mount, file share is resolved in the same way as GetAccountInfo:
+// volume context and secrets override the <rg>#<account>#<share> format volumeID
+func (d *Driver) ValidateVolumeID(ctx context.Context, volumeID string, secrets, volumeContext map[string]string) error {
+	rgName, accountName, fileShareName, _, _, subsID, parseErr := GetFileShareInfo(volumeID)
+	if parseErr != nil && d.strictVolumeIDParsing {
+		return status.Errorf(codes.InvalidArgument, "invalid volume id(%s): %v", volumeID, parseErr)
+	}
+	for k, v := range volumeContext {
+		switch strings.ToLower(k) {
+		case subscriptionIDField:
+			subsID = v
+		case resourceGroupField:
+			rgName = v
+		case storageAccountField:
+			accountName = v
+		case shareNameField:
+			fileShareName = v
+		}
+	}
+	if len(secrets) > 0 {
+		if account, _, err := getStorageAccount(secrets); err == nil && account != "" {
+			accountName = account
+		}
+	}
+	if accountName == "" || fileShareName == "" {
+		if parseErr != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid volume id(%s): %v", volumeID, parseErr)
+		}
+		return status.Errorf(codes.InvalidArgument, "invalid volume id(%s): storage account or file share name is empty in volume id and volume context", volumeID)
+	}
+	if rgName == "" {
+		rgName = d.cloud.ResourceGroup
+	}
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	// fileShareName may contain subPath, e.g. csi-shared-config/ASCP01/certs
+	fileShareName = strings.Split(fileShareName, "/")[0]
+	quota, err := d.getFileShareQuota(ctx, subsID, rgName, accountName, fileShareName, secrets)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get file share(%s) under account(%s) rg(%s) of volume id(%s): %v", fileShareName, accountName, rgName, volumeID, err)
+	}
+	if quota == -1 {
+		return status.Errorf(codes.NotFound, "file share(%s) under account(%s) rg(%s) of volume id(%s) does not exist", fileShareName, accountName, rgName, volumeID)
+	}
+	return nil
+}
+
 // getSubnetResourceID get default subnet resource ID from cloud provider config
 func (d *Driver) getSubnetResourceID(vnetResourceGroup, vnetName, subnetName string) string {
 	subsID := d.cloud.SubscriptionID
@@ -1074,6 +3237,22 @@ func (d *Driver) getSubnetResourceID(vnetResourceGroup, vnetName, subnetName str
 	return fmt.Sprintf(subnetTemplate, subsID, vnetResourceGroup, vnetName, subnetName)
 }
 
+// getVolumeStorageEndPointSuffix returns the storage endpoint suffix of the volume (or of the source volume of a snapshot)
+// recorded from its storage class or volume context, falls back to the suffix of cloud environment
+func (d *Driver) getVolumeStorageEndPointSuffix(volumeID string) string {
+	if v, ok := d.storageEndpointSuffixVolMap.Load(volumeID); ok {
+		return d.getStorageEndPointSuffix(v.(string))
+	}
+	if i := strings.LastIndex(volumeID, separator); i > 0 {
+		if _, err := getSnapshot(volumeID); err == nil {
+			if v, ok := d.storageEndpointSuffixVolMap.Load(volumeID[:i]); ok {
+				return d.getStorageEndPointSuffix(v.(string))
+			}
+		}
+	}
+	return d.getStorageEndPointSuffix("")
+}
+
 func (d *Driver) useDataPlaneAPI(volumeID, accountName string) bool {
 	_, useDataPlaneAPI := d.dataPlaneAPIVolMap.Load(volumeID)
 	if useDataPlaneAPI {
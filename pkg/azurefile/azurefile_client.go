@@ -19,10 +19,12 @@ package azurefile
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	azs "github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/pointer"
 
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
@@ -61,24 +63,49 @@ func (f *azureFileClient) CreateFileShare(accountName, accountKey string, shareO
 	if shareOptions == nil {
 		return fmt.Errorf("shareOptions of account(%s) is nil", accountName)
 	}
-	return f.createFileShare(accountName, accountKey, shareOptions.Name, shareOptions.RequestGiB)
+	_, err := f.createFileShare(accountName, accountKey, shareOptions.Name, shareOptions.RequestGiB, shareOptions.Metadata)
+	return err
 }
 
-func (f *azureFileClient) createFileShare(accountName, accountKey, name string, sizeGiB int) error {
+// createFileShare creates a file share if it does not exist, returns true if the file share is newly created
+func (f *azureFileClient) createFileShare(accountName, accountKey, name string, sizeGiB int, metadata map[string]*string) (bool, error) {
 	fileClient, err := f.getFileSvcClient(accountName, accountKey)
 	if err != nil {
-		return err
+		return false, err
 	}
 	share := fileClient.GetShareReference(name)
 	share.Properties.Quota = sizeGiB
+	if len(metadata) > 0 {
+		share.Metadata = make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			share.Metadata[k] = pointer.StringDeref(v, "")
+		}
+	}
 	newlyCreated, err := share.CreateIfNotExists(nil)
 	if err != nil {
-		return fmt.Errorf("failed to create file share, err: %v", err)
+		return false, fmt.Errorf("failed to create file share, err: %v", err)
 	}
 	if !newlyCreated {
 		klog.V(2).Infof("file share(%s) under account(%s) already exists", name, accountName)
 	}
-	return nil
+	return newlyCreated, nil
+}
+
+// getFileShareMetadata returns the metadata of a file share with lower case keys
+func (f *azureFileClient) getFileShareMetadata(accountName, accountKey, name string) (map[string]string, error) {
+	fileClient, err := f.getFileSvcClient(accountName, accountKey)
+	if err != nil {
+		return nil, err
+	}
+	share := fileClient.GetShareReference(name)
+	if err := share.FetchAttributes(nil); err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string, len(share.Metadata))
+	for k, v := range share.Metadata {
+		metadata[strings.ToLower(k)] = v
+	}
+	return metadata, nil
 }
 
 // delete a file share
@@ -109,13 +136,34 @@ func (f *azureFileClient) resizeFileShare(accountName, accountKey, name string,
 	return nil
 }
 
+// setFileShareMetadata replaces the metadata of a file share
+func (f *azureFileClient) setFileShareMetadata(accountName, accountKey, name string, metadata map[string]string) error {
+	fileClient, err := f.getFileSvcClient(accountName, accountKey)
+	if err != nil {
+		return err
+	}
+	share := fileClient.GetShareReference(name)
+	share.Metadata = metadata
+	return share.SetMetadata(nil)
+}
+
+// validateAccountKey checks whether accountKey is still valid by listing at most one file share
+func (f *azureFileClient) validateAccountKey(accountName, accountKey string) error {
+	fileClient, err := f.getFileSvcClient(accountName, accountKey)
+	if err != nil {
+		return err
+	}
+	_, err = fileClient.ListShares(azs.ListSharesParameters{MaxResults: 1})
+	return err
+}
+
 func (f *azureFileClient) getFileSvcClient(accountName, accountKey string) (*azs.FileServiceClient, error) {
 	storageEndpointSuffix := f.env.StorageEndpointSuffix
 	if f.StorageEndpointSuffix != "" {
 		storageEndpointSuffix = f.StorageEndpointSuffix
 	}
 	if storageEndpointSuffix == "" {
-		storageEndpointSuffix = defaultStorageEndPointSuffix
+		storageEndpointSuffix = getDefaultStorageEndPointSuffix(f.env.Name)
 	}
 
 	fileClient, err := azs.NewClient(accountName, accountKey, storageEndpointSuffix, azs.DefaultAPIVersion, useHTTPS)
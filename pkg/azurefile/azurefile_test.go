@@ -17,28 +17,46 @@ limitations under the License.
 package azurefile
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/azure-storage-file-go/azfile"
 	azure2 "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/date"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
+	"github.com/rubiojr/go-vhd/vhd"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/pointer"
 
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	"sigs.k8s.io/cloud-provider-azure/pkg/consts"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 	auth "sigs.k8s.io/cloud-provider-azure/pkg/provider/config"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 )
 
 const (
@@ -177,6 +195,52 @@ func TestAppendDefaultMountOptions(t *testing.T) {
 				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
 			},
 		},
+		{
+			options: []string{noMfsymlinks},
+			expected: []string{
+				fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+				fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+			},
+		},
+		{
+			options: []string{"mfsymlinks=false", "vers=3.0"},
+			expected: []string{
+				"vers=3.0",
+				fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+				fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+			},
+		},
+		{
+			options: []string{"vers=3.0,nomfsymlinks", "mfsymlinks=false,nomfsymlinks"},
+			expected: []string{
+				"vers=3.0",
+				fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+				fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+			},
+		},
+		{
+			options: []string{"mfsymlinks=true"},
+			expected: []string{
+				mfsymlinks,
+				fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+				fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+			},
+		},
+		{
+			// option name is matched as a whole instead of by prefix
+			options: []string{"file_modex=0700", "actimeos=10"},
+			expected: []string{
+				"file_modex=0700", "actimeos=10",
+				fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+				fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+				mfsymlinks,
+			},
+		},
 		{
 			options: []string{"vers=3.1.1"},
 			expected: []string{"dir_mode=0777",
@@ -231,7 +295,7 @@ func TestAppendDefaultMountOptions(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result := appendDefaultMountOptions(test.options, test.appendNoShareSockOption, test.appendClosetimeoOption)
+		result := appendDefaultMountOptions(test.options, test.appendNoShareSockOption, test.appendClosetimeoOption, nil, "", "")
 		sort.Strings(result)
 		sort.Strings(test.expected)
 
@@ -241,6 +305,188 @@ func TestAppendDefaultMountOptions(t *testing.T) {
 	}
 }
 
+func TestAppendDefaultMountOptionsWithFSGroup(t *testing.T) {
+	defaults := []string{
+		fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+		fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+		fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+		mfsymlinks,
+	}
+	tests := []struct {
+		desc     string
+		options  []string
+		fsGroup  string
+		expected []string
+	}{
+		{
+			desc:     "gid is not appended without fsGroup",
+			options:  []string{"vers=3.0"},
+			expected: append([]string{"vers=3.0"}, defaults...),
+		},
+		{
+			desc:     "gid is appended with fsGroup",
+			options:  []string{"vers=3.0"},
+			fsGroup:  "3000",
+			expected: append([]string{"vers=3.0", "gid=3000"}, defaults...),
+		},
+		{
+			desc:     "gid in mount options is not overridden by fsGroup",
+			options:  []string{"gid=2000"},
+			fsGroup:  "3000",
+			expected: append([]string{"gid=2000"}, defaults...),
+		},
+		{
+			desc:     "gidfoo is not regarded as gid",
+			options:  []string{"gidfoo"},
+			fsGroup:  "3000",
+			expected: append([]string{"gidfoo", "gid=3000"}, defaults...),
+		},
+	}
+
+	for _, test := range tests {
+		result := appendDefaultMountOptions(test.options, false, false, nil, test.fsGroup, "")
+		assert.ElementsMatch(t, test.expected, result, test.desc)
+	}
+}
+
+func TestAppendDefaultMountOptionsReadOnly(t *testing.T) {
+	tests := []struct {
+		desc            string
+		options         []string
+		driverDefaults  map[string]string
+		readOnlyActimeo string
+		expected        []string
+	}{
+		{
+			desc:     "read-write mount uses default actimeo",
+			expected: []string{"file_mode=0777", "dir_mode=0777", "actimeo=30", mfsymlinks},
+		},
+		{
+			desc:            "read-only mount uses read-only actimeo",
+			readOnlyActimeo: defaultReadOnlyActimeo,
+			expected:        []string{"file_mode=0777", "dir_mode=0777", "actimeo=600", mfsymlinks},
+		},
+		{
+			desc:            "read-only actimeo takes precedence over driver default actimeo",
+			driverDefaults:  map[string]string{actimeo: "60"},
+			readOnlyActimeo: "3600",
+			expected:        []string{"file_mode=0777", "dir_mode=0777", "actimeo=3600", mfsymlinks},
+		},
+		{
+			desc:            "actimeo in mount options overrides read-only actimeo",
+			options:         []string{"ro", "actimeo=10"},
+			readOnlyActimeo: defaultReadOnlyActimeo,
+			expected:        []string{"ro", "actimeo=10", "file_mode=0777", "dir_mode=0777", mfsymlinks},
+		},
+		{
+			desc:            "acregmax in mount options overrides read-only actimeo",
+			options:         []string{"acregmax=10"},
+			readOnlyActimeo: defaultReadOnlyActimeo,
+			expected:        []string{"acregmax=10", "file_mode=0777", "dir_mode=0777", mfsymlinks},
+		},
+	}
+
+	for _, test := range tests {
+		result := appendDefaultMountOptions(test.options, false, false, test.driverDefaults, "", test.readOnlyActimeo)
+		assert.ElementsMatch(t, test.expected, result, test.desc)
+	}
+
+	d := NewFakeDriver()
+	assert.Equal(t, defaultReadOnlyActimeo, d.readOnlyActimeo)
+	d = NewFakeDriverCustomOptions(DriverOptions{DefaultReadOnlyActimeo: "1200"})
+	assert.Equal(t, "1200", d.readOnlyActimeo)
+}
+
+func TestAppendDefaultMountOptionsWithDriverDefaults(t *testing.T) {
+	d := NewFakeDriverCustomOptions(DriverOptions{
+		DefaultFileMode: "0750",
+		DefaultDirMode:  "0750",
+		DefaultVers:     "3.1.1",
+	})
+
+	tests := []struct {
+		desc           string
+		options        []string
+		driverDefaults map[string]string
+		expected       []string
+	}{
+		{
+			desc:           "empty driver defaults fall back to hardcoded defaults",
+			options:        []string{},
+			driverDefaults: map[string]string{fileMode: "", dirMode: "", vers: "", actimeo: ""},
+			expected: []string{
+				fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+				fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+				mfsymlinks,
+			},
+		},
+		{
+			desc:           "driver defaults override hardcoded defaults",
+			options:        []string{},
+			driverDefaults: d.defaultMountOptions,
+			expected: []string{
+				"file_mode=0750",
+				"dir_mode=0750",
+				"vers=3.1.1",
+				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+				mfsymlinks,
+			},
+		},
+		{
+			desc:           "options with colliding names do not suppress driver defaults",
+			options:        []string{"versioning=x", "file_mode_ext=1", "dir_modes", "acregmaxx=1", "nomfsymlinksx"},
+			driverDefaults: map[string]string{vers: "3.0"},
+			expected: []string{
+				"versioning=x",
+				"file_mode_ext=1",
+				"dir_modes",
+				"acregmaxx=1",
+				"nomfsymlinksx",
+				"vers=3.0",
+				fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+				fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+				fmt.Sprintf("%s=%s", actimeo, defaultActimeo),
+				mfsymlinks,
+			},
+		},
+		{
+			desc:           "options with exact names suppress driver defaults",
+			options:        []string{"vers=2.1", "mfsymlinks", "acdirmax=5"},
+			driverDefaults: map[string]string{vers: "3.0"},
+			expected: []string{
+				"vers=2.1",
+				"mfsymlinks",
+				"acdirmax=5",
+				fmt.Sprintf("%s=%s", fileMode, defaultFileMode),
+				fmt.Sprintf("%s=%s", dirMode, defaultDirMode),
+			},
+		},
+		{
+			desc:           "mount options in storage class override driver defaults",
+			options:        []string{"file_mode=0700", "vers=3.0", "actimeo=10"},
+			driverDefaults: map[string]string{fileMode: "0750", dirMode: "0750", vers: "3.1.1", actimeo: "60"},
+			expected: []string{
+				"file_mode=0700",
+				"vers=3.0",
+				"actimeo=10",
+				"dir_mode=0750",
+				mfsymlinks,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		result := appendDefaultMountOptions(test.options, false, false, test.driverDefaults, "", "")
+		sort.Strings(result)
+		sort.Strings(test.expected)
+
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: appendDefaultMountOptions result: %q, expected: %q", test.desc, result, test.expected)
+		}
+	}
+}
+
 func TestGetFileShareInfo(t *testing.T) {
 	tests := []struct {
 		id                string
@@ -375,6 +621,65 @@ func TestGetFileShareInfo(t *testing.T) {
 	}
 }
 
+func TestGetStorageAccountConflictingFields(t *testing.T) {
+	tests := []struct {
+		desc                string
+		secrets             map[string]string
+		expectedAccountName string
+		expectedAccountKey  string
+		expectedErr         error
+	}{
+		{
+			desc:                "same values in both fields",
+			secrets:             map[string]string{"accountname": "account", defaultSecretAccountName: "account\n", "accountkey": "key", defaultSecretAccountKey: "key"},
+			expectedAccountName: "account",
+			expectedAccountKey:  "key",
+		},
+		{
+			desc:                "empty field is ignored",
+			secrets:             map[string]string{"accountname": "", defaultSecretAccountName: "account", "accountkey": "key", defaultSecretAccountKey: " "},
+			expectedAccountName: "account",
+			expectedAccountKey:  "key",
+		},
+		{
+			desc:                "account names in different cases are not conflicting",
+			secrets:             map[string]string{"accountname": "Account", defaultSecretAccountName: "account", "accountkey": "key"},
+			expectedAccountName: "Account",
+			expectedAccountKey:  "key",
+		},
+		{
+			desc:        "account keys in different cases are conflicting",
+			secrets:     map[string]string{"accountname": "account", "accountkey": "Key", defaultSecretAccountKey: "key"},
+			expectedErr: fmt.Errorf("secret fields(accountkey, azurestorageaccountkey) have conflicting account keys"),
+		},
+		{
+			desc:        "conflicting account names",
+			secrets:     map[string]string{"accountname": "account1", defaultSecretAccountName: "account2", "accountkey": "key"},
+			expectedErr: fmt.Errorf("secret fields(accountname, azurestorageaccountname) have conflicting account names"),
+		},
+		{
+			desc:        "conflicting account names with different cases of field name",
+			secrets:     map[string]string{"AccountName": "account1", "accountname": "account2", "accountkey": "key"},
+			expectedErr: fmt.Errorf("secret fields(AccountName, accountname) have conflicting account names"),
+		},
+		{
+			desc:        "conflicting account keys",
+			secrets:     map[string]string{"accountname": "account", "accountkey": "key1", defaultSecretAccountKey: "key2"},
+			expectedErr: fmt.Errorf("secret fields(accountkey, azurestorageaccountkey) have conflicting account keys"),
+		},
+	}
+
+	for _, test := range tests {
+		accountName, accountKey, err := getStorageAccount(test.secrets)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedAccountName, accountName, test.desc)
+		assert.Equal(t, test.expectedAccountKey, accountKey, test.desc)
+		if err != nil {
+			assert.NotContains(t, err.Error(), "key1", test.desc)
+		}
+	}
+}
+
 func TestGetStorageAccount(t *testing.T) {
 	emptyAccountKeyMap := map[string]string{
 		"accountname": "testaccount",
@@ -420,6 +725,33 @@ func TestGetStorageAccount(t *testing.T) {
 			expected2: "testkey",
 			expected3: nil,
 		},
+		{
+			options: map[string]string{
+				"accountname": " testaccount\n",
+				"accountkey":  "testkey\n",
+			},
+			expected1: "testaccount",
+			expected2: "testkey",
+			expected3: nil,
+		},
+		{
+			options: map[string]string{
+				defaultSecretAccountName: "testaccount\r\n",
+				defaultSecretAccountKey:  " test\nkey== \n",
+			},
+			expected1: "testaccount",
+			expected2: "testkey==",
+			expected3: nil,
+		},
+		{
+			options: map[string]string{
+				"accountname": "testaccount",
+				"accountkey":  " \n",
+			},
+			expected1: "",
+			expected2: "",
+			expected3: fmt.Errorf("could not find accountkey or azurestorageaccountkey field in secrets"),
+		},
 		{
 			options: map[string]string{
 				"accountname": "",
@@ -476,8 +808,9 @@ func TestGetStorageAccount(t *testing.T) {
 
 func TestGetValidFileShareName(t *testing.T) {
 	tests := []struct {
-		volumeName string
-		expected   string
+		volumeName      string
+		shareNamePrefix string
+		expected        string
 	}{
 		{
 			volumeName: "aqz",
@@ -491,6 +824,10 @@ func TestGetValidFileShareName(t *testing.T) {
 			volumeName: "a--z",
 			expected:   "a-z",
 		},
+		{
+			volumeName: "a---z",
+			expected:   "a-z",
+		},
 		{
 			volumeName: "A2Z",
 			expected:   "a2z",
@@ -500,17 +837,90 @@ func TestGetValidFileShareName(t *testing.T) {
 			expected:   "123456789123456789123456789123456789123456789123456789123456789",
 		},
 		{
+			// short name is padded with a deterministic suffix instead of being regenerated
 			volumeName: "aq",
+			expected:   "aq-dd9603a1",
+		},
+		{
+			volumeName: "A",
+			expected:   "a-ca978112",
+		},
+		{
+			volumeName: "7",
+			expected:   "7-7902699b",
+		},
+		{
+			// trailing hyphen is removed before padding
+			volumeName: "a-",
+			expected:   "a-ca978112",
+		},
+		{
+			// short name starting with a hyphen is still regenerated
+			volumeName: "-a",
+			expected:   "pvc-file-dynamic",
+		},
+		{
+			volumeName: "",
 			expected:   "pvc-file-dynamic",
 		},
+		{
+			volumeName:      "pvc-8d0b5f5a-1d1c-4d7e-9f0a-2b6b7e0c9d11",
+			shareNamePrefix: "team-a",
+			expected:        "team-a-pvc-8d0b5f5a-1d1c-4d7e-9f0a-2b6b7e0c9d11",
+		},
+		{
+			volumeName:      "pvc-8d0b5f5a-1d1c-4d7e-9f0a-2b6b7e0c9d11",
+			shareNamePrefix: "team-a-",
+			expected:        "team-a-pvc-8d0b5f5a-1d1c-4d7e-9f0a-2b6b7e0c9d11",
+		},
+		{
+			volumeName:      "aq",
+			shareNamePrefix: "pre",
+			expected:        "pre-aq",
+		},
+		{
+			// prefix pushes the name over the limit, truncate the tail and keep the prefix
+			volumeName:      "pvc-8d0b5f5a-1d1c-4d7e-9f0a-2b6b7e0c9d11abcdef",
+			shareNamePrefix: "abcdefghijklmnopqrst",
+			expected:        "abcdefghijklmnopqrst-pvc-8d0b5f5a-1d1c-4d7e-9f0a-2b6b7e0c9d11ab",
+		},
+		{
+			// trailing hyphen after truncation is removed
+			volumeName:      "pvc-8d0b5f5a-1d1c-4d7e-9f0a-2b6b7e0c9d11a-extra",
+			shareNamePrefix: "abcdefghijklmnopqrst",
+			expected:        "abcdefghijklmnopqrst-pvc-8d0b5f5a-1d1c-4d7e-9f0a-2b6b7e0c9d11a",
+		},
+		{
+			volumeName:      "1234567891234567891234567891234567891234567891234567891234567891",
+			shareNamePrefix: "team-a",
+			expected:        "team-a-12345678912345678912345678912345678912345678912345678912",
+		},
+		{
+			// prefix starting with a hyphen could not be kept
+			volumeName:      "pvc",
+			shareNamePrefix: "-team",
+			expected:        "pvc-file-dynamic",
+		},
+		{
+			volumeName:      "-",
+			shareNamePrefix: "team",
+			expected:        "team",
+		},
 	}
 
 	for _, test := range tests {
-		result := getValidFileShareName(test.volumeName)
-		if test.volumeName == "aq" {
-			assert.Contains(t, result, test.expected)
+		result := getValidFileShareName(test.volumeName, test.shareNamePrefix)
+		// padded and original names are idempotent
+		if !strings.HasSuffix(test.expected, "-dynamic") {
+			assert.Equal(t, result, getValidFileShareName(test.volumeName, test.shareNamePrefix))
+		}
+		if len(result) < fileShareNameMinLength || len(result) > fileShareNameMaxLength || !checkShareNameBeginAndEnd(result) || strings.Contains(result, "--") {
+			t.Errorf("input: (%q, %q), getValidFileShareName result: %q is not a valid file share name", test.volumeName, test.shareNamePrefix, result)
+		}
+		if strings.HasSuffix(test.expected, "-dynamic") {
+			assert.True(t, strings.HasPrefix(result, test.expected), "input: (%q, %q), getValidFileShareName result: %q, expected prefix: %q", test.volumeName, test.shareNamePrefix, result, test.expected)
 		} else if !reflect.DeepEqual(result, test.expected) {
-			t.Errorf("input: %q, getValidFileShareName result: %q, expected: %q", test.volumeName, result, test.expected)
+			t.Errorf("input: (%q, %q), getValidFileShareName result: %q, expected: %q", test.volumeName, test.shareNamePrefix, result, test.expected)
 		}
 	}
 }
@@ -575,6 +985,16 @@ func TestGetSnapshot(t *testing.T) {
 			expected1: "2021-08-22T07:17:53.0000000Z",
 			expected2: nil,
 		},
+		{
+			options:   "rg#f123#csivolumename#diskname#2019-08-22T07:17:53.12Z",
+			expected1: "2019-08-22T07:17:53.1200000Z",
+			expected2: nil,
+		},
+		{
+			options:   "rg#f123#csivolumename#diskname#invalid",
+			expected1: "",
+			expected2: fmt.Errorf("invalid snapshot time(invalid), should be in %s format", snapshotTimeFormat),
+		},
 		{
 			options:   "rg#f123#csivolumename",
 			expected1: "",
@@ -605,6 +1025,35 @@ func TestGetSnapshot(t *testing.T) {
 	}
 }
 
+func TestNormalizeSnapshotTime(t *testing.T) {
+	tests := []struct {
+		snapshot    string
+		expected    string
+		expectedErr bool
+	}{
+		{snapshot: "2019-08-22T07:17:53.0000000Z", expected: "2019-08-22T07:17:53.0000000Z"},
+		{snapshot: "2019-08-22T07:17:53.1234567Z", expected: "2019-08-22T07:17:53.1234567Z"},
+		{snapshot: "2019-08-22T07:17:53Z", expected: "2019-08-22T07:17:53.0000000Z"},
+		{snapshot: "2019-08-22T07:17:53.1Z", expected: "2019-08-22T07:17:53.1000000Z"},
+		{snapshot: "2019-08-22T07:17:53.123Z", expected: "2019-08-22T07:17:53.1230000Z"},
+		{snapshot: "2019-08-22T07:17:53.123456789Z", expected: "2019-08-22T07:17:53.1234567Z"},
+		{snapshot: "2019-08-22T15:17:53.5+08:00", expected: "2019-08-22T07:17:53.5000000Z"},
+		{snapshot: "2019-08-22 07:17:53Z", expectedErr: true},
+		{snapshot: "testuuid", expectedErr: true},
+		{snapshot: "", expectedErr: true},
+	}
+
+	for _, test := range tests {
+		result, err := normalizeSnapshotTime(test.snapshot)
+		if test.expectedErr {
+			assert.Error(t, err, test.snapshot)
+			continue
+		}
+		assert.NoError(t, err, test.snapshot)
+		assert.Equal(t, test.expected, result, test.snapshot)
+	}
+}
+
 func TestIsCorruptedDir(t *testing.T) {
 	skipIfTestingOnWindows(t)
 	existingMountPath, err := os.MkdirTemp(os.TempDir(), "csi-mount-test")
@@ -715,7 +1164,7 @@ func TestGetFileURL(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		_, err := getFileURL(test.accountName, test.accountKey, test.storageEndpointSuffix, test.fileShareName, test.diskName)
+		_, err := getFileURL(test.accountName, test.accountKey, test.storageEndpointSuffix, test.fileShareName, test.diskName, newDataPlaneRetryOptions(0, 0, 0, 0))
 		if !reflect.DeepEqual(err, test.expectedError) {
 			t.Errorf("accountName: %v accountKey: %v storageEndpointSuffix: %v fileShareName: %v diskName: %v Error: %v",
 				test.accountName, test.accountKey, test.storageEndpointSuffix, test.fileShareName, test.diskName, err)
@@ -723,40 +1172,216 @@ func TestGetFileURL(t *testing.T) {
 	}
 }
 
-func TestGetAccountInfo(t *testing.T) {
+func TestGetFileURLWithStorageEndpointSuffix(t *testing.T) {
+	accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
 	d := NewFakeDriver()
 	d.cloud = &azure.Cloud{}
 
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+	// custom suffix of azure stack hub
+	fileURL, err := getFileURL("account", accountKey, d.getStorageEndPointSuffix("local.azurestack.external"), "share", "disk.vhd", d.dataPlaneRetryOptions)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://account.file.local.azurestack.external/share/disk.vhd", fileURL.String())
 
-	validSecret := map[string]string{
-		defaultSecretAccountName: "testaccount",
-		defaultSecretAccountKey:  "testkey",
+	// default suffix is used when unspecified
+	fileURL, err = getFileURL("account", accountKey, d.getStorageEndPointSuffix(""), "share", "disk.vhd", d.dataPlaneRetryOptions)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://account.file."+defaultStorageEndPointSuffix+"/share/disk.vhd", fileURL.String())
+
+	// empty suffix does not produce a malformed url
+	fileURL, err = getFileURL("account", accountKey, "", "share", "disk.vhd", d.dataPlaneRetryOptions)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://account.file."+defaultStorageEndPointSuffix+"/share/disk.vhd", fileURL.String())
+}
+
+func TestGetDefaultStorageEndPointSuffix(t *testing.T) {
+	tests := []struct {
+		cloudName string
+		expected  string
+	}{
+		{cloudName: "", expected: "core.windows.net"},
+		{cloudName: "AzurePublicCloud", expected: "core.windows.net"},
+		{cloudName: "AzureChinaCloud", expected: "core.chinacloudapi.cn"},
+		{cloudName: "AZUREUSGOVERNMENTCLOUD", expected: "core.usgovcloudapi.net"},
+		{cloudName: "unknown", expected: "core.windows.net"},
 	}
-	emptySecret := map[string]string{}
-	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
-	key := storage.AccountListKeysResult{
-		Keys: &[]storage.AccountKey{
-			{Value: &value},
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getDefaultStorageEndPointSuffix(test.cloudName), test.cloudName)
+	}
+}
+
+func TestNewDataPlaneRetryOptions(t *testing.T) {
+	defaultOptions := azfile.RetryOptions{
+		Policy:        azfile.RetryPolicyExponential,
+		MaxTries:      3,
+		TryTimeout:    3 * time.Second,
+		RetryDelay:    time.Second,
+		MaxRetryDelay: 3 * time.Second,
+	}
+	tests := []struct {
+		desc          string
+		maxTries      int
+		tryTimeout    time.Duration
+		retryDelay    time.Duration
+		maxRetryDelay time.Duration
+		expected      azfile.RetryOptions
+	}{
+		{
+			desc:     "zero values fall back to defaults",
+			expected: defaultOptions,
+		},
+		{
+			desc:          "negative values fall back to defaults",
+			maxTries:      -1,
+			tryTimeout:    -time.Second,
+			retryDelay:    -time.Second,
+			maxRetryDelay: -time.Second,
+			expected:      defaultOptions,
+		},
+		{
+			desc:          "custom values",
+			maxTries:      5,
+			tryTimeout:    time.Minute,
+			retryDelay:    2 * time.Second,
+			maxRetryDelay: 10 * time.Second,
+			expected: azfile.RetryOptions{
+				Policy:        azfile.RetryPolicyExponential,
+				MaxTries:      5,
+				TryTimeout:    time.Minute,
+				RetryDelay:    2 * time.Second,
+				MaxRetryDelay: 10 * time.Second,
+			},
 		},
 	}
 
-	clientSet := fake.NewSimpleClientset()
+	for _, test := range tests {
+		result := newDataPlaneRetryOptions(test.maxTries, test.tryTimeout, test.retryDelay, test.maxRetryDelay)
+		assert.Equal(t, test.expected, result, test.desc)
+	}
 
+	d := NewFakeDriverCustomOptions(DriverOptions{DataPlaneMaxTries: 5, DataPlaneTryTimeout: time.Minute})
+	assert.Equal(t, int32(5), d.dataPlaneRetryOptions.MaxTries)
+	assert.Equal(t, time.Minute, d.dataPlaneRetryOptions.TryTimeout)
+	assert.Equal(t, defaultDataPlaneRetryDelay, d.dataPlaneRetryOptions.RetryDelay)
+}
+
+func TestGetStorageEndPointSuffix(t *testing.T) {
 	tests := []struct {
-		volumeID            string
-		rgName              string
-		secrets             map[string]string
-		reqContext          map[string]string
-		expectErr           bool
-		err                 error
-		expectAccountName   string
-		expectFileShareName string
-		expectDiskName      string
+		desc     string
+		cloud    *azure.Cloud
+		override string
+		expected string
 	}{
 		{
-			volumeID: "##",
+			desc:     "nil cloud",
+			cloud:    nil,
+			expected: defaultStorageEndPointSuffix,
+		},
+		{
+			desc:     "empty cloud environment",
+			cloud:    &azure.Cloud{},
+			expected: defaultStorageEndPointSuffix,
+		},
+		{
+			desc:     "suffix from cloud environment",
+			cloud:    &azure.Cloud{Environment: azure2.Environment{StorageEndpointSuffix: "core.chinacloudapi.cn"}},
+			expected: "core.chinacloudapi.cn",
+		},
+		{
+			desc:     "override takes precedence over cloud environment",
+			cloud:    &azure.Cloud{Environment: azure2.Environment{StorageEndpointSuffix: "core.chinacloudapi.cn"}},
+			override: "core.usgovcloudapi.net",
+			expected: "core.usgovcloudapi.net",
+		},
+		{
+			desc:     "blank override is ignored",
+			cloud:    &azure.Cloud{Environment: azure2.Environment{StorageEndpointSuffix: "core.chinacloudapi.cn"}},
+			override: " ",
+			expected: "core.chinacloudapi.cn",
+		},
+		{
+			desc:     "empty suffix falls back to the suffix of environment name",
+			cloud:    &azure.Cloud{Environment: azure2.Environment{Name: "AzureChinaCloud"}},
+			expected: "core.chinacloudapi.cn",
+		},
+		{
+			desc:     "empty suffix falls back to the suffix of cloud in cloud config",
+			cloud:    &azure.Cloud{Config: azure.Config{AzureAuthConfig: auth.AzureAuthConfig{Cloud: "AzureUSGovernmentCloud"}}},
+			expected: "core.usgovcloudapi.net",
+		},
+		{
+			desc:     "empty suffix of unknown cloud falls back to public cloud",
+			cloud:    &azure.Cloud{Config: azure.Config{AzureAuthConfig: auth.AzureAuthConfig{Cloud: "unknown"}}},
+			expected: defaultStorageEndPointSuffix,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = test.cloud
+		result := d.getStorageEndPointSuffix(test.override)
+		if result != test.expected {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestGetStorageEndPointSuffixCached(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{Environment: azure2.Environment{StorageEndpointSuffix: "core.chinacloudapi.cn"}}
+	assert.Equal(t, "core.chinacloudapi.cn", d.getStorageEndPointSuffix(""))
+
+	// suffix of cloud environment is only resolved once
+	d.cloud.Environment.StorageEndpointSuffix = "core.usgovcloudapi.net"
+	assert.Equal(t, "core.chinacloudapi.cn", d.getStorageEndPointSuffix(""))
+	assert.Equal(t, "core.usgovcloudapi.net", d.getStorageEndPointSuffix("core.usgovcloudapi.net"))
+}
+
+func TestGetVolumeStorageEndPointSuffix(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{Environment: azure2.Environment{StorageEndpointSuffix: "core.windows.net"}}
+	volumeID := "rg#account#share#"
+	d.storageEndpointSuffixVolMap.Store(volumeID, "local.azurestack.external")
+
+	assert.Equal(t, "local.azurestack.external", d.getVolumeStorageEndPointSuffix(volumeID))
+	assert.Equal(t, "local.azurestack.external", d.getVolumeStorageEndPointSuffix(volumeID+"#2019-08-22T07:17:53.0000000Z"))
+	assert.Equal(t, "core.windows.net", d.getVolumeStorageEndPointSuffix("rg#account#othershare#"))
+	assert.Equal(t, "core.windows.net", d.getVolumeStorageEndPointSuffix("rg#account#othershare##2019-08-22T07:17:53.0000000Z"))
+}
+
+func TestGetAccountInfo(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	validSecret := map[string]string{
+		defaultSecretAccountName: "testaccount",
+		defaultSecretAccountKey:  "testkey",
+	}
+	emptySecret := map[string]string{}
+	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	key := storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{Value: &value},
+		},
+	}
+
+	clientSet := fake.NewSimpleClientset()
+
+	tests := []struct {
+		volumeID            string
+		rgName              string
+		secrets             map[string]string
+		reqContext          map[string]string
+		expectErr           bool
+		err                 error
+		expectAccountName   string
+		expectFileShareName string
+		expectDiskName      string
+	}{
+		{
+			volumeID: "##",
 			rgName:   "",
 			secrets:  emptySecret,
 			reqContext: map[string]string{
@@ -854,408 +1479,1441 @@ func TestGetAccountInfo(t *testing.T) {
 	}
 }
 
-func TestCreateDisk(t *testing.T) {
-	skipIfTestingOnWindows(t)
-	d := NewFakeDriver()
-	d.cloud = &azure.Cloud{}
-	tests := []struct {
-		accountName           string
-		accountKey            string
-		storageEndpointSuffix string
-		fileShareName         string
-		diskName              string
-		expectedError         error
-	}{
-		{
-			accountName:           "f5713de20cde511e8ba4900",
-			accountKey:            "abc",
-			storageEndpointSuffix: "suffix",
-			fileShareName:         "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			diskName:              "diskname.vhd",
-			expectedError:         fmt.Errorf("NewSharedKeyCredential(f5713de20cde511e8ba4900) failed with error: illegal base64 data at input byte 0"),
-		},
-		{
-			accountName:           "f5713de20cde511e8ba4900",
-			accountKey:            base64.StdEncoding.EncodeToString([]byte("acc_key")),
-			storageEndpointSuffix: "suffix",
-			fileShareName:         "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
-			diskName:              "diskname.vhd",
-			expectedError:         nil,
-		},
-	}
-
-	for _, test := range tests {
-		_ = createDisk(context.Background(), test.accountName, test.accountKey, test.storageEndpointSuffix,
-			test.fileShareName, test.diskName, 20)
-	}
-}
-
-func TestGetFileShareQuota(t *testing.T) {
-	d := NewFakeDriver()
-	d.cloud = &azure.Cloud{}
-	d.fileClient = &azureFileClient{env: &azure2.Environment{}}
+func TestGetFileShareQuotaNilShareQuota(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	shareQuota := int32(10)
-	resourceGroupName := "rg"
-	accountName := "accountname"
-	fileShareName := "filesharename"
 
 	tests := []struct {
-		desc                string
-		secrets             map[string]string
-		mockedFileShareResp storage.FileShare
-		mockedFileShareErr  error
-		expectedQuota       int
-		expectedError       error
+		desc          string
+		policy        string
+		listKeysErr   *retry.Error
+		expectedQuota int
+		expectedErr   string
 	}{
 		{
-			desc:                "Get file share return error",
-			secrets:             map[string]string{},
-			mockedFileShareResp: storage.FileShare{},
-			mockedFileShareErr:  fmt.Errorf("test error"),
-			expectedQuota:       -1,
-			expectedError:       fmt.Errorf("test error"),
-		},
-		{
-			desc:                "Share not found",
-			secrets:             map[string]string{},
-			mockedFileShareResp: storage.FileShare{},
-			mockedFileShareErr:  fmt.Errorf("ShareNotFound"),
-			expectedQuota:       -1,
-			expectedError:       nil,
+			desc:          "nil quota returns error by default",
+			policy:        "",
+			expectedQuota: -1,
+			expectedErr:   "FileShareProperties or FileShareProperties.ShareQuota is nil",
 		},
 		{
-			desc:                "Volume already exists",
-			secrets:             map[string]string{},
-			mockedFileShareResp: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}},
-			mockedFileShareErr:  nil,
-			expectedQuota:       int(shareQuota),
-			expectedError:       nil,
+			desc:          "nil quota falls back to default quota",
+			policy:        nilShareQuotaDefault,
+			expectedQuota: defaultAzureFileQuota,
 		},
 		{
-			desc: "Could not find accountname in secrets",
-			secrets: map[string]string{
-				"secrets": "secrets",
-			},
-			mockedFileShareResp: storage.FileShare{},
-			mockedFileShareErr:  nil,
-			expectedQuota:       -1,
-			expectedError:       fmt.Errorf("could not find accountname or azurestorageaccountname field in secrets"),
+			desc:          "nil quota queried via data plane",
+			policy:        nilShareQuotaDataPlane,
+			expectedQuota: -1,
+			expectedErr:   "error creating azure client",
 		},
 		{
-			desc: "Error creating azure client",
-			secrets: map[string]string{
-				"accountname": "ut",
-				"accountkey":  "testkey",
-			},
-			mockedFileShareResp: storage.FileShare{},
-			mockedFileShareErr:  nil,
-			expectedQuota:       -1,
-			expectedError:       fmt.Errorf("error creating azure client: azure: account name is not valid: it must be between 3 and 24 characters, and only may contain numbers and lowercase letters: ut"),
+			desc:          "failed to get account key for data plane query",
+			policy:        nilShareQuotaDataPlane,
+			listKeysErr:   retry.NewError(false, fmt.Errorf("AuthorizationFailed")),
+			expectedQuota: -1,
+			expectedErr:   "FileShareProperties.ShareQuota is nil and failed to get account key of accountname",
 		},
 	}
 
 	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{NilShareQuotaPolicy: test.policy})
+		d.cloud = &azure.Cloud{}
+		d.fileClient = &azureFileClient{env: &azure2.Environment{StorageEndpointSuffix: "core.windows.net"}}
 		mockFileClient := mockfileclient.NewMockInterface(ctrl)
-		d.cloud.FileClient = mockFileClient
-		mockFileClient.EXPECT().GetFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(test.mockedFileShareResp, test.mockedFileShareErr).AnyTimes()
 		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
-		quota, err := d.getFileShareQuota(context.TODO(), "", resourceGroupName, accountName, fileShareName, test.secrets)
-		if !reflect.DeepEqual(err, test.expectedError) {
-			t.Errorf("test name: %s, Unexpected error: %v, expected error: %v", test.desc, err, test.expectedError)
-		}
-		if quota != test.expectedQuota {
-			t.Errorf("Unexpected return quota: %d, expected: %d", quota, test.expectedQuota)
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "accountname", "share", gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{}}, nil).Times(1)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		// invalid base64 key fails data plane client creation without sending any request
+		key := "invalid key"
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "accountname").Return(storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &key}}}, test.listKeysErr).AnyTimes()
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+		quota, err := d.getFileShareQuota(context.Background(), "", "rg", "accountname", "share", nil)
+		if test.expectedErr == "" {
+			assert.NoError(t, err, test.desc)
+		} else {
+			assert.ErrorContains(t, err, test.expectedErr, test.desc)
 		}
+		assert.Equal(t, test.expectedQuota, quota, test.desc)
 	}
 }
 
-func TestRun(t *testing.T) {
-	fakeCredFile := "fake-cred-file.json"
-	fakeCredContent := `{
-    "tenantId": "1234",
-    "subscriptionId": "12345",
-    "aadClientId": "123456",
-    "aadClientSecret": "1234567",
-    "resourceGroup": "rg1",
-    "location": "loc"
-}`
-
-	testCases := []struct {
-		name     string
-		testFunc func(t *testing.T)
-	}{
-		{
-			name: "Successful run",
-			testFunc: func(t *testing.T) {
-				if err := os.WriteFile(fakeCredFile, []byte(fakeCredContent), 0666); err != nil {
-					t.Error(err)
-				}
-
-				defer func() {
-					if err := os.Remove(fakeCredFile); err != nil {
-						t.Error(err)
-					}
-				}()
-
-				originalCredFile, ok := os.LookupEnv(DefaultAzureCredentialFileEnv)
-				if ok {
-					defer os.Setenv(DefaultAzureCredentialFileEnv, originalCredFile)
-				} else {
-					defer os.Unsetenv(DefaultAzureCredentialFileEnv)
-				}
-				os.Setenv(DefaultAzureCredentialFileEnv, fakeCredFile)
-
-				d := NewFakeDriver()
-				d.Run("tcp://127.0.0.1:0", "", true)
-			},
-		},
-		{
-			name: "Successful run with node ID missing",
-			testFunc: func(t *testing.T) {
-				if err := os.WriteFile(fakeCredFile, []byte(fakeCredContent), 0666); err != nil {
-					t.Error(err)
-				}
-
-				defer func() {
-					if err := os.Remove(fakeCredFile); err != nil {
-						t.Error(err)
-					}
-				}()
+func TestGetStorageAccesskeyWithConcurrentCallers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
 
-				originalCredFile, ok := os.LookupEnv(DefaultAzureCredentialFileEnv)
-				if ok {
-					defer os.Setenv(DefaultAzureCredentialFileEnv, originalCredFile)
-				} else {
-					defer os.Unsetenv(DefaultAzureCredentialFileEnv)
-				}
-				os.Setenv(DefaultAzureCredentialFileEnv, fakeCredFile)
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+	// secret does not exist, fall back to cluster identity which is blocked until all callers are issued
+	var fetchCount int32
+	release := make(chan struct{})
+	key := "key"
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "account").DoAndReturn(
+		func(_ context.Context, _, _, _ string) (storage.AccountListKeysResult, *retry.Error) {
+			atomic.AddInt32(&fetchCount, 1)
+			<-release
+			return storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &key}}}, nil
+		}).AnyTimes()
+
+	const callers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accountKey, err := d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "account", ResourceGroup: "rg"}, nil, "", "default", "", "")
+			if err == nil && accountKey != key {
+				err = fmt.Errorf("unexpected account key: %s", accountKey)
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetchCount))
+
+	// lookups with different secrets are not shared
+	var secretFetchCount int32
+	secretRelease := make(chan struct{})
+	mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "secretaccount").DoAndReturn(
+		func(_ context.Context, _, _, _ string) (storage.AccountListKeysResult, *retry.Error) {
+			atomic.AddInt32(&secretFetchCount, 1)
+			<-secretRelease
+			return storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &key}}}, nil
+		}).AnyTimes()
+	for _, secretName := range []string{"secret1", "secret2"} {
+		wg.Add(1)
+		go func(secretName string) {
+			defer wg.Done()
+			_, err := d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "secretaccount", ResourceGroup: "rg"}, nil, secretName, "default", "", "")
+			assert.NoError(t, err)
+		}(secretName)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secretFetchCount))
+
+	// the shared lookup is not canceled with the context of the first caller
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.GetStorageAccesskey(ctx, &azure.AccountOptions{Name: "secretaccount", ResourceGroup: "rg"}, nil, "secret1", "default", "", "")
+	assert.Equal(t, context.Canceled, err)
+	close(secretRelease)
+	wg.Wait()
+
+	// errors are not cached
+	failed := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = failed
+	failed.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "other").Return(storage.AccountListKeysResult{}, &retry.Error{RawError: fmt.Errorf("test error")}).Times(2)
+	for i := 0; i < 2; i++ {
+		_, err := d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "other", ResourceGroup: "rg"}, nil, "", "default", "", "")
+		assert.Error(t, err)
+	}
+}
 
-				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-				d.NodeID = ""
-				d.Run("tcp://127.0.0.1:0", "", true)
-			},
-		},
+func TestIsEphemeralVolume(t *testing.T) {
+	tests := []struct {
+		context  map[string]string
+		expected bool
+	}{
+		{context: nil, expected: false},
+		{context: map[string]string{}, expected: false},
+		{context: map[string]string{ephemeralField: "false"}, expected: false},
+		{context: map[string]string{ephemeralField: "true"}, expected: true},
+		{context: map[string]string{"CSI.storage.k8s.io/Ephemeral": "True"}, expected: true},
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.name, tc.testFunc)
+	for _, test := range tests {
+		result := isEphemeralVolume(test.context)
+		assert.Equal(t, test.expected, result, "context: %v", test.context)
 	}
 }
 
-func TestIsSupportedProtocol(t *testing.T) {
+func TestGetEphemeralVolumeMountOptions(t *testing.T) {
 	tests := []struct {
-		protocol       string
-		expectedResult bool
+		desc         string
+		mountFlags   []string
+		mountOptions string
+		expected     []string
 	}{
 		{
-			protocol:       "",
-			expectedResult: true,
+			desc:       "empty mountOptions",
+			mountFlags: []string{"vers=3.0"},
+			expected:   []string{"vers=3.0"},
 		},
 		{
-			protocol:       "smb",
-			expectedResult: true,
+			desc:         "mountOptions are appended",
+			mountFlags:   []string{"vers=3.0"},
+			mountOptions: "dir_mode=0755, file_mode=0755",
+			expected:     []string{"vers=3.0", "dir_mode=0755", "file_mode=0755"},
 		},
 		{
-			protocol:       "nfs",
-			expectedResult: true,
+			desc:         "empty entries are skipped",
+			mountOptions: ",cache=strict,,",
+			expected:     []string{"cache=strict"},
 		},
 		{
-			protocol:       "invalid",
-			expectedResult: false,
+			desc:         "duplicate mountOptions are removed",
+			mountFlags:   []string{"cache=strict"},
+			mountOptions: "cache=strict,actimeo=30",
+			expected:     []string{"cache=strict", "actimeo=30"},
 		},
 	}
 
 	for _, test := range tests {
-		result := isSupportedProtocol(test.protocol)
-		if result != test.expectedResult {
-			t.Errorf("isSupportedProtocol(%s) returned with %v, not equal to %v", test.protocol, result, test.expectedResult)
-		}
+		result := getEphemeralVolumeMountOptions(test.mountFlags, test.mountOptions)
+		assert.ElementsMatch(t, test.expected, result, test.desc)
 	}
 }
 
-func TestIsSupportedShareAccessTier(t *testing.T) {
+func TestEnsureEphemeralFileShare(t *testing.T) {
+	d := NewFakeDriver()
+	d.fileClient = &azureFileClient{env: &azure2.Environment{}}
+
 	tests := []struct {
-		accessTier     string
-		expectedResult bool
+		desc        string
+		context     map[string]string
+		expectedErr error
 	}{
 		{
-			accessTier:     "",
-			expectedResult: true,
+			desc:        "invalid retain",
+			context:     map[string]string{retainField: "invalid"},
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid retain: invalid in volume attributes"),
 		},
 		{
-			accessTier:     "TransactionOptimized",
-			expectedResult: true,
+			desc:    "nfs file share is not created",
+			context: map[string]string{protocolField: nfs, retainField: "false"},
 		},
 		{
-			accessTier:     "Hot",
-			expectedResult: true,
+			desc:    "disk volume is not created",
+			context: map[string]string{fsTypeField: ext4},
 		},
 		{
-			accessTier:     "Cool",
-			expectedResult: true,
+			desc:    "account info is not complete",
+			context: map[string]string{shareNameField: "share"},
 		},
+	}
+
+	for _, test := range tests {
+		share, err := d.ensureEphemeralFileShare(context.Background(), "vol_1", test.context)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Nil(t, share, test.desc)
+	}
+}
+
+func TestDeleteEphemeralFileShare(t *testing.T) {
+	d := NewFakeDriver()
+	d.fileClient = &azureFileClient{env: &azure2.Environment{}}
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	statePath := getEphemeralVolumeStatePath(targetPath)
+
+	// nothing to delete without state file
+	assert.NoError(t, d.deleteEphemeralFileShare(context.Background(), "vol_1", targetPath))
+
+	// state file is kept if account info could not be resolved, so that NodeUnpublishVolume could retry
+	assert.NoError(t, saveEphemeralVolumeState(targetPath, map[string]string{shareNameField: "share"}))
+	assert.Error(t, d.deleteEphemeralFileShare(context.Background(), "vol_1", targetPath))
+	_, err := os.Stat(statePath)
+	assert.NoError(t, err)
+
+	// invalid state file is removed
+	assert.NoError(t, os.WriteFile(statePath, []byte("invalid"), 0600))
+	assert.NoError(t, d.deleteEphemeralFileShare(context.Background(), "vol_1", targetPath))
+	_, err = os.Stat(statePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIsTransientMountError(t *testing.T) {
+	tests := []struct {
+		desc                 string
+		transientMountErrors string
+		err                  error
+		expected             bool
+	}{
 		{
-			accessTier:     "Premium",
-			expectedResult: true,
+			desc:     "nil error",
+			err:      nil,
+			expected: false,
 		},
 		{
-			accessTier:     "transactionOptimized",
-			expectedResult: false,
+			desc:     "EAGAIN is transient by default",
+			err:      fmt.Errorf("mount failed: exit status 32\nmount error(11): Resource temporarily unavailable"),
+			expected: true,
 		},
 		{
-			accessTier:     "premium",
-			expectedResult: false,
+			desc:     "EHOSTDOWN is transient by default",
+			err:      fmt.Errorf("mount failed: exit status 32\nmount error(112): Host is down"),
+			expected: true,
 		},
 		{
-			accessTier:     "unknown",
-			expectedResult: false,
+			desc:     "permission denied is permanent by default",
+			err:      fmt.Errorf("mount failed: exit status 32\nmount error(13): Permission denied"),
+			expected: false,
+		},
+		{
+			desc:                 "custom transient mount errors",
+			transientMountErrors: " mount error(115) , mount error(113)",
+			err:                  fmt.Errorf("mount error(113): No route to host"),
+			expected:             true,
+		},
+		{
+			desc:                 "default transient mount errors are replaced by custom ones",
+			transientMountErrors: "mount error(115)",
+			err:                  fmt.Errorf("mount error(112): Host is down"),
+			expected:             false,
+		},
+		{
+			desc:                 "mount error is matched case insensitively",
+			transientMountErrors: "HOST IS DOWN",
+			err:                  fmt.Errorf("mount error(112): Host is down"),
+			expected:             true,
 		},
 	}
 
 	for _, test := range tests {
-		result := isSupportedShareAccessTier(test.accessTier)
-		if result != test.expectedResult {
-			t.Errorf("isSupportedTier(%s) returned with %v, not equal to %v", test.accessTier, result, test.expectedResult)
+		d := NewFakeDriverCustomOptions(DriverOptions{TransientMountErrors: test.transientMountErrors})
+		assert.Equal(t, test.expected, d.isTransientMountError(test.err), test.desc)
+	}
+}
+
+func TestIsAllowedAccount(t *testing.T) {
+	tests := []struct {
+		allowedAccounts string
+		accountName     string
+		expected        bool
+	}{
+		{allowedAccounts: "", accountName: "account", expected: true},
+		{allowedAccounts: "account1,account2", accountName: "", expected: true},
+		{allowedAccounts: "account1,account2", accountName: "account2", expected: true},
+		{allowedAccounts: " Account1 , ,account2", accountName: "ACCOUNT1", expected: true},
+		{allowedAccounts: "account1,account2", accountName: "account3", expected: false},
+	}
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{AllowedAccounts: test.allowedAccounts})
+		if result := d.isAllowedAccount(test.accountName); result != test.expected {
+			t.Errorf("isAllowedAccount(%s) with allowed accounts(%s) returned %v, expected %v", test.accountName, test.allowedAccounts, result, test.expected)
 		}
 	}
 }
 
-func TestIsSupportedAccountAccessTier(t *testing.T) {
+func TestStrictVolumeIDParsing(t *testing.T) {
 	tests := []struct {
-		accessTier     string
-		expectedResult bool
+		volumeID      string
+		expectedValid bool
+	}{
+		{volumeID: "rg#account#share", expectedValid: true},
+		{volumeID: "rg#account#share#disk.vhd#uuid#namespace#subsID", expectedValid: true},
+		{volumeID: "#account#share##namespace", expectedValid: true},
+		{volumeID: "vol_1", expectedValid: false},
+		{volumeID: "rg#account", expectedValid: false},
+		{volumeID: "rg##share", expectedValid: false},
+		{volumeID: "rg#account#", expectedValid: false},
+	}
+
+	for _, strict := range []bool{true, false} {
+		d := NewFakeDriverCustomOptions(DriverOptions{StrictVolumeIDParsing: strict})
+		for _, test := range tests {
+			err := d.validateVolumeID(test.volumeID)
+			if !strict || test.expectedValid {
+				assert.NoError(t, err, "strict: %v, volumeID: %s", strict, test.volumeID)
+				continue
+			}
+			assert.Equal(t, codes.InvalidArgument, status.Code(err), "strict: %v, volumeID: %s", strict, test.volumeID)
+
+			_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: test.volumeID})
+			assert.Equal(t, codes.InvalidArgument, status.Code(err), "DeleteVolume with volumeID: %s", test.volumeID)
+		}
+
+		// malformed volume ID is only tolerated by GetAccountInfo in lenient mode
+		_, _, _, _, _, _, err := d.GetAccountInfo(context.Background(), "vol_1", nil, map[string]string{protocolField: nfs})
+		assert.Equal(t, strict, err != nil, "strict: %v, GetAccountInfo returned error: %v", strict, err)
+
+		if !strict {
+			// lenient mode keeps the CSI sanity behavior of deleting a malformed volume ID successfully
+			_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol_1"})
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestValidateVolumeID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := NewFakeDriverCustomOptions(DriverOptions{ValidateStaticVolumeID: true})
+	d.cloud.ResourceGroup = "defaultrg"
+	mockFileClient := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClient
+	mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", gomock.Any()).
+		Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: to.Int32Ptr(100)}}, nil).AnyTimes()
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), "defaultrg", "account", "share", gomock.Any()).
+		Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: to.Int32Ptr(100)}}, nil).AnyTimes()
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "typo", gomock.Any()).
+		Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "error", gomock.Any()).
+		Return(storage.FileShare{}, fmt.Errorf("server error")).AnyTimes()
+
+	tests := []struct {
+		volumeID      string
+		secrets       map[string]string
+		volumeContext map[string]string
+		expectedCode  codes.Code
+	}{
+		{volumeID: "rg#account#share", expectedCode: codes.OK},
+		{volumeID: "rg#account#share#disk.vhd#uuid#namespace#subsID", expectedCode: codes.OK},
+		{volumeID: "rg#account#share/subpath", expectedCode: codes.OK},
+		{volumeID: "rg#account#typo/subpath", expectedCode: codes.NotFound},
+		{volumeID: "#account#share##namespace", expectedCode: codes.OK},
+		{volumeID: "vol_1", expectedCode: codes.InvalidArgument},
+		{volumeID: "rg#account", expectedCode: codes.InvalidArgument},
+		{volumeID: "rg##share", expectedCode: codes.InvalidArgument},
+		{volumeID: "rg#account#", expectedCode: codes.InvalidArgument},
+		{volumeID: "rg#account#typo", expectedCode: codes.NotFound},
+		{volumeID: "rg#account#error", expectedCode: codes.Internal},
+		{volumeID: "unique-volume-handle", volumeContext: map[string]string{"resourceGroup": "rg", "storageAccount": "account", "shareName": "share"}, expectedCode: codes.OK},
+		{volumeID: "rg#account#typo", volumeContext: map[string]string{shareNameField: "share"}, expectedCode: codes.OK},
+		{volumeID: "rg#account#share", volumeContext: map[string]string{shareNameField: "typo"}, expectedCode: codes.NotFound},
+		{volumeID: "unique-volume-handle", volumeContext: map[string]string{shareNameField: "share"}, expectedCode: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		err := d.ValidateVolumeID(context.Background(), test.volumeID, test.secrets, test.volumeContext)
+		assert.Equal(t, test.expectedCode, status.Code(err), "volumeID: %s, error: %v", test.volumeID, err)
+	}
+
+	// nonexistent share is reported before mount
+	_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "rg#account#typo",
+		StagingTargetPath: "target",
+		VolumeCapability:  &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "rg#account#typo",
+		NodeId:           fakeNodeID,
+		VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestNodeOperationLimiter(t *testing.T) {
+	d := NewFakeDriverCustomOptions(DriverOptions{
+		MaxConcurrentDiskNodeOperations:  1,
+		MaxConcurrentShareNodeOperations: 3,
+	})
+	diskLimiter, shareLimiter := d.getNodeOperationLimiter(true), d.getNodeOperationLimiter(false)
+	assert.Equal(t, 1, cap(diskLimiter.slots))
+	assert.Equal(t, 3, cap(shareLimiter.slots))
+
+	tryAcquire := func(l *operationLimiter) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		return l.Acquire(ctx)
+	}
+
+	// a heavy disk operation does not block share operations
+	assert.NoError(t, tryAcquire(diskLimiter))
+	assert.Error(t, tryAcquire(diskLimiter))
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, tryAcquire(shareLimiter))
+	}
+	assert.Error(t, tryAcquire(shareLimiter))
+
+	// share operations in use do not block disk operations
+	diskLimiter.Release()
+	assert.NoError(t, tryAcquire(diskLimiter))
+
+	// no limit by default
+	d = NewFakeDriver()
+	assert.Nil(t, d.getNodeOperationLimiter(true))
+	assert.Nil(t, d.getNodeOperationLimiter(false))
+}
+
+func TestCheckFileShareCompatibility(t *testing.T) {
+	maxShareQuota := "200"
+	tests := []struct {
+		desc         string
+		properties   *storage.FileShareProperties
+		shareOptions *fileclient.ShareOptions
+		expectedErr  error
 	}{
 		{
-			accessTier:     "",
-			expectedResult: true,
+			desc:         "compatible smb share",
+			properties:   &storage.FileShareProperties{ShareQuota: to.Int32Ptr(100)},
+			shareOptions: &fileclient.ShareOptions{RequestGiB: 100, Protocol: storage.EnabledProtocolsSMB},
 		},
 		{
-			accessTier:     "TransactionOptimized",
-			expectedResult: false,
+			desc:         "larger existing share is compatible",
+			properties:   &storage.FileShareProperties{ShareQuota: to.Int32Ptr(200), EnabledProtocols: storage.EnabledProtocolsSMB},
+			shareOptions: &fileclient.ShareOptions{RequestGiB: 100},
 		},
 		{
-			accessTier:     "Hot",
-			expectedResult: true,
+			desc: "compatible nfs share",
+			properties: &storage.FileShareProperties{ShareQuota: to.Int32Ptr(100), EnabledProtocols: storage.EnabledProtocolsNFS,
+				AccessTier: storage.ShareAccessTierPremium, RootSquash: storage.RootSquashTypeNoRootSquash,
+				Metadata: map[string]*string{"MaxShareQuota": &maxShareQuota}},
+			shareOptions: &fileclient.ShareOptions{RequestGiB: 100, Protocol: storage.EnabledProtocolsNFS, AccessTier: "premium", RootSquash: "NoRootSquash",
+				Metadata: map[string]*string{maxShareQuotaKey: &maxShareQuota}},
 		},
 		{
-			accessTier:     "Cool",
-			expectedResult: true,
+			desc:         "smaller existing share",
+			properties:   &storage.FileShareProperties{ShareQuota: to.Int32Ptr(50)},
+			shareOptions: &fileclient.ShareOptions{RequestGiB: 100},
+			expectedErr:  fmt.Errorf("its capacity 50 is smaller than 100"),
 		},
 		{
-			accessTier:     "Premium",
-			expectedResult: true,
+			desc:         "protocol mismatch",
+			properties:   &storage.FileShareProperties{ShareQuota: to.Int32Ptr(100)},
+			shareOptions: &fileclient.ShareOptions{RequestGiB: 100, Protocol: storage.EnabledProtocolsNFS},
+			expectedErr:  fmt.Errorf("its protocol SMB is different from NFS"),
 		},
 		{
-			accessTier:     "transactionOptimized",
-			expectedResult: false,
+			desc:         "access tier mismatch",
+			properties:   &storage.FileShareProperties{ShareQuota: to.Int32Ptr(100), AccessTier: storage.ShareAccessTierHot},
+			shareOptions: &fileclient.ShareOptions{RequestGiB: 100, AccessTier: "Cool"},
+			expectedErr:  fmt.Errorf("its access tier Hot is different from Cool"),
 		},
 		{
-			accessTier:     "premium",
-			expectedResult: false,
+			desc:         "root squash mismatch",
+			properties:   &storage.FileShareProperties{ShareQuota: to.Int32Ptr(100), EnabledProtocols: storage.EnabledProtocolsNFS, RootSquash: storage.RootSquashTypeAllSquash},
+			shareOptions: &fileclient.ShareOptions{RequestGiB: 100, Protocol: storage.EnabledProtocolsNFS, RootSquash: "RootSquash"},
+			expectedErr:  fmt.Errorf("its root squash type AllSquash is different from RootSquash"),
 		},
 		{
-			accessTier:     "unknown",
-			expectedResult: false,
+			desc:         "max share quota mismatch",
+			properties:   &storage.FileShareProperties{ShareQuota: to.Int32Ptr(100)},
+			shareOptions: &fileclient.ShareOptions{RequestGiB: 100, Metadata: map[string]*string{maxShareQuotaKey: &maxShareQuota}},
+			expectedErr:  fmt.Errorf(`its maxsharequota "" is different from "200"`),
 		},
 	}
 
 	for _, test := range tests {
-		result := isSupportedAccountAccessTier(test.accessTier)
-		if result != test.expectedResult {
-			t.Errorf("isSupportedTier(%s) returned with %v, not equal to %v", test.accessTier, result, test.expectedResult)
+		err := checkFileShareCompatibility(test.properties, test.shareOptions)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
 		}
 	}
 }
 
-func TestIsSupportedRootSquashType(t *testing.T) {
+func TestTagAccountWithDriverVersion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := NewFakeDriver()
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	ctx := context.Background()
+
+	// tag is added and existing tags are kept
+	mockStorageAccountsClient.EXPECT().GetProperties(ctx, "subsID", "rg", "account1").Return(storage.Account{Tags: map[string]*string{"foo": to.StringPtr("bar")}}, nil).Times(1)
+	mockStorageAccountsClient.EXPECT().Update(ctx, "subsID", "rg", "account1", storage.AccountUpdateParameters{
+		Tags: map[string]*string{"foo": to.StringPtr("bar"), driverVersionTag: to.StringPtr(d.Version)},
+	}).Return(nil).Times(1)
+	assert.NoError(t, d.tagAccountWithDriverVersion(ctx, "subsID", "rg", "account1"))
+	// tag is not re-applied within the rate limit window
+	assert.NoError(t, d.tagAccountWithDriverVersion(ctx, "subsID", "rg", "account1"))
+
+	// account is already tagged with current driver version
+	mockStorageAccountsClient.EXPECT().GetProperties(ctx, "subsID", "rg", "account2").Return(storage.Account{Tags: map[string]*string{driverVersionTag: to.StringPtr(d.Version)}}, nil).Times(1)
+	assert.NoError(t, d.tagAccountWithDriverVersion(ctx, "subsID", "rg", "account2"))
+
+	// account tagged by an old driver version is updated
+	mockStorageAccountsClient.EXPECT().GetProperties(ctx, "subsID", "rg", "account3").Return(storage.Account{Tags: map[string]*string{driverVersionTag: to.StringPtr("v0.0.1")}}, nil).Times(1)
+	mockStorageAccountsClient.EXPECT().Update(ctx, "subsID", "rg", "account3", storage.AccountUpdateParameters{
+		Tags: map[string]*string{driverVersionTag: to.StringPtr(d.Version)},
+	}).Return(nil).Times(1)
+	assert.NoError(t, d.tagAccountWithDriverVersion(ctx, "subsID", "rg", "account3"))
+
+	// failure is also rate limited to avoid throttling
+	mockStorageAccountsClient.EXPECT().GetProperties(ctx, "subsID", "rg", "account4").Return(storage.Account{}, &retry.Error{RawError: fmt.Errorf("TooManyRequests")}).Times(1)
+	assert.Error(t, d.tagAccountWithDriverVersion(ctx, "subsID", "rg", "account4"))
+	assert.NoError(t, d.tagAccountWithDriverVersion(ctx, "subsID", "rg", "account4"))
+}
+
+func TestSkipAccountKeyForNFS(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	// no expectation on storage account client, any ListKeys call fails the test
+	d.cloud.StorageAccountClient = mockstorageaccountclient.NewMockInterface(ctrl)
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+
+	contexts := []map[string]string{
+		{protocolField: "nfs"},
+		{protocolField: "NFS", shareNameField: "share"},
+		{protocolField: "nfs", secretNameField: "secret", getLatestAccountKeyField: "true"},
+	}
+	for _, reqContext := range contexts {
+		rgName, accountName, accountKey, fileShareName, _, _, err := d.GetAccountInfo(context.Background(), "rg#account#share", nil, reqContext)
+		assert.NoError(t, err)
+		assert.Equal(t, "rg", rgName)
+		assert.Equal(t, "account", accountName)
+		assert.Equal(t, "share", fileShareName)
+		assert.Equal(t, "", accountKey)
+	}
+	assert.Empty(t, clientSet.Actions(), "secret should not be read for nfs volumes")
+
+	// account name is still resolved from secrets without account key
+	_, accountName, accountKey, _, _, _, err := d.GetAccountInfo(context.Background(), "rg#account#share", map[string]string{"accountname": "secretaccount"}, map[string]string{protocolField: "nfs"})
+	assert.NoError(t, err)
+	assert.Equal(t, "secretaccount", accountName)
+	assert.Equal(t, "", accountKey)
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: defaultNamespace},
+		Data:       map[string][]byte{defaultSecretAccountName: []byte("k8saccount")},
+	}
+	_, err = clientSet.CoreV1().Secrets(defaultNamespace).Create(context.Background(), secret, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	clientSet.ClearActions()
+	_, accountName, accountKey, fileShareName, _, _, err := d.GetAccountInfo(context.Background(), "rg##share", nil, map[string]string{protocolField: "nfs", secretNameField: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, "k8saccount", accountName)
+	assert.Equal(t, "share", fileShareName)
+	assert.Equal(t, "", accountKey)
+	clientSet.ClearActions()
+
+	volumeSource := &csi.VolumeContentSource_VolumeSource{VolumeId: "rg#account#share"}
+	req := &csi.CreateVolumeRequest{
+		Name: "nfs-clone",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+		Parameters:          map[string]string{protocolField: "nfs"},
+		VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: volumeSource}},
+	}
+	_, err = d.CreateVolume(context.Background(), req)
+	assert.Equal(t, status.Errorf(codes.InvalidArgument, "protocol nfs is not supported for volume cloning"), err)
+	assert.Empty(t, clientSet.Actions(), "secret should not be read for nfs volumes")
+}
+
+func TestCreateDisk(t *testing.T) {
+	skipIfTestingOnWindows(t)
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
 	tests := []struct {
-		rootSquashType string
-		expectedResult bool
+		accountName           string
+		accountKey            string
+		storageEndpointSuffix string
+		fileShareName         string
+		diskName              string
+		expectedError         error
 	}{
 		{
-			rootSquashType: "",
-			expectedResult: true,
+			accountName:           "f5713de20cde511e8ba4900",
+			accountKey:            "abc",
+			storageEndpointSuffix: "suffix",
+			fileShareName:         "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
+			diskName:              "diskname.vhd",
+			expectedError:         fmt.Errorf("NewSharedKeyCredential(f5713de20cde511e8ba4900) failed with error: illegal base64 data at input byte 0"),
 		},
 		{
-			rootSquashType: "AllSquash",
-			expectedResult: true,
+			accountName:           "f5713de20cde511e8ba4900",
+			accountKey:            base64.StdEncoding.EncodeToString([]byte("acc_key")),
+			storageEndpointSuffix: "suffix",
+			fileShareName:         "pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41",
+			diskName:              "diskname.vhd",
+			expectedError:         nil,
 		},
+	}
+
+	for _, test := range tests {
+		_ = createDisk(context.Background(), test.accountName, test.accountKey, test.storageEndpointSuffix,
+			test.fileShareName, test.diskName, 1024, d.dataPlaneRetryOptions)
+	}
+
+	// disk size should be larger than vhd footer
+	err := createDisk(context.Background(), "f5713de20cde511e8ba4900", base64.StdEncoding.EncodeToString([]byte("acc_key")), "suffix",
+		"pvc-file-dynamic-17e43f84-f474-11e8-acd0-000d3a00df41", "diskname.vhd", 512, d.dataPlaneRetryOptions)
+	assert.Equal(t, fmt.Errorf("disk size(512) should be larger than vhd header size(512)"), err)
+}
+
+// fakeDiskFile records the data written to it and returns the configured errors
+type fakeDiskFile struct {
+	data        []byte
+	createErr   error
+	resizeErr   error
+	uploadErr   error
+	downloadErr error
+	corrupt     bool
+	deleted     bool
+}
+
+func (f *fakeDiskFile) Create(_ context.Context, size int64) error {
+	if f.createErr != nil {
+		return f.createErr
+	}
+	f.data = make([]byte, size)
+	return nil
+}
+
+func (f *fakeDiskFile) GetSize(_ context.Context) (int64, error) {
+	return int64(len(f.data)), nil
+}
+
+func (f *fakeDiskFile) Resize(_ context.Context, size int64) error {
+	if f.resizeErr != nil {
+		return f.resizeErr
+	}
+	data := make([]byte, size)
+	copy(data, f.data)
+	f.data = data
+	return nil
+}
+
+func (f *fakeDiskFile) UploadRange(_ context.Context, offset int64, data []byte) error {
+	if f.uploadErr != nil {
+		return f.uploadErr
+	}
+	copy(f.data[offset:], data)
+	return nil
+}
+
+func (f *fakeDiskFile) DownloadRange(_ context.Context, offset, count int64) ([]byte, error) {
+	if f.downloadErr != nil {
+		return nil, f.downloadErr
+	}
+	footer := append([]byte{}, f.data[offset:offset+count]...)
+	if f.corrupt {
+		footer[len(footer)-1] ^= 0xff
+	}
+	return footer, nil
+}
+
+func (f *fakeDiskFile) Delete(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	f.deleted = true
+	return nil
+}
+
+func TestWriteVHDDisk(t *testing.T) {
+	diskSizeBytes := int64(10 * 1024 * 1024)
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		desc            string
+		ctx             context.Context
+		file            *fakeDiskFile
+		expectedErr     bool
+		expectedDeleted bool
+	}{
 		{
-			rootSquashType: "NoRootSquash",
-			expectedResult: true,
+			desc: "success",
+			ctx:  context.Background(),
+			file: &fakeDiskFile{},
 		},
 		{
-			rootSquashType: "RootSquash",
-			expectedResult: true,
+			desc:        "create failure leaves nothing to clean up",
+			ctx:         context.Background(),
+			file:        &fakeDiskFile{createErr: fmt.Errorf("create error")},
+			expectedErr: true,
 		},
 		{
-			rootSquashType: "unknown",
-			expectedResult: false,
+			desc:            "upload failure deletes partially created file",
+			ctx:             context.Background(),
+			file:            &fakeDiskFile{uploadErr: fmt.Errorf("upload error")},
+			expectedErr:     true,
+			expectedDeleted: true,
+		},
+		{
+			desc:            "upload failure with canceled context still deletes partially created file",
+			ctx:             canceledCtx,
+			file:            &fakeDiskFile{uploadErr: context.Canceled},
+			expectedErr:     true,
+			expectedDeleted: true,
+		},
+		{
+			desc:            "download failure deletes partially created file",
+			ctx:             context.Background(),
+			file:            &fakeDiskFile{downloadErr: fmt.Errorf("download error")},
+			expectedErr:     true,
+			expectedDeleted: true,
+		},
+		{
+			desc:            "corrupted footer deletes partially created file",
+			ctx:             context.Background(),
+			file:            &fakeDiskFile{corrupt: true},
+			expectedErr:     true,
+			expectedDeleted: true,
 		},
 	}
 
 	for _, test := range tests {
-		result := isSupportedRootSquashType(test.rootSquashType)
-		if result != test.expectedResult {
-			t.Errorf("isSupportedRootSquashType(%s) returned with %v, not equal to %v", test.rootSquashType, result, test.expectedResult)
+		err := writeVHDDisk(test.ctx, test.file, "diskname.vhd", diskSizeBytes)
+		assert.Equal(t, test.expectedErr, err != nil, test.desc)
+		assert.Equal(t, test.expectedDeleted, test.file.deleted, test.desc)
+	}
+}
+
+func TestResizeVHDDisk(t *testing.T) {
+	oldSizeBytes := int64(10 * 1024 * 1024)
+	newSizeBytes := int64(20 * 1024 * 1024)
+	newDisk := func(file *fakeDiskFile) *fakeDiskFile {
+		if err := writeVHDDisk(context.Background(), file, "diskname.vhd", oldSizeBytes); err != nil {
+			t.Fatalf("failed to create vhd disk: %v", err)
 		}
+		// filesystem data at the beginning of disk
+		copy(file.data, "data")
+		return file
 	}
+
+	t.Run("disk is grown and footer is moved to the end", func(t *testing.T) {
+		file := newDisk(&fakeDiskFile{})
+		resized, err := resizeVHDDisk(context.Background(), file, "diskname.vhd", newSizeBytes)
+		assert.NoError(t, err)
+		assert.True(t, resized)
+		assert.Equal(t, newSizeBytes, int64(len(file.data)))
+		assert.Equal(t, "data", string(file.data[:4]))
+		assert.NoError(t, verifyVHDFooter(file.data[newSizeBytes-vhd.VHD_HEADER_SIZE:], newSizeBytes))
+
+		// retry after success is a no-op
+		resized, err = resizeVHDDisk(context.Background(), file, "diskname.vhd", newSizeBytes)
+		assert.NoError(t, err)
+		assert.False(t, resized)
+	})
+
+	t.Run("shrinking disk is skipped", func(t *testing.T) {
+		file := newDisk(&fakeDiskFile{})
+		resized, err := resizeVHDDisk(context.Background(), file, "diskname.vhd", oldSizeBytes/2)
+		assert.NoError(t, err)
+		assert.False(t, resized)
+		assert.Equal(t, oldSizeBytes, int64(len(file.data)))
+	})
+
+	t.Run("resize failure", func(t *testing.T) {
+		file := newDisk(&fakeDiskFile{})
+		file.resizeErr = fmt.Errorf("resize error")
+		_, err := resizeVHDDisk(context.Background(), file, "diskname.vhd", newSizeBytes)
+		assert.ErrorContains(t, err, "resize error")
+		assert.Equal(t, oldSizeBytes, int64(len(file.data)))
+	})
+
+	t.Run("retry after footer upload failure", func(t *testing.T) {
+		file := newDisk(&fakeDiskFile{})
+		file.uploadErr = fmt.Errorf("upload error")
+		_, err := resizeVHDDisk(context.Background(), file, "diskname.vhd", newSizeBytes)
+		assert.ErrorContains(t, err, "upload error")
+		assert.Equal(t, newSizeBytes, int64(len(file.data)))
+
+		file.uploadErr = nil
+		resized, err := resizeVHDDisk(context.Background(), file, "diskname.vhd", newSizeBytes)
+		assert.NoError(t, err)
+		assert.True(t, resized)
+		assert.NoError(t, verifyVHDFooter(file.data[newSizeBytes-vhd.VHD_HEADER_SIZE:], newSizeBytes))
+	})
 }
 
-func TestGetSubnetResourceID(t *testing.T) {
-	testCases := []struct {
-		name     string
-		testFunc func(t *testing.T)
+func TestVerifyVHDFooter(t *testing.T) {
+	diskSizeBytes := int64(10 * 1024 * 1024)
+	newFooter := func() []byte {
+		buf := new(bytes.Buffer)
+		if err := binary.Write(buf, binary.BigEndian, vhd.CreateFixedHeader(uint64(diskSizeBytes), &vhd.VHDOptions{})); err != nil {
+			t.Fatalf("failed to write vhd footer: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		desc        string
+		footer      func() []byte
+		diskSize    int64
+		expectedErr bool
 	}{
 		{
-			name: "NetworkResourceSubscriptionID is Empty",
-			testFunc: func(t *testing.T) {
-				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-				d.cloud.SubscriptionID = "fakeSubID"
-				d.cloud.NetworkResourceSubscriptionID = ""
-				d.cloud.ResourceGroup = "foo"
-				d.cloud.VnetResourceGroup = "foo"
-				actualOutput := d.getSubnetResourceID("", "", "")
-				expectedOutput := fmt.Sprintf(subnetTemplate, d.cloud.SubscriptionID, "foo", d.cloud.VnetName, d.cloud.SubnetName)
-				assert.Equal(t, actualOutput, expectedOutput, "cloud.SubscriptionID should be used as the SubID")
-			},
+			desc:     "valid footer",
+			footer:   newFooter,
+			diskSize: diskSizeBytes,
 		},
 		{
-			name: "NetworkResourceSubscriptionID is not Empty",
-			testFunc: func(t *testing.T) {
-				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-				d.cloud.SubscriptionID = "fakeSubID"
-				d.cloud.NetworkResourceSubscriptionID = "fakeNetSubID"
-				d.cloud.ResourceGroup = "foo"
-				d.cloud.VnetResourceGroup = "foo"
-				actualOutput := d.getSubnetResourceID("", "", "")
-				expectedOutput := fmt.Sprintf(subnetTemplate, d.cloud.NetworkResourceSubscriptionID, "foo", d.cloud.VnetName, d.cloud.SubnetName)
-				assert.Equal(t, actualOutput, expectedOutput, "cloud.NetworkResourceSubscriptionID should be used as the SubID")
+			desc:        "zero-length footer",
+			footer:      func() []byte { return []byte{} },
+			diskSize:    diskSizeBytes,
+			expectedErr: true,
+		},
+		{
+			desc: "invalid cookie",
+			footer: func() []byte {
+				footer := newFooter()
+				copy(footer, "invalid!")
+				return footer
 			},
+			diskSize:    diskSizeBytes,
+			expectedErr: true,
 		},
 		{
-			name: "VnetResourceGroup is Empty",
-			testFunc: func(t *testing.T) {
-				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-				d.cloud.SubscriptionID = "bar"
-				d.cloud.NetworkResourceSubscriptionID = "bar"
-				d.cloud.ResourceGroup = "fakeResourceGroup"
-				d.cloud.VnetResourceGroup = ""
-				actualOutput := d.getSubnetResourceID("", "", "")
-				expectedOutput := fmt.Sprintf(subnetTemplate, "bar", d.cloud.ResourceGroup, d.cloud.VnetName, d.cloud.SubnetName)
-				assert.Equal(t, actualOutput, expectedOutput, "cloud.Resourcegroup should be used as the rg")
+			desc: "corrupted footer",
+			footer: func() []byte {
+				footer := newFooter()
+				footer[vhd.VHD_HEADER_SIZE-1] ^= 0xff
+				return footer
 			},
+			diskSize:    diskSizeBytes,
+			expectedErr: true,
 		},
 		{
-			name: "VnetResourceGroup is not Empty",
-			testFunc: func(t *testing.T) {
-				d := NewFakeDriver()
+			desc:        "disk size mismatch",
+			footer:      newFooter,
+			diskSize:    diskSizeBytes * 2,
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		err := verifyVHDFooter(test.footer(), test.diskSize)
+		assert.Equal(t, test.expectedErr, err != nil, "%s: %v", test.desc, err)
+	}
+}
+
+func TestGetFileShareQuota(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	d.fileClient = &azureFileClient{env: &azure2.Environment{}}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	shareQuota := int32(10)
+	resourceGroupName := "rg"
+	accountName := "accountname"
+	fileShareName := "filesharename"
+
+	tests := []struct {
+		desc                string
+		secrets             map[string]string
+		mockedFileShareResp storage.FileShare
+		mockedFileShareErr  error
+		expectedQuota       int
+		expectedError       error
+	}{
+		{
+			desc:                "Get file share return error",
+			secrets:             map[string]string{},
+			mockedFileShareResp: storage.FileShare{},
+			mockedFileShareErr:  fmt.Errorf("test error"),
+			expectedQuota:       -1,
+			expectedError:       fmt.Errorf("test error"),
+		},
+		{
+			desc:                "Share not found",
+			secrets:             map[string]string{},
+			mockedFileShareResp: storage.FileShare{},
+			mockedFileShareErr:  fmt.Errorf("ShareNotFound"),
+			expectedQuota:       -1,
+			expectedError:       nil,
+		},
+		{
+			desc:                "Volume already exists",
+			secrets:             map[string]string{},
+			mockedFileShareResp: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}},
+			mockedFileShareErr:  nil,
+			expectedQuota:       int(shareQuota),
+			expectedError:       nil,
+		},
+		{
+			desc: "Could not find accountname in secrets",
+			secrets: map[string]string{
+				"secrets": "secrets",
+			},
+			mockedFileShareResp: storage.FileShare{},
+			mockedFileShareErr:  nil,
+			expectedQuota:       -1,
+			expectedError:       fmt.Errorf("could not find accountname or azurestorageaccountname field in secrets"),
+		},
+		{
+			desc: "Error creating azure client",
+			secrets: map[string]string{
+				"accountname": "ut",
+				"accountkey":  "testkey",
+			},
+			mockedFileShareResp: storage.FileShare{},
+			mockedFileShareErr:  nil,
+			expectedQuota:       -1,
+			expectedError:       fmt.Errorf("error creating azure client: azure: account name is not valid: it must be between 3 and 24 characters, and only may contain numbers and lowercase letters: ut"),
+		},
+	}
+
+	for _, test := range tests {
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().GetFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(test.mockedFileShareResp, test.mockedFileShareErr).AnyTimes()
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		quota, err := d.getFileShareQuota(context.TODO(), "", resourceGroupName, accountName, fileShareName, test.secrets)
+		if !reflect.DeepEqual(err, test.expectedError) {
+			t.Errorf("test name: %s, Unexpected error: %v, expected error: %v", test.desc, err, test.expectedError)
+		}
+		if quota != test.expectedQuota {
+			t.Errorf("Unexpected return quota: %d, expected: %d", quota, test.expectedQuota)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	fakeCredFile := "fake-cred-file.json"
+	fakeCredContent := `{
+    "tenantId": "1234",
+    "subscriptionId": "12345",
+    "aadClientId": "123456",
+    "aadClientSecret": "1234567",
+    "resourceGroup": "rg1",
+    "location": "loc"
+}`
+
+	testCases := []struct {
+		name     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			name: "Successful run",
+			testFunc: func(t *testing.T) {
+				if err := os.WriteFile(fakeCredFile, []byte(fakeCredContent), 0666); err != nil {
+					t.Error(err)
+				}
+
+				defer func() {
+					if err := os.Remove(fakeCredFile); err != nil {
+						t.Error(err)
+					}
+				}()
+
+				originalCredFile, ok := os.LookupEnv(DefaultAzureCredentialFileEnv)
+				if ok {
+					defer os.Setenv(DefaultAzureCredentialFileEnv, originalCredFile)
+				} else {
+					defer os.Unsetenv(DefaultAzureCredentialFileEnv)
+				}
+				os.Setenv(DefaultAzureCredentialFileEnv, fakeCredFile)
+
+				d := NewFakeDriver()
+				d.Run("tcp://127.0.0.1:0", "", true)
+			},
+		},
+		{
+			name: "Successful run with node ID missing",
+			testFunc: func(t *testing.T) {
+				if err := os.WriteFile(fakeCredFile, []byte(fakeCredContent), 0666); err != nil {
+					t.Error(err)
+				}
+
+				defer func() {
+					if err := os.Remove(fakeCredFile); err != nil {
+						t.Error(err)
+					}
+				}()
+
+				originalCredFile, ok := os.LookupEnv(DefaultAzureCredentialFileEnv)
+				if ok {
+					defer os.Setenv(DefaultAzureCredentialFileEnv, originalCredFile)
+				} else {
+					defer os.Unsetenv(DefaultAzureCredentialFileEnv)
+				}
+				os.Setenv(DefaultAzureCredentialFileEnv, fakeCredFile)
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.NodeID = ""
+				d.Run("tcp://127.0.0.1:0", "", true)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, tc.testFunc)
+	}
+}
+
+func TestIsSupportedProtocol(t *testing.T) {
+	tests := []struct {
+		protocol       string
+		expectedResult bool
+	}{
+		{
+			protocol:       "",
+			expectedResult: true,
+		},
+		{
+			protocol:       "smb",
+			expectedResult: true,
+		},
+		{
+			protocol:       "nfs",
+			expectedResult: true,
+		},
+		{
+			protocol:       "invalid",
+			expectedResult: false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isSupportedProtocol(test.protocol)
+		if result != test.expectedResult {
+			t.Errorf("isSupportedProtocol(%s) returned with %v, not equal to %v", test.protocol, result, test.expectedResult)
+		}
+	}
+}
+
+func TestValidateProtocolFsType(t *testing.T) {
+	tests := []struct {
+		protocol      string
+		fsType        string
+		diskName      string
+		expectedValid bool
+	}{
+		{protocol: "", fsType: "", expectedValid: true},
+		{protocol: smb, fsType: "", expectedValid: true},
+		{protocol: smb, fsType: cifs, expectedValid: true},
+		{protocol: smb, fsType: smb, expectedValid: true},
+		{protocol: "", fsType: nfs, expectedValid: true},
+		{protocol: nfs, fsType: "", expectedValid: true},
+		{protocol: nfs, fsType: nfs, expectedValid: true},
+		{protocol: "", fsType: ext4, expectedValid: true},
+		{protocol: smb, fsType: xfs, expectedValid: true},
+		{protocol: smb, fsType: ext3, diskName: "disk.vhd", expectedValid: true},
+		{protocol: nfs, fsType: ext4, diskName: "disk.vhd", expectedValid: true},
+		{protocol: "", fsType: "", diskName: "disk.vhd", expectedValid: true},
+		{protocol: nfs, fsType: ext4, expectedValid: false},
+		{protocol: nfs, fsType: xfs, expectedValid: false},
+		{protocol: nfs, fsType: cifs, expectedValid: false},
+		{protocol: nfs, fsType: smb, expectedValid: false},
+		{protocol: smb, fsType: nfs, expectedValid: false},
+		{protocol: smb, fsType: ext2, diskName: "disk", expectedValid: false},
+		{protocol: nfs, fsType: ext4, diskName: "disk.img", expectedValid: false},
+		{protocol: smb, fsType: cifs, diskName: "disk.vhd", expectedValid: false},
+		{protocol: "", fsType: nfs, diskName: "disk.vhd", expectedValid: false},
+	}
+
+	for _, test := range tests {
+		err := validateProtocolFsType(test.protocol, test.fsType, test.diskName)
+		if (err == nil) != test.expectedValid {
+			t.Errorf("validateProtocolFsType(%s, %s, %s) returned with %v, expected valid: %v", test.protocol, test.fsType, test.diskName, err, test.expectedValid)
+		}
+	}
+}
+
+func TestValidateSMBVers(t *testing.T) {
+	tests := []struct {
+		mountOptions  []string
+		expectedValid bool
+	}{
+		{mountOptions: nil, expectedValid: true},
+		{mountOptions: []string{"dir_mode=0777", "versioning=1.0"}, expectedValid: true},
+		{mountOptions: []string{"vers=2.0"}, expectedValid: true},
+		{mountOptions: []string{"vers=2.1"}, expectedValid: true},
+		{mountOptions: []string{"vers=3.0"}, expectedValid: true},
+		{mountOptions: []string{"dir_mode=0777,vers=3.1.1,actimeo=30"}, expectedValid: true},
+		{mountOptions: []string{"vers=3"}, expectedValid: true},
+		{mountOptions: []string{"vers=3.02"}, expectedValid: true},
+		{mountOptions: []string{"vers=3.0.2"}, expectedValid: true},
+		{mountOptions: []string{"vers=3.11"}, expectedValid: true},
+		{mountOptions: []string{"vers=default"}, expectedValid: true},
+		{mountOptions: []string{"vers=1.0"}, expectedValid: false},
+		{mountOptions: []string{"vers=3.2"}, expectedValid: false},
+		{mountOptions: []string{"vers"}, expectedValid: false},
+		{mountOptions: []string{"vers=3.0", "file_mode=0777,vers=1.0"}, expectedValid: false},
+	}
+
+	for _, test := range tests {
+		err := validateSMBVers(test.mountOptions)
+		if (err == nil) != test.expectedValid {
+			t.Errorf("validateSMBVers(%v) returned with %v, expected valid: %v", test.mountOptions, err, test.expectedValid)
+		}
+	}
+}
+
+func TestUseProxyMount(t *testing.T) {
+	tests := []struct {
+		desc             string
+		enableProxyMount bool
+		proxyMountValue  string
+		fsType           string
+		expected         bool
+		expectedErr      error
+	}{
+		{desc: "direct mount by default", fsType: cifs},
+		{desc: "proxy mount by driver default", enableProxyMount: true, fsType: nfs, expected: true},
+		{desc: "proxy mount by volume", proxyMountValue: "True", fsType: cifs, expected: true},
+		{desc: "volume overrides driver default", enableProxyMount: true, proxyMountValue: "false", fsType: cifs},
+		{desc: "vhd disk always uses proxy mount", fsType: ext4, expected: true},
+		{desc: "vhd disk with proxy mount", proxyMountValue: "true", fsType: xfs, expected: true},
+		{desc: "vhd disk with direct mount", enableProxyMount: true, proxyMountValue: "false", fsType: ext4, expectedErr: fmt.Errorf("proxymount could not be false with vhd disk volume(fsType: ext4)")},
+		{desc: "invalid value", proxyMountValue: "yes", fsType: cifs, expectedErr: fmt.Errorf("invalid proxymount: yes, should be true or false")},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.enableProxyMount = test.enableProxyMount
+		result, err := d.useProxyMount(test.proxyMountValue, test.fsType)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expected, result, test.desc)
+	}
+}
+
+func TestParseDiskMountOptions(t *testing.T) {
+	tests := []struct {
+		diskMountOptions string
+		fsType           string
+		expected         []string
+		expectedErr      bool
+	}{
+		{diskMountOptions: "", fsType: ext4, expected: []string{"noatime"}},
+		{diskMountOptions: " , ", fsType: xfs, expected: []string{"noatime"}},
+		{diskMountOptions: "noatime,nodiratime", fsType: ext4, expected: []string{"noatime", "nodiratime"}},
+		{diskMountOptions: "relatime, lazytime,discard", fsType: xfs, expected: []string{"relatime", "lazytime", "discard"}},
+		{diskMountOptions: "noatime,commit=60", fsType: ext4, expected: []string{"noatime", "commit=60"}},
+		{diskMountOptions: "commit=60", fsType: ext3, expected: []string{"commit=60"}},
+		{diskMountOptions: "commit=60", fsType: xfs, expectedErr: true},
+		{diskMountOptions: "commit=-1", fsType: ext4, expectedErr: true},
+		{diskMountOptions: "commit=", fsType: ext4, expectedErr: true},
+		{diskMountOptions: "noatime,nobarrier", fsType: ext4, expectedErr: true},
+		{diskMountOptions: "errors=continue", fsType: ext4, expectedErr: true},
+		{diskMountOptions: "data=writeback", fsType: ext4, expectedErr: true},
+		{diskMountOptions: "suid,dev", fsType: ext4, expectedErr: true},
+	}
+
+	for _, test := range tests {
+		result, err := parseDiskMountOptions(test.diskMountOptions, test.fsType)
+		if test.expectedErr {
+			assert.Error(t, err, test.diskMountOptions)
+			continue
+		}
+		assert.NoError(t, err, test.diskMountOptions)
+		assert.Equal(t, test.expected, result, test.diskMountOptions)
+	}
+}
+
+func TestNewDriverDefaultVers(t *testing.T) {
+	tests := []struct {
+		defaultVers  string
+		expectedVers string
+	}{
+		{defaultVers: "", expectedVers: ""},
+		{defaultVers: "3.0", expectedVers: "3.0"},
+		{defaultVers: "3.1.1", expectedVers: "3.1.1"},
+		{defaultVers: "1.0", expectedVers: ""},
+	}
+
+	for _, test := range tests {
+		d := NewDriver(&DriverOptions{NodeID: fakeNodeID, DriverName: DefaultDriverName, DefaultVers: test.defaultVers})
+		assert.Equal(t, test.expectedVers, d.defaultMountOptions[vers], test.defaultVers)
+	}
+}
+
+func TestNormalizeSkuName(t *testing.T) {
+	tests := []struct {
+		sku      string
+		expected string
+	}{
+		{sku: "", expected: ""},
+		{sku: "standard_lrs", expected: "Standard_LRS"},
+		{sku: "PREMIUM_ZRS", expected: "Premium_ZRS"},
+		{sku: "Standard_RAGZRS", expected: "Standard_RAGZRS"},
+		{sku: "premium", expected: "premium"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, normalizeSkuName(test.sku), test.sku)
+	}
+}
+
+func TestIsSupportedShareAccessTier(t *testing.T) {
+	tests := []struct {
+		accessTier     string
+		expectedResult bool
+	}{
+		{
+			accessTier:     "",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "TransactionOptimized",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "Hot",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "Cool",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "Premium",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "transactionOptimized",
+			expectedResult: false,
+		},
+		{
+			accessTier:     "premium",
+			expectedResult: false,
+		},
+		{
+			accessTier:     "unknown",
+			expectedResult: false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isSupportedShareAccessTier(test.accessTier)
+		if result != test.expectedResult {
+			t.Errorf("isSupportedTier(%s) returned with %v, not equal to %v", test.accessTier, result, test.expectedResult)
+		}
+	}
+}
+
+func TestIsSupportedAccountAccessTier(t *testing.T) {
+	tests := []struct {
+		accessTier     string
+		expectedResult bool
+	}{
+		{
+			accessTier:     "",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "TransactionOptimized",
+			expectedResult: false,
+		},
+		{
+			accessTier:     "Hot",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "Cool",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "Premium",
+			expectedResult: true,
+		},
+		{
+			accessTier:     "transactionOptimized",
+			expectedResult: false,
+		},
+		{
+			accessTier:     "premium",
+			expectedResult: false,
+		},
+		{
+			accessTier:     "unknown",
+			expectedResult: false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isSupportedAccountAccessTier(test.accessTier)
+		if result != test.expectedResult {
+			t.Errorf("isSupportedTier(%s) returned with %v, not equal to %v", test.accessTier, result, test.expectedResult)
+		}
+	}
+}
+
+func TestIsSupportedRootSquashType(t *testing.T) {
+	tests := []struct {
+		rootSquashType string
+		expectedResult bool
+	}{
+		{
+			rootSquashType: "",
+			expectedResult: true,
+		},
+		{
+			rootSquashType: "AllSquash",
+			expectedResult: true,
+		},
+		{
+			rootSquashType: "NoRootSquash",
+			expectedResult: true,
+		},
+		{
+			rootSquashType: "RootSquash",
+			expectedResult: true,
+		},
+		{
+			rootSquashType: "unknown",
+			expectedResult: false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isSupportedRootSquashType(test.rootSquashType)
+		if result != test.expectedResult {
+			t.Errorf("isSupportedRootSquashType(%s) returned with %v, not equal to %v", test.rootSquashType, result, test.expectedResult)
+		}
+	}
+}
+
+func TestGetSubnetResourceID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		testFunc func(t *testing.T)
+	}{
+		{
+			name: "NetworkResourceSubscriptionID is Empty",
+			testFunc: func(t *testing.T) {
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.SubscriptionID = "fakeSubID"
+				d.cloud.NetworkResourceSubscriptionID = ""
+				d.cloud.ResourceGroup = "foo"
+				d.cloud.VnetResourceGroup = "foo"
+				actualOutput := d.getSubnetResourceID("", "", "")
+				expectedOutput := fmt.Sprintf(subnetTemplate, d.cloud.SubscriptionID, "foo", d.cloud.VnetName, d.cloud.SubnetName)
+				assert.Equal(t, actualOutput, expectedOutput, "cloud.SubscriptionID should be used as the SubID")
+			},
+		},
+		{
+			name: "NetworkResourceSubscriptionID is not Empty",
+			testFunc: func(t *testing.T) {
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.SubscriptionID = "fakeSubID"
+				d.cloud.NetworkResourceSubscriptionID = "fakeNetSubID"
+				d.cloud.ResourceGroup = "foo"
+				d.cloud.VnetResourceGroup = "foo"
+				actualOutput := d.getSubnetResourceID("", "", "")
+				expectedOutput := fmt.Sprintf(subnetTemplate, d.cloud.NetworkResourceSubscriptionID, "foo", d.cloud.VnetName, d.cloud.SubnetName)
+				assert.Equal(t, actualOutput, expectedOutput, "cloud.NetworkResourceSubscriptionID should be used as the SubID")
+			},
+		},
+		{
+			name: "VnetResourceGroup is Empty",
+			testFunc: func(t *testing.T) {
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.SubscriptionID = "bar"
+				d.cloud.NetworkResourceSubscriptionID = "bar"
+				d.cloud.ResourceGroup = "fakeResourceGroup"
+				d.cloud.VnetResourceGroup = ""
+				actualOutput := d.getSubnetResourceID("", "", "")
+				expectedOutput := fmt.Sprintf(subnetTemplate, "bar", d.cloud.ResourceGroup, d.cloud.VnetName, d.cloud.SubnetName)
+				assert.Equal(t, actualOutput, expectedOutput, "cloud.Resourcegroup should be used as the rg")
+			},
+		},
+		{
+			name: "VnetResourceGroup is not Empty",
+			testFunc: func(t *testing.T) {
+				d := NewFakeDriver()
 				d.cloud = &azure.Cloud{}
 				d.cloud.SubscriptionID = "bar"
 				d.cloud.NetworkResourceSubscriptionID = "bar"
@@ -1267,86 +2925,1077 @@ func TestGetSubnetResourceID(t *testing.T) {
 			},
 		},
 		{
-			name: "VnetResourceGroup, vnetName, subnetName is specified",
-			testFunc: func(t *testing.T) {
-				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-				d.cloud.SubscriptionID = "bar"
-				d.cloud.NetworkResourceSubscriptionID = "bar"
-				d.cloud.ResourceGroup = "fakeResourceGroup"
-				d.cloud.VnetResourceGroup = "fakeVnetResourceGroup"
-				actualOutput := d.getSubnetResourceID("vnetrg", "vnetName", "subnetName")
-				expectedOutput := fmt.Sprintf(subnetTemplate, "bar", "vnetrg", "vnetName", "subnetName")
-				assert.Equal(t, actualOutput, expectedOutput, "VnetResourceGroup, vnetName, subnetName is specified")
+			name: "VnetResourceGroup, vnetName, subnetName is specified",
+			testFunc: func(t *testing.T) {
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.SubscriptionID = "bar"
+				d.cloud.NetworkResourceSubscriptionID = "bar"
+				d.cloud.ResourceGroup = "fakeResourceGroup"
+				d.cloud.VnetResourceGroup = "fakeVnetResourceGroup"
+				actualOutput := d.getSubnetResourceID("vnetrg", "vnetName", "subnetName")
+				expectedOutput := fmt.Sprintf(subnetTemplate, "bar", "vnetrg", "vnetName", "subnetName")
+				assert.Equal(t, actualOutput, expectedOutput, "VnetResourceGroup, vnetName, subnetName is specified")
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, tc.testFunc)
+	}
+}
+
+func TestGetTotalAccountQuota(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fileShareItemsWithQuota := []storage.FileShareItem{
+		{
+			FileShareProperties: &storage.FileShareProperties{
+				ShareQuota: to.Int32Ptr(100),
+			},
+		},
+		{
+			FileShareProperties: &storage.FileShareProperties{
+				ShareQuota: to.Int32Ptr(200),
+			},
+		},
+	}
+
+	tests := []struct {
+		name             string
+		subsID           string
+		resourceGroup    string
+		accountName      string
+		fileShareItems   []storage.FileShareItem
+		listFileShareErr error
+		expectedQuota    int32
+		expectedShareNum int32
+		expectedErr      error
+	}{
+		{
+			name:             "GetTotalAccountQuota success",
+			expectedQuota:    0,
+			expectedShareNum: 0,
+		},
+		{
+			name:             "GetTotalAccountQuota success (with 2 file shares)",
+			fileShareItems:   fileShareItemsWithQuota,
+			expectedQuota:    300,
+			expectedShareNum: 2,
+		},
+		{
+			name:             "list file share error",
+			listFileShareErr: fmt.Errorf("list file share error"),
+			expectedQuota:    -1,
+			expectedShareNum: -1,
+			expectedErr:      fmt.Errorf("list file share error"),
+		},
+	}
+
+	for _, test := range tests {
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().ListFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(test.fileShareItems, test.listFileShareErr).AnyTimes()
+
+		quota, fileShareNum, err := d.GetTotalAccountQuota(context.TODO(), test.subsID, test.resourceGroup, test.accountName)
+		assert.Equal(t, test.expectedErr, err, test.name)
+		assert.Equal(t, test.expectedQuota, quota, test.name)
+		assert.Equal(t, test.expectedShareNum, fileShareNum, test.name)
+	}
+}
+
+func TestParseSecretAccountKeyNames(t *testing.T) {
+	tests := []struct {
+		names    string
+		expected []string
+	}{
+		{names: "", expected: []string{defaultSecretAccountKey}},
+		{names: " , ", expected: []string{defaultSecretAccountKey}},
+		{names: "accountkey", expected: []string{"accountkey"}},
+		{names: "accountkey, azurestorageaccountkey,", expected: []string{"accountkey", "azurestorageaccountkey"}},
+	}
+
+	for _, test := range tests {
+		result := parseSecretAccountKeyNames(test.names)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("input: %q, parseSecretAccountKeyNames result: %q, expected: %q", test.names, result, test.expected)
+		}
+	}
+}
+
+func TestParseAccountKeySources(t *testing.T) {
+	tests := []struct {
+		sources  string
+		expected []string
+	}{
+		{sources: "", expected: defaultAccountKeySources},
+		{sources: "unknown, ", expected: defaultAccountKeySources},
+		{sources: "clusteridentity", expected: []string{accountKeySourceClusterIdentity}},
+		{sources: "WorkloadIdentity, secret,unknown", expected: []string{accountKeySourceWorkloadIdentity, accountKeySourceSecret}},
+	}
+
+	for _, test := range tests {
+		result := parseAccountKeySources(test.sources)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("input: %q, parseAccountKeySources result: %q, expected: %q", test.sources, result, test.expected)
+		}
+	}
+}
+
+type fakeWorkloadIdentityClient struct {
+	// account keys <accountName, key>
+	keys                map[string]string
+	calls               int
+	getLatestAccountKey bool
+}
+
+func (c *fakeWorkloadIdentityClient) GetStorageAccountKey(_ context.Context, _, _, accountName string, getLatestAccountKey bool) (string, error) {
+	c.calls++
+	c.getLatestAccountKey = getLatestAccountKey
+	if key, ok := c.keys[accountName]; ok {
+		return key, nil
+	}
+	return "", fmt.Errorf("AuthorizationFailed")
+}
+
+func TestGetStorageAccesskeyFromSources(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	clusterKey := "clusterkey"
+	tests := []struct {
+		desc               string
+		sources            string
+		secretKey          string
+		workloadKey        string
+		clusterIdentityErr bool
+		expectedKey        string
+		expectedErr        string
+	}{
+		{
+			desc:        "k8s secret takes precedence by default",
+			secretKey:   "secretkey",
+			workloadKey: "workloadkey",
+			expectedKey: "secretkey",
+		},
+		{
+			desc:        "workload identity is used if secret does not exist",
+			workloadKey: "workloadkey",
+			expectedKey: "workloadkey",
+		},
+		{
+			desc:        "cluster identity is used if secret and workload identity both fail",
+			expectedKey: clusterKey,
+		},
+		{
+			desc:        "workload identity is preferred over secret if configured",
+			sources:     "workloadidentity,secret,clusteridentity",
+			secretKey:   "secretkey",
+			workloadKey: "workloadkey",
+			expectedKey: "workloadkey",
+		},
+		{
+			desc:        "cluster identity is preferred over secret if configured",
+			sources:     "clusteridentity,secret",
+			secretKey:   "secretkey",
+			expectedKey: clusterKey,
+		},
+		{
+			desc:               "cluster identity is not used if it's not configured",
+			sources:            "secret,workloadidentity",
+			clusterIdentityErr: true,
+			expectedErr:        "AuthorizationFailed",
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{AccountKeySources: test.sources})
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		if test.secretKey != "" {
+			secret := &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf(secretNameTemplate, "account"), Namespace: defaultNamespace},
+				Data:       map[string][]byte{defaultSecretAccountKey: []byte(test.secretKey)},
+			}
+			_, err := d.cloud.KubeClient.CoreV1().Secrets(defaultNamespace).Create(context.Background(), secret, metav1.CreateOptions{})
+			assert.NoError(t, err, test.desc)
+		}
+		wiClient := &fakeWorkloadIdentityClient{keys: map[string]string{}}
+		if test.workloadKey != "" {
+			wiClient.keys["account"] = test.workloadKey
+		}
+		d.workloadIdentityClient = wiClient
+		// unexpected ListKeys call fails the test if cluster identity should not be used
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		if test.expectedKey == clusterKey {
+			mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "account").
+				Return(storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &clusterKey}}}, nil).Times(1)
+		}
+
+		accountKey, err := d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "account", ResourceGroup: "rg"}, nil, "", defaultNamespace, "", "")
+		if test.expectedErr != "" {
+			assert.ErrorContains(t, err, test.expectedErr, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expectedKey, accountKey, test.desc)
+	}
+
+	// request secrets always take precedence over all other sources
+	d := NewFakeDriverCustomOptions(DriverOptions{AccountKeySources: "workloadidentity"})
+	wiClient := &fakeWorkloadIdentityClient{keys: map[string]string{"account": "workloadkey"}}
+	d.workloadIdentityClient = wiClient
+	secrets := map[string]string{defaultSecretAccountName: "account", defaultSecretAccountKey: "requestkey"}
+	accountKey, err := d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "account", ResourceGroup: "rg"}, secrets, "", defaultNamespace, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "requestkey", accountKey)
+	assert.Equal(t, 0, wiClient.calls)
+}
+
+func TestGetAccountInfoFromSources(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf(secretNameTemplate, "account"), Namespace: defaultNamespace},
+		Data:       map[string][]byte{defaultSecretAccountKey: []byte("secretkey")},
+	}
+	newDriver := func(sources string) (*Driver, *fakeWorkloadIdentityClient) {
+		d := NewFakeDriverCustomOptions(DriverOptions{AccountKeySources: sources})
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset(secret)
+		// unexpected ListKeys call fails the test
+		d.cloud.StorageAccountClient = mockstorageaccountclient.NewMockInterface(ctrl)
+		wiClient := &fakeWorkloadIdentityClient{keys: map[string]string{"account": "workloadkey"}}
+		d.workloadIdentityClient = wiClient
+		return d, wiClient
+	}
+
+	// k8s secret takes precedence by default, the same as GetStorageAccesskey
+	d, wiClient := newDriver("")
+	_, _, accountKey, _, _, _, err := d.GetAccountInfo(context.Background(), "rg#account#share", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "secretkey", accountKey)
+	assert.Equal(t, 0, wiClient.calls)
+
+	// configured precedence is honored
+	d, wiClient = newDriver("workloadidentity,secret")
+	_, _, accountKey, _, _, _, err = d.GetAccountInfo(context.Background(), "rg#account#share", nil, map[string]string{getLatestAccountKeyField: trueValue})
+	assert.NoError(t, err)
+	assert.Equal(t, "workloadkey", accountKey)
+	assert.True(t, wiClient.getLatestAccountKey)
+
+	// secret is skipped if account key is not stored
+	d, wiClient = newDriver("")
+	_, _, accountKey, _, _, _, err = d.GetAccountInfo(context.Background(), "rg#account#share", nil, map[string]string{storeAccountKeyField: falseValue})
+	assert.NoError(t, err)
+	assert.Equal(t, "workloadkey", accountKey)
+	assert.Equal(t, 1, wiClient.calls)
+}
+
+func TestStorageAccountListKeysResultGetKey(t *testing.T) {
+	key1, key2 := "key1", "key2"
+	older := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	result := storageAccountListKeysResult{Keys: []storageAccountKey{
+		{Value: &key1, CreationTime: &older},
+		{Value: &key2, CreationTime: &newer},
+	}}
+
+	assert.Equal(t, "key1", result.getKey(false))
+	assert.Equal(t, "key2", result.getKey(true))
+	assert.Equal(t, "", storageAccountListKeysResult{}.getKey(true))
+}
+
+func TestGetStorageAccountFromSecret(t *testing.T) {
+	secretName := "secret"
+	secretNamespace := "default"
+
+	tests := []struct {
+		desc                  string
+		secretAccountKeyNames string
+		data                  map[string][]byte
+		expectedAccountName   string
+		expectedAccountKey    string
+	}{
+		{
+			desc: "read from default data key",
+			data: map[string][]byte{
+				defaultSecretAccountName: []byte("account"),
+				defaultSecretAccountKey:  []byte("key"),
+			},
+			expectedAccountName: "account",
+			expectedAccountKey:  "key",
+		},
+		{
+			desc:                  "read from alternate data key",
+			secretAccountKeyNames: "accountkey",
+			data: map[string][]byte{
+				defaultSecretAccountName: []byte("account"),
+				defaultSecretAccountKey:  []byte("default-key"),
+				"accountkey":             []byte("alternate-key"),
+			},
+			expectedAccountName: "account",
+			expectedAccountKey:  "alternate-key",
+		},
+		{
+			desc:                  "fall back to next data key in the list",
+			secretAccountKeyNames: "accountkey,azurestorageaccountkey",
+			data: map[string][]byte{
+				defaultSecretAccountName: []byte("account"),
+				defaultSecretAccountKey:  []byte(" default-key "),
+			},
+			expectedAccountName: "account",
+			expectedAccountKey:  "default-key",
+		},
+		{
+			desc: "strip trailing newline and spaces",
+			data: map[string][]byte{
+				defaultSecretAccountName: []byte("account\n"),
+				defaultSecretAccountKey:  []byte("key== \r\n"),
+			},
+			expectedAccountName: "account",
+			expectedAccountKey:  "key==",
+		},
+		{
+			desc:                  "no data key matched",
+			secretAccountKeyNames: "accountkey",
+			data: map[string][]byte{
+				defaultSecretAccountName: []byte("account"),
+				defaultSecretAccountKey:  []byte("default-key"),
+			},
+			expectedAccountName: "account",
+			expectedAccountKey:  "",
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{SecretAccountKeyNames: test.secretAccountKeyNames})
+		clientSet := fake.NewSimpleClientset()
+		d.cloud.KubeClient = clientSet
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: secretNamespace},
+			Data:       test.data,
+		}
+		if _, err := clientSet.CoreV1().Secrets(secretNamespace).Create(context.Background(), secret, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("test[%s]: create secret failed with %v", test.desc, err)
+		}
+
+		accountName, accountKey, err := d.GetStorageAccountFromSecret(context.Background(), secretName, secretNamespace)
+		assert.NoError(t, err)
+		if accountName != test.expectedAccountName || accountKey != test.expectedAccountKey {
+			t.Errorf("test[%s]: unexpected result: (%s, %s), expected: (%s, %s)", test.desc, accountName, accountKey, test.expectedAccountName, test.expectedAccountKey)
+		}
+	}
+}
+
+func TestGetAccountInfoWithoutStoredAccountKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf(secretNameTemplate, "test_accountname"), Namespace: defaultNamespace},
+		Data: map[string][]byte{
+			defaultSecretAccountName: []byte("test_accountname"),
+			defaultSecretAccountKey:  []byte("secret_key"),
+		},
+	}
+	clusterKey := "cluster_key"
+	keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &clusterKey}}}
+
+	tests := []struct {
+		desc          string
+		reqContext    map[string]string
+		expectedKey   string
+		expectListKey bool
+	}{
+		{
+			desc:        "account key is read from secret by default",
+			reqContext:  map[string]string{},
+			expectedKey: "secret_key",
+		},
+		{
+			desc:          "secret is skipped if account key is not stored",
+			reqContext:    map[string]string{storeAccountKeyField: "false"},
+			expectedKey:   clusterKey,
+			expectListKey: true,
+		},
+		{
+			desc:        "getAccountKeyFromSecret takes precedence",
+			reqContext:  map[string]string{storeAccountKeyField: "false", getAccountKeyFromSecretField: "true"},
+			expectedKey: "secret_key",
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = azure.GetTestCloud(ctrl)
+		d.cloud.KubeClient = fake.NewSimpleClientset(secret)
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		if test.expectListKey {
+			mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "test_accountname").Return(keys, nil).Times(1)
+		}
+
+		_, accountName, accountKey, _, _, _, err := d.GetAccountInfo(context.Background(), "rg#test_accountname#test_sharename###", nil, test.reqContext)
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, "test_accountname", accountName, test.desc)
+		assert.Equal(t, test.expectedKey, accountKey, test.desc)
+	}
+}
+
+func TestGetAccountInfoWithInferredNFS(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		desc       string
+		reqContext map[string]string
+	}{
+		{
+			desc: "protocol is nfs",
+			reqContext: map[string]string{
+				storageAccountField: "test_accountname",
+				shareNameField:      "test_sharename",
+				protocolField:       "NFS",
+			},
+		},
+		{
+			desc: "nfs is inferred from fsType if protocol is not set",
+			reqContext: map[string]string{
+				storageAccountField: "test_accountname",
+				shareNameField:      "test_sharename",
+				fsTypeField:         nfs,
 			},
 		},
 	}
-	for _, tc := range testCases {
-		t.Run(tc.name, tc.testFunc)
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = azure.GetTestCloud(ctrl)
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		// account key is not retrieved for nfs volume, unexpected ListKeys call fails the test
+		d.cloud.StorageAccountClient = mockstorageaccountclient.NewMockInterface(ctrl)
+
+		_, accountName, accountKey, fileShareName, _, _, err := d.GetAccountInfo(context.Background(), "rg#test_accountname#test_sharename###", nil, test.reqContext)
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, "test_accountname", accountName, test.desc)
+		assert.Equal(t, "test_sharename", fileShareName, test.desc)
+		assert.Empty(t, accountKey, test.desc)
 	}
 }
 
-func TestGetTotalAccountQuota(t *testing.T) {
+func TestGetEffectiveProtocol(t *testing.T) {
+	tests := []struct {
+		protocol string
+		fsType   string
+		expected string
+	}{
+		{protocol: "", fsType: "", expected: ""},
+		{protocol: smb, fsType: "", expected: smb},
+		{protocol: nfs, fsType: "", expected: nfs},
+		{protocol: "NFS", fsType: "", expected: nfs},
+		{protocol: "", fsType: nfs, expected: nfs},
+		{protocol: "", fsType: "NFS", expected: nfs},
+		{protocol: "", fsType: ext4, expected: ""},
+		{protocol: smb, fsType: nfs, expected: smb},
+	}
+
+	for _, test := range tests {
+		result := getEffectiveProtocol(test.protocol, test.fsType)
+		assert.Equal(t, test.expected, result, "protocol: %s, fsType: %s", test.protocol, test.fsType)
+	}
+}
+
+func TestGetAccountKeyWithoutKubeClient(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	secrets := map[string]string{
+		defaultSecretAccountName: "secretaccount",
+		defaultSecretAccountKey:  "secretkey",
+	}
+	newDriver := func() *Driver {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.ResourceGroup = "rg"
+		return d
+	}
+
+	// directly passed secrets are used without KubeClient
+	d := newDriver()
+	accountKey, err := d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "account"}, secrets, "", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "secretkey", accountKey)
+
+	_, accountName, accountKey, _, _, _, err := d.GetAccountInfo(context.Background(), "rg#account#share", secrets, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "secretaccount", accountName)
+	assert.Equal(t, "secretkey", accountKey)
+
+	// secret is not read without KubeClient, cluster identity is used directly
+	key := "clusterkey"
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "account").
+		Return(storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &key}}}, nil).Times(2)
+	d = newDriver()
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	accountKey, err = d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "account", ResourceGroup: "rg"}, nil, "", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, key, accountKey)
+
+	d = newDriver()
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	_, _, accountKey, _, _, _, err = d.GetAccountInfo(context.Background(), "rg#account#share", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, key, accountKey)
+
+	// nil KubeClient is reported only if the secret has to be read
+	d = newDriver()
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	_, _, _, _, _, _, err = d.GetAccountInfo(context.Background(), "rg#account#share", nil, map[string]string{getAccountKeyFromSecretField: trueValue})
+	assert.ErrorContains(t, err, "KubeClient is nil")
+
+	d = newDriver()
+	_, _, _, _, _, _, err = d.GetAccountInfo(context.Background(), "rg#account#share", nil, nil)
+	assert.ErrorContains(t, err, "KubeClient is nil")
+}
+
+func TestGetAccountInfoDefaultSecretNamespace(t *testing.T) {
+	tests := []struct {
+		desc                   string
+		defaultSecretNamespace string
+		expectedNamespace      string
+	}{
+		{desc: "compiled default namespace", expectedNamespace: defaultNamespace},
+		{desc: "namespace overridden by driver option", defaultSecretNamespace: "kube-system", expectedNamespace: "kube-system"},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{DefaultSecretNamespace: test.defaultSecretNamespace})
+		clientSet := fake.NewSimpleClientset()
+		d.cloud.KubeClient = clientSet
+		for _, ns := range []string{defaultNamespace, "kube-system"} {
+			secret := &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf(secretNameTemplate, "account"), Namespace: ns},
+				Data: map[string][]byte{
+					defaultSecretAccountName: []byte("account"),
+					defaultSecretAccountKey:  []byte("key-in-" + ns),
+				},
+			}
+			if _, err := clientSet.CoreV1().Secrets(ns).Create(context.Background(), secret, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("test[%s]: create secret failed with %v", test.desc, err)
+			}
+		}
+
+		_, _, accountKey, _, _, _, err := d.GetAccountInfo(context.Background(), "rg#account#share", nil, nil)
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, "key-in-"+test.expectedNamespace, accountKey, test.desc)
+
+		// pvc namespace takes precedence over default secret namespace
+		d.accountCacheMap.Delete("account")
+		_, _, accountKey, _, _, _, err = d.GetAccountInfo(context.Background(), "rg#account#share", nil, map[string]string{pvcNamespaceKey: defaultNamespace})
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, "key-in-"+defaultNamespace, accountKey, test.desc)
+	}
+}
+
+func TestGetSecretNamespace(t *testing.T) {
+	tests := []struct {
+		desc                   string
+		centralSecretNamespace string
+		secretNamespace        string
+		pvcNamespace           string
+		expected               string
+	}{
+		{desc: "no namespace", expected: defaultNamespace},
+		{desc: "pvc namespace", pvcNamespace: "ns", expected: "ns"},
+		{desc: "secret namespace", secretNamespace: "secretns", pvcNamespace: "ns", expected: "secretns"},
+		{desc: "central namespace without pvc namespace", centralSecretNamespace: "central", expected: "central"},
+		{desc: "central namespace takes precedence over pvc namespace", centralSecretNamespace: "central", pvcNamespace: "ns", expected: "central"},
+		{desc: "secret namespace overrides central namespace", centralSecretNamespace: "central", secretNamespace: "secretns", pvcNamespace: "ns", expected: "secretns"},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{CentralSecretNamespace: test.centralSecretNamespace})
+		assert.Equal(t, test.expected, d.getSecretNamespace(test.secretNamespace, test.pvcNamespace), test.desc)
+	}
+}
+
+func TestGetAccountInfoCentralSecretNamespace(t *testing.T) {
+	d := NewFakeDriverCustomOptions(DriverOptions{CentralSecretNamespace: "central"})
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+	for _, ns := range []string{"central", "tenant"} {
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf(secretNameTemplate, "account"), Namespace: ns},
+			Data: map[string][]byte{
+				defaultSecretAccountName: []byte("account"),
+				defaultSecretAccountKey:  []byte("key-in-" + ns),
+			},
+		}
+		if _, err := clientSet.CoreV1().Secrets(ns).Create(context.Background(), secret, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("create secret failed with %v", err)
+		}
+	}
+
+	// secret in central namespace is used regardless of pvc namespace
+	for _, pvcNamespace := range []string{"", "tenant", "other"} {
+		d.accountCacheMap.Delete("account")
+		_, _, accountKey, _, _, _, err := d.GetAccountInfo(context.Background(), "rg#account#share", nil, map[string]string{pvcNamespaceKey: pvcNamespace})
+		assert.NoError(t, err, pvcNamespace)
+		assert.Equal(t, "key-in-central", accountKey, pvcNamespace)
+	}
+
+	// secretNamespace in volume attributes overrides central namespace
+	d.accountCacheMap.Delete("account")
+	_, _, accountKey, _, _, _, err := d.GetAccountInfo(context.Background(), "rg#account#share", nil, map[string]string{pvcNamespaceKey: "other", secretNamespaceField: "tenant"})
+	assert.NoError(t, err)
+	assert.Equal(t, "key-in-tenant", accountKey)
+}
+
+func TestAccountKeyRotation(t *testing.T) {
+	d := NewFakeDriverCustomOptions(DriverOptions{AccountKeyTTL: 100 * time.Millisecond})
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+	secretName := fmt.Sprintf(secretNameTemplate, "account")
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: defaultNamespace},
+		Data: map[string][]byte{
+			defaultSecretAccountName: []byte("account"),
+			defaultSecretAccountKey:  []byte("key1"),
+		},
+	}
+	if _, err := clientSet.CoreV1().Secrets(defaultNamespace).Create(context.Background(), secret, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create secret failed with %v", err)
+	}
+	accountOptions := &azure.AccountOptions{Name: "account"}
+
+	accountKey, err := d.GetStorageAccesskey(context.Background(), accountOptions, nil, "", defaultNamespace, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "key1", accountKey)
+
+	// rotate account key in secret
+	secret.Data[defaultSecretAccountKey] = []byte("key2")
+	if _, err := clientSet.CoreV1().Secrets(defaultNamespace).Update(context.Background(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update secret failed with %v", err)
+	}
+	accountKey, err = d.GetStorageAccesskey(context.Background(), accountOptions, nil, "", defaultNamespace, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "key1", accountKey, "cached account key should be returned before ttl expires")
+
+	time.Sleep(200 * time.Millisecond)
+	accountKey, err = d.GetStorageAccesskey(context.Background(), accountOptions, nil, "", defaultNamespace, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "key2", accountKey, "rotated account key should be fetched after ttl expires")
+}
+
+func TestRevalidateAccountKeys(t *testing.T) {
 	d := NewFakeDriver()
-	d.cloud = &azure.Cloud{}
+	d.fileClient = &azureFileClient{env: &azure2.Environment{}}
+	// account key which is not base64 encoded is rejected before sending any request
+	d.accountCacheMap.Set("invalidaccount", "invalid key")
+
+	d.revalidateAccountKeys()
+
+	cache, err := d.accountCacheMap.Get("invalidaccount", azcache.CacheReadTypeDefault)
+	assert.NoError(t, err)
+	assert.Nil(t, cache, "invalid account key should be evicted from cache")
+}
+
+func TestIsAccountKeyInvalidError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{err: nil, expected: false},
+		{err: fmt.Errorf("error creating azure client: illegal base64 data at input byte 7"), expected: true},
+		{err: fmt.Errorf("storage: service returned error: StatusCode=403, ErrorCode=AuthenticationFailed, ErrorMessage=Server failed to authenticate the request"), expected: true},
+		{err: fmt.Errorf("dial tcp: lookup account.file.core.windows.net: no such host"), expected: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isAccountKeyInvalidError(test.err), "error: %v", test.err)
+	}
+}
 
+func TestRestoreFileShare(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	fileShareItemsWithQuota := []storage.FileShareItem{
+	deletedShare := func(name, version string, deletedTime time.Time) storage.FileShareItem {
+		return storage.FileShareItem{Name: to.StringPtr(name), FileShareProperties: &storage.FileShareProperties{
+			Deleted: to.BoolPtr(true), Version: to.StringPtr(version), DeletedTime: &date.Time{Time: deletedTime}}}
+	}
+	now := time.Now()
+
+	nfsShare := deletedShare("share", "v1", now)
+	nfsShare.EnabledProtocols = storage.EnabledProtocolsNFS
+	ownedMetadata := map[string]string{createdByMetadataKey: fakeDriverName}
+
+	tests := []struct {
+		desc             string
+		shares           []storage.FileShareItem
+		listErr          error
+		metadata         map[string]string
+		restoreErr       error
+		setMetadataErr   error
+		expectedVersion  string
+		expectedRestore  bool
+		expectedMetadata bool
+		expectedErr      bool
+	}{
 		{
-			FileShareProperties: &storage.FileShareProperties{
-				ShareQuota: to.Int32Ptr(100),
+			desc: "latest soft deleted share is restored",
+			shares: []storage.FileShareItem{
+				{Name: to.StringPtr("share"), FileShareProperties: &storage.FileShareProperties{}},
+				deletedShare("othershare", "v0", now),
+				deletedShare("share", "v1", now.Add(-time.Hour)),
+				deletedShare("share", "v2", now),
 			},
+			metadata:         ownedMetadata,
+			expectedVersion:  "v2",
+			expectedRestore:  true,
+			expectedMetadata: true,
 		},
 		{
-			FileShareProperties: &storage.FileShareProperties{
-				ShareQuota: to.Int32Ptr(200),
+			desc:     "soft deleted share created by others is not restored",
+			shares:   []storage.FileShareItem{deletedShare("share", "v1", now)},
+			metadata: map[string]string{createdByMetadataKey: "other.csi.azure.com"},
+		},
+		{
+			desc:     "soft deleted share created in another cluster is not restored",
+			shares:   []storage.FileShareItem{deletedShare("share", "v1", now)},
+			metadata: map[string]string{createdByMetadataKey: fakeDriverName, clusterIDMetadataKey: "other"},
+		},
+		{
+			desc:        "incompatible soft deleted share is not restored",
+			shares:      []storage.FileShareItem{nfsShare},
+			metadata:    ownedMetadata,
+			expectedErr: true,
+		},
+		{
+			desc:             "set metadata failure",
+			shares:           []storage.FileShareItem{deletedShare("share", "v1", now)},
+			metadata:         ownedMetadata,
+			setMetadataErr:   fmt.Errorf("set metadata error"),
+			expectedVersion:  "v1",
+			expectedRestore:  true,
+			expectedMetadata: true,
+			expectedErr:      true,
+		},
+		{
+			desc: "no soft deleted share with the name",
+			shares: []storage.FileShareItem{
+				{Name: to.StringPtr("share"), FileShareProperties: &storage.FileShareProperties{}},
+				deletedShare("othershare", "v0", now),
 			},
 		},
+		{
+			desc:        "list deleted shares failure",
+			listErr:     fmt.Errorf("list error"),
+			expectedErr: true,
+		},
+		{
+			desc:            "restore failure",
+			shares:          []storage.FileShareItem{deletedShare("share", "v1", now)},
+			metadata:        ownedMetadata,
+			restoreErr:      fmt.Errorf("restore error"),
+			expectedVersion: "v1",
+			expectedErr:     true,
+		},
+	}
+
+	defer func(f func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName, version string) error) {
+		restoreDeletedFileShare = f
+	}(restoreDeletedFileShare)
+	defer func(f func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName, version string) (map[string]string, error)) {
+		getDeletedFileShareMetadata = f
+	}(getDeletedFileShareMetadata)
+	defer func(f func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName string, metadata map[string]*string) error) {
+		setFileShareMetadataWithKey = f
+	}(setFileShareMetadataWithKey)
+
+	shareOptions := &fileclient.ShareOptions{Name: "share", RequestGiB: 100, Metadata: map[string]*string{createdByMetadataKey: to.StringPtr(fakeDriverName)}}
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.clusterID = "cluster"
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID("subsID").Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", deletedSharesExpand).Return(test.shares, test.listErr).Times(1)
+
+		var restoredVersion string
+		restoreDeletedFileShare = func(_ context.Context, accountName, accountKey, storageEndpointSuffix, shareName, version string) error {
+			assert.Equal(t, "account", accountName, test.desc)
+			assert.Equal(t, "key", accountKey, test.desc)
+			assert.Equal(t, "core.windows.net", storageEndpointSuffix, test.desc)
+			assert.Equal(t, "share", shareName, test.desc)
+			restoredVersion = version
+			return test.restoreErr
+		}
+		getDeletedFileShareMetadata = func(_ context.Context, _, _, _, shareName, _ string) (map[string]string, error) {
+			assert.Equal(t, "share", shareName, test.desc)
+			return test.metadata, nil
+		}
+		var metadataSet bool
+		setFileShareMetadataWithKey = func(_ context.Context, _, _, _, shareName string, metadata map[string]*string) error {
+			assert.Equal(t, "share", shareName, test.desc)
+			assert.Equal(t, shareOptions.Metadata, metadata, test.desc)
+			metadataSet = true
+			return test.setMetadataErr
+		}
+
+		restored, err := d.RestoreFileShare(context.Background(), "subsID", "rg", "account", "key", "core.windows.net", shareOptions)
+		assert.Equal(t, test.expectedErr, err != nil, test.desc)
+		assert.Equal(t, test.expectedRestore, restored, test.desc)
+		assert.Equal(t, test.expectedVersion, restoredVersion, test.desc)
+		assert.Equal(t, test.expectedMetadata, metadataSet, test.desc)
+	}
+}
+
+func TestCreateFileShareWhenShareBeingDeleted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	beingDeletedErr := fmt.Errorf("Code=\"ShareBeingDeleted\" Message=\"%s. Try operation later.\"", shareBeingDeleted)
+	accountOptions := &azure.AccountOptions{Name: "account", ResourceGroup: "rg"}
+	shareOptions := &fileclient.ShareOptions{Name: "share", RequestGiB: 100}
+
+	newDriver := func() (*Driver, *mockfileclient.MockInterface) {
+		d := NewFakeDriverCustomOptions(DriverOptions{ShareBeingDeletedTimeoutInSeconds: 1})
+		d.shareBeingDeletedPollInterval = 10 * time.Millisecond
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		return d, mockFileClient
+	}
+
+	t.Run("create file share after deletion completes", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		gomock.InOrder(
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", shareOptions, "").Return(storage.FileShare{}, beingDeletedErr).Times(2),
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", shareOptions, "").Return(storage.FileShare{}, nil).Times(1),
+		)
+
+		err := d.CreateFileShare(context.Background(), accountOptions, shareOptions, nil)
+		assert.NoError(t, err)
+	})
+
+	t.Run("return timeout error if share is still being deleted", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", shareOptions, "").Return(storage.FileShare{}, beingDeletedErr).MinTimes(2)
+
+		start := time.Now()
+		err := d.CreateFileShare(context.Background(), accountOptions, shareOptions, nil)
+		elapsed := time.Since(start)
+		expectedErr := fmt.Errorf("file share(share) on account(account) is still being deleted after 1s: %v", beingDeletedErr)
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("unexpected error: %v, expected error: %v", err, expectedErr)
+		}
+		if elapsed < time.Second || elapsed > 5*time.Second {
+			t.Errorf("unexpected wait time: %v", elapsed)
+		}
+	})
+
+	t.Run("return other error immediately", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", shareOptions, "").Return(storage.FileShare{}, fmt.Errorf("test error")).Times(1)
+
+		err := d.CreateFileShare(context.Background(), accountOptions, shareOptions, nil)
+		assert.Equal(t, fmt.Errorf("test error"), err)
+	})
+}
+
+func TestResizeDiskFile(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.vhd")
+	if err := os.WriteFile(diskPath, make([]byte, 4096), 0600); err != nil {
+		t.Fatalf("failed to create disk file: %v", err)
 	}
 
+	resized, err := resizeDiskFile(diskPath, 8192)
+	assert.NoError(t, err)
+	assert.True(t, resized)
+	content, err := os.ReadFile(diskPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 8192, len(content))
+	// vhd footer starts with cookie "conectix"
+	assert.Equal(t, "conectix", string(content[8192-512:8192-504]))
+
+	// shrinking is not allowed
+	resized, err = resizeDiskFile(diskPath, 4096)
+	assert.NoError(t, err)
+	assert.False(t, resized)
+
+	_, err = resizeDiskFile(filepath.Join(t.TempDir(), "not-exist.vhd"), 8192)
+	assert.Error(t, err)
+}
+
+func TestDeleteAccountIfEmpty(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	createdByDriver := map[string]*string{consts.CreatedByTag: pointer.String("azure"), accountCreatedByDriverTag: pointer.String(fakeDriverName)}
+	share := storage.FileShareItem{Name: pointer.String("share")}
 	tests := []struct {
-		name             string
-		subsID           string
-		resourceGroup    string
-		accountName      string
-		fileShareItems   []storage.FileShareItem
-		listFileShareErr error
-		expectedQuota    int32
-		expectedShareNum int32
-		expectedErr      error
+		desc            string
+		account         storage.Account
+		sharesList      [][]storage.FileShareItem
+		expectedUpdates int
+		expectedDeleted bool
 	}{
 		{
-			name:             "GetTotalAccountQuota success",
-			expectedQuota:    0,
-			expectedShareNum: 0,
+			desc:       "account not created by driver",
+			account:    storage.Account{Tags: map[string]*string{"key": pointer.String("value")}},
+			sharesList: nil,
 		},
 		{
-			name:             "GetTotalAccountQuota success (with 2 file shares)",
-			fileShareItems:   fileShareItemsWithQuota,
-			expectedQuota:    300,
-			expectedShareNum: 2,
+			desc:    "account created by other azure component",
+			account: storage.Account{Kind: storage.KindFileStorage, Tags: map[string]*string{consts.CreatedByTag: pointer.String("azure")}},
 		},
 		{
-			name:             "list file share error",
-			listFileShareErr: fmt.Errorf("list file share error"),
-			expectedQuota:    -1,
-			expectedShareNum: -1,
-			expectedErr:      fmt.Errorf("list file share error"),
+			desc:    "account supports other storage services",
+			account: storage.Account{Kind: storage.KindStorageV2, Tags: createdByDriver},
+		},
+		{
+			desc: "account with private endpoint connections",
+			account: storage.Account{
+				Kind:              storage.KindFileStorage,
+				Tags:              createdByDriver,
+				AccountProperties: &storage.AccountProperties{PrivateEndpointConnections: &[]storage.PrivateEndpointConnection{{}}},
+			},
+		},
+		{
+			desc:       "not the last file share",
+			account:    storage.Account{Kind: storage.KindFileStorage, Tags: createdByDriver},
+			sharesList: [][]storage.FileShareItem{{share}},
+		},
+		{
+			desc:            "file share is created before deletion",
+			account:         storage.Account{Kind: storage.KindFileStorage, Tags: createdByDriver},
+			sharesList:      [][]storage.FileShareItem{{}, {share}},
+			expectedUpdates: 2,
+		},
+		{
+			desc:            "empty account created by driver",
+			account:         storage.Account{Kind: storage.KindFileStorage, Tags: createdByDriver},
+			sharesList:      [][]storage.FileShareItem{{}, {}},
+			expectedUpdates: 1,
+			expectedDeleted: true,
 		},
 	}
 
 	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = azure.GetTestCloud(ctrl)
 		mockFileClient := mockfileclient.NewMockInterface(ctrl)
 		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		d.volMap.Store("vol", "account")
 
 		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
-		mockFileClient.EXPECT().ListFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(test.fileShareItems, test.listFileShareErr).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), "subsID", "rg", "account").Return(test.account, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), "subsID", "rg", "account", gomock.Any()).Return(nil).Times(test.expectedUpdates)
+		for _, shares := range test.sharesList {
+			mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", snapshotsExpand).Return(shares, nil).Times(1)
+		}
+		if test.expectedDeleted {
+			mockStorageAccountsClient.EXPECT().Delete(gomock.Any(), "subsID", "rg", "account").Return(nil).Times(1)
+		}
 
-		quota, fileShareNum, err := d.GetTotalAccountQuota(context.TODO(), test.subsID, test.resourceGroup, test.accountName)
-		assert.Equal(t, test.expectedErr, err, test.name)
-		assert.Equal(t, test.expectedQuota, quota, test.name)
-		assert.Equal(t, test.expectedShareNum, fileShareNum, test.name)
+		err := d.deleteAccountIfEmpty(context.Background(), "subsID", "rg", "account")
+		assert.NoError(t, err, test.desc)
+		_, ok := d.volMap.Load("vol")
+		assert.Equal(t, test.expectedUpdates == 0, ok, test.desc)
+	}
+}
+
+func TestEnableDeleteRetentionPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		desc        string
+		days        int
+		expectedErr string
+	}{
+		{desc: "zero days", days: 0, expectedErr: "share delete retention days(0) should be in range [1, 365]"},
+		{desc: "negative days", days: -1, expectedErr: "share delete retention days(-1) should be in range [1, 365]"},
+		{desc: "minimum days", days: 1},
+		{desc: "default days", days: 7},
+		{desc: "maximum days", days: 365},
+		{desc: "exceeds maximum days", days: 366, expectedErr: "share delete retention days(366) should be in range [1, 365]"},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+
+		disabled := storage.FileServiceProperties{
+			FileServicePropertiesProperties: &storage.FileServicePropertiesProperties{
+				ShareDeleteRetentionPolicy: &storage.DeleteRetentionPolicy{Enabled: pointer.Bool(false)},
+			},
+		}
+		enabled := storage.FileServiceProperties{
+			FileServicePropertiesProperties: &storage.FileServicePropertiesProperties{
+				ShareDeleteRetentionPolicy: &storage.DeleteRetentionPolicy{Enabled: pointer.Bool(true), Days: pointer.Int32(int32(test.days))},
+			},
+		}
+		d.shareDeleteRetentionPolicyCache.Set("subsID/rg/account", disabled.ShareDeleteRetentionPolicy)
+		if test.expectedErr == "" {
+			mockFileClient.EXPECT().GetServiceProperties(gomock.Any(), "rg", "account").Return(disabled, nil).Times(1)
+			mockFileClient.EXPECT().SetServiceProperties(gomock.Any(), "rg", "account", enabled).Return(enabled, nil).Times(1)
+		}
+
+		err := d.EnableDeleteRetentionPolicy(context.Background(), "subsID", "rg", "account", test.days)
+		if test.expectedErr != "" {
+			assert.EqualError(t, err, test.expectedErr, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+
+		// cached policy is refreshed after it's enabled
+		mockFileClient.EXPECT().GetServiceProperties(gomock.Any(), "rg", "account").Return(enabled, nil).Times(1)
+		policy, err := d.getShareDeleteRetentionPolicy(context.Background(), "subsID", "rg", "account")
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, enabled.ShareDeleteRetentionPolicy, policy, test.desc)
+	}
+}
+
+func TestValidateDeleteFileShareParams(t *testing.T) {
+	secrets := map[string]string{defaultSecretAccountName: "account", defaultSecretAccountKey: "key"}
+	tests := []struct {
+		desc          string
+		resourceGroup string
+		accountName   string
+		shareName     string
+		secrets       map[string]string
+		expectedCode  codes.Code
+	}{
+		{desc: "management API", resourceGroup: "rg", accountName: "account", shareName: "share", expectedCode: codes.OK},
+		{desc: "data plane API without resource group", shareName: "share", secrets: secrets, expectedCode: codes.OK},
+		{desc: "resource group is empty without secrets", accountName: "account", shareName: "share", expectedCode: codes.InvalidArgument},
+		{desc: "account name is empty without secrets", resourceGroup: "rg", shareName: "share", expectedCode: codes.InvalidArgument},
+		{desc: "share name is empty", resourceGroup: "rg", accountName: "account", expectedCode: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		err := validateDeleteFileShareParams(test.resourceGroup, test.accountName, test.shareName, test.secrets)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
 	}
+
+	// DeleteFileShare fails before any cloud call
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	err := d.DeleteFileShare(context.Background(), "", "", "account", "share", nil)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
 }
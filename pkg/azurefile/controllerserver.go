@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -53,6 +54,7 @@ const (
 	privateEndpoint        = "privateendpoint"
 	snapshotTimeFormat     = "2006-01-02T15:04:05.0000000Z07:00"
 	snapshotsExpand        = "snapshots"
+	deletedSharesExpand    = "deleted"
 )
 
 var (
@@ -101,6 +103,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
 	requestGiB := volumehelper.RoundUpGiB(capacityBytes)
 	if requestGiB == 0 {
+		// default quota is not smaller than minimum quota of premium file share, so it also applies to nfs file share
 		requestGiB = defaultAzureFileQuota
 		klog.Warningf("no quota specified, set as default value(%d GiB)", defaultAzureFileQuota)
 	}
@@ -121,8 +124,9 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 	var sku, subsID, resourceGroup, location, account, fileShareName, diskName, fsType, secretName string
 	var secretNamespace, pvcNamespace, protocol, customTags, storageEndpointSuffix, networkEndpointType, shareAccessTier, accountAccessTier, rootSquashType string
-	var createAccount, useDataPlaneAPI, useSeretCache, matchTags, selectRandomMatchingAccount, getLatestAccountKey bool
-	var vnetResourceGroup, vnetName, subnetName, shareNamePrefix, fsGroupChangePolicy string
+	var createAccount, disableCreateAccount, useDataPlaneAPI, useSeretCache, matchTags, selectRandomMatchingAccount, getLatestAccountKey, restoreFromSoftDelete bool
+	var vnetResourceGroup, vnetName, subnetName, subnetResourceIDs, shareNamePrefix, fsGroupChangePolicy, folderName, accountTagSelector string
+	var keyVaultURL, keyVaultSecretName, diskMountOptions, proxyMountValue string
 	var requireInfraEncryption, disableDeleteRetentionPolicy, enableLFS, isMultichannelEnabled *bool
 	// set allowBlobPublicAccess as false by default
 	allowBlobPublicAccess := pointer.Bool(false)
@@ -132,6 +136,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	storeAccountKey := true
 
 	var accountQuota int32
+	var maxShareQuota int
+	retainSharePolicy := retainSharePolicyDelete
+	var deleteAccountWhenEmpty bool
+	var dryRun bool
 	// Apply ProvisionerParameters (case-insensitive). We leave validation of
 	// the values to the cloud provider.
 	for k, v := range parameters {
@@ -168,14 +176,22 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			secretName = v
 		case secretNamespaceField:
 			secretNamespace = v
+		case keyVaultURLField:
+			keyVaultURL = v
+		case keyVaultSecretNameField:
+			keyVaultSecretName = v
 		case protocolField:
 			protocol = v
 		case matchTagsField:
 			matchTags = strings.EqualFold(v, trueValue)
+		case accountTagSelectorField:
+			// tags in 'key1=value1,key2=value2' format, an account is matched only when it has all of these tags
+			accountTagSelector = v
 		case tagsField:
 			customTags = v
 		case createAccountField:
 			createAccount = strings.EqualFold(v, trueValue)
+			disableCreateAccount = strings.EqualFold(v, falseValue)
 		case useSecretCacheField:
 			useSeretCache = strings.EqualFold(v, trueValue)
 		case enableLargeFileSharesField:
@@ -192,6 +208,12 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 				return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid %s: %s in storage class", disableDeleteRetentionPolicyField, v))
 			}
 			disableDeleteRetentionPolicy = &value
+		case restoreFromSoftDeleteField:
+			value, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid %s: %s in storage class", restoreFromSoftDeleteField, v))
+			}
+			restoreFromSoftDelete = value
 		case pvcNamespaceKey:
 			pvcNamespace = v
 			fileShareNameReplaceMap[pvcNamespaceMetadata] = v
@@ -220,20 +242,34 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		case serverNameField:
 			// no op, only used in NodeStageVolume
 		case folderNameField:
-			// no op, only used in NodeStageVolume
+			// only do validations here, used in NodeStageVolume
+			folderName = v
 		case fsGroupChangePolicyField:
 			fsGroupChangePolicy = v
+		case initMarkerField:
+			// only do validations here, used in NodeStageVolume
+			if !isValidInitMarker(v) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s in storage class, should be a relative path under volume root", initMarkerField, v)
+			}
 		case mountPermissionsField:
 			// only do validations here, used in NodeStageVolume, NodePublishVolume
 			if _, err := strconv.ParseUint(v, 8, 32); err != nil {
 				return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid mountPermissions %s in storage class", v))
 			}
+		case diskMountOptionsField:
+			// only do validations here, used in NodeStageVolume
+			diskMountOptions = v
+		case proxyMountField:
+			// only do validations here, used in NodeStageVolume
+			proxyMountValue = v
 		case vnetResourceGroupField:
 			vnetResourceGroup = v
 		case vnetNameField:
 			vnetName = v
 		case subnetNameField:
 			subnetName = v
+		case subnetResourceIDsField:
+			subnetResourceIDs = v
 		case shareNamePrefixField:
 			shareNamePrefix = v
 		case requireInfraEncryptionField:
@@ -260,33 +296,76 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 				return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid accountQuota %s in storage class, minimum quota: %d", v, minimumAccountQuota))
 			}
 			accountQuota = int32(value)
+		case maxShareQuotaField:
+			value, err := strconv.Atoi(v)
+			if err != nil || value <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s %s in storage class, should be a positive integer in GiB", maxShareQuotaField, v)
+			}
+			maxShareQuota = value
+		case dryRunField:
+			value, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s in storage class", dryRunField, v)
+			}
+			dryRun = value
+		case retainSharePolicyField:
+			if !strings.EqualFold(v, retainSharePolicyDelete) && !strings.EqualFold(v, retainSharePolicyRetain) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s %s in storage class, supported values: %s, %s", retainSharePolicyField, v, retainSharePolicyDelete, retainSharePolicyRetain)
+			}
+			retainSharePolicy = strings.ToLower(v)
+		case deleteAccountWhenEmptyField:
+			value, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s in storage class", deleteAccountWhenEmptyField, v)
+			}
+			deleteAccountWhenEmpty = value
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid parameter %q in storage class", k))
 		}
 	}
 
+	if dryRun && !d.enableDryRun {
+		return nil, status.Errorf(codes.InvalidArgument, "%s storage class parameter is disabled, use --enable-dry-run driver option to enable it", dryRunField)
+	}
+
+	requiredTags, err := ConvertTagsToMap(accountTagSelector)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %v", accountTagSelectorField, err)
+	}
+	tags, err := ConvertTagsToMap(customTags)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+
 	if matchTags && account != "" {
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("matchTags must set as false when storageAccount(%s) is provided", account))
 	}
+	if len(requiredTags) > 0 && account != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s could not be set when storageAccount(%s) is provided", accountTagSelectorField, account)
+	}
+
+	if subsID != "" && !isValidSubscriptionID(subsID) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s(%s) in storage class, it should be a GUID", subscriptionIDField, subsID)
+	}
 
-	if subsID != "" && subsID != d.cloud.SubscriptionID {
+	if subsID != "" && !strings.EqualFold(subsID, d.cloud.SubscriptionID) {
 		if resourceGroup == "" {
 			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("resourceGroup must be provided in cross subscription(%s)", subsID))
 		}
 	}
 
-	if secretNamespace == "" {
-		if pvcNamespace == "" {
-			secretNamespace = defaultNamespace
-		} else {
-			secretNamespace = pvcNamespace
-		}
-	}
+	secretNamespace = d.getSecretNamespace(secretNamespace, pvcNamespace)
 
 	if !d.enableVHDDiskFeature && fsType != "" {
 		return nil, status.Errorf(codes.InvalidArgument, "fsType storage class parameter enables experimental VDH disk feature which is currently disabled, use --enable-vhd driver option to enable it")
 	}
 
+	for _, name := range []string{account, getValueInMap(req.GetSecrets(), defaultSecretAccountName)} {
+		if !d.isAllowedAccount(name) {
+			return nil, status.Errorf(codes.PermissionDenied, "storage account(%s) is not in the allowed account list", name)
+		}
+	}
+
 	if !isSupportedFsType(fsType) {
 		return nil, status.Errorf(codes.InvalidArgument, "fsType(%s) is not supported, supported fsType list: %v", fsType, supportedFsTypeList)
 	}
@@ -295,6 +374,11 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Errorf(codes.InvalidArgument, "protocol(%s) is not supported, supported protocol list: %v", protocol, supportedProtocolList)
 	}
 
+	sku = normalizeSkuName(sku)
+	if (fsType == nfs || protocol == nfs) && sku != "" && !isPremiumSku(sku) {
+		return nil, status.Errorf(codes.InvalidArgument, "skuName(%s) is not supported with nfs protocol, supported skuName list: %v", sku, getSupportedSkuNames(nfs))
+	}
+
 	if !isSupportedShareAccessTier(shareAccessTier) {
 		return nil, status.Errorf(codes.InvalidArgument, "shareAccessTier(%s) is not supported, supported ShareAccessTier list: %v", shareAccessTier, storage.PossibleShareAccessTierValues())
 	}
@@ -311,12 +395,61 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Errorf(codes.InvalidArgument, "fsGroupChangePolicy(%s) is not supported, supported fsGroupChangePolicy list: %v", fsGroupChangePolicy, supportedFSGroupChangePolicyList)
 	}
 
+	if !isSupportedStorageEndpointSuffix(storageEndpointSuffix) {
+		return nil, status.Errorf(codes.InvalidArgument, "storageEndpointSuffix(%s) should be a valid host name, e.g. core.windows.net", storageEndpointSuffix)
+	}
+
 	if !isSupportedShareNamePrefix(shareNamePrefix) {
 		return nil, status.Errorf(codes.InvalidArgument, "shareNamePrefix(%s) can only contain lowercase letters, numbers, hyphens, and length should be less than 21", shareNamePrefix)
 	}
 
-	if protocol == nfs && fsType != "" && fsType != nfs {
-		return nil, status.Errorf(codes.InvalidArgument, "fsType(%s) is not supported with protocol(%s)", fsType, protocol)
+	if folderName != "" && (diskName != "" || isDiskFsType(fsType)) {
+		// vhd disk is created in the root of file share, mounting a sub directory of the share would lose it
+		return nil, status.Errorf(codes.InvalidArgument, "folderName(%s) is not supported with vhd disk volume(diskName: %s, fsType: %s)", folderName, diskName, fsType)
+	}
+
+	if err := validateProtocolFsType(protocol, fsType, diskName); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err := d.useProxyMount(proxyMountValue, fsType); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if diskMountOptions != "" {
+		if !isDiskFsType(fsType) {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is only supported with vhd disk volume, fsType(%s) should be one of %v", diskMountOptionsField, fsType, supportedDiskFsTypeList)
+		}
+		if _, err := parseDiskMountOptions(diskMountOptions, fsType); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if protocol != nfs {
+		for _, c := range volumeCapabilities {
+			if err := validateSMBVers(c.GetMount().GetMountFlags()); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+	}
+
+	if keyVaultURL != "" || keyVaultSecretName != "" {
+		if keyVaultURL == "" || keyVaultSecretName == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "keyVaultURL(%s) and keyVaultSecretName(%s) should be specified together", keyVaultURL, keyVaultSecretName)
+		}
+		if _, err := getKeyVaultScope(keyVaultURL); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if account == "" {
+			// key of a storage account selected or created by driver is not in key vault
+			return nil, status.Errorf(codes.InvalidArgument, "storageAccount should be specified with keyVaultURL(%s)", keyVaultURL)
+		}
+		// account key is stored in key vault, do not store it in k8s secret
+		storeAccountKey = false
+	}
+
+	if restoreFromSoftDelete && req.GetVolumeContentSource() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is not supported with volume content source", restoreFromSoftDeleteField)
 	}
 
 	enableHTTPSTrafficOnly := true
@@ -329,7 +462,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	if fsType == nfs || protocol == nfs {
 		protocol = nfs
 		enableHTTPSTrafficOnly = false
-		if !strings.HasPrefix(strings.ToLower(sku), premium) {
+		if sku == "" {
 			// NFS protocol only supports Premium storage
 			sku = string(storage.SkuNamePremiumLRS)
 		}
@@ -338,18 +471,51 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		storeAccountKey = false
 		// reset protocol field (compatible with "fsType: nfs")
 		setKeyValueInMap(parameters, protocolField, protocol)
+		if rootSquashType != "" {
+			// surface root squash type on the persistent volume
+			setKeyValueInMap(parameters, rootSquashTypeField, rootSquashType)
+		}
+		if req.GetVolumeContentSource() != nil {
+			// volume cloning relies on SAS token generated from account key
+			return nil, status.Errorf(codes.InvalidArgument, "protocol nfs is not supported for volume cloning")
+		}
+		if useDataPlaneAPI {
+			// data plane API relies on account key, create nfs file share by management API instead
+			klog.V(2).Infof("ignore %s since nfs protocol does not need account key", useDataPlaneAPIField)
+			useDataPlaneAPI = false
+		}
 
 		if !pointer.BoolDeref(createPrivateEndpoint, false) {
 			// set VirtualNetworkResourceIDs for storage account firewall setting
-			vnetResourceID := d.getSubnetResourceID(vnetResourceGroup, vnetName, subnetName)
-			klog.V(2).Infof("set vnetResourceID(%s) for NFS protocol", vnetResourceID)
-			vnetResourceIDs = []string{vnetResourceID}
-			if err := d.updateSubnetServiceEndpoints(ctx, vnetResourceGroup, vnetName, subnetName); err != nil {
+			if subnetResourceIDs != "" {
+				// node pools of the cluster may span multiple subnets
+				ids, err := parseSubnetResourceIDs(subnetResourceIDs)
+				if err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %v", subnetResourceIDsField, err)
+				}
+				vnetResourceIDs = ids
+			} else {
+				vnetResourceIDs = []string{d.getSubnetResourceID(vnetResourceGroup, vnetName, subnetName)}
+			}
+			klog.V(2).Infof("set vnetResourceIDs(%v) for NFS protocol", vnetResourceIDs)
+			var err error
+			if dryRun {
+				klog.V(2).Infof("skip updating service endpoints of subnets(%v) in dry run mode", vnetResourceIDs)
+			} else if subnetResourceIDs != "" {
+				err = d.updateSubnetsServiceEndpoints(ctx, vnetResourceIDs)
+			} else {
+				err = d.updateSubnetServiceEndpoints(ctx, vnetResourceGroup, vnetName, subnetName)
+			}
+			if err != nil {
 				return nil, status.Errorf(codes.Internal, "update service endpoints failed with error: %v", err)
 			}
 		}
 	}
 
+	if rootSquashType != "" && protocol != nfs {
+		return nil, status.Errorf(codes.InvalidArgument, "rootSquashType(%s) is only supported with nfs protocol, current protocol: %s", rootSquashType, protocol)
+	}
+
 	if pointer.BoolDeref(isMultichannelEnabled, false) {
 		if sku != "" && !strings.HasPrefix(strings.ToLower(sku), premium) {
 			return nil, status.Errorf(codes.InvalidArgument, "smb multichannel is only supported with premium account, current account type: %s", sku)
@@ -365,7 +531,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 
 	fileShareSize := int(requestGiB)
 
-	if account != "" && resourceGroup != "" && sku == "" && fileShareSize < minimumPremiumShareSize {
+	if account != "" && resourceGroup != "" && sku == "" && fileShareSize < minimumPremiumShareSize && !dryRun {
 		accountProperties, err := d.cloud.StorageAccountClient.GetProperties(ctx, subsID, resourceGroup, account)
 		if err != nil {
 			klog.Warningf("failed to get properties on storage account account(%s) rg(%s), error: %v", account, resourceGroup, err)
@@ -375,22 +541,36 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
+	if isDiskFsType(fsType) && d.maxVHDDiskSizeGiB > 0 && requestGiB > d.maxVHDDiskSizeGiB {
+		return nil, status.Errorf(codes.OutOfRange, "requested vhd disk size(%d GiB) exceeds the maximum vhd disk size(%d GiB)", requestGiB, d.maxVHDDiskSizeGiB)
+	}
+
 	// account kind should be FileStorage for Premium File
 	accountKind := string(storage.KindStorageV2)
-	if strings.HasPrefix(strings.ToLower(sku), premium) {
+	if isPremiumSku(sku) {
 		accountKind = string(storage.KindFileStorage)
 		if fileShareSize < minimumPremiumShareSize {
 			fileShareSize = minimumPremiumShareSize
 		}
 	}
 
+	if maxShareQuota > 0 && fileShareSize > maxShareQuota {
+		return nil, status.Errorf(codes.InvalidArgument, "requested file share size(%d GiB) exceeds %s(%d GiB)", fileShareSize, maxShareQuotaField, maxShareQuota)
+	}
+
+	if shareAccessTier != "" && sku != "" {
+		// Premium tier only applies to premium account, while other tiers only apply to standard account
+		isPremiumAccount := strings.HasPrefix(strings.ToLower(sku), premium)
+		if isPremiumAccount != strings.EqualFold(shareAccessTier, string(storage.ShareAccessTierPremium)) {
+			return nil, status.Errorf(codes.InvalidArgument, "shareAccessTier(%s) is not supported with account type(%s)", shareAccessTier, sku)
+		}
+	}
+
 	// replace pv/pvc name namespace metadata in fileShareName
 	validFileShareName := replaceWithMap(fileShareName, fileShareNameReplaceMap)
 	if validFileShareName == "" {
 		name := volName
-		if shareNamePrefix != "" {
-			name = shareNamePrefix + "-" + volName
-		} else {
+		if shareNamePrefix == "" {
 			if protocol == nfs {
 				// use "pvcn" prefix for nfs protocol file share
 				name = strings.Replace(name, "pvc", "pvcn", 1)
@@ -399,25 +579,21 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 				name = strings.Replace(name, "pvc", "pvcd", 1)
 			}
 		}
-		validFileShareName = getValidFileShareName(name)
-	}
-
-	tags, err := ConvertTagsToMap(customTags)
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		validFileShareName = getValidFileShareName(name, shareNamePrefix)
 	}
 
-	if strings.TrimSpace(storageEndpointSuffix) == "" {
-		if d.cloud.Environment.StorageEndpointSuffix != "" {
-			storageEndpointSuffix = d.cloud.Environment.StorageEndpointSuffix
-		} else {
-			storageEndpointSuffix = defaultStorageEndPointSuffix
-		}
-	}
+	storageEndpointSuffix = d.getStorageEndPointSuffix(storageEndpointSuffix)
 	if d.fileClient != nil {
 		d.fileClient.StorageEndpointSuffix = storageEndpointSuffix
 	}
 
+	// tags are only applied to storage accounts created by the driver
+	accountTags := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		accountTags[k] = v
+	}
+	accountTags[accountCreatedByDriverTag] = d.Name
+
 	accountOptions := &azure.AccountOptions{
 		Name:                                    account,
 		Type:                                    sku,
@@ -427,7 +603,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		Location:                                location,
 		EnableHTTPSTrafficOnly:                  enableHTTPSTrafficOnly,
 		MatchTags:                               matchTags,
-		Tags:                                    tags,
+		Tags:                                    accountTags,
 		VirtualNetworkResourceIDs:               vnetResourceIDs,
 		CreateAccount:                           createAccount,
 		CreatePrivateEndpoint:                   createPrivateEndpoint,
@@ -446,6 +622,44 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		GetLatestAccountKey:                     getLatestAccountKey,
 	}
 
+	if dryRun {
+		// all parameters are validated, return a synthetic volume without any account or file share operation
+		if err := validateVolumeContentSource(req.GetVolumeContentSource()); err != nil {
+			return nil, err
+		}
+		var uuid string
+		if fileShareName != "" {
+			uuid = volName
+		}
+		volumeID := fmt.Sprintf(volumeIDTemplate, resourceGroup, account, validFileShareName, diskName, uuid, secretNamespace)
+		klog.V(2).Infof("dry run: CreateVolume(%s) with file share(%s) on account(%s) rg(%s) size(%d GiB) is valid, skip provisioning", volName, validFileShareName, account, resourceGroup, fileShareSize)
+		setKeyValueInMap(parameters, secretNamespaceField, secretNamespace)
+		setKeyValueInMap(parameters, shareNameField, validFileShareName)
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:      volumeID,
+				CapacityBytes: volumehelper.GiBToBytes(int64(fileShareSize)),
+				VolumeContext: parameters,
+				ContentSource: req.GetVolumeContentSource(),
+			},
+		}, nil
+	}
+
+	if srcQuota, err := d.getContentSourceQuota(ctx, req); err != nil {
+		return nil, err
+	} else if srcQuota > fileShareSize {
+		if capacityBytes > 0 {
+			return nil, status.Errorf(codes.OutOfRange, "requested file share size(%d GiB) is smaller than the quota(%d GiB) of source file share", fileShareSize, srcQuota)
+		}
+		klog.V(2).Infof("no capacity is requested, use quota(%d GiB) of source file share as file share size", srcQuota)
+		fileShareSize = srcQuota
+	}
+
+	// reject unsupported volume content source before any file share is created or restored
+	if err := validateVolumeContentSource(req.GetVolumeContentSource()); err != nil {
+		return nil, err
+	}
+
 	var volumeID string
 	requestName := "controller_create_volume"
 	if req.GetVolumeContentSource() != nil {
@@ -457,13 +671,19 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 	mc := metrics.NewMetricContext(azureFileCSIDriverName, requestName, d.cloud.ResourceGroup, subsID, d.Name)
+	lifecycle := newVolumeLifecycleEvent("CreateVolume", volName, "")
+	lifecycle.share = validFileShareName
+	lifecycle.setProtocol(protocol, fsType)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
+		lifecycle.volumeID = volumeID
+		lifecycle.finish(isOperationSucceeded)
 	}()
 
 	var accountKey, lockKey string
 	accountName := account
+	lifecycle.account = accountName
 	if len(req.GetSecrets()) == 0 && accountName == "" {
 		if v, ok := d.volMap.Load(volName); ok {
 			accountName = v.(string)
@@ -471,6 +691,9 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			lockKey = fmt.Sprintf("%s%s%s%s%s%s%s%v%v%v%v%v", sku, accountKind, resourceGroup, location, protocol, subsID, accountAccessTier,
 				pointer.BoolDeref(createPrivateEndpoint, false), pointer.BoolDeref(allowBlobPublicAccess, false), pointer.BoolDeref(requireInfraEncryption, false),
 				pointer.BoolDeref(enableLFS, false), pointer.BoolDeref(disableDeleteRetentionPolicy, false))
+			if len(requiredTags) > 0 {
+				lockKey = fmt.Sprintf("%s%s", lockKey, formatTags(requiredTags))
+			}
 			// search in cache first
 			cache, err := d.accountSearchCache.Get(lockKey, azcache.CacheReadTypeDefault)
 			if err != nil {
@@ -479,19 +702,75 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			if cache != nil {
 				accountName = cache.(string)
 			} else {
-				d.volLockMap.LockEntry(lockKey)
-				err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
-					var retErr error
-					accountName, accountKey, retErr = d.cloud.EnsureStorageAccount(ctx, accountOptions, defaultAccountNamePrefix)
-					if isRetriableError(retErr) {
-						klog.Warningf("EnsureStorageAccount(%s) failed with error(%v), waiting for retrying", account, retErr)
-						sleepIfThrottled(retErr, accountOpThrottlingSleepSec)
-						return false, nil
+				unlock := d.lockAccountSelection(lockKey, subsID, resourceGroup)
+				// the account may be selected or created by a concurrent request which held the lock just now
+				if cache, err = d.accountSearchCache.Get(lockKey, azcache.CacheReadTypeDefault); err != nil {
+					unlock()
+					return nil, status.Errorf(codes.Internal, err.Error())
+				}
+				if cache != nil {
+					accountName = cache.(string)
+				}
+				// existing account selected by tags or allowed account list, it's still passed to EnsureStorageAccount, e.g. for private endpoint setup
+				var selectedAccount string
+				if accountName == "" && (len(requiredTags) > 0 || len(d.allowedAccounts) > 0) {
+					if selectedAccount, err = d.searchAccountByTags(ctx, accountOptions, requiredTags); err != nil {
+						unlock()
+						return nil, status.Errorf(codes.Internal, "failed to search storage account by %s(%s): %v", accountTagSelectorField, accountTagSelector, err)
+					}
+					if selectedAccount == "" {
+						if len(d.allowedAccounts) > 0 {
+							// a new account with generated name is never in the allowed account list
+							unlock()
+							return nil, status.Errorf(codes.PermissionDenied, "no storage account in the allowed account list matches the request in resource group(%s)", resourceGroup)
+						}
+						if !createAccount {
+							unlock()
+							return nil, status.Errorf(codes.ResourceExhausted, "no storage account matches %s(%s) in resource group(%s), set %s as true to create a new storage account", accountTagSelectorField, accountTagSelector, resourceGroup, createAccountField)
+						}
+						// tag the new account so that it could be matched by following volumes
+						for k, v := range requiredTags {
+							accountOptions.Tags[k] = v
+						}
+						accountOptions.CreateAccount = true
+					}
+				}
+				ensureStorageAccount := func(name string) error {
+					accountOptions.Name = name
+					defer func() { accountOptions.Name = account }()
+					return wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+						var retErr error
+						accountName, accountKey, retErr = d.cloud.EnsureStorageAccount(ctx, accountOptions, d.getAccountNamePrefix(protocol))
+						if isRetriableError(retErr) {
+							klog.Warningf("EnsureStorageAccount(%s) failed with error(%v), waiting for retrying", name, retErr)
+							d.sleepIfAccountOpThrottled(retErr)
+							return false, nil
+						}
+						return true, retErr
+					})
+				}
+				if accountName == "" {
+					err = ensureStorageAccount(selectedAccount)
+				}
+				if err == nil && d.isAccountLimitExceeded(accountName) {
+					if len(d.allowedAccounts) > 0 {
+						unlock()
+						return nil, status.Errorf(codes.ResourceExhausted, "account(%s) reached the account limit and a new storage account is not in the allowed account list", accountName)
 					}
-					return true, retErr
-				})
-				d.volLockMap.UnlockEntry(lockKey)
+					// skipMatchingTag may not be added on the exhausted account, e.g. tag update failure, create a new account instead
+					klog.V(2).Infof("account(%s) reached the account limit recently, create a new storage account", accountName)
+					accountName, accountOptions.CreateAccount = "", true
+					err = ensureStorageAccount("")
+				}
+				if err == nil {
+					// share the result with concurrent requests waiting for the lock
+					d.accountSearchCache.Set(lockKey, accountName)
+				}
+				unlock()
 				if err != nil {
+					if isPolicyDeniedError(err) {
+						return nil, status.Errorf(codes.FailedPrecondition, "failed to ensure storage account since the request is denied by Azure Policy, check policy assignments of subscription(%s) resource group(%s) location(%s): %v", subsID, resourceGroup, location, err)
+					}
 					return nil, status.Errorf(codes.Internal, "failed to ensure storage account: %v", err)
 				}
 				if accountQuota > minimumAccountQuota {
@@ -507,11 +786,16 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 						}
 						// release volume lock first to prevent deadlock
 						d.volumeLocks.Release(volName)
+						// clean search cache
+						if err := d.accountSearchCache.Delete(lockKey); err != nil {
+							return nil, status.Errorf(codes.Internal, err.Error())
+						}
 						return d.CreateVolume(ctx, req)
 					}
 				}
 				d.accountSearchCache.Set(lockKey, accountName)
 				d.volMap.Store(volName, accountName)
+				d.trackShareGCAccount(accountName, subsID, resourceGroup)
 				if accountKey != "" {
 					d.accountCacheMap.Set(accountName, accountKey)
 				}
@@ -519,25 +803,41 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
+	if !d.isAllowedAccount(accountName) {
+		return nil, status.Errorf(codes.PermissionDenied, "selected storage account(%s) is not in the allowed account list", accountName)
+	}
+
+	if len(vnetResourceIDs) > 0 {
+		// existing account(e.g. specified by storageAccount or matchTags) may not allow access from cluster subnets
+		if err := d.updateAccountVirtualNetworkRules(ctx, subsID, resourceGroup, accountName, vnetResourceIDs...); err != nil {
+			return nil, status.Errorf(codes.Internal, "update virtual network rules of storage account(%s) failed with error: %v", accountName, err)
+		}
+	}
+
 	if pointer.BoolDeref(createPrivateEndpoint, false) {
 		setKeyValueInMap(parameters, serverNameField, fmt.Sprintf("%s.privatelink.file.%s", accountName, storageEndpointSuffix))
 	}
 
 	accountOptions.Name = accountName
 	secret := req.GetSecrets()
+	// provisioned quota of the file share in GiB, 0 if it's unknown, e.g. file share quota is not read with data plane API
+	var shareQuotaGiB int
 	if len(secret) == 0 && useDataPlaneAPI {
 		if accountKey == "" {
-			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, secret, secretName, secretNamespace); err != nil {
+			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, secret, secretName, secretNamespace, keyVaultURL, keyVaultSecretName); err != nil {
 				return nil, status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
 			}
 		}
 		secret = createStorageAccountSecret(accountName, accountKey)
 		// skip validating file share quota if useDataPlaneAPI
-	} else {
+	} else if len(secret) > 0 {
+		// only quota is available from data plane API
 		if quota, err := d.getFileShareQuota(ctx, subsID, resourceGroup, accountName, validFileShareName, secret); err != nil {
 			return nil, status.Errorf(codes.Internal, err.Error())
 		} else if quota != -1 && quota < fileShareSize {
 			return nil, status.Errorf(codes.AlreadyExists, "request file share(%s) already exists, but its capacity %d is smaller than %d", validFileShareName, quota, fileShareSize)
+		} else if quota != -1 {
+			shareQuotaGiB = quota
 		}
 	}
 
@@ -548,44 +848,174 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		AccessTier: shareAccessTier,
 		RootSquash: rootSquashType,
 	}
+	for k, v := range convertTagsToShareMetadata(tags) {
+		if shareOptions.Metadata == nil {
+			shareOptions.Metadata = map[string]*string{}
+		}
+		shareOptions.Metadata[k] = pointer.String(v)
+	}
+	if retainSharePolicy == retainSharePolicyRetain {
+		// DeleteVolume only has volume ID, so the policy is recorded in share metadata
+		if shareOptions.Metadata == nil {
+			shareOptions.Metadata = map[string]*string{}
+		}
+		shareOptions.Metadata[retainSharePolicyKey] = pointer.String(retainSharePolicy)
+	}
+	if deleteAccountWhenEmpty {
+		// storage account is deleted with its last file share only if it's created by the driver
+		if shareOptions.Metadata == nil {
+			shareOptions.Metadata = map[string]*string{}
+		}
+		shareOptions.Metadata[deleteAccountWhenEmptyKey] = pointer.String(trueValue)
+	}
+	if d.enableShareGC || restoreFromSoftDelete {
+		// fingerprint of file shares created by the driver, only such soft deleted file share could be restored
+		if shareOptions.Metadata == nil {
+			shareOptions.Metadata = map[string]*string{}
+		}
+		shareOptions.Metadata[createdByMetadataKey] = pointer.String(d.Name)
+	}
+	if d.enableShareGC {
+		// fingerprint of file shares which could be reclaimed by share gc
+		shareOptions.Metadata[clusterIDMetadataKey] = pointer.String(d.clusterID)
+	}
+	if maxShareQuota > 0 {
+		// record the cap in share metadata so that ControllerExpandVolume could honor it
+		if shareOptions.Metadata == nil {
+			shareOptions.Metadata = map[string]*string{}
+		}
+		shareOptions.Metadata[maxShareQuotaKey] = pointer.String(strconv.Itoa(maxShareQuota))
+	}
 
-	klog.V(2).Infof("begin to create file share(%s) on account(%s) type(%s) subID(%s) rg(%s) location(%s) size(%d) protocol(%s)", validFileShareName, accountName, sku, subsID, resourceGroup, location, fileShareSize, shareProtocol)
-	if err := d.CreateFileShare(ctx, accountOptions, shareOptions, secret); err != nil {
-		if strings.Contains(err.Error(), accountLimitExceedManagementAPI) || strings.Contains(err.Error(), accountLimitExceedDataPlaneAPI) {
-			klog.Warningf("create file share(%s) on account(%s) type(%s) subID(%s) rg(%s) location(%s) size(%d), error: %v, skip matching current account", validFileShareName, accountName, sku, subsID, resourceGroup, location, fileShareSize, err)
-			if rerr := d.cloud.AddStorageAccountTags(ctx, subsID, resourceGroup, accountName, skipMatchingTag); rerr != nil {
-				klog.Warningf("AddStorageAccountTags(%v) on account(%s) subsID(%s) rg(%s) failed with error: %v", tags, accountName, subsID, resourceGroup, rerr.Error())
+	// shareNotFound is true only if the file share is known to be absent before CreateFileShare
+	var restored, shareNotFound, shareCreated bool
+	if len(secret) == 0 && !useDataPlaneAPI {
+		fileShare, err := d.cloud.GetFileShare(ctx, subsID, resourceGroup, accountName, validFileShareName)
+		if err != nil && !strings.Contains(err.Error(), "ShareNotFound") {
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+		shareNotFound = err != nil
+		if err != nil && restoreFromSoftDelete {
+			// restore the soft deleted file share with the same name instead of creating a new one
+			if accountKey == "" {
+				var keyErr error
+				if accountKey, keyErr = d.GetStorageAccesskey(ctx, accountOptions, secret, secretName, secretNamespace, keyVaultURL, keyVaultSecretName); keyErr != nil {
+					return nil, status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, keyErr)
+				}
 			}
-			// do not remove skipMatchingTag in a period of time
-			d.skipMatchingTagCache.Set(accountName, "")
-			// release volume lock first to prevent deadlock
-			d.volumeLocks.Release(volName)
-			// clean search cache
-			if err := d.accountSearchCache.Delete(lockKey); err != nil {
-				return nil, status.Errorf(codes.Internal, err.Error())
+			var restoreErr error
+			if restored, restoreErr = d.RestoreFileShare(ctx, subsID, resourceGroup, accountName, accountKey, storageEndpointSuffix, shareOptions); restoreErr != nil {
+				if _, ok := status.FromError(restoreErr); ok {
+					return nil, restoreErr
+				}
+				return nil, status.Errorf(codes.Internal, "%v", restoreErr)
+			}
+			if restored {
+				if fileShare, err = d.cloud.GetFileShare(ctx, subsID, resourceGroup, accountName, validFileShareName); err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to get restored file share(%s) on account(%s): %v", validFileShareName, accountName, err)
+				}
+				if fileShare.FileShareProperties != nil && int(pointer.Int32Deref(fileShare.ShareQuota, 0)) < fileShareSize {
+					klog.V(2).Infof("resize restored file share(%s) on account(%s) to %d GiB", validFileShareName, accountName, fileShareSize)
+					// protocol of soft deleted file share is checked before restoring
+					err := d.ResizeFileShare(ctx, subsID, resourceGroup, accountName, validFileShareName, fileShareSize, secret)
+					if err != nil && len(secret) == 0 && isThrottlingError(err) {
+						klog.Warningf("ResizeFileShare(%s) on account(%s) is throttled, retry with data plane API", validFileShareName, accountName)
+						err = d.ResizeFileShare(ctx, subsID, resourceGroup, accountName, validFileShareName, fileShareSize, createStorageAccountSecret(accountName, accountKey))
+					}
+					if err != nil {
+						return nil, status.Errorf(codes.Internal, "failed to resize restored file share(%s) on account(%s): %v", validFileShareName, accountName, err)
+					}
+					fileShare.ShareQuota = pointer.Int32(int32(fileShareSize))
+				}
+			}
+		}
+		if err == nil {
+			if fileShare.FileShareProperties == nil || fileShare.FileShareProperties.ShareQuota == nil {
+				return nil, status.Errorf(codes.Internal, "FileShareProperties or FileShareProperties.ShareQuota is nil")
+			}
+			// CreateVolume is idempotent only if the existing file share is compatible with the request
+			if err := checkFileShareCompatibility(fileShare.FileShareProperties, shareOptions); err != nil {
+				return nil, status.Errorf(codes.AlreadyExists, "request file share(%s) already exists, but %v", validFileShareName, err)
+			}
+			shareQuotaGiB = int(*fileShare.FileShareProperties.ShareQuota)
+		}
+	} else if restoreFromSoftDelete {
+		klog.Warningf("%s is not supported with data plane API, file share(%s) would be created on account(%s)", restoreFromSoftDeleteField, validFileShareName, accountName)
+	}
+
+	if restored {
+		klog.V(2).Infof("restored soft deleted file share(%s) on account(%s), skip creating file share", validFileShareName, accountName)
+	} else {
+		klog.V(2).Infof("begin to create file share(%s) on account(%s) type(%s) subID(%s) rg(%s) location(%s) size(%d) protocol(%s)", validFileShareName, accountName, sku, subsID, resourceGroup, location, fileShareSize, shareProtocol)
+		if err := d.CreateFileShare(ctx, accountOptions, shareOptions, secret); err != nil {
+			if strings.Contains(err.Error(), accountLimitExceedManagementAPI) || strings.Contains(err.Error(), accountLimitExceedDataPlaneAPI) {
+				if lockKey != "" && disableCreateAccount {
+					return nil, status.Errorf(codes.ResourceExhausted, "failed to create file share(%s) on account(%s) since account limit is exceeded, %s is false, no new storage account would be created: %v", validFileShareName, accountName, createAccountField, err)
+				}
+				klog.Warningf("create file share(%s) on account(%s) type(%s) subID(%s) rg(%s) location(%s) size(%d), error: %v, skip matching current account", validFileShareName, accountName, sku, subsID, resourceGroup, location, fileShareSize, err)
+				if rerr := d.cloud.AddStorageAccountTags(ctx, subsID, resourceGroup, accountName, skipMatchingTag); rerr != nil {
+					klog.Warningf("AddStorageAccountTags(%v) on account(%s) subsID(%s) rg(%s) failed with error: %v", tags, accountName, subsID, resourceGroup, rerr.Error())
+				}
+				// do not remove skipMatchingTag in a period of time
+				d.skipMatchingTagCache.Set(accountName, "")
+				if lockKey != "" {
+					// stop selecting the exhausted account in following volume provisioning, a new account would be created if no other account matches
+					d.accountLimitExceededCache.Set(accountName, "")
+					d.removeAccountFromCache(accountName)
+				}
+				// release volume lock first to prevent deadlock
+				d.volumeLocks.Release(volName)
+				// clean search cache
+				if err := d.accountSearchCache.Delete(lockKey); err != nil {
+					return nil, status.Errorf(codes.Internal, err.Error())
+				}
+				// remove the volName from the volMap to stop matching the same storage account
+				d.volMap.Delete(volName)
+				return d.CreateVolume(ctx, req)
 			}
-			// remove the volName from the volMap to stop matching the same storage account
-			d.volMap.Delete(volName)
-			return d.CreateVolume(ctx, req)
+			return nil, status.Errorf(codes.Internal, "failed to create file share(%s) on account(%s) type(%s) subsID(%s) rg(%s) location(%s) size(%d), error: %v", validFileShareName, account, sku, subsID, resourceGroup, location, fileShareSize, err)
 		}
-		return nil, status.Errorf(codes.Internal, "failed to create file share(%s) on account(%s) type(%s) subsID(%s) rg(%s) location(%s) size(%d), error: %v", validFileShareName, account, sku, subsID, resourceGroup, location, fileShareSize, err)
+		shareCreated = shareNotFound
 	}
 	if req.GetVolumeContentSource() != nil {
-		accountKeyCopy, err := d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace)
+		accountKeyCopy, err := d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, keyVaultURL, keyVaultSecretName)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
 		}
 		if err := d.copyVolume(ctx, req, accountKeyCopy, shareOptions, storageEndpointSuffix); err != nil {
+			if status.Code(err) == codes.DeadlineExceeded {
+				// azcopy may still be writing to the file share, keep it so that the retry could wait for the copy job
+				return nil, err
+			}
+			// do not leave a partially copied file share behind, while an existing file share is never deleted
+			if shareCreated {
+				if delErr := d.DeleteFileShare(ctx, subsID, resourceGroup, accountName, validFileShareName, secret); delErr != nil {
+					klog.Warningf("failed to delete file share(%s) on account(%s) after copy volume failure: %v", validFileShareName, accountName, delErr)
+				}
+			}
 			return nil, err
 		}
+		if vs := req.GetVolumeContentSource().GetVolume(); vs != nil {
+			if _, _, _, srcDiskName, _, _, err := GetFileShareInfo(vs.GetVolumeId()); err == nil && strings.HasSuffix(srcDiskName, vhdSuffix) {
+				// the vhd disk file is copied with the same name
+				diskName = srcDiskName
+				setKeyValueInMap(parameters, diskNameField, diskName)
+			}
+		}
 		// storeAccountKey is not needed here since copy volume is only using SAS token
 		storeAccountKey = false
 	}
 	klog.V(2).Infof("create file share %s on storage account %s successfully", validFileShareName, accountName)
+	d.shareProtocolCache.Set(getShareProtocolCacheKey(accountName, validFileShareName), shareProtocol)
+	if len(req.GetSecrets()) == 0 {
+		if err := d.tagAccountWithDriverVersion(ctx, subsID, resourceGroup, accountName); err != nil {
+			klog.Warningf("failed to tag account(%s) rg(%s) with driver version: %v", accountName, resourceGroup, err)
+		}
+	}
 
 	if isDiskFsType(fsType) && !strings.HasSuffix(diskName, vhdSuffix) && req.GetVolumeContentSource() == nil {
 		if accountKey == "" {
-			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace); err != nil {
+			if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, keyVaultURL, keyVaultSecretName); err != nil {
 				return nil, status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
 			}
 		}
@@ -599,7 +1029,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		diskSizeBytes := volumehelper.GiBToBytes(requestGiB)
 		klog.V(2).Infof("begin to create vhd file(%s) size(%d) on share(%s) on account(%s) type(%s) rg(%s) location(%s)",
 			diskName, diskSizeBytes, validFileShareName, account, sku, resourceGroup, location)
-		if err := createDisk(ctx, accountName, accountKey, d.cloud.Environment.StorageEndpointSuffix, validFileShareName, diskName, diskSizeBytes); err != nil {
+		if err := createDisk(ctx, accountName, accountKey, storageEndpointSuffix, validFileShareName, diskName, diskSizeBytes, d.dataPlaneRetryOptions); err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to create VHD disk: %v", err)
 		}
 		klog.V(2).Infof("create vhd file(%s) size(%d) on share(%s) on account(%s) type(%s) rg(%s) location(%s) successfully",
@@ -618,7 +1048,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 		if !useSeretCache {
 			if accountKey == "" {
-				if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace); err != nil {
+				if accountKey, err = d.GetStorageAccesskey(ctx, accountOptions, req.GetSecrets(), secretName, secretNamespace, keyVaultURL, keyVaultSecretName); err != nil {
 					return nil, status.Errorf(codes.Internal, "failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
 				}
 			}
@@ -639,19 +1069,36 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		// not necessary for dynamic file share name creation since volumeID already contains volume name
 		uuid = volName
 	}
+	lifecycle.account = accountName
 	volumeID = fmt.Sprintf(volumeIDTemplate, resourceGroup, accountName, validFileShareName, diskName, uuid, secretNamespace)
-	if subsID != "" && subsID != d.cloud.SubscriptionID {
+	if subsID != "" && !strings.EqualFold(subsID, d.cloud.SubscriptionID) {
 		volumeID = volumeID + "#" + subsID
 	}
 
 	if useDataPlaneAPI {
 		d.dataPlaneAPIVolMap.Store(volumeID, "")
 	}
+	if customSuffix := getValueInMap(parameters, storageEndpointSuffixField); strings.TrimSpace(customSuffix) != "" {
+		d.storageEndpointSuffixVolMap.Store(volumeID, customSuffix)
+	}
 
 	isOperationSucceeded = true
 
+	switch {
+	case isDiskFsType(fsType):
+		// capacity of vhd disk volume is the disk size instead of the file share quota
+		capacityBytes = volumehelper.GiBToBytes(requestGiB)
+	case shareQuotaGiB > 0:
+		capacityBytes = volumehelper.GiBToBytes(int64(shareQuotaGiB))
+	default:
+		// quota could not be read back, report the rounded size requested on file share creation
+		// instead of the raw request, otherwise resizer would find the volume smaller than its quota
+		capacityBytes = volumehelper.GiBToBytes(int64(fileShareSize))
+	}
 	// reset secretNamespace field in VolumeContext
 	setKeyValueInMap(parameters, secretNamespaceField, secretNamespace)
+	// surface the resolved file share name since it may be generated from volume name or replaced with pv/pvc metadata
+	setKeyValueInMap(parameters, shareNameField, validFileShareName)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
@@ -668,6 +1115,9 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if err := d.validateVolumeID(volumeID); err != nil {
+		return nil, err
+	}
 
 	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid delete volume request: %v", req)
@@ -684,6 +1134,9 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		klog.Errorf("GetFileShareInfo(%s) in DeleteVolume failed with error: %v", volumeID, err)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
+	if !d.isAllowedAccount(accountName) {
+		return nil, status.Errorf(codes.PermissionDenied, "storage account(%s) of volume(%s) is not in the allowed account list", accountName, volumeID)
+	}
 
 	if resourceGroupName == "" {
 		resourceGroupName = d.cloud.ResourceGroup
@@ -706,56 +1159,187 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		}
 		secret = createStorageAccountSecret(accountName, accountKey)
 	}
+	if err := validateDeleteFileShareParams(resourceGroupName, accountName, fileShareName, secret); err != nil {
+		return nil, err
+	}
 
 	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_delete_volume", resourceGroupName, subsID, d.Name)
+	lifecycle := newVolumeLifecycleEvent("DeleteVolume", "", volumeID)
+	lifecycle.account, lifecycle.share = accountName, fileShareName
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
+		lifecycle.finish(isOperationSucceeded)
 	}()
 
+	metadata, err := d.getAllFileShareMetadata(ctx, subsID, resourceGroupName, accountName, fileShareName, secret)
+	if err != nil && !isNotFoundError(err) {
+		// do not delete a file share which may need to be retained
+		return nil, status.Errorf(codes.Internal, "failed to get %s of file share(%s) under account(%s) rg(%s): %v", retainSharePolicyField, fileShareName, accountName, resourceGroupName, err)
+	}
+	if strings.EqualFold(metadata[retainSharePolicyKey], retainSharePolicyRetain) {
+		if metadata[createdByMetadataKey] != "" {
+			// retained file share must not be reclaimed by share gc, it's still skipped by share gc due to its retain policy if this fails
+			if err := d.markShareRetained(ctx, volumeID, accountName, fileShareName, secretNamespace, secret, metadata); err != nil {
+				klog.Warningf("failed to remove share gc fingerprint from retained file share(%s) under account(%s): %v", fileShareName, accountName, err)
+			}
+		}
+		d.dataPlaneAPIVolMap.Delete(volumeID)
+		d.storageEndpointSuffixVolMap.Delete(volumeID)
+		klog.V(2).Infof("azure file(%s) under subsID(%s) rg(%s) account(%s) is retained intentionally since %s is %s, volume(%s) is deleted without deleting the file share",
+			fileShareName, subsID, resourceGroupName, accountName, retainSharePolicyField, retainSharePolicyRetain, volumeID)
+		isOperationSucceeded = true
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
 	if err := d.DeleteFileShare(ctx, subsID, resourceGroupName, accountName, fileShareName, secret); err != nil {
 		return nil, status.Errorf(codes.Internal, "DeleteFileShare %s under account(%s) rg(%s) failed with error: %v", fileShareName, accountName, resourceGroupName, err)
 	}
 	klog.V(2).Infof("azure file(%s) under subsID(%s) rg(%s) account(%s) volume(%s) is deleted successfully", fileShareName, subsID, resourceGroupName, accountName, volumeID)
+	if err := d.shareProtocolCache.Delete(getShareProtocolCacheKey(accountName, fileShareName)); err != nil {
+		klog.Warningf("failed to delete file share(%s) on account(%s) from shareProtocolCache: %v", fileShareName, accountName, err)
+	}
 	if err := d.RemoveStorageAccountTag(ctx, subsID, resourceGroupName, accountName, azure.SkipMatchingTag); err != nil {
 		klog.Warningf("RemoveStorageAccountTag(%s) under rg(%s) account(%s) failed with %v", azure.SkipMatchingTag, resourceGroupName, accountName, err)
 	}
+	if len(secret) == 0 && strings.EqualFold(metadata[deleteAccountWhenEmptyKey], trueValue) {
+		// the file share is already deleted, failure of deleting the account is not returned
+		if err := d.deleteAccountIfEmpty(ctx, subsID, resourceGroupName, accountName); err != nil {
+			klog.Warningf("failed to delete empty account(%s) under subsID(%s) rg(%s): %v", accountName, subsID, resourceGroupName, err)
+		}
+	}
 
+	d.storageEndpointSuffixVolMap.Delete(volumeID)
 	isOperationSucceeded = true
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (d *Driver) copyVolume(ctx context.Context, req *csi.CreateVolumeRequest, accountKey string, shareOptions *fileclient.ShareOptions, storageEndpointSuffix string) error {
-	vs := req.VolumeContentSource
+// validateVolumeContentSource returns InvalidArgument if the volume content source is not supported by copyVolume
+func validateVolumeContentSource(vs *csi.VolumeContentSource) error {
+	if vs == nil {
+		return nil
+	}
 	switch vs.Type.(type) {
 	case *csi.VolumeContentSource_Snapshot:
 		return status.Errorf(codes.InvalidArgument, "copy volume from volumeSnapshot is not supported")
 	case *csi.VolumeContentSource_Volume:
-		return d.copyFileShare(ctx, req, accountKey, shareOptions, storageEndpointSuffix)
+		return nil
 	default:
 		return status.Errorf(codes.InvalidArgument, "%v is not a proper volume source", vs)
 	}
 }
 
-// ControllerGetVolume get volume
-func (d *Driver) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (d *Driver) copyVolume(ctx context.Context, req *csi.CreateVolumeRequest, accountKey string, shareOptions *fileclient.ShareOptions, storageEndpointSuffix string) error {
+	if err := validateVolumeContentSource(req.VolumeContentSource); err != nil {
+		return err
+	}
+	return d.copyFileShare(ctx, req, accountKey, shareOptions, storageEndpointSuffix)
 }
 
-// ValidateVolumeCapabilities return the capabilities of the volume
-func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+// checkSnapshotSourceShare returns NotFound if the source file share of snapshot has been deleted,
+// otherwise returns the quota of source file share in GiB, 0 is returned if the source is a vhd disk volume
+func (d *Driver) checkSnapshotSourceShare(ctx context.Context, snapshotID string) (int, error) {
+	rgName, accountName, fileShareName, diskName, _, subsID, err := GetFileShareInfo(snapshotID)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid snapshot id(%s): %v", snapshotID, err)
+	}
+	if fileShareName == "" {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid snapshot id(%s): file share name is empty", snapshotID)
+	}
+	if rgName == "" {
+		rgName = d.cloud.ResourceGroup
+	}
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	if d.cloud.FileClient == nil {
+		return 0, nil
+	}
+	share, err := d.cloud.FileClient.WithSubscriptionID(subsID).GetFileShare(ctx, rgName, accountName, fileShareName, "")
+	if err != nil {
+		if isNotFoundError(err) {
+			return 0, status.Errorf(codes.NotFound, "source file share(%s) of snapshot(%s) on account(%s) does not exist", fileShareName, snapshotID, accountName)
+		}
+		return 0, status.Errorf(codes.Internal, "failed to get source file share(%s) of snapshot(%s) on account(%s): %v", fileShareName, snapshotID, accountName, err)
+	}
+	if share.FileShareProperties == nil {
+		return 0, nil
+	}
+	if pointer.BoolDeref(share.FileShareProperties.Deleted, false) {
+		return 0, status.Errorf(codes.NotFound, "source file share(%s) of snapshot(%s) on account(%s) has been deleted", fileShareName, snapshotID, accountName)
+	}
+	if strings.HasSuffix(diskName, vhdSuffix) {
+		// size of vhd disk volume is not the share quota
+		return 0, nil
+	}
+	// quota of source file share could be changed after the snapshot is taken
+	snapshot, err := getSnapshot(snapshotID)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid snapshot id(%s): %v", snapshotID, err)
+	}
+	snapshotShare, err := d.cloud.FileClient.WithSubscriptionID(subsID).GetFileShare(ctx, rgName, accountName, fileShareName, snapshot)
+	if err != nil {
+		if isNotFoundError(err) {
+			return 0, status.Errorf(codes.NotFound, "snapshot(%s) of file share(%s) on account(%s) does not exist", snapshotID, fileShareName, accountName)
+		}
+		return 0, status.Errorf(codes.Internal, "failed to get snapshot(%s) of file share(%s) on account(%s): %v", snapshotID, fileShareName, accountName, err)
+	}
+	if snapshotShare.FileShareProperties == nil {
+		return 0, nil
+	}
+	return int(pointer.Int32Deref(snapshotShare.FileShareProperties.ShareQuota, 0)), nil
+}
+
+// getContentSourceQuota returns the quota of source file share of the volume content source in GiB,
+// 0 is returned if there is no content source or the source is a vhd disk volume
+func (d *Driver) getContentSourceQuota(ctx context.Context, req *csi.CreateVolumeRequest) (int, error) {
+	if vs := req.GetVolumeContentSource().GetSnapshot(); vs != nil {
+		return d.checkSnapshotSourceShare(ctx, vs.GetSnapshotId())
+	}
+	var sourceID string
+	if vs := req.GetVolumeContentSource().GetVolume(); vs != nil {
+		sourceID = vs.GetVolumeId()
+	}
+	if sourceID == "" || d.cloud.FileClient == nil {
+		return 0, nil
+	}
+	rgName, accountName, fileShareName, diskName, _, subsID, err := GetFileShareInfo(sourceID)
+	if err != nil || fileShareName == "" || strings.HasSuffix(diskName, vhdSuffix) {
+		// invalid source id is reported when copying volume, size of vhd disk volume is not the share quota
+		return 0, nil
+	}
+	if rgName == "" {
+		rgName = d.cloud.ResourceGroup
+	}
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+	quota, err := d.getFileShareQuota(ctx, subsID, rgName, accountName, fileShareName, req.GetSecrets())
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "failed to get quota of source file share(%s) on account(%s): %v", fileShareName, accountName, err)
+	}
+	if quota == -1 {
+		return 0, status.Errorf(codes.NotFound, "source file share(%s) on account(%s) does not exist", fileShareName, accountName)
+	}
+	return quota, nil
+}
+
+// ControllerGetVolume get volume
+func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	volCaps := req.GetVolumeCapabilities()
-	if len(volCaps) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not provided")
+	if err := d.validateVolumeID(volumeID); err != nil {
+		return nil, err
+	}
+	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid get volume request: %v", req)
 	}
 
-	resourceGroupName, accountName, _, fileShareName, diskName, subsID, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), req.GetVolumeContext())
-	if err != nil || accountName == "" || fileShareName == "" {
-		return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
+	resourceGroupName, accountName, fileShareName, _, _, subsID, err := GetFileShareInfo(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "GetFileShareInfo(%s) failed with error: %v", volumeID, err)
 	}
 	if resourceGroupName == "" {
 		resourceGroupName = d.cloud.ResourceGroup
@@ -764,20 +1348,115 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		subsID = d.cloud.SubscriptionID
 	}
 
-	if quota, err := d.getFileShareQuota(ctx, subsID, resourceGroupName, accountName, fileShareName, req.GetSecrets()); err != nil {
-		return nil, status.Errorf(codes.Internal, "error checking if volume(%s) exists: %v", volumeID, err)
-	} else if quota == -1 {
+	quota, err := d.getFileShareQuota(ctx, subsID, resourceGroupName, accountName, fileShareName, nil)
+	if err != nil {
+		// volume is reported as abnormal instead of returning error so that external-health-monitor could record the condition
+		var message string
+		switch {
+		case isThrottlingError(err):
+			message = fmt.Sprintf("storage account(%s) is throttled: %v", accountName, err)
+		case isShareBeingDeletedError(err):
+			message = fmt.Sprintf("file share(%s) on account(%s) is being deleted", fileShareName, accountName)
+		default:
+			message = fmt.Sprintf("failed to get file share(%s) on account(%s): %v", fileShareName, accountName, err)
+		}
+		klog.Warningf("ControllerGetVolume(%s): %s", volumeID, message)
+		return &csi.ControllerGetVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId: volumeID,
+			},
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: message},
+			},
+		}, nil
+	}
+	if quota == -1 {
 		return nil, status.Errorf(codes.NotFound, "the requested volume(%s) does not exist.", volumeID)
 	}
 
-	confirmed := &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps}
-	if !strings.HasSuffix(diskName, vhdSuffix) {
-		return &csi.ValidateVolumeCapabilitiesResponse{Confirmed: confirmed}, nil
+	volumeContext := map[string]string{
+		shareDeleteRetentionPolicyEnabledKey: unknownValue,
 	}
-	for _, c := range volCaps {
-		if c.GetAccessMode().Mode == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER {
-			return &csi.ValidateVolumeCapabilitiesResponse{}, nil
-		}
+	policy, err := d.getShareDeleteRetentionPolicy(ctx, subsID, resourceGroupName, accountName)
+	if err != nil {
+		// soft delete state is informational, account being inaccessible should not fail the request
+		klog.Warningf("failed to get share delete retention policy of account(%s) in resource group(%s): %v", accountName, resourceGroupName, err)
+	} else {
+		enabled := pointer.BoolDeref(policy.Enabled, false)
+		volumeContext[shareDeleteRetentionPolicyEnabledKey] = strconv.FormatBool(enabled)
+		if enabled && policy.Days != nil {
+			volumeContext[shareDeleteRetentionDaysKey] = strconv.Itoa(int(*policy.Days))
+		}
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: volumehelper.GiBToBytes(int64(quota)),
+			VolumeContext: volumeContext,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: "file share is accessible"},
+		},
+	}, nil
+}
+
+// lockAccountSelection locks storage account selection and creation with the same account options,
+// it also locks the whole resource group if serializeAccountCreation is set, returns the unlock function
+func (d *Driver) lockAccountSelection(lockKey, subsID, resourceGroup string) func() {
+	var rgLockKey string
+	if d.serializeAccountCreation {
+		rgLockKey = strings.ToLower(subsID + "/" + resourceGroup)
+		d.accountLockMap.LockEntry(rgLockKey)
+	}
+	d.volLockMap.LockEntry(lockKey)
+	return func() {
+		d.volLockMap.UnlockEntry(lockKey)
+		if rgLockKey != "" {
+			d.accountLockMap.UnlockEntry(rgLockKey)
+		}
+	}
+}
+
+// ValidateVolumeCapabilities return the capabilities of the volume
+func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	if err := d.validateVolumeID(volumeID); err != nil {
+		return nil, err
+	}
+	volCaps := req.GetVolumeCapabilities()
+	if len(volCaps) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not provided")
+	}
+
+	resourceGroupName, accountName, _, fileShareName, diskName, subsID, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), req.GetVolumeContext())
+	if err != nil || accountName == "" || fileShareName == "" {
+		return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
+	}
+	if resourceGroupName == "" {
+		resourceGroupName = d.cloud.ResourceGroup
+	}
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+
+	if quota, err := d.getFileShareQuota(ctx, subsID, resourceGroupName, accountName, fileShareName, req.GetSecrets()); err != nil {
+		return nil, status.Errorf(codes.Internal, "error checking if volume(%s) exists: %v", volumeID, err)
+	} else if quota == -1 {
+		return nil, status.Errorf(codes.NotFound, "the requested volume(%s) does not exist.", volumeID)
+	}
+
+	if err := isSupportedVolumeCapabilities(volCaps, strings.HasSuffix(diskName, vhdSuffix)); err != nil {
+		klog.V(2).Infof("volume capabilities of volume(%s) are not supported: %v", volumeID, err)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	confirmed := &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+		VolumeContext:      req.GetVolumeContext(),
+		VolumeCapabilities: volCaps,
+		Parameters:         req.GetParameters(),
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{Confirmed: confirmed}, nil
 }
@@ -789,9 +1468,91 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	}, nil
 }
 
-// GetCapacity returns the capacity of the total available storage pool
+// GetCapacity returns the provisioned share capacity remaining in the storage account before hitting the account limit
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid get capacity request: %v", req)
+	}
+
+	var sku, subsID, resourceGroup, account, protocol, fsType string
+	var accountQuota int32
+	for k, v := range req.GetParameters() {
+		switch strings.ToLower(k) {
+		case skuNameField:
+			sku = v
+		case storageAccountTypeField:
+			sku = v
+		case protocolField:
+			protocol = v
+		case fsTypeField:
+			fsType = v
+		case storageAccountField:
+			account = v
+		case subscriptionIDField:
+			subsID = v
+		case resourceGroupField:
+			resourceGroup = v
+		case accountQuotaField:
+			value, err := strconv.ParseInt(v, 10, 32)
+			if err != nil || value < minimumAccountQuota {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid accountQuota %s in storage class, minimum quota: %d", v, minimumAccountQuota)
+			}
+			accountQuota = int32(value)
+		}
+	}
+	if subsID != "" && !isValidSubscriptionID(subsID) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s(%s) in storage class, it should be a GUID", subscriptionIDField, subsID)
+	}
+
+	if resourceGroup == "" {
+		resourceGroup = d.cloud.ResourceGroup
+	}
+	if sku == "" && (fsType == nfs || protocol == nfs) {
+		// NFS protocol only supports Premium storage
+		sku = string(storage.SkuNamePremiumLRS)
+	}
+	if sku == "" && account != "" && accountQuota == 0 {
+		accountProperties, err := d.cloud.StorageAccountClient.GetProperties(ctx, subsID, resourceGroup, account)
+		if err != nil {
+			klog.Warningf("failed to get properties on storage account account(%s) rg(%s), error: %v", account, resourceGroup, err)
+		}
+		if accountProperties.Sku != nil {
+			sku = string(accountProperties.Sku.Name)
+		}
+	}
+
+	var accountLimitGB int32
+	switch {
+	case accountQuota > 0:
+		accountLimitGB = accountQuota
+	case sku == "":
+		klog.V(2).Infof("account type of storage account(%s) is unknown, available capacity could not be estimated", account)
+		return &csi.GetCapacityResponse{}, nil
+	case isPremiumSku(sku):
+		accountLimitGB = premiumAccountCapacityLimit
+	default:
+		accountLimitGB = standardAccountCapacityLimit
+	}
+
+	if account == "" {
+		klog.V(2).Infof("storage account is not specified, available capacity(%d GB) is a coarse estimate of the account limit", accountLimitGB)
+		return &csi.GetCapacityResponse{
+			AvailableCapacity: volumehelper.GiBToBytes(int64(accountLimitGB)),
+		}, nil
+	}
+
+	totalQuotaGB, _, err := d.GetTotalAccountQuota(ctx, subsID, resourceGroup, account)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get total quota of account(%s) in resource group(%s): %v", account, resourceGroup, err)
+	}
+	availableGB := accountLimitGB - totalQuotaGB
+	if availableGB < 0 {
+		availableGB = 0
+	}
+	klog.V(2).Infof("account(%s) provisioned quota(%d GB), account limit(%d GB), available capacity(%d GB)", account, totalQuotaGB, accountLimitGB, availableGB)
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: volumehelper.GiBToBytes(int64(availableGB)),
+	}, nil
 }
 
 // ListVolumes return all available volumes
@@ -816,7 +1577,16 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Error(codes.InvalidArgument, "Node ID not provided")
 	}
 
+	if d.validateStaticVolumeID {
+		if err := d.ValidateVolumeID(ctx, volumeID, req.GetSecrets(), req.GetVolumeContext()); err != nil {
+			return nil, err
+		}
+	}
+
 	volContext := req.GetVolumeContext()
+	if customSuffix := getValueInMap(volContext, storageEndpointSuffixField); strings.TrimSpace(customSuffix) != "" {
+		d.storageEndpointSuffixVolMap.Store(volumeID, customSuffix)
+	}
 	_, accountName, accountKey, fileShareName, diskName, _, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), volContext)
 	// always check diskName first since if it's not vhd disk attach, ControllerPublishVolume is not necessary
 	if !strings.HasSuffix(diskName, vhdSuffix) {
@@ -848,8 +1618,8 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 	}
 	defer d.volumeLocks.Release(volumeID)
 
-	storageEndpointSuffix := d.cloud.Environment.StorageEndpointSuffix
-	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
+	storageEndpointSuffix := d.getStorageEndPointSuffix(getValueInMap(volContext, storageEndpointSuffixField))
+	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName, d.dataPlaneRetryOptions)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned with error: %v", accountName, storageEndpointSuffix, fileShareName, diskName, err))
 	}
@@ -862,10 +1632,15 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Error(codes.Internal, fmt.Sprintf("GetProperties for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err))
 	}
 
-	attachedNodeID, ok := properties.NewMetadata()[metaDataNode]
-	if ok && attachedNodeID != "" && !strings.EqualFold(attachedNodeID, nodeID) {
+	attachedNodeID := properties.NewMetadata()[metaDataNode]
+	if isAttachedToOtherNode(attachedNodeID, nodeID) {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("volume(%s) cannot be attached to node(%s) since it's already attached to node(%s)", volumeID, nodeID, attachedNodeID))
 	}
+	if attachedNodeID != "" {
+		// attach may be retried after driver restart, the attachment is derived from the metadata of vhd disk
+		klog.V(2).Infof("ControllerPublishVolume: volume(%s) is already attached to node(%s)", volumeID, nodeID)
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
 	if _, err = fileURL.SetMetadata(ctx, azfile.Metadata{metaDataNode: nodeID}); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("SetMetadata for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err))
 	}
@@ -900,8 +1675,8 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	}
 	defer d.volumeLocks.Release(volumeID)
 
-	storageEndpointSuffix := d.cloud.Environment.StorageEndpointSuffix
-	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
+	storageEndpointSuffix := d.getVolumeStorageEndPointSuffix(volumeID)
+	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName, d.dataPlaneRetryOptions)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned with error: %v", accountName, storageEndpointSuffix, fileShareName, diskName, err))
 	}
@@ -909,6 +1684,20 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName))
 	}
 
+	properties, err := fileURL.GetProperties(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("GetProperties for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err))
+	}
+	attachedNodeID := properties.NewMetadata()[metaDataNode]
+	if attachedNodeID == "" {
+		klog.V(2).Infof("ControllerUnpublishVolume: volume(%s) is already detached", volumeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if isAttachedToOtherNode(attachedNodeID, nodeID) {
+		// a stale detach (e.g. retried after driver restart) must not break the attachment of another node
+		klog.Warningf("ControllerUnpublishVolume: skip detaching volume(%s) from node(%s) since it's attached to node(%s)", volumeID, nodeID, attachedNodeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
 	if _, err = fileURL.SetMetadata(ctx, azfile.Metadata{metaDataNode: ""}); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("SetMetadata for volume(%s) on node(%s) returned with error: %v", volumeID, nodeID, err))
 	}
@@ -916,6 +1705,12 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
+// isAttachedToOtherNode returns true if the vhd disk is attached to a node other than nodeID,
+// attachedNodeID is read from the metadata of vhd disk which is the source of truth of attachment
+func isAttachedToOtherNode(attachedNodeID, nodeID string) bool {
+	return attachedNodeID != "" && !strings.EqualFold(attachedNodeID, nodeID)
+}
+
 // CreateSnapshot create a snapshot
 func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
 	sourceVolumeID := req.GetSourceVolumeId()
@@ -926,6 +1721,9 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	if len(sourceVolumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID must be provided")
 	}
+	if err := d.validateVolumeID(sourceVolumeID); err != nil {
+		return nil, err
+	}
 
 	rgName, accountName, fileShareName, _, _, subsID, err := GetFileShareInfo(sourceVolumeID) //nolint:dogsled
 	if err != nil {
@@ -948,6 +1746,15 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 		}
 	}
 
+	// serialize snapshot creation of the same file share, otherwise concurrent calls with the same name
+	// could all miss the existing snapshot check below and create duplicate snapshots
+	rateLimitKey := strings.ToLower(accountName + "/" + fileShareName)
+	snapshotLockKey := "snapshot#" + rateLimitKey
+	if acquired := d.volumeLocks.TryAcquire(snapshotLockKey); !acquired {
+		return nil, status.Errorf(codes.Aborted, snapshotOperationAlreadyExistsFmt, sourceVolumeID)
+	}
+	defer d.volumeLocks.Release(snapshotLockKey)
+
 	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_create_snapshot", rgName, subsID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
@@ -963,6 +1770,9 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	}
 	if exists {
 		klog.V(2).Infof("snapshot(%s) already exists", snapshotName)
+		if itemSnapshot, err = normalizeSnapshotTime(itemSnapshot); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to construct id of snapshot(%s) from(%s): %v", snapshotName, sourceVolumeID, err)
+		}
 		return &csi.CreateSnapshotResponse{
 			Snapshot: &csi.Snapshot{
 				SizeBytes:      volumehelper.GiBToBytes(int64(itemSnapshotQuota)),
@@ -975,42 +1785,34 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 		}, nil
 	}
 
-	if len(req.GetSecrets()) > 0 || useDataPlaneAPI {
-		shareURL, err := d.getShareURL(ctx, sourceVolumeID, req.GetSecrets())
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to get share url with (%s): %v", sourceVolumeID, err)
-		}
-
-		snapshotShare, err := shareURL.CreateSnapshot(ctx, azfile.Metadata{snapshotNameKey: snapshotName})
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "create snapshot from(%s) failed with %v, shareURL: %q", sourceVolumeID, err, shareURL)
-		}
-
-		properties, err := shareURL.GetProperties(ctx)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to get snapshot properties from (%s): %v", snapshotShare.Snapshot(), err)
-		}
+	// retry of the same snapshot is already coalesced by snapshotExists above,
+	// reject a new snapshot of the same share within the minimum interval to avoid throttling
+	if d.shareSnapshotRateLimitCache.limited(rateLimitKey) {
+		return nil, status.Errorf(codes.ResourceExhausted, "snapshot of share(%s) in account(%s) was created less than %d seconds ago, wait for a while to retry", fileShareName, accountName, d.shareSnapshotMinIntervalInSeconds)
+	}
 
-		itemSnapshot = snapshotShare.Snapshot()
-		itemSnapshotTime = properties.LastModified()
-		itemSnapshotQuota = properties.Quota()
-	} else {
-		fileshare, err := d.cloud.FileClient.WithSubscriptionID(subsID).GetFileShare(ctx, rgName, accountName, fileShareName, "")
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "get fileshare from(%s) failed with %v, accountName: %q", sourceVolumeID, err, accountName)
+	var createErr error
+	err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+		itemSnapshot, itemSnapshotTime, itemSnapshotQuota, createErr = d.createShareSnapshot(ctx, sourceVolumeID, subsID, rgName, accountName, fileShareName, snapshotName, req.GetSecrets(), useDataPlaneAPI)
+		if isRetriableError(createErr) {
+			klog.Warningf("create snapshot(%s) from(%s) failed with error(%v), waiting for retrying", snapshotName, sourceVolumeID, createErr)
+			d.sleepIfFileOpThrottled(createErr)
+			return false, nil
 		}
-		snapshotShare, err := d.cloud.FileClient.WithSubscriptionID(subsID).CreateFileShare(ctx, rgName, accountName, &fileclient.ShareOptions{Name: fileShareName, RequestGiB: int(pointer.Int32Deref(fileshare.ShareQuota, defaultAzureFileQuota)), Metadata: map[string]*string{snapshotNameKey: &snapshotName}}, snapshotsExpand)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "create snapshot from(%s) failed with %v, accountName: %q", sourceVolumeID, err, accountName)
-		}
-
-		if snapshotShare.SnapshotTime == nil {
-			return nil, status.Errorf(codes.Internal, "Last modified time of snapshot is null")
+		return true, createErr
+	})
+	if err != nil {
+		if wait.Interrupted(err) && createErr != nil {
+			if isSnapshotRateExceededError(createErr) {
+				return nil, status.Errorf(codes.ResourceExhausted, "snapshot frequency of share(%s) in account(%s) exceeds the limit, wait for a while to retry: %v", fileShareName, accountName, createErr)
+			}
+			return nil, createErr
 		}
-
-		itemSnapshot = snapshotShare.SnapshotTime.Format(snapshotTimeFormat)
-		itemSnapshotTime = snapshotShare.SnapshotTime.Time
-		itemSnapshotQuota = pointer.Int32Deref(snapshotShare.ShareQuota, 0)
+		return nil, err
+	}
+	d.shareSnapshotRateLimitCache.set(rateLimitKey)
+	if itemSnapshot, err = normalizeSnapshotTime(itemSnapshot); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to construct id of snapshot(%s) from(%s): %v", snapshotName, sourceVolumeID, err)
 	}
 
 	klog.V(2).Infof("Created share snapshot: %s", itemSnapshot)
@@ -1029,6 +1831,43 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	return createResp, nil
 }
 
+// createShareSnapshot creates a snapshot of the source file share, returns its x-ms-snapshot string, creation time and share quota
+func (d *Driver) createShareSnapshot(ctx context.Context, sourceVolumeID, subsID, rgName, accountName, fileShareName, snapshotName string, secrets map[string]string, useDataPlaneAPI bool) (string, time.Time, int32, error) {
+	if len(secrets) > 0 || useDataPlaneAPI {
+		shareURL, err := d.getShareURL(ctx, sourceVolumeID, secrets)
+		if err != nil {
+			return "", time.Time{}, 0, status.Errorf(codes.Internal, "failed to get share url with (%s): %v", sourceVolumeID, err)
+		}
+
+		snapshotShare, err := shareURL.CreateSnapshot(ctx, azfile.Metadata{snapshotNameKey: snapshotName})
+		if err != nil {
+			return "", time.Time{}, 0, status.Errorf(codes.Internal, "create snapshot from(%s) failed with %v, shareURL: %q", sourceVolumeID, err, shareURL)
+		}
+
+		properties, err := shareURL.GetProperties(ctx)
+		if err != nil {
+			return "", time.Time{}, 0, status.Errorf(codes.Internal, "failed to get snapshot properties from (%s): %v", snapshotShare.Snapshot(), err)
+		}
+
+		return snapshotShare.Snapshot(), properties.LastModified(), properties.Quota(), nil
+	}
+
+	fileshare, err := d.cloud.FileClient.WithSubscriptionID(subsID).GetFileShare(ctx, rgName, accountName, fileShareName, "")
+	if err != nil {
+		return "", time.Time{}, 0, status.Errorf(codes.Internal, "get fileshare from(%s) failed with %v, accountName: %q", sourceVolumeID, err, accountName)
+	}
+	snapshotShare, err := d.cloud.FileClient.WithSubscriptionID(subsID).CreateFileShare(ctx, rgName, accountName, &fileclient.ShareOptions{Name: fileShareName, RequestGiB: int(pointer.Int32Deref(fileshare.ShareQuota, defaultAzureFileQuota)), Metadata: map[string]*string{snapshotNameKey: &snapshotName}}, snapshotsExpand)
+	if err != nil {
+		return "", time.Time{}, 0, status.Errorf(codes.Internal, "create snapshot from(%s) failed with %v, accountName: %q", sourceVolumeID, err, accountName)
+	}
+
+	if snapshotShare.SnapshotTime == nil {
+		return "", time.Time{}, 0, status.Errorf(codes.Internal, "Last modified time of snapshot is null")
+	}
+
+	return snapshotShare.SnapshotTime.Format(snapshotTimeFormat), snapshotShare.SnapshotTime.Time, pointer.Int32Deref(snapshotShare.ShareQuota, 0), nil
+}
+
 // DeleteSnapshot delete a snapshot (todo)
 func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
 	if len(req.SnapshotId) == 0 {
@@ -1055,26 +1894,39 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 		mc.ObserveOperationWithResult(isOperationSucceeded, SnapshotID, req.SnapshotId)
 	}()
 
-	var deleteErr error
+	var shareURL azfile.ShareURL
 	if len(req.GetSecrets()) > 0 {
-		shareURL, err := d.getShareURL(ctx, req.SnapshotId, req.GetSecrets())
+		shareURL, err = d.getShareURL(ctx, req.SnapshotId, req.GetSecrets())
 		if err != nil {
 			// According to CSI Driver Sanity Tester, should succeed when an invalid snapshot id is used
 			klog.V(4).Infof("failed to get share url with (%s): %v, returning with success", req.SnapshotId, err)
 			return &csi.DeleteSnapshotResponse{}, nil
 		}
-
-		_, deleteErr = shareURL.WithSnapshot(snapshot).Delete(ctx, azfile.DeleteSnapshotsOptionNone)
-	} else {
-		deleteErr = d.cloud.FileClient.WithSubscriptionID(subsID).DeleteFileShare(ctx, rgName, accountName, fileShareName, snapshot)
 	}
 
-	if deleteErr != nil {
-		if strings.Contains(deleteErr.Error(), "ShareSnapshotNotFound") {
+	var deleteErr error
+	err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+		if len(req.GetSecrets()) > 0 {
+			_, deleteErr = shareURL.WithSnapshot(snapshot).Delete(ctx, azfile.DeleteSnapshotsOptionNone)
+		} else {
+			deleteErr = d.cloud.FileClient.WithSubscriptionID(subsID).DeleteFileShare(ctx, rgName, accountName, fileShareName, snapshot)
+		}
+		if deleteErr != nil && strings.Contains(deleteErr.Error(), "ShareSnapshotNotFound") {
 			klog.Warningf("the specify snapshot(%s) was not found", snapshot)
-			return &csi.DeleteSnapshotResponse{}, nil
+			return true, nil
 		}
-		return nil, status.Errorf(codes.Internal, "failed to delete snapshot(%s): %v", snapshot, deleteErr)
+		if isRetriableError(deleteErr) {
+			klog.Warningf("delete snapshot(%s) failed with error(%v), waiting for retrying", snapshot, deleteErr)
+			d.sleepIfFileOpThrottled(deleteErr)
+			return false, nil
+		}
+		return true, deleteErr
+	})
+	if err != nil {
+		if wait.Interrupted(err) && deleteErr != nil {
+			err = deleteErr
+		}
+		return nil, status.Errorf(codes.Internal, "failed to delete snapshot(%s): %v", snapshot, err)
 	}
 
 	klog.V(2).Infof("delete snapshot(%s) successfully", snapshot)
@@ -1082,9 +1934,130 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-// ListSnapshots list all snapshots (todo)
+// ListSnapshots list snapshots of a source volume, SourceVolumeId or SnapshotId must be provided
+// since listing snapshots of all storage accounts is too expensive
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		return nil, err
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries: %d", req.GetMaxEntries())
+	}
+
+	start := 0
+	if req.GetStartingToken() != "" {
+		var err error
+		start, err = strconv.Atoi(req.GetStartingToken())
+		if err != nil || start < 0 {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token: %s", req.GetStartingToken())
+		}
+	}
+
+	sourceVolumeID := req.GetSourceVolumeId()
+	var snapshotTime string
+	if snapshotID := req.GetSnapshotId(); snapshotID != "" {
+		snapshot, err := getSnapshot(snapshotID)
+		if err != nil {
+			klog.V(2).Infof("ListSnapshots: invalid snapshot id(%s): %v, returning empty list", snapshotID, err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		source := snapshotID[:strings.LastIndex(snapshotID, separator)]
+		if sourceVolumeID != "" && sourceVolumeID != source {
+			// snapshot does not belong to the specified source volume
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		sourceVolumeID, snapshotTime = source, snapshot
+	}
+	if sourceVolumeID == "" {
+		klog.V(2).Infof("ListSnapshots: neither SourceVolumeId nor SnapshotId is provided, returning empty list")
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+
+	rgName, accountName, fileShareName, _, _, subsID, err := GetFileShareInfo(sourceVolumeID) //nolint:dogsled
+	if err != nil || fileShareName == "" {
+		klog.V(2).Infof("ListSnapshots: invalid source volume id(%s): %v, returning empty list", sourceVolumeID, err)
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+	if rgName == "" {
+		rgName = d.cloud.ResourceGroup
+	}
+	if subsID == "" {
+		subsID = d.cloud.SubscriptionID
+	}
+
+	mc := metrics.NewMetricContext(azureFileCSIDriverName, "controller_list_snapshots", rgName, subsID, d.Name)
+	isOperationSucceeded := false
+	defer func() {
+		mc.ObserveOperationWithResult(isOperationSucceeded, SourceResourceID, sourceVolumeID)
+	}()
+
+	shares, err := d.cloud.FileClient.WithSubscriptionID(subsID).ListFileShare(ctx, rgName, accountName, "", snapshotsExpand)
+	if err != nil {
+		if isNotFoundError(err) {
+			klog.V(2).Infof("ListSnapshots: account(%s) of source volume(%s) is not found, returning empty list", accountName, sourceVolumeID)
+			isOperationSucceeded = true
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "failed to list snapshots of share(%s) in account(%s): %v", fileShareName, accountName, err)
+	}
+
+	sourceShareExists := false
+	for _, share := range shares {
+		if pointer.StringDeref(share.Name, "") == fileShareName && share.FileShareProperties != nil && share.SnapshotTime == nil &&
+			!pointer.BoolDeref(share.Deleted, false) {
+			sourceShareExists = true
+			break
+		}
+	}
+	if !sourceShareExists {
+		// snapshots of a deleted share could not be used to restore volume, skip them
+		klog.V(2).Infof("ListSnapshots: source share(%s) of volume(%s) has been deleted, returning empty list", fileShareName, sourceVolumeID)
+		isOperationSucceeded = true
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, share := range shares {
+		if pointer.StringDeref(share.Name, "") != fileShareName || share.FileShareProperties == nil || share.SnapshotTime == nil {
+			continue
+		}
+		shareSnapshotTime := share.SnapshotTime.Format(snapshotTimeFormat)
+		if snapshotTime != "" && shareSnapshotTime != snapshotTime {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: &csi.Snapshot{
+				SizeBytes:      volumehelper.GiBToBytes(int64(pointer.Int32Deref(share.ShareQuota, 0))),
+				SnapshotId:     sourceVolumeID + separator + shareSnapshotTime,
+				SourceVolumeId: sourceVolumeID,
+				CreationTime:   timestamppb.New(share.SnapshotTime.Time),
+				// Since the snapshot of azurefile has no field of ReadyToUse, here ReadyToUse is always set to true.
+				ReadyToUse: true,
+			},
+		})
+	}
+	// sort entries so that the starting token is stable across calls
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Snapshot.SnapshotId < entries[j].Snapshot.SnapshotId
+	})
+
+	if start > len(entries) {
+		return nil, status.Errorf(codes.Aborted, "starting token(%d) is greater than total number of snapshots(%d)", start, len(entries))
+	}
+	end := len(entries)
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+	nextToken := ""
+	if end < len(entries) {
+		nextToken = strconv.Itoa(end)
+	}
+
+	isOperationSucceeded = true
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
 }
 
 // ControllerExpandVolume controller expand volume
@@ -1093,6 +2066,9 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if err := d.validateVolumeID(volumeID); err != nil {
+		return nil, err
+	}
 	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
 	if capacityBytes == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume capacity range missing in request")
@@ -1106,9 +2082,12 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetFileShareInfo(%s) failed with error: %v", volumeID, err))
 	}
-	if strings.HasSuffix(diskName, vhdSuffix) {
-		// todo: figure out how to support vhd disk resize
-		return nil, status.Error(codes.Unimplemented, fmt.Sprintf("vhd disk volume(%s, diskName:%s) is not supported on ControllerExpandVolume", volumeID, diskName))
+	if !d.isAllowedAccount(accountName) {
+		return nil, status.Errorf(codes.PermissionDenied, "storage account(%s) of volume(%s) is not in the allowed account list", accountName, volumeID)
+	}
+	isVHDDisk := strings.HasSuffix(diskName, vhdSuffix)
+	if isVHDDisk && d.maxVHDDiskSizeGiB > 0 && requestGiB > d.maxVHDDiskSizeGiB {
+		return nil, status.Errorf(codes.OutOfRange, "requested vhd disk size(%d GiB) exceeds the maximum vhd disk size(%d GiB)", requestGiB, d.maxVHDDiskSizeGiB)
 	}
 	if resourceGroupName == "" {
 		resourceGroupName = d.cloud.ResourceGroup
@@ -1133,21 +2112,103 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
 	}()
 
-	secrets := req.GetSecrets()
-	if len(secrets) == 0 && d.useDataPlaneAPI(volumeID, accountName) {
+	getDataPlaneSecrets := func() (map[string]string, error) {
 		reqContext := map[string]string{}
 		if secretNamespace != "" {
 			setKeyValueInMap(reqContext, secretNamespaceField, secretNamespace)
 		}
 		// use data plane api, get account key first
-		_, _, accountKey, _, _, _, err := d.GetAccountInfo(ctx, volumeID, secrets, reqContext)
+		_, _, accountKey, _, _, _, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), reqContext)
 		if err != nil {
 			return nil, status.Errorf(codes.NotFound, "get account info from(%s) failed with error: %v", volumeID, err)
 		}
-		secrets = createStorageAccountSecret(accountName, accountKey)
+		return createStorageAccountSecret(accountName, accountKey), nil
+	}
+
+	secrets := req.GetSecrets()
+	if len(secrets) == 0 && d.useDataPlaneAPI(volumeID, accountName) {
+		if secrets, err = getDataPlaneSecrets(); err != nil {
+			return nil, err
+		}
+	}
+
+	maxShareQuota, err := d.getFileShareMaxQuota(ctx, subsID, resourceGroupName, accountName, fileShareName, secrets)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get %s of file share(%s) on account(%s): %v", maxShareQuotaField, fileShareName, accountName, err)
+	}
+	if maxShareQuota > 0 && int(requestGiB) > maxShareQuota {
+		return nil, status.Errorf(codes.InvalidArgument, "requested file share size(%d GiB) exceeds %s(%d GiB) of volume(%s)", requestGiB, maxShareQuotaField, maxShareQuota, volumeID)
 	}
 
-	if err = d.ResizeFileShare(ctx, subsID, resourceGroupName, accountName, fileShareName, int(requestGiB), secrets); err != nil {
+	currentQuota, shareProtocol, err := d.getFileShareQuotaAndProtocol(ctx, subsID, resourceGroupName, accountName, fileShareName, secrets)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get quota of file share(%s) on account(%s): %v", fileShareName, accountName, err)
+	}
+	if currentQuota == -1 {
+		return nil, status.Errorf(codes.NotFound, "file share(%s) of volume(%s) is not found", fileShareName, volumeID)
+	}
+	// protocol of file share created by the driver is cached, the check is skipped for other file shares
+	// and if protocol of file share is unknown with data plane API
+	if cache, cacheErr := d.shareProtocolCache.Get(getShareProtocolCacheKey(accountName, fileShareName), azcache.CacheReadTypeDefault); cacheErr == nil && cache != nil {
+		if err := checkFileShareProtocol(accountName, fileShareName, shareProtocol, cache.(storage.EnabledProtocols)); err != nil {
+			return nil, status.Errorf(codes.Internal, "expand volume error: %v", err)
+		}
+	}
+	storageEndpointSuffix := d.getVolumeStorageEndPointSuffix(volumeID)
+	var disk diskFile
+	if isVHDDisk {
+		// quota of file share could be larger than the vhd disk on it, e.g. minimum quota of premium file share is 100 GiB
+		diskSecrets := secrets
+		if len(diskSecrets) == 0 {
+			if diskSecrets, err = getDataPlaneSecrets(); err != nil {
+				return nil, err
+			}
+		}
+		diskAccountName, accountKey, err := getStorageAccount(diskSecrets)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to get account key of volume(%s): %v", volumeID, err)
+		}
+		if disk, err = newDiskFile(diskAccountName, accountKey, storageEndpointSuffix, fileShareName, diskName, d.dataPlaneRetryOptions); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get disk file(%s) of volume(%s): %v", diskName, volumeID, err)
+		}
+		diskSizeBytes, err := disk.GetSize(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get size of disk file(%s) of volume(%s): %v", diskName, volumeID, err)
+		}
+		if volumehelper.GiBToBytes(requestGiB) < diskSizeBytes {
+			return nil, status.Errorf(codes.InvalidArgument, "requested vhd disk size(%d GiB) is smaller than current disk size(%d bytes) of volume(%s), shrinking vhd disk is not supported", requestGiB, diskSizeBytes, volumeID)
+		}
+	} else {
+		if int(requestGiB) < currentQuota {
+			return nil, status.Errorf(codes.InvalidArgument, "requested file share size(%d GiB) is smaller than current quota(%d GiB) of volume(%s), shrinking azure file share is not supported", requestGiB, currentQuota, volumeID)
+		}
+		if int(requestGiB) == currentQuota {
+			klog.V(2).Infof("ControllerExpandVolume(%s): quota of file share is already %d GiB, skip resizing", volumeID, currentQuota)
+			isOperationSucceeded = true
+			return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+		}
+	}
+
+	if err := d.resizeOperationLimiter.Acquire(ctx); err != nil {
+		return nil, status.Errorf(codes.Aborted, "failed to wait for resize operation slot of volume(%s): %v", volumeID, err)
+	}
+	defer d.resizeOperationLimiter.Release()
+
+	if d.fileClient != nil {
+		d.fileClient.StorageEndpointSuffix = storageEndpointSuffix
+	}
+	// file share of vhd disk could be large enough already, or resized in the previous call while the disk file was not
+	if int(requestGiB) > currentQuota {
+		err = d.ResizeFileShare(ctx, subsID, resourceGroupName, accountName, fileShareName, int(requestGiB), secrets)
+	}
+	if err != nil && len(secrets) == 0 && isThrottlingError(err) {
+		klog.Warningf("ResizeFileShare(%s) on account(%s) is throttled, retry with data plane API", fileShareName, accountName)
+		if secrets, err = getDataPlaneSecrets(); err != nil {
+			return nil, err
+		}
+		err = d.ResizeFileShare(ctx, subsID, resourceGroupName, accountName, fileShareName, int(requestGiB), secrets)
+	}
+	if err != nil {
 		if strings.Contains(err.Error(), accountLimitExceedManagementAPI) || strings.Contains(err.Error(), accountLimitExceedDataPlaneAPI) {
 			if accountName != "" {
 				d.resizeFileShareFailureCache.Set(accountName, "")
@@ -1155,10 +2216,23 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 		}
 		return nil, status.Errorf(codes.Internal, "expand volume error: %v", err)
 	}
+	if isVHDDisk {
+		// file share is large enough now, grow the vhd disk file while the filesystem inside is expanded by NodeExpandVolume
+		diskSizeBytes := volumehelper.GiBToBytes(requestGiB)
+		if _, err := resizeVHDDisk(ctx, disk, diskName, diskSizeBytes); err != nil {
+			return nil, status.Errorf(codes.Internal, "expand vhd disk of volume(%s) error: %v", volumeID, err)
+		}
+		klog.V(2).Infof("ControllerExpandVolume: disk(%s) of volume(%s) is resized to %d bytes", diskName, volumeID, diskSizeBytes)
+	}
+	if len(req.GetSecrets()) == 0 {
+		if err := d.tagAccountWithDriverVersion(ctx, subsID, resourceGroupName, accountName); err != nil {
+			klog.Warningf("failed to tag account(%s) rg(%s) with driver version: %v", accountName, resourceGroupName, err)
+		}
+	}
 
 	isOperationSucceeded = true
 	klog.V(2).Infof("ControllerExpandVolume(%s) successfully, currentQuota: %d Gi", volumeID, int(requestGiB))
-	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes, NodeExpansionRequired: isVHDDisk}, nil
 }
 
 // getShareURL: sourceVolumeID is the id of source file share, returns a ShareURL of source file share.
@@ -1188,7 +2262,7 @@ func (d *Driver) getServiceURL(ctx context.Context, sourceVolumeID string, secre
 		return azfile.ServiceURL{}, "", err
 	}
 
-	u, err := url.Parse(fmt.Sprintf(serviceURLTemplate, accountName, d.cloud.Environment.StorageEndpointSuffix))
+	u, err := url.Parse(fmt.Sprintf(serviceURLTemplate, accountName, d.getVolumeStorageEndPointSuffix(sourceVolumeID)))
 	if err != nil {
 		klog.Errorf("parse serviceURLTemplate error: %v", err)
 		return azfile.ServiceURL{}, "", err
@@ -1299,6 +2373,25 @@ func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) error {
 	return nil
 }
 
+// isSupportedVolumeCapabilities validates the given VolumeCapability array against volume type,
+// file share could be mounted on multiple nodes with write access while vhd disk volume is formatted
+// with a local filesystem and could only be written by one node at a time
+func isSupportedVolumeCapabilities(volCaps []*csi.VolumeCapability, isVHDDisk bool) error {
+	if err := isValidVolumeCapabilities(volCaps); err != nil {
+		return err
+	}
+	if !isVHDDisk {
+		return nil
+	}
+	for _, c := range volCaps {
+		switch mode := c.GetAccessMode().GetMode(); mode {
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			return fmt.Errorf("vhd disk volume does not support access mode %v", mode)
+		}
+	}
+	return nil
+}
+
 func generateSASToken(accountName, accountKey, storageEndpointSuffix string, expiryTime int) (string, error) {
 	credential, err := service.NewSharedKeyCredential(accountName, accountKey)
 	if err != nil {
@@ -22,9 +22,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -37,12 +40,16 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/azure-storage-file-go/azfile"
 	azure2 "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/date"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
+	"github.com/rubiojr/go-vhd/vhd"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
@@ -289,6 +296,56 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "accessTier not supported with premium account",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					skuNameField:    "Premium_LRS",
+					accessTierField: "Hot",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-access-tier-premium",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "shareAccessTier(Hot) is not supported with account type(Premium_LRS)")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Premium accessTier not supported with standard account",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					skuNameField:         "Standard_LRS",
+					shareAccessTierField: "Premium",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-access-tier-standard",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "shareAccessTier(Premium) is not supported with account type(Standard_LRS)")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
 		{
 			name: "Invalid rootSquashType",
 			testFunc: func(t *testing.T) {
@@ -312,6 +369,53 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "rootSquashType with smb protocol",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					protocolField:       smb,
+					rootSquashTypeField: string(storage.RootSquashTypeRootSquash),
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "rootSquashType(RootSquash) is only supported with nfs protocol, current protocol: smb")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Invalid initMarker",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					initMarkerField: "../.initialized",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "invalid initmarker: ../.initialized in storage class, should be a relative path under volume root")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
 		{
 			name: "Invalid fsGroupChangePolicy",
 			testFunc: func(t *testing.T) {
@@ -357,6 +461,28 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "Invalid storageEndpointSuffix",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageEndpointSuffixField: "https://core.windows.net",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+				d := NewFakeDriver()
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "storageEndpointSuffix(https://core.windows.net) should be a valid host name, e.g. core.windows.net")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
 		{
 			name: "Invalid accountQuota",
 			testFunc: func(t *testing.T) {
@@ -393,7 +519,7 @@ func TestCreateVolume(t *testing.T) {
 					pvcNameKey:                 "pvc",
 					pvNameKey:                  "pv",
 					shareNamePrefixField:       "pre",
-					storageEndpointSuffixField: ".core",
+					storageEndpointSuffixField: "core.windows.net",
 				}
 
 				req := &csi.CreateVolumeRequest{
@@ -416,7 +542,6 @@ func TestCreateVolume(t *testing.T) {
 			name: "failed to GetStorageAccesskey",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					protocolField:            "nfs",
 					networkEndpointTypeField: "privateendpoint",
 					useDataPlaneAPIField:     "true",
 					vnetResourceGroupField:   "",
@@ -450,6 +575,30 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "diskName & folderName combination",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					diskNameField:   "diskname.vhd",
+					folderNameField: "folder",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-vol-cap-invalid",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "folderName(folder) is not supported with vhd disk volume(diskName: diskname.vhd, fsType: )")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
 		{
 			name: "Invalid protocol & fsType combination",
 			testFunc: func(t *testing.T) {
@@ -472,7 +621,7 @@ func TestCreateVolume(t *testing.T) {
 				}
 				d := NewFakeDriverCustomOptions(driverOptions)
 
-				expectedErr := status.Errorf(codes.InvalidArgument, "fsType(ext4) is not supported with protocol(nfs)")
+				expectedErr := status.Errorf(codes.InvalidArgument, "fsType(ext4) is not supported with protocol(nfs) unless diskName of an existing vhd disk is set")
 				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
@@ -483,7 +632,7 @@ func TestCreateVolume(t *testing.T) {
 			name: "storeAccountKey must set as true in cross subscription",
 			testFunc: func(t *testing.T) {
 				allParam := map[string]string{
-					subscriptionIDField:              "abc",
+					subscriptionIDField:              "00000000-0000-0000-0000-000000000abc",
 					storeAccountKeyField:             "false",
 					selectRandomMatchingAccountField: "true",
 				}
@@ -500,7 +649,7 @@ func TestCreateVolume(t *testing.T) {
 					Config: azure.Config{},
 				}
 
-				expectedErr := status.Errorf(codes.InvalidArgument, "resourceGroup must be provided in cross subscription(abc)")
+				expectedErr := status.Errorf(codes.InvalidArgument, "resourceGroup must be provided in cross subscription(00000000-0000-0000-0000-000000000abc)")
 				_, err := d.CreateVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
@@ -559,6 +708,80 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "invalid diskMountOptions",
+			testFunc: func(t *testing.T) {
+				tests := []struct {
+					parameters  map[string]string
+					expectedErr error
+				}{
+					{
+						parameters:  map[string]string{fsTypeField: ext4, diskMountOptionsField: "noatime,nobarrier"},
+						expectedErr: status.Errorf(codes.InvalidArgument, "disk mount option(nobarrier) is not supported, supported options: %v", supportedDiskMountOptionList),
+					},
+					{
+						parameters:  map[string]string{diskMountOptionsField: "noatime"},
+						expectedErr: status.Errorf(codes.InvalidArgument, "diskmountoptions is only supported with vhd disk volume, fsType() should be one of %v", supportedDiskFsTypeList),
+					},
+					{
+						parameters:  map[string]string{fsTypeField: ext4, proxyMountField: "false"},
+						expectedErr: status.Errorf(codes.InvalidArgument, "proxymount could not be false with vhd disk volume(fsType: ext4)"),
+					},
+				}
+
+				d := NewFakeDriver()
+				d.enableVHDDiskFeature = true
+				d.cloud = &azure.Cloud{
+					Config: azure.Config{},
+				}
+				for _, test := range tests {
+					req := &csi.CreateVolumeRequest{
+						Name:          "random-vol-name-disk-mount-options-invalid",
+						CapacityRange: stdCapRange,
+						VolumeCapabilities: []*csi.VolumeCapability{
+							{
+								AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+								AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+							},
+						},
+						Parameters: test.parameters,
+					}
+					_, err := d.CreateVolume(ctx, req)
+					if !reflect.DeepEqual(err, test.expectedErr) {
+						t.Errorf("Unexpected error: %v, expected error: %v", err, test.expectedErr)
+					}
+				}
+			},
+		},
+		{
+			name: "unsupported smb protocol version in mountOptions",
+			testFunc: func(t *testing.T) {
+				req := &csi.CreateVolumeRequest{
+					Name:          "random-vol-name-vers-invalid",
+					CapacityRange: stdCapRange,
+					VolumeCapabilities: []*csi.VolumeCapability{
+						{
+							AccessType: &csi.VolumeCapability_Mount{
+								Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"dir_mode=0777", "vers=1.0"}},
+							},
+							AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+						},
+					},
+					Parameters: map[string]string{},
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{
+					Config: azure.Config{},
+				}
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "smb protocol version(vers=1.0) is not supported, supported versions: [2.0 2.1 3 3.0 3.02 3.0.2 3.1.1 3.11 default]")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+				}
+			},
+		},
 		{
 			name: "storageAccount and matchTags conflict",
 			testFunc: func(t *testing.T) {
@@ -1019,6 +1242,8 @@ func TestCreateVolume(t *testing.T) {
 					mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
 					mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 					mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+					mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+					mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 					mockFileClient.EXPECT().GetFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
 
 					_, err := d.CreateVolume(ctx, req)
@@ -1085,6 +1310,8 @@ func TestCreateVolume(t *testing.T) {
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockFileClient.EXPECT().GetFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
 
 				_, err := d.CreateVolume(ctx, req)
@@ -1093,6 +1320,148 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "resolved file share name is surfaced in volume context",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					skuNameField:        "Standard_LRS",
+					storageAccountField: "stoacc",
+					resourceGroupField:  "rg",
+				}
+				req := &csi.CreateVolumeRequest{
+					Name:               "PVC_Invalid--Share--Name",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+				keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: nil}}, nil).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+				resp, err := d.CreateVolume(ctx, req)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				_, _, fileShareName, _, _, _, err := GetFileShareInfo(resp.Volume.VolumeId)
+				assert.NoError(t, err)
+				assert.Equal(t, getValidFileShareName(req.Name, ""), fileShareName)
+				assert.NotEqual(t, req.Name, fileShareName)
+				assert.Equal(t, fileShareName, resp.Volume.VolumeContext[shareNameField])
+			},
+		},
+		{
+			name: "default quota of NFS file share when no capacity is requested",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					protocolField:            "nfs",
+					networkEndpointTypeField: privateEndpoint,
+					storageAccountField:      "stoacc",
+					resourceGroupField:       "rg",
+				}
+				req := &csi.CreateVolumeRequest{
+					Name:               "nfs-no-capacity",
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+				keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, _, _ string, shareOptions *fileclient.ShareOptions, _ string) (storage.FileShare, error) {
+						assert.Equal(t, minimumPremiumShareSize, shareOptions.RequestGiB)
+						return storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: nil}}, nil
+					}).Times(1)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+				resp, err := d.CreateVolume(ctx, req)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				assert.Equal(t, util.GiBToBytes(int64(minimumPremiumShareSize)), resp.Volume.CapacityBytes)
+			},
+		},
+		{
+			name: "rootSquashType of NFS file share",
+			testFunc: func(t *testing.T) {
+				for _, rootSquashType := range storage.PossibleRootSquashTypeValues() {
+					allParam := map[string]string{
+						protocolField:            nfs,
+						rootSquashTypeField:      string(rootSquashType),
+						networkEndpointTypeField: privateEndpoint,
+						storageAccountField:      "stoacc",
+						resourceGroupField:       "rg",
+					}
+					req := &csi.CreateVolumeRequest{
+						Name:               "nfs-root-squash",
+						VolumeCapabilities: stdVolCap,
+						CapacityRange:      stdCapRange,
+						Parameters:         allParam,
+					}
+
+					d := NewFakeDriver()
+					d.cloud = &azure.Cloud{}
+					d.cloud.KubeClient = fake.NewSimpleClientset()
+
+					ctrl := gomock.NewController(t)
+
+					mockFileClient := mockfileclient.NewMockInterface(ctrl)
+					d.cloud.FileClient = mockFileClient
+					mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+					d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+					mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+					mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+						func(_ context.Context, _, _ string, shareOptions *fileclient.ShareOptions, _ string) (storage.FileShare, error) {
+							assert.Equal(t, string(rootSquashType), shareOptions.RootSquash)
+							return storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: nil}}, nil
+						}).Times(1)
+					mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+					mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+					mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+					resp, err := d.CreateVolume(ctx, req)
+					if err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+					assert.Equal(t, string(rootSquashType), resp.Volume.VolumeContext[rootSquashTypeField])
+					ctrl.Finish()
+				}
+			},
+		},
 		{
 			name: "invalid mountPermissions",
 			testFunc: func(t *testing.T) {
@@ -1270,17 +1639,52 @@ func TestCreateVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "Premium storage account type (sku) loads from storage account when not given as parameter and share request size is increased to min. size required by premium",
+			name: "Account creation denied by policy",
 			testFunc: func(t *testing.T) {
-				name := "stoacc"
-				sku := "premium"
-				value := "foo bar"
-				accounts := []storage.Account{
-					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}},
+				allParam := map[string]string{
+					createAccountField: "true",
+					resourceGroupField: "rg",
+					locationField:      "loc",
 				}
-				keys := storage.AccountListKeysResult{
-					Keys: &[]storage.AccountKey{
-						{Value: &value},
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-policy-denied",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+				// policy denied error should not be retried
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&retry.Error{RawError: fmt.Errorf("Code=\"RequestDisallowedByPolicy\" Message=\"Resource was disallowed by policy.\"")}).Times(1)
+
+				_, err := d.CreateVolume(ctx, req)
+				if status.Code(err) != codes.FailedPrecondition {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if !strings.Contains(err.Error(), "denied by Azure Policy") {
+					t.Errorf("Unexpected error message: %v", err)
+				}
+			},
+		},
+		{
+			name: "Premium storage account type (sku) loads from storage account when not given as parameter and share request size is increased to min. size required by premium",
+			testFunc: func(t *testing.T) {
+				name := "stoacc"
+				sku := "premium"
+				value := "foo bar"
+				accounts := []storage.Account{
+					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}},
+				}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
 					},
 				}
 				capRange := &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024, LimitBytes: 1024 * 1024 * 1024}
@@ -1322,6 +1726,7 @@ func TestCreateVolume(t *testing.T) {
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts[0], nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
 				_, err := d.CreateVolume(ctx, req)
 
@@ -1382,6 +1787,8 @@ func TestCreateVolume(t *testing.T) {
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
 				_, err := d.CreateVolume(ctx, req)
 
@@ -1442,6 +1849,7 @@ func TestCreateVolume(t *testing.T) {
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(accounts[0], nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
 				_, err := d.CreateVolume(ctx, req)
 
@@ -1549,13 +1957,36 @@ func TestDeleteVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "Delete file share returns error",
+			name: "resource group is empty without secrets",
 			testFunc: func(t *testing.T) {
 				req := &csi.DeleteVolumeRequest{
 					VolumeId: "#f5713de20cde511e8ba4900#fileshare#diskname.vhd#",
 					Secrets:  map[string]string{},
 				}
 
+				d := NewFakeDriver()
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				// no expectation on file client, any call fails the test
+				d.cloud = &azure.Cloud{}
+				d.cloud.FileClient = mockfileclient.NewMockInterface(ctrl)
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "could not delete file share(fileshare) without account key in secrets, resource group() and account name(f5713de20cde511e8ba4900) are required, "+
+					"resource group could be specified in volume handle(<rg>#<account>#<share>) or resourceGroup of cloud config")
+				_, err := d.DeleteVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Delete file share returns error",
+			testFunc: func(t *testing.T) {
+				req := &csi.DeleteVolumeRequest{
+					VolumeId: "rg#f5713de20cde511e8ba4900#fileshare#diskname.vhd#",
+					Secrets:  map[string]string{},
+				}
+
 				d := NewFakeDriver()
 				ctrl := gomock.NewController(t)
 				defer ctrl.Finish()
@@ -1563,9 +1994,10 @@ func TestDeleteVolume(t *testing.T) {
 				d.cloud = &azure.Cloud{}
 				d.cloud.FileClient = mockFileClient
 				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, nil).Times(1)
 				mockFileClient.EXPECT().DeleteFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("test error")).Times(1)
 
-				expectedErr := status.Errorf(codes.Internal, "DeleteFileShare fileshare under account(f5713de20cde511e8ba4900) rg() failed with error: test error")
+				expectedErr := status.Errorf(codes.Internal, "DeleteFileShare fileshare under account(f5713de20cde511e8ba4900) rg(rg) failed with error: test error")
 				_, err := d.DeleteVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectedErr) {
 					t.Errorf("Unexpected error: %v", err)
@@ -1587,6 +2019,7 @@ func TestDeleteVolume(t *testing.T) {
 				d.cloud = &azure.Cloud{}
 				d.cloud.FileClient = mockFileClient
 				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, nil).Times(1)
 				mockFileClient.EXPECT().DeleteFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(1)
 
 				expectedResp := &csi.DeleteSnapshotResponse{}
@@ -1785,6 +2218,62 @@ func TestCopyVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "source volume ID is parsed into subscription, resource group, account and share",
+			testFunc: func(t *testing.T) {
+				volumeSource := &csi.VolumeContentSource_VolumeSource{
+					VolumeId: "srcrg#srcaccount#srcshare#disk.vhd#uuid#namespace#srcsubs",
+				}
+				req := &csi.CreateVolumeRequest{
+					Name:                "unit-test",
+					VolumeCapabilities:  stdVolCap,
+					VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: volumeSource}},
+				}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				d := NewFakeDriver()
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+				mockFileClient.EXPECT().WithSubscriptionID("srcsubs").Return(mockFileClient).Times(1)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), "srcrg", "srcaccount", "srcshare", "").Return(storage.FileShare{}, fmt.Errorf("test error")).Times(1)
+
+				expectedErr := status.Errorf(codes.NotFound, "failed to get source file share(srcshare) on account(srcaccount): test error")
+				err := d.copyVolume(context.Background(), req, "", &fileclient.ShareOptions{Name: "dstFileshare"}, "core.windows.net")
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "source and target protocols are different",
+			testFunc: func(t *testing.T) {
+				volumeSource := &csi.VolumeContentSource_VolumeSource{
+					VolumeId: "vol_1#f5713de20cde511e8ba4900#fileshare#",
+				}
+				req := &csi.CreateVolumeRequest{
+					Name:                "unit-test",
+					VolumeCapabilities:  stdVolCap,
+					VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: volumeSource}},
+				}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				d := NewFakeDriver()
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), "vol_1", "f5713de20cde511e8ba4900", "fileshare", "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{EnabledProtocols: storage.EnabledProtocolsNFS}}, nil).Times(1)
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "protocol(NFS) of source volume(vol_1#f5713de20cde511e8ba4900#fileshare#) does not match protocol(SMB) of target volume")
+				err := d.copyVolume(context.Background(), req, "", &fileclient.ShareOptions{Name: "dstFileshare", Protocol: storage.EnabledProtocolsSMB}, "core.windows.net")
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
 		{
 			name: "azcopy job is already completed",
 			testFunc: func(t *testing.T) {
@@ -1874,6 +2363,33 @@ func TestCopyVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "azcopy job is still in progress when clone timeout expires",
+			testFunc: func(t *testing.T) {
+				d := NewFakeDriver()
+				d.cloneTimeout = time.Millisecond
+				volumeSource := &csi.VolumeContentSource_VolumeSource{
+					VolumeId: "vol_1#f5713de20cde511e8ba4900#fileshare#",
+				}
+				req := &csi.CreateVolumeRequest{
+					Name:                "unit-test",
+					VolumeCapabilities:  stdVolCap,
+					VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: volumeSource}},
+				}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				m := util.NewMockEXEC(ctrl)
+				listStr := "JobId: ed1c3833-eaff-fe42-71d7-513fb065a9d9\nStart Time: Monday, 07-Aug-23 03:29:54 UTC\nStatus: InProgress\nCommand: copy https://{accountName}.file.core.windows.net/{srcFileshare}{SAStoken} https://{accountName}.file.core.windows.net/{dstFileshare}{SAStoken} --recursive --check-length=false"
+				m.EXPECT().RunCommand(gomock.Eq("azcopy jobs list | grep dstFileshare -B 3")).Return(listStr, nil).AnyTimes()
+				m.EXPECT().RunCommand(gomock.Not("azcopy jobs list | grep dstFileshare -B 3")).Return("Percent Complete (approx): 50.0", nil).AnyTimes()
+				d.azcopy.ExecCmd = m
+
+				err := d.copyVolume(context.Background(), req, "", &fileclient.ShareOptions{Name: "dstFileshare"}, "core.windows.net")
+				assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -1882,13 +2398,109 @@ func TestCopyVolume(t *testing.T) {
 }
 
 func TestControllerGetVolume(t *testing.T) {
-	d := NewFakeDriver()
-	req := csi.ControllerGetVolumeRequest{}
-	resp, err := d.ControllerGetVolume(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	newDriver := func() (*Driver, *mockfileclient.MockInterface) {
+		d := NewFakeDriver()
+		d.AddControllerServiceCapabilities(
+			[]csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+				csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			})
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		d.cloud.FileClient = mockFileClient
+		return d, mockFileClient
 	}
+	fileShare := storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: pointer.Int32(100)}}
+	volumeID := "rg#account#share"
+
+	t.Run("volume ID missing", func(t *testing.T) {
+		d, _ := newDriver()
+		_, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{})
+		assert.Equal(t, status.Error(codes.InvalidArgument, "Volume ID missing in request"), err)
+	})
+
+	t.Run("GET_VOLUME capability not supported", func(t *testing.T) {
+		d := NewFakeDriver()
+		_, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("volume does not exist", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).Times(1)
+		_, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("soft delete enabled", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		properties := storage.FileServiceProperties{
+			FileServicePropertiesProperties: &storage.FileServicePropertiesProperties{
+				ShareDeleteRetentionPolicy: &storage.DeleteRetentionPolicy{Enabled: pointer.Bool(true), Days: pointer.Int32(7)},
+			},
+		}
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", gomock.Any()).Return(fileShare, nil).Times(2)
+		// service properties are cached per account
+		mockFileClient.EXPECT().GetServiceProperties(gomock.Any(), "rg", "account").Return(properties, nil).Times(1)
+		for i := 0; i < 2; i++ {
+			resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+			assert.NoError(t, err)
+			assert.Equal(t, volumeID, resp.Volume.VolumeId)
+			assert.Equal(t, util.GiBToBytes(100), resp.Volume.CapacityBytes)
+			assert.Equal(t, map[string]string{
+				shareDeleteRetentionPolicyEnabledKey: "true",
+				shareDeleteRetentionDaysKey:          "7",
+			}, resp.Volume.VolumeContext)
+			assert.False(t, resp.Status.VolumeCondition.Abnormal)
+		}
+	})
+
+	t.Run("soft delete not set", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		properties := storage.FileServiceProperties{
+			FileServicePropertiesProperties: &storage.FileServicePropertiesProperties{},
+		}
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", gomock.Any()).Return(fileShare, nil).Times(1)
+		mockFileClient.EXPECT().GetServiceProperties(gomock.Any(), "rg", "account").Return(properties, nil).Times(1)
+		resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{shareDeleteRetentionPolicyEnabledKey: "false"}, resp.Volume.VolumeContext)
+	})
+
+	t.Run("account inaccessible", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", gomock.Any()).Return(fileShare, nil).Times(2)
+		// errors are not cached
+		mockFileClient.EXPECT().GetServiceProperties(gomock.Any(), "rg", "account").Return(storage.FileServiceProperties{}, fmt.Errorf("AuthorizationFailed")).Times(2)
+		for i := 0; i < 2; i++ {
+			resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{shareDeleteRetentionPolicyEnabledKey: unknownValue}, resp.Volume.VolumeContext)
+		}
+	})
+
+	t.Run("account throttled", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("Retriable: true, StatusCode: 429, TooManyRequests")).Times(1)
+		resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		assert.NoError(t, err)
+		assert.Equal(t, volumeID, resp.Volume.VolumeId)
+		assert.True(t, resp.Status.VolumeCondition.Abnormal)
+		assert.Contains(t, resp.Status.VolumeCondition.Message, "storage account(account) is throttled")
+	})
+
+	t.Run("share being deleted", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("The specified share is being deleted")).Times(1)
+		resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		assert.NoError(t, err)
+		assert.True(t, resp.Status.VolumeCondition.Abnormal)
+		assert.Equal(t, "file share(share) on account(account) is being deleted", resp.Status.VolumeCondition.Message)
+	})
 }
 
 func TestControllerGetCapabilities(t *testing.T) {
@@ -1947,6 +2559,7 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 		req                csi.ValidateVolumeCapabilitiesRequest
 		expectedErr        error
 		mockedFileShareErr error
+		expectUnconfirmed  bool
 	}{
 		{
 			desc:               "Volume ID missing",
@@ -2004,6 +2617,16 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 			},
 			expectedErr:        nil,
 			mockedFileShareErr: nil,
+			expectUnconfirmed:  true,
+		},
+		{
+			desc: "Multi node single writer is confirmed for file share",
+			req: csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           "vol_1#f5713de20cde511e8ba4900#fileshare#",
+				VolumeCapabilities: multiNodeVolCap,
+			},
+			expectedErr:        nil,
+			mockedFileShareErr: nil,
 		},
 		{
 			desc: "Valid request",
@@ -2040,11 +2663,53 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
 		mockFileClient.EXPECT().GetFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, test.mockedFileShareErr).AnyTimes()
 
-		_, err := d.ValidateVolumeCapabilities(context.TODO(), &test.req)
+		resp, err := d.ValidateVolumeCapabilities(context.TODO(), &test.req)
 		if !reflect.DeepEqual(err, test.expectedErr) {
 			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
 		}
+		if err == nil {
+			assert.Equal(t, test.expectUnconfirmed, resp.GetConfirmed() == nil, test.desc)
+			assert.Equal(t, test.expectUnconfirmed, resp.GetMessage() != "", test.desc)
+		}
+	}
+}
+
+func TestIsSupportedVolumeCapabilities(t *testing.T) {
+	unsupportedByDisk := map[csi.VolumeCapability_AccessMode_Mode]bool{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER: true,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:  true,
+	}
+	for _, accessMode := range volumeCaps {
+		mode := accessMode.GetMode()
+		volCaps := []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+		}
+		assert.NoError(t, isSupportedVolumeCapabilities(volCaps, false), "file share with access mode %v", mode)
+		err := isSupportedVolumeCapabilities(volCaps, true)
+		if unsupportedByDisk[mode] {
+			assert.EqualError(t, err, fmt.Sprintf("vhd disk volume does not support access mode %v", mode))
+		} else {
+			assert.NoError(t, err, "vhd disk with access mode %v", mode)
+		}
+	}
+
+	blockVolCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	assert.EqualError(t, isSupportedVolumeCapabilities(blockVolCaps, false), "driver does not support block volumes")
+	unknownModeVolCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_UNKNOWN},
+		},
 	}
+	assert.Error(t, isSupportedVolumeCapabilities(unknownModeVolCaps, true))
 }
 
 func TestControllerPublishVolume(t *testing.T) {
@@ -2305,6 +2970,258 @@ func TestCreateSnapshot(t *testing.T) {
 	}
 }
 
+func TestCreateSnapshotConcurrently(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sourceVolumeID := "rg#account#share#diskname#uuid#namespace"
+	shareName := "share"
+	snapshotName := "snapshot-1"
+	quota := int32(100)
+	snapshotTime := date.Time{Time: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)}
+	snapshotShare := storage.FileShare{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, SnapshotTime: &snapshotTime}}
+	snapshotItem := storage.FileShareItem{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, SnapshotTime: &snapshotTime}}
+
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	mockFileClient := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClient
+	mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", shareName, "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}}, nil).AnyTimes()
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", shareName, snapshotTime.Format(snapshotTimeFormat)).
+		Return(storage.FileShare{Name: &shareName, FileShareProperties: &storage.FileShareProperties{Metadata: map[string]*string{snapshotNameKey: &snapshotName}}}, nil).AnyTimes()
+
+	// the first call is blocked on listing snapshots until the concurrent call returns
+	listStarted, concurrentDone := make(chan struct{}), make(chan struct{})
+	gomock.InOrder(
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", snapshotsExpand).DoAndReturn(
+			func(_ context.Context, _, _, _, _ string) ([]storage.FileShareItem, error) {
+				close(listStarted)
+				<-concurrentDone
+				return nil, nil
+			}).Times(1),
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", snapshotsExpand).Return([]storage.FileShareItem{snapshotItem}, nil).Times(1),
+	)
+	// only one snapshot is created
+	mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), snapshotsExpand).Return(snapshotShare, nil).Times(1)
+
+	req := &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: snapshotName}
+	var firstResp *csi.CreateSnapshotResponse
+	var firstErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		firstResp, firstErr = d.CreateSnapshot(context.Background(), req)
+	}()
+
+	<-listStarted
+	_, err := d.CreateSnapshot(context.Background(), req)
+	assert.Equal(t, status.Errorf(codes.Aborted, snapshotOperationAlreadyExistsFmt, sourceVolumeID), err)
+	close(concurrentDone)
+	wg.Wait()
+	assert.NoError(t, firstErr)
+
+	// retry of the rejected call returns the existing snapshot
+	resp, err := d.CreateSnapshot(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, firstResp.Snapshot.SnapshotId, resp.Snapshot.SnapshotId)
+}
+
+func TestSnapshotThrottling(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sourceVolumeID := "rg#account#share#diskname#uuid#namespace"
+	shareName := "share"
+	quota := int32(100)
+	snapshotTime := date.Time{Time: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)}
+	snapshotShare := storage.FileShare{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, SnapshotTime: &snapshotTime}}
+	rateExceededErr := fmt.Errorf("Retriable: false, RetryAfter: 0s, HTTPStatusCode: 409, RawError: %s", snapshotOperationRateExceeded)
+
+	newDriver := func(minInterval int, backoff wait.Backoff) (*Driver, *mockfileclient.MockInterface) {
+		d := NewFakeDriverCustomOptions(DriverOptions{ShareSnapshotMinIntervalInSeconds: minInterval})
+		d.cloud = &azure.Cloud{}
+		d.cloud.CloudProviderBackoff = true
+		d.cloud.ResourceRequestBackoff = backoff
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", snapshotsExpand).Return(nil, nil).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", shareName, "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}}, nil).AnyTimes()
+		return d, mockFileClient
+	}
+
+	t.Run("reject too frequent snapshots of the same share", func(t *testing.T) {
+		d, mockFileClient := newDriver(60, wait.Backoff{Steps: 1})
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), snapshotsExpand).Return(snapshotShare, nil).Times(1)
+
+		_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: "snapshot-1"})
+		assert.NoError(t, err)
+
+		_, err = d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: "snapshot-2"})
+		expectedErr := status.Errorf(codes.ResourceExhausted, "snapshot of share(share) in account(account) was created less than 60 seconds ago, wait for a while to retry")
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("unexpected error: %v, expected error: %v", err, expectedErr)
+		}
+	})
+
+	t.Run("no limit when min interval is not set", func(t *testing.T) {
+		d, mockFileClient := newDriver(0, wait.Backoff{Steps: 1})
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), snapshotsExpand).Return(snapshotShare, nil).Times(2)
+
+		_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: "snapshot-1"})
+		assert.NoError(t, err)
+		_, err = d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: "snapshot-2"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("retry when snapshot operation rate exceeded", func(t *testing.T) {
+		d, mockFileClient := newDriver(0, wait.Backoff{Steps: 3, Duration: time.Millisecond})
+		gomock.InOrder(
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), snapshotsExpand).Return(storage.FileShare{}, rateExceededErr).Times(1),
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), snapshotsExpand).Return(snapshotShare, nil).Times(1),
+		)
+
+		resp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: "snapshot-1"})
+		assert.NoError(t, err)
+		assert.Equal(t, sourceVolumeID+"#"+snapshotTime.Format(snapshotTimeFormat), resp.Snapshot.SnapshotId)
+	})
+
+	t.Run("retry when snapshot operation in progress", func(t *testing.T) {
+		d, mockFileClient := newDriver(0, wait.Backoff{Steps: 3, Duration: time.Millisecond})
+		inProgressErr := fmt.Errorf("Code=\"%s\" Message=\"Another share snapshot operation is in progress.\"", shareSnapshotOperationInProgress)
+		gomock.InOrder(
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), snapshotsExpand).Return(storage.FileShare{}, inProgressErr).Times(1),
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), snapshotsExpand).Return(snapshotShare, nil).Times(1),
+		)
+
+		_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: "snapshot-1"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteSnapshot retries when snapshot operation in progress", func(t *testing.T) {
+		d, mockFileClient := newDriver(0, wait.Backoff{Steps: 3, Duration: time.Millisecond})
+		inProgressErr := fmt.Errorf("Code=\"%s\" Message=\"Another share snapshot operation is in progress.\"", shareSnapshotOperationInProgress)
+		snapshot := snapshotTime.Format(snapshotTimeFormat)
+		gomock.InOrder(
+			mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", shareName, snapshot).Return(inProgressErr).Times(1),
+			mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", shareName, snapshot).Return(nil).Times(1),
+		)
+
+		_, err := d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: sourceVolumeID + "#" + snapshot})
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteSnapshot returns the last error when retries are exhausted", func(t *testing.T) {
+		d, mockFileClient := newDriver(0, wait.Backoff{Steps: 2, Duration: time.Millisecond})
+		inProgressErr := fmt.Errorf("Code=\"%s\"", shareSnapshotOperationInProgress)
+		snapshot := snapshotTime.Format(snapshotTimeFormat)
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", shareName, snapshot).Return(inProgressErr).Times(2)
+
+		_, err := d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: sourceVolumeID + "#" + snapshot})
+		expectedErr := status.Errorf(codes.Internal, "failed to delete snapshot(%s): %v", snapshot, inProgressErr)
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("unexpected error: %v, expected error: %v", err, expectedErr)
+		}
+	})
+
+	t.Run("return ResourceExhausted when retries are exhausted", func(t *testing.T) {
+		d, mockFileClient := newDriver(0, wait.Backoff{Steps: 2, Duration: time.Millisecond})
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), snapshotsExpand).Return(storage.FileShare{}, rateExceededErr).Times(2)
+
+		_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: "snapshot-1"})
+		if status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), snapshotOperationRateExceeded) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestIsAttachedToOtherNode(t *testing.T) {
+	tests := []struct {
+		attachedNodeID string
+		nodeID         string
+		expected       bool
+	}{
+		{attachedNodeID: "", nodeID: "node1", expected: false},
+		{attachedNodeID: "node1", nodeID: "node1", expected: false},
+		{attachedNodeID: "Node1", nodeID: "node1", expected: false},
+		{attachedNodeID: "node2", nodeID: "node1", expected: true},
+	}
+
+	for _, test := range tests {
+		result := isAttachedToOtherNode(test.attachedNodeID, test.nodeID)
+		if result != test.expected {
+			t.Errorf("isAttachedToOtherNode(%s, %s) = %v, expected: %v", test.attachedNodeID, test.nodeID, result, test.expected)
+		}
+	}
+}
+
+// TestReinvokeAfterRestart simulates driver restart in the middle of an operation:
+// the previous process still holds the volume lock and has completed the Azure operation,
+// the new process does not have the lock and must derive the state from Azure when CO retries
+func TestReinvokeAfterRestart(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sourceVolumeID := "rg#account#share#diskname#uuid#namespace"
+	shareName := "share"
+	snapshotName := "snapshot"
+	quota := int32(100)
+	snapshotTime := date.Time{Time: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)}
+	snapshotID := sourceVolumeID + "#" + snapshotTime.Format(snapshotTimeFormat)
+
+	newRestartedDriver := func() (*Driver, *mockfileclient.MockInterface) {
+		previous := NewFakeDriver()
+		previous.volumeLocks.TryAcquire(sourceVolumeID)
+
+		d := NewFakeDriver()
+		d.AddControllerServiceCapabilities(
+			[]csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			})
+		d.cloud = &azure.Cloud{}
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		return d, mockFileClient
+	}
+
+	t.Run("CreateSnapshot returns the snapshot created before restart", func(t *testing.T) {
+		d, mockFileClient := newRestartedDriver()
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", snapshotsExpand).Return([]storage.FileShareItem{
+			{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, SnapshotTime: &snapshotTime}},
+		}, nil).Times(1)
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", shareName, snapshotTime.Format(snapshotTimeFormat)).Return(storage.FileShare{
+			Name:                &shareName,
+			FileShareProperties: &storage.FileShareProperties{Metadata: map[string]*string{snapshotNameKey: &snapshotName}},
+		}, nil).Times(1)
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		resp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{SourceVolumeId: sourceVolumeID, Name: snapshotName})
+		assert.NoError(t, err)
+		assert.Equal(t, snapshotID, resp.Snapshot.SnapshotId)
+	})
+
+	t.Run("DeleteSnapshot succeeds when snapshot is deleted before restart", func(t *testing.T) {
+		d, mockFileClient := newRestartedDriver()
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", shareName, snapshotTime.Format(snapshotTimeFormat)).Return(fmt.Errorf("ShareSnapshotNotFound")).Times(1)
+
+		_, err := d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteVolume succeeds when share is deleted before restart", func(t *testing.T) {
+		d, mockFileClient := newRestartedDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", shareName, "").Return(storage.FileShare{}, fmt.Errorf(fileShareNotFound)).Times(1)
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", shareName, "").Return(fmt.Errorf(fileShareNotFound)).Times(1)
+
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: sourceVolumeID})
+		assert.NoError(t, err)
+	})
+}
+
 func TestDeleteSnapshot(t *testing.T) {
 	d := NewFakeDriver()
 	d.cloud = &azure.Cloud{}
@@ -2445,9 +3362,10 @@ func TestControllerExpandVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "Disk name not empty",
+			name: "vhd disk size exceeds the maximum",
 			testFunc: func(t *testing.T) {
-				d := NewFakeDriver()
+				d := NewFakeDriverCustomOptions(DriverOptions{MaxVHDDiskSizeGiB: 1})
+				d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_EXPAND_VOLUME})
 				d.cloud = &azure.Cloud{}
 
 				ctrl := gomock.NewController(t)
@@ -2470,7 +3388,7 @@ func TestControllerExpandVolume(t *testing.T) {
 				d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "vol_1", gomock.Any()).Return(key, nil).AnyTimes()
 
-				expectErr := status.Error(codes.Unimplemented, "vhd disk volume(vol_1#f5713de20cde511e8ba4900#filename#diskname.vhd#, diskName:diskname.vhd) is not supported on ControllerExpandVolume")
+				expectErr := status.Error(codes.OutOfRange, "requested vhd disk size(5 GiB) exceeds the maximum vhd disk size(1 GiB)")
 				_, err := d.ControllerExpandVolume(ctx, req)
 				if !reflect.DeepEqual(err, expectErr) {
 					t.Errorf("Unexpected error: %v, expected error: %v", err, expectErr)
@@ -2505,6 +3423,8 @@ func TestControllerExpandVolume(t *testing.T) {
 				mockFileClient := mockfileclient.NewMockInterface(ctrl)
 				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
 				mockFileClient.EXPECT().ResizeFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("test error")).AnyTimes()
+				shareQuota := int32(1)
+				mockFileClient.EXPECT().GetFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}}, nil).AnyTimes()
 				d.cloud.FileClient = mockFileClient
 
 				expectErr := status.Errorf(codes.Internal, "expand volume error: test error")
@@ -2578,6 +3498,8 @@ func TestControllerExpandVolume(t *testing.T) {
 				d.cloud.KubeClient = clientSet
 				d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "capz-d18sqm", gomock.Any()).Return(key, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockFileClient := mockfileclient.NewMockInterface(ctrl)
 				mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
 				mockFileClient.EXPECT().ResizeFileShare(context.TODO(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
@@ -2599,47 +3521,849 @@ func TestControllerExpandVolume(t *testing.T) {
 	}
 }
 
-func TestGetShareURL(t *testing.T) {
-	d := NewFakeDriver()
-	validSecret := map[string]string{}
-	d.cloud = &azure.Cloud{}
+func TestMaxShareQuota(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+	maxShareQuota := "100"
+
+	newDriver := func() (*Driver, *mockfileclient.MockInterface) {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		return d, mockFileClient
+	}
+	createReq := func(sizeGiB int64) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               "max-share-quota",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(sizeGiB)},
+			Parameters: map[string]string{
+				skuNameField:        "Standard_LRS",
+				storageAccountField: "account",
+				resourceGroupField:  "rg",
+				maxShareQuotaField:  maxShareQuota,
+			},
+		}
+	}
+	expandReq := func(sizeGiB int64) *csi.ControllerExpandVolumeRequest {
+		return &csi.ControllerExpandVolumeRequest{
+			VolumeId:      "rg#account#share#",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(sizeGiB)},
+		}
+	}
+	shareQuota := int32(10)
+	shareWithMaxQuota := storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota, Metadata: map[string]*string{maxShareQuotaKey: &maxShareQuota}}}
+
+	t.Run("create volume exactly at the cap", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").DoAndReturn(
+			func(_ context.Context, _, _ string, shareOptions *fileclient.ShareOptions, _ string) (storage.FileShare, error) {
+				assert.Equal(t, 100, shareOptions.RequestGiB)
+				assert.Equal(t, maxShareQuota, pointer.StringDeref(shareOptions.Metadata[maxShareQuotaKey], ""))
+				return storage.FileShare{}, nil
+			}).Times(1)
+
+		_, err := d.CreateVolume(context.Background(), createReq(100))
+		assert.NoError(t, err)
+	})
+
+	t.Run("create volume above the cap", func(t *testing.T) {
+		d, _ := newDriver()
+		_, err := d.CreateVolume(context.Background(), createReq(101))
+		assert.Equal(t, status.Errorf(codes.InvalidArgument, "requested file share size(101 GiB) exceeds maxsharequota(100 GiB)"), err)
+	})
+
+	t.Run("invalid maxShareQuota", func(t *testing.T) {
+		d, _ := newDriver()
+		req := createReq(100)
+		req.Parameters[maxShareQuotaField] = "0"
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, status.Errorf(codes.InvalidArgument, "invalid maxsharequota 0 in storage class, should be a positive integer in GiB"), err)
+	})
+
+	t.Run("expand volume up to the cap", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(shareWithMaxQuota, nil).Times(2)
+		mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), "rg", "account", "share", 100).Return(nil).Times(1)
+
+		resp, err := d.ControllerExpandVolume(context.Background(), expandReq(100))
+		assert.NoError(t, err)
+		assert.Equal(t, util.GiBToBytes(100), resp.GetCapacityBytes())
+	})
+
+	t.Run("expand volume crossing the cap", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(shareWithMaxQuota, nil).Times(1)
+		// ResizeFileShare must not be called
+
+		_, err := d.ControllerExpandVolume(context.Background(), expandReq(200))
+		assert.Equal(t, status.Errorf(codes.InvalidArgument, "requested file share size(200 GiB) exceeds maxsharequota(100 GiB) of volume(rg#account#share#)"), err)
+	})
+}
 
+func TestCreateVolumeDryRun(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
-	key := storage.AccountListKeysResult{
-		Keys: &[]storage.AccountKey{
-			{Value: &value},
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
 		},
 	}
-	clientSet := fake.NewSimpleClientset()
+
 	tests := []struct {
-		desc           string
-		sourceVolumeID string
-		expectedErr    error
+		desc         string
+		enableDryRun bool
+		parameters   map[string]string
+		expectedID   string
+		expectedSize int64
+		expectedErr  error
 	}{
 		{
-			desc:           "Volume ID error",
-			sourceVolumeID: "vol_1",
-			expectedErr:    fmt.Errorf("failed to get file share from vol_1"),
+			desc:        "dryrun is disabled",
+			parameters:  map[string]string{dryRunField: "true"},
+			expectedErr: status.Errorf(codes.InvalidArgument, "dryrun storage class parameter is disabled, use --enable-dry-run driver option to enable it"),
 		},
 		{
-			desc:           "Volume ID error2",
-			sourceVolumeID: "vol_1###",
-			expectedErr:    fmt.Errorf("failed to get file share from vol_1###"),
+			desc:         "invalid dryrun value",
+			enableDryRun: true,
+			parameters:   map[string]string{dryRunField: "maybe"},
+			expectedErr:  status.Errorf(codes.InvalidArgument, "invalid dryrun: maybe in storage class"),
 		},
 		{
-			desc:           "Valid request",
-			sourceVolumeID: "rg#accountname#fileshare#",
-			expectedErr:    nil,
+			desc:         "invalid parameter is still rejected",
+			enableDryRun: true,
+			parameters:   map[string]string{dryRunField: "true", shareAccessTierField: "Premium", skuNameField: "Standard_LRS"},
+			expectedErr:  status.Errorf(codes.InvalidArgument, "shareAccessTier(Premium) is not supported with account type(Standard_LRS)"),
 		},
-	}
-
-	for _, test := range tests {
-		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
-		d.cloud.StorageAccountClient = mockStorageAccountsClient
-		d.cloud.KubeClient = clientSet
-		d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
+		{
+			desc:         "smb volume on existing account",
+			enableDryRun: true,
+			parameters:   map[string]string{dryRunField: "true", storageAccountField: "account", resourceGroupField: "rg", tagsField: "owner=alice"},
+			expectedID:   "rg#account#pvc-dryrun###default",
+			expectedSize: util.GiBToBytes(10),
+		},
+		{
+			desc:         "duplicated tag keys",
+			enableDryRun: true,
+			parameters:   map[string]string{dryRunField: "true", tagsField: "env=dev;Env=prod"},
+			expectedErr:  status.Errorf(codes.InvalidArgument, "Tags 'env=dev;Env=prod' are invalid, tag key(Env) is duplicated"),
+		},
+		{
+			desc:         "invalid subnetResourceIDs",
+			enableDryRun: true,
+			parameters:   map[string]string{dryRunField: "true", protocolField: "nfs", subnetResourceIDsField: "subnet1,subnet2"},
+			expectedErr:  status.Errorf(codes.InvalidArgument, "invalid subnetresourceids: invalid subnet resource ID(subnet1), should be in /subscriptions/%%s/resourceGroups/%%s/providers/Microsoft.Network/virtualNetworks/%%s/subnets/%%s format"),
+		},
+		{
+			desc:         "nfs volume with multiple subnets",
+			enableDryRun: true,
+			parameters: map[string]string{dryRunField: "true", protocolField: "nfs", locationField: "eastus",
+				subnetResourceIDsField: "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet1,/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet2"},
+			expectedID:   "##pvcn-dryrun###default",
+			expectedSize: util.GiBToBytes(100),
+		},
+		{
+			desc:         "premium nfs volume",
+			enableDryRun: true,
+			parameters:   map[string]string{dryRunField: "True", protocolField: "nfs", locationField: "eastus", shareAccessTierField: "Premium"},
+			expectedID:   "##pvcn-dryrun###default",
+			expectedSize: util.GiBToBytes(100),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{EnableDryRun: test.enableDryRun})
+		clientSet := fake.NewSimpleClientset()
+		d.cloud.KubeClient = clientSet
+		// no expectation on cloud clients, any call fails the test
+		d.cloud.FileClient = mockfileclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.SubnetsClient = mocksubnetclient.NewMockInterface(ctrl)
+
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-dryrun",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(10)},
+			Parameters:         test.parameters,
+		}
+		resp, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, "test[%s]", test.desc)
+		if test.expectedErr == nil {
+			assert.Equal(t, test.expectedID, resp.GetVolume().GetVolumeId(), "test[%s]", test.desc)
+			assert.Equal(t, test.expectedSize, resp.GetVolume().GetCapacityBytes(), "test[%s]", test.desc)
+		}
+		assert.Empty(t, clientSet.Actions(), "test[%s]: no secret should be created in dry run", test.desc)
+		if _, ok := d.volMap.Load("pvc-dryrun"); ok {
+			t.Errorf("test[%s]: volume should not be recorded in dry run", test.desc)
+		}
+	}
+}
+
+func TestLockAccountSelection(t *testing.T) {
+	for _, serialize := range []bool{true, false} {
+		d := NewFakeDriverCustomOptions(DriverOptions{SerializeAccountCreation: serialize})
+		unlock := d.lockAccountSelection("key1", "subsID", "rg")
+
+		locked := make(chan struct{})
+		go func() {
+			defer close(locked)
+			d.lockAccountSelection("key2", "subsID", "RG")()
+		}()
+		select {
+		case <-locked:
+			assert.False(t, serialize, "account selection with different account options should not be blocked unless serialized in resource group")
+		case <-time.After(100 * time.Millisecond):
+			assert.True(t, serialize, "account selection with different account options should be blocked when serialized in resource group")
+		}
+		unlock()
+		<-locked
+	}
+}
+
+func TestCreateVolumeConcurrentAccountCreation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	volCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+
+	for _, serialize := range []bool{true, false} {
+		d := NewFakeDriverCustomOptions(DriverOptions{SerializeAccountCreation: serialize})
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+		var createCount int32
+		value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
+		quota := int32(100)
+		// account created just now is not listed yet, concurrent requests could not find it by listing accounts
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), "rg").Return([]storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), "rg", gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, _, _, _ string, _ storage.AccountCreateParameters) *retry.Error {
+				atomic.AddInt32(&createCount, 1)
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			}).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), "rg", gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), "rg", gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}}, nil).AnyTimes()
+
+		const callers = 10
+		var wg sync.WaitGroup
+		accountNames := make(chan string, callers)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:               fmt.Sprintf("pvc-concurrent-%d", i),
+					VolumeCapabilities: volCap,
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(int64(quota))},
+					Parameters:         map[string]string{skuNameField: "Standard_LRS", locationField: "eastus", resourceGroupField: "rg"},
+				})
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, accountName, _, _, _, _, _ := GetFileShareInfo(resp.Volume.VolumeId)
+				accountNames <- accountName
+			}(i)
+		}
+		wg.Wait()
+		close(accountNames)
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&createCount), "serialize: %v", serialize)
+		names := map[string]bool{}
+		for name := range accountNames {
+			names[name] = true
+		}
+		assert.Len(t, names, 1, "serialize: %v", serialize)
+	}
+}
+
+func TestCreateVolumeSkuNameWithProtocol(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+
+	tests := []struct {
+		desc         string
+		sku          string
+		protocol     string
+		expectedSize int64
+		expectedErr  error
+	}{
+		{
+			desc:         "standard smb",
+			sku:          "Standard_LRS",
+			protocol:     smb,
+			expectedSize: util.GiBToBytes(10),
+		},
+		{
+			desc:         "premium smb",
+			sku:          "Premium_ZRS",
+			protocol:     smb,
+			expectedSize: util.GiBToBytes(minimumPremiumShareSize),
+		},
+		{
+			desc:        "standard nfs",
+			sku:         "Standard_GRS",
+			protocol:    nfs,
+			expectedErr: status.Errorf(codes.InvalidArgument, "skuName(Standard_GRS) is not supported with nfs protocol, supported skuName list: [Premium_LRS Premium_ZRS]"),
+		},
+		{
+			desc:         "premium nfs",
+			sku:          "Premium_LRS",
+			protocol:     nfs,
+			expectedSize: util.GiBToBytes(minimumPremiumShareSize),
+		},
+		{
+			desc:         "sku name is case insensitive",
+			sku:          "premium_lrs",
+			protocol:     nfs,
+			expectedSize: util.GiBToBytes(minimumPremiumShareSize),
+		},
+		{
+			desc:        "normalized sku name is reported",
+			sku:         "standard_lrs",
+			protocol:    nfs,
+			expectedErr: status.Errorf(codes.InvalidArgument, "skuName(Standard_LRS) is not supported with nfs protocol, supported skuName list: [Premium_LRS Premium_ZRS]"),
+		},
+		{
+			desc:         "premium sku is used for nfs by default",
+			protocol:     nfs,
+			expectedSize: util.GiBToBytes(minimumPremiumShareSize),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{EnableDryRun: true})
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		// no expectation on cloud clients, any call fails the test
+		d.cloud.FileClient = mockfileclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.SubnetsClient = mocksubnetclient.NewMockInterface(ctrl)
+
+		parameters := map[string]string{dryRunField: "true", locationField: "eastus", protocolField: test.protocol}
+		if test.sku != "" {
+			parameters[skuNameField] = test.sku
+		}
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-sku",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(10)},
+			Parameters:         parameters,
+		}
+		resp, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, "test[%s]", test.desc)
+		if test.expectedErr == nil {
+			assert.Equal(t, test.expectedSize, resp.GetVolume().GetCapacityBytes(), "test[%s]", test.desc)
+		}
+	}
+}
+
+func TestCreateVolumeMaxVHDDiskSize(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+
+	tests := []struct {
+		desc        string
+		maxSizeGiB  int64
+		fsType      string
+		requestGiB  int64
+		expectedErr error
+	}{
+		{
+			desc:       "no limit by default",
+			fsType:     ext4,
+			requestGiB: 2048,
+		},
+		{
+			desc:       "vhd disk size at the limit",
+			maxSizeGiB: 100,
+			fsType:     ext4,
+			requestGiB: 100,
+		},
+		{
+			desc:        "vhd disk size over the limit",
+			maxSizeGiB:  100,
+			fsType:      xfs,
+			requestGiB:  101,
+			expectedErr: status.Errorf(codes.OutOfRange, "requested vhd disk size(101 GiB) exceeds the maximum vhd disk size(100 GiB)"),
+		},
+		{
+			desc:       "file share volume is not limited",
+			maxSizeGiB: 100,
+			fsType:     smb,
+			requestGiB: 101,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{EnableDryRun: true, EnableVHDDiskFeature: true, MaxVHDDiskSizeGiB: test.maxSizeGiB})
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		// no expectation on cloud clients, any call fails the test
+		d.cloud.FileClient = mockfileclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockstorageaccountclient.NewMockInterface(ctrl)
+
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-vhd",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(test.requestGiB)},
+			Parameters: map[string]string{
+				dryRunField:         "true",
+				storageAccountField: "account",
+				resourceGroupField:  "rg",
+				fsTypeField:         test.fsType,
+			},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, "test[%s]", test.desc)
+	}
+}
+
+func TestCreateVolumeIdempotency(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+
+	tests := []struct {
+		desc          string
+		existingShare storage.FileShare
+		expectedErr   error
+	}{
+		{
+			desc:          "compatible existing share",
+			existingShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: pointer.Int32(100), AccessTier: storage.ShareAccessTierHot}},
+		},
+		{
+			desc:          "existing share with different protocol",
+			existingShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: pointer.Int32(100), AccessTier: storage.ShareAccessTierHot, EnabledProtocols: storage.EnabledProtocolsNFS}},
+			expectedErr:   status.Errorf(codes.AlreadyExists, "request file share(idempotent-vol) already exists, but its protocol NFS is different from SMB"),
+		},
+		{
+			desc:          "existing share with different access tier",
+			existingShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: pointer.Int32(100), AccessTier: storage.ShareAccessTierCool}},
+			expectedErr:   status.Errorf(codes.AlreadyExists, "request file share(idempotent-vol) already exists, but its access tier Cool is different from Hot"),
+		},
+		{
+			desc:          "existing share with smaller capacity",
+			existingShare: storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: pointer.Int32(10), AccessTier: storage.ShareAccessTierHot}},
+			expectedErr:   status.Errorf(codes.AlreadyExists, "request file share(idempotent-vol) already exists, but its capacity 10 is smaller than 100"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "idempotent-vol", "").Return(test.existingShare, nil).AnyTimes()
+		if test.expectedErr == nil {
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").Return(test.existingShare, nil).Times(1)
+		}
+
+		req := &csi.CreateVolumeRequest{
+			Name:               "idempotent-vol",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)},
+			Parameters: map[string]string{
+				skuNameField:         "Standard_LRS",
+				storageAccountField:  "account",
+				resourceGroupField:   "rg",
+				shareAccessTierField: "Hot",
+			},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, "test[%s]", test.desc)
+	}
+}
+
+func TestShareMetadataTags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+
+	tests := []struct {
+		desc             string
+		tags             string
+		expectedMetadata map[string]*string
+	}{
+		{
+			desc:             "empty tags",
+			tags:             "",
+			expectedMetadata: nil,
+		},
+		{
+			desc: "key value tags",
+			tags: "owner=alice,environment=dev,cost-center=1234",
+			expectedMetadata: map[string]*string{
+				"owner":       pointer.String("alice"),
+				"environment": pointer.String("dev"),
+			},
+		},
+		{
+			desc: "JSON tags",
+			tags: `{"owner":"alice","environment":"dev"}`,
+			expectedMetadata: map[string]*string{
+				"owner":       pointer.String("alice"),
+				"environment": pointer.String("dev"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").DoAndReturn(
+			func(_ context.Context, _, _ string, shareOptions *fileclient.ShareOptions, _ string) (storage.FileShare, error) {
+				assert.Equal(t, test.expectedMetadata, shareOptions.Metadata, "test[%s]", test.desc)
+				return storage.FileShare{}, nil
+			}).Times(1)
+
+		req := &csi.CreateVolumeRequest{
+			Name:               "share-metadata-tags",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)},
+			Parameters: map[string]string{
+				skuNameField:        "Standard_LRS",
+				storageAccountField: "account",
+				resourceGroupField:  "rg",
+				tagsField:           test.tags,
+			},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.NoError(t, err, "test[%s]", test.desc)
+	}
+}
+
+func TestRetainSharePolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	newRequest := func(policy string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               "retain-share",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)},
+			Parameters: map[string]string{
+				skuNameField:           "Standard_LRS",
+				storageAccountField:    "account",
+				resourceGroupField:     "rg",
+				retainSharePolicyField: policy,
+			},
+		}
+	}
+	newDriver := func() (*Driver, *mockfileclient.MockInterface) {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		return d, mockFileClient
+	}
+
+	t.Run("invalid retainSharePolicy", func(t *testing.T) {
+		d, _ := newDriver()
+		_, err := d.CreateVolume(context.Background(), newRequest("keep"))
+		assert.Equal(t, status.Errorf(codes.InvalidArgument, "invalid %s keep in storage class, supported values: delete, retain", retainSharePolicyField), err)
+	})
+
+	t.Run("retainSharePolicy is recorded in share metadata", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").DoAndReturn(
+			func(_ context.Context, _, _ string, shareOptions *fileclient.ShareOptions, _ string) (storage.FileShare, error) {
+				assert.Equal(t, map[string]*string{retainSharePolicyKey: pointer.String(retainSharePolicyRetain)}, shareOptions.Metadata)
+				return storage.FileShare{}, nil
+			}).Times(1)
+
+		_, err := d.CreateVolume(context.Background(), newRequest("Retain"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteVolume retains file share", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		retained := storage.FileShare{FileShareProperties: &storage.FileShareProperties{Metadata: map[string]*string{retainSharePolicyKey: pointer.String(retainSharePolicyRetain)}}}
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "retain-share", "").Return(retained, nil).Times(1)
+		// no DeleteFileShare call is expected
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "rg#account#retain-share###default"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeleteVolume fails when retainSharePolicy is unknown", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "retain-share", "").Return(storage.FileShare{}, fmt.Errorf("internal error")).Times(1)
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "rg#account#retain-share###default"})
+		assert.Equal(t, status.Errorf(codes.Internal, "failed to get %s of file share(retain-share) under account(account) rg(rg): internal error", retainSharePolicyField), err)
+	})
+}
+
+func TestAllowedAccounts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	capRange := &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)}
+
+	newDriver := func() (*Driver, *mockfileclient.MockInterface) {
+		d := NewFakeDriverCustomOptions(DriverOptions{AllowedAccounts: "allowed1, Allowed2"})
+		d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		})
+		d.cloud = &azure.Cloud{}
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		d.cloud.FileClient = mockFileClient
+		return d, mockFileClient
+	}
+
+	t.Run("CreateVolume with disallowed account", func(t *testing.T) {
+		d, _ := newDriver()
+		req := &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      capRange,
+			Parameters:         map[string]string{storageAccountField: "other", resourceGroupField: "rg", skuNameField: "Standard_LRS"},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, status.Errorf(codes.PermissionDenied, "storage account(other) is not in the allowed account list"), err)
+	})
+
+	t.Run("CreateVolume with disallowed account in secrets", func(t *testing.T) {
+		d, _ := newDriver()
+		req := &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      capRange,
+			Parameters:         map[string]string{skuNameField: "Standard_LRS"},
+			Secrets:            map[string]string{defaultSecretAccountName: "other", defaultSecretAccountKey: "key"},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, status.Errorf(codes.PermissionDenied, "storage account(other) is not in the allowed account list"), err)
+	})
+
+	t.Run("CreateVolume with allowed account", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "allowed2", gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "allowed2", gomock.Any(), "").Return(storage.FileShare{}, nil).Times(1)
+		req := &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      capRange,
+			Parameters:         map[string]string{storageAccountField: "allowed2", resourceGroupField: "rg", skuNameField: "Standard_LRS", storeAccountKeyField: "false"},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CreateVolume selects account in allowed account list", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		newAccount := func(name string) storage.Account {
+			return storage.Account{
+				Name:              pointer.String(name),
+				Sku:               &storage.Sku{Name: storage.SkuNameStandardLRS},
+				Kind:              storage.KindStorageV2,
+				Location:          pointer.String("eastus"),
+				AccountProperties: &storage.AccountProperties{EnableHTTPSTrafficOnly: pointer.Bool(true), AllowBlobPublicAccess: pointer.Bool(false)},
+			}
+		}
+		accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), "rg").Return([]storage.Account{newAccount("other"), newAccount("allowed1")}, nil).Times(1)
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "allowed1").Return(storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), "rg", "allowed1").Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), "rg", "allowed1", gomock.Any()).Return(nil).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "allowed1", gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "allowed1", gomock.Any(), "").Return(storage.FileShare{}, nil).Times(1)
+		req := &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      capRange,
+			Parameters:         map[string]string{resourceGroupField: "rg", locationField: "eastus", skuNameField: "Standard_LRS", storeAccountKeyField: "false"},
+		}
+		resp, err := d.CreateVolume(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, "rg#allowed1#vol###default", resp.Volume.VolumeId)
+	})
+
+	t.Run("CreateVolume does not create account out of allowed account list", func(t *testing.T) {
+		d, _ := newDriver()
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), "rg").Return([]storage.Account{}, nil).Times(1)
+		// no Create call on the storage account is expected
+		req := &csi.CreateVolumeRequest{
+			Name:               "vol",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      capRange,
+			Parameters:         map[string]string{resourceGroupField: "rg", skuNameField: "Standard_LRS"},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, status.Errorf(codes.PermissionDenied, "no storage account in the allowed account list matches the request in resource group(rg)"), err)
+		cache, _ := d.accountSearchCache.Get("", azcache.CacheReadTypeDefault)
+		assert.Nil(t, cache)
+	})
+
+	t.Run("DeleteVolume with disallowed account", func(t *testing.T) {
+		d, _ := newDriver()
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "rg#other#share#"})
+		assert.Equal(t, status.Errorf(codes.PermissionDenied, "storage account(other) of volume(rg#other#share#) is not in the allowed account list"), err)
+	})
+
+	t.Run("DeleteVolume with allowed account", func(t *testing.T) {
+		d, mockFileClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "allowed1", "share", "").Return(storage.FileShare{}, nil).Times(1)
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "allowed1", "share", "").Return(nil).Times(1)
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "rg#allowed1#share#"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("ControllerExpandVolume with disallowed account", func(t *testing.T) {
+		d, _ := newDriver()
+		_, err := d.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{VolumeId: "rg#other#share#", CapacityRange: capRange})
+		assert.Equal(t, status.Errorf(codes.PermissionDenied, "storage account(other) of volume(rg#other#share#) is not in the allowed account list"), err)
+	})
+}
+
+func TestGetShareURL(t *testing.T) {
+	d := NewFakeDriver()
+	validSecret := map[string]string{}
+	d.cloud = &azure.Cloud{}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	key := storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{Value: &value},
+		},
+	}
+	clientSet := fake.NewSimpleClientset()
+	tests := []struct {
+		desc           string
+		sourceVolumeID string
+		expectedErr    error
+	}{
+		{
+			desc:           "Volume ID error",
+			sourceVolumeID: "vol_1",
+			expectedErr:    fmt.Errorf("failed to get file share from vol_1"),
+		},
+		{
+			desc:           "Volume ID error2",
+			sourceVolumeID: "vol_1###",
+			expectedErr:    fmt.Errorf("failed to get file share from vol_1###"),
+		},
+		{
+			desc:           "Valid request",
+			sourceVolumeID: "rg#accountname#fileshare#",
+			expectedErr:    nil,
+		},
+	}
+
+	for _, test := range tests {
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		d.cloud.KubeClient = clientSet
+		d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
 		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", gomock.Any()).Return(key, nil).AnyTimes()
 		_, err := d.getShareURL(context.Background(), test.sourceVolumeID, validSecret)
 		if !reflect.DeepEqual(err, test.expectedErr) {
@@ -2648,266 +4372,1870 @@ func TestGetShareURL(t *testing.T) {
 	}
 }
 
-func TestGetServiceURL(t *testing.T) {
-	d := NewFakeDriver()
-	validSecret := map[string]string{}
-	d.cloud = &azure.Cloud{}
-
+func TestGetServiceURL(t *testing.T) {
+	d := NewFakeDriver()
+	validSecret := map[string]string{}
+	d.cloud = &azure.Cloud{}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	errValue := "acc_key"
+	validKey := storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{Value: &value},
+		},
+	}
+	errKey := storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{Value: &errValue},
+		},
+	}
+	clientSet := fake.NewSimpleClientset()
+	tests := []struct {
+		desc           string
+		sourceVolumeID string
+		key            storage.AccountListKeysResult
+		expectedErr    error
+	}{
+		{
+			desc:           "Invalid volume ID",
+			sourceVolumeID: "vol_1",
+			key:            validKey,
+			expectedErr:    nil,
+		},
+		{
+			desc:           "Invalid Key",
+			sourceVolumeID: "vol_1##",
+			key:            errKey,
+			expectedErr:    nil,
+		},
+		{
+			desc:           "Invalid URL",
+			sourceVolumeID: "vol_1#^f5713de20cde511e8ba4900#",
+			key:            validKey,
+			expectedErr:    &url.Error{Op: "parse", URL: "https://^f5713de20cde511e8ba4900.file.abc", Err: url.InvalidHostError("^")},
+		},
+		{
+			desc:           "Valid call",
+			sourceVolumeID: "vol_1##",
+			key:            validKey,
+			expectedErr:    nil,
+		},
+	}
+
+	for _, test := range tests {
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		d.cloud.KubeClient = clientSet
+		d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "vol_1", gomock.Any()).Return(test.key, nil).AnyTimes()
+
+		_, _, err := d.getServiceURL(context.Background(), test.sourceVolumeID, validSecret)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestSnapshotExists(t *testing.T) {
+	d := NewFakeDriver()
+	validSecret := map[string]string{}
+	d.cloud = &azure.Cloud{}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+
+	validKey := storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{Value: &value},
+		},
+	}
+
+	clientSet := fake.NewSimpleClientset()
+	tests := []struct {
+		desc           string
+		sourceVolumeID string
+		key            storage.AccountListKeysResult
+		secret         map[string]string
+		expectedErr    error
+	}{
+		{
+			desc:           "Invalid volume ID with data plane api",
+			sourceVolumeID: "vol_1",
+			key:            validKey,
+			secret:         map[string]string{"accountName": "TestAccountName", "accountKey": base64.StdEncoding.EncodeToString([]byte("TestAccountKey"))},
+			expectedErr:    fmt.Errorf("file share is empty after parsing sourceVolumeID: vol_1"),
+		},
+		{
+			desc:           "Invalid volume ID with management api",
+			sourceVolumeID: "vol_1",
+			key:            validKey,
+			secret:         validSecret,
+			expectedErr:    fmt.Errorf("error parsing volume id: %q, should at least contain two #", "vol_1"),
+		},
+	}
+
+	for _, test := range tests {
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		d.cloud.KubeClient = clientSet
+		d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "", gomock.Any()).Return(test.key, nil).AnyTimes()
+
+		_, _, _, _, err := d.snapshotExists(context.Background(), test.sourceVolumeID, "sname", test.secret, false)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	quota := int32(1024)
+	shareItems := []storage.FileShareItem{
+		{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}},
+		{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}},
+		{FileShareProperties: &storage.FileShareProperties{}},
+	}
+
+	premiumAccount := storage.Account{Sku: &storage.Sku{Name: storage.SkuNamePremiumLRS}}
+
+	tests := []struct {
+		desc              string
+		params            map[string]string
+		disableCapability bool
+		expectGetAccount  bool
+		account           storage.Account
+		getAccountErr     *retry.Error
+		listErr           error
+		expectList        bool
+		expectedCapacity  int64
+		expectedErr       error
+	}{
+		{
+			desc:              "GET_CAPACITY capability is not supported",
+			disableCapability: true,
+			expectedErr:       status.Errorf(codes.InvalidArgument, "invalid get capacity request: %v", &csi.GetCapacityRequest{}),
+		},
+		{
+			desc:             "empty response when account type is unknown",
+			expectedCapacity: 0,
+		},
+		{
+			desc:             "coarse estimate of standard account limit when account is not specified",
+			params:           map[string]string{"skuName": "Standard_LRS"},
+			expectedCapacity: util.GiBToBytes(standardAccountCapacityLimit),
+		},
+		{
+			desc:             "nfs protocol implies premium account",
+			params:           map[string]string{"protocol": "nfs"},
+			expectedCapacity: util.GiBToBytes(premiumAccountCapacityLimit),
+		},
+		{
+			desc:             "coarse estimate of premium account limit when account is not specified",
+			params:           map[string]string{"skuName": "Premium_LRS"},
+			expectedCapacity: util.GiBToBytes(premiumAccountCapacityLimit),
+		},
+		{
+			desc:        "invalid accountQuota",
+			params:      map[string]string{"accountQuota": "10"},
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid accountQuota 10 in storage class, minimum quota: %d", minimumAccountQuota),
+		},
+		{
+			desc:             "subtract provisioned share quota from premium account limit",
+			params:           map[string]string{"skuName": "Premium_LRS", "storageAccount": "account", "resourceGroup": "rg"},
+			expectList:       true,
+			expectedCapacity: util.GiBToBytes(premiumAccountCapacityLimit - 2048),
+		},
+		{
+			desc:             "account type is resolved from storage account",
+			params:           map[string]string{"storageAccount": "account", "resourceGroup": "rg"},
+			expectGetAccount: true,
+			account:          premiumAccount,
+			expectList:       true,
+			expectedCapacity: util.GiBToBytes(premiumAccountCapacityLimit - 2048),
+		},
+		{
+			desc:             "empty response when account type could not be resolved from storage account",
+			params:           map[string]string{"storageAccount": "account", "resourceGroup": "rg"},
+			expectGetAccount: true,
+			getAccountErr:    retry.NewError(false, fmt.Errorf("test error")),
+			expectedCapacity: 0,
+		},
+		{
+			desc:             "accountQuota overrides account limit",
+			params:           map[string]string{"storageAccount": "account", "resourceGroup": "rg", "accountQuota": "3000"},
+			expectList:       true,
+			expectedCapacity: util.GiBToBytes(3000 - 2048),
+		},
+		{
+			desc:             "no capacity left when provisioned quota exceeds accountQuota",
+			params:           map[string]string{"storageAccount": "account", "resourceGroup": "rg", "accountQuota": "1000"},
+			expectList:       true,
+			expectedCapacity: 0,
+		},
+		{
+			desc:        "list file share failure",
+			params:      map[string]string{"skuName": "Standard_LRS", "storageAccount": "account", "resourceGroup": "rg"},
+			expectList:  true,
+			listErr:     fmt.Errorf("test error"),
+			expectedErr: status.Errorf(codes.Internal, "failed to get total quota of account(account) in resource group(rg): test error"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		if !test.disableCapability {
+			d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_GET_CAPACITY})
+		}
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		if test.expectGetAccount {
+			mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), "", "rg", "account").Return(test.account, test.getAccountErr).Times(1)
+		}
+		if test.expectList {
+			mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).Times(1)
+			mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", "").Return(shareItems, test.listErr).Times(1)
+		}
+
+		resp, err := d.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: test.params})
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if test.expectedErr == nil && resp.GetAvailableCapacity() != test.expectedCapacity {
+			t.Errorf("test[%s]: unexpected capacity: %d, expected capacity: %d", test.desc, resp.GetAvailableCapacity(), test.expectedCapacity)
+		}
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	d := NewFakeDriver()
+	req := csi.ListVolumesRequest{}
+	resp, err := d.ListVolumes(context.Background(), &req)
+	assert.Nil(t, resp)
+	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	shareName := "share"
+	otherShareName := "other"
+	quota := int32(100)
+	time1 := date.Time{Time: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)}
+	time2 := date.Time{Time: time.Date(2023, 1, 3, 3, 4, 5, 0, time.UTC)}
+	shareItems := []storage.FileShareItem{
+		{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}},
+		{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, SnapshotTime: &time2}},
+		{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, SnapshotTime: &time1}},
+		{Name: &otherShareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, SnapshotTime: &time1}},
+		{Name: &shareName},
+	}
+	sourceVolumeID := "rg#account#share#diskname#uuid#namespace"
+	snapshotID1 := sourceVolumeID + "#" + time1.Format(snapshotTimeFormat)
+	snapshotID2 := sourceVolumeID + "#" + time2.Format(snapshotTimeFormat)
+	deleted := true
+
+	tests := []struct {
+		desc                string
+		req                 *csi.ListSnapshotsRequest
+		shareItems          []storage.FileShareItem
+		listErr             error
+		expectedSnapshotIDs []string
+		expectedNextToken   string
+		expectedErr         error
+	}{
+		{
+			desc:        "negative max entries",
+			req:         &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID, MaxEntries: -1},
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid max entries: -1"),
+		},
+		{
+			desc:        "invalid starting token",
+			req:         &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID, StartingToken: "abc"},
+			expectedErr: status.Errorf(codes.Aborted, "invalid starting token: abc"),
+		},
+		{
+			desc: "no filter returns empty list",
+			req:  &csi.ListSnapshotsRequest{},
+		},
+		{
+			desc: "invalid snapshot id returns empty list",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: "rg#account#share"},
+		},
+		{
+			desc: "snapshot id does not belong to source volume",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: snapshotID1, SourceVolumeId: "rg#account#other#diskname#uuid#namespace"},
+		},
+		{
+			desc:        "list file share failed",
+			req:         &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID},
+			listErr:     fmt.Errorf("list error"),
+			expectedErr: status.Errorf(codes.Internal, "failed to list snapshots of share(share) in account(account): list error"),
+		},
+		{
+			desc:    "account of source volume is not found",
+			req:     &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID},
+			listErr: fmt.Errorf("Retriable: false, RetryAfter: 0s, HTTPStatusCode: 404, RawError: account not found"),
+		},
+		{
+			desc:       "source share is deleted",
+			req:        &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID},
+			shareItems: []storage.FileShareItem{{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, Deleted: &deleted}}, shareItems[1], shareItems[2]},
+		},
+		{
+			desc:       "source share does not exist",
+			req:        &csi.ListSnapshotsRequest{SnapshotId: snapshotID1},
+			shareItems: []storage.FileShareItem{shareItems[1], shareItems[2]},
+		},
+		{
+			desc:                "list by source volume id",
+			req:                 &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID},
+			expectedSnapshotIDs: []string{snapshotID1, snapshotID2},
+		},
+		{
+			desc:                "list by snapshot id",
+			req:                 &csi.ListSnapshotsRequest{SnapshotId: snapshotID2},
+			expectedSnapshotIDs: []string{snapshotID2},
+		},
+		{
+			desc:                "list with max entries",
+			req:                 &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID, MaxEntries: 1},
+			expectedSnapshotIDs: []string{snapshotID1},
+			expectedNextToken:   "1",
+		},
+		{
+			desc:                "list with starting token",
+			req:                 &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID, MaxEntries: 1, StartingToken: "1"},
+			expectedSnapshotIDs: []string{snapshotID2},
+		},
+		{
+			desc:        "starting token out of range",
+			req:         &csi.ListSnapshotsRequest{SourceVolumeId: sourceVolumeID, StartingToken: "3"},
+			expectedErr: status.Errorf(codes.Aborted, "starting token(3) is greater than total number of snapshots(2)"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.AddControllerServiceCapabilities(
+			[]csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			})
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		items := shareItems
+		if test.shareItems != nil {
+			items = test.shareItems
+		}
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", snapshotsExpand).Return(items, test.listErr).AnyTimes()
+
+		resp, err := d.ListSnapshots(context.Background(), test.req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		snapshotIDs := []string{}
+		for _, entry := range resp.Entries {
+			snapshotIDs = append(snapshotIDs, entry.Snapshot.SnapshotId)
+			if entry.Snapshot.SourceVolumeId != sourceVolumeID || entry.Snapshot.SizeBytes != 100*1024*1024*1024 || !entry.Snapshot.ReadyToUse {
+				t.Errorf("test[%s]: unexpected snapshot: %v", test.desc, entry.Snapshot)
+			}
+		}
+		if test.expectedSnapshotIDs == nil {
+			test.expectedSnapshotIDs = []string{}
+		}
+		if !reflect.DeepEqual(snapshotIDs, test.expectedSnapshotIDs) {
+			t.Errorf("test[%s]: unexpected snapshot ids: %v, expected: %v", test.desc, snapshotIDs, test.expectedSnapshotIDs)
+		}
+		if resp.NextToken != test.expectedNextToken {
+			t.Errorf("test[%s]: unexpected next token: %s, expected: %s", test.desc, resp.NextToken, test.expectedNextToken)
+		}
+	}
+}
+
+func TestCheckSnapshotSourceShare(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	snapshotID := "rg#account#share#diskname#uuid#namespace#2023-01-02T03:04:05.0000000Z"
+	deleted := true
+	quota, snapshotQuota := int32(100), int32(50)
+	notFoundErr := fmt.Errorf("storage.FileSharesClient#Get: Failure responding to request: StatusCode=404 -- Original Error: autorest/azure: Service returned an error. Code=\"ShareNotFound\"")
+	tests := []struct {
+		desc           string
+		snapshotID     string
+		share          storage.FileShare
+		getErr         error
+		snapshot       storage.FileShare
+		getSnapshotErr error
+		expectedQuota  int
+		expectedErr    error
+	}{
+		{
+			desc:        "invalid snapshot id",
+			snapshotID:  "rg#account",
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid snapshot id(rg#account): %v", fmt.Errorf("error parsing volume id: \"rg#account\", should at least contain two #")),
+		},
+		{
+			desc:        "empty file share name in snapshot id",
+			snapshotID:  "rg#account#",
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid snapshot id(rg#account#): file share name is empty"),
+		},
+		{
+			desc:        "source share is not found",
+			snapshotID:  snapshotID,
+			getErr:      notFoundErr,
+			expectedErr: status.Errorf(codes.NotFound, "source file share(share) of snapshot(%s) on account(account) does not exist", snapshotID),
+		},
+		{
+			desc:        "source share is soft deleted",
+			snapshotID:  snapshotID,
+			share:       storage.FileShare{FileShareProperties: &storage.FileShareProperties{Deleted: &deleted}},
+			expectedErr: status.Errorf(codes.NotFound, "source file share(share) of snapshot(%s) on account(account) has been deleted", snapshotID),
+		},
+		{
+			desc:        "get source share failed",
+			snapshotID:  snapshotID,
+			getErr:      fmt.Errorf("internal error"),
+			expectedErr: status.Errorf(codes.Internal, "failed to get source file share(share) of snapshot(%s) on account(account): internal error", snapshotID),
+		},
+		{
+			desc:          "quota of snapshot instead of source share is returned",
+			snapshotID:    snapshotID,
+			share:         storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}},
+			snapshot:      storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &snapshotQuota}},
+			expectedQuota: 50,
+		},
+		{
+			desc:           "snapshot is not found",
+			snapshotID:     snapshotID,
+			share:          storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}},
+			getSnapshotErr: notFoundErr,
+			expectedErr:    status.Errorf(codes.NotFound, "snapshot(%s) of file share(share) on account(account) does not exist", snapshotID),
+		},
+		{
+			desc:        "invalid snapshot time",
+			snapshotID:  "rg#account#share#diskname#uuid#namespace#invalid",
+			share:       storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}},
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid snapshot id(rg#account#share#diskname#uuid#namespace#invalid): %v", fmt.Errorf("invalid snapshot time(invalid), should be in %s format", snapshotTimeFormat)),
+		},
+		{
+			desc:       "source share of vhd disk volume exists",
+			snapshotID: "rg#account#share#disk.vhd#uuid#namespace#2023-01-02T03:04:05.0000000Z",
+			share:      storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}},
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(test.share, test.getErr).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "2023-01-02T03:04:05.0000000Z").Return(test.snapshot, test.getSnapshotErr).AnyTimes()
+
+		quota, err := d.checkSnapshotSourceShare(context.Background(), test.snapshotID)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		assert.Equal(t, test.expectedQuota, quota, test.desc)
+	}
+}
+
+func TestListSnapshotsRoundTrip(t *testing.T) {
+	snapshotID := "rg#account#share#diskname#uuid#namespace#2023-01-02T03:04:05.0000000Z"
+	snapshot, err := getSnapshot(snapshotID)
+	assert.NoError(t, err)
+	assert.Equal(t, "2023-01-02T03:04:05.0000000Z", snapshot)
+	rg, account, share, _, _, _, err := GetFileShareInfo(snapshotID) //nolint:dogsled
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rg", "account", "share"}, []string{rg, account, share})
+}
+
+func TestSetAzureCredentials(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{
+		Config: azure.Config{
+			ResourceGroup: "rg",
+			Location:      "loc",
+			VnetName:      "fake-vnet",
+			SubnetName:    "fake-subnet",
+		},
+	}
+	fakeClient := fake.NewSimpleClientset()
+
+	tests := []struct {
+		desc            string
+		kubeClient      kubernetes.Interface
+		accountName     string
+		accountKey      string
+		secretName      string
+		secretNamespace string
+		expectedName    string
+		expectedErr     error
+	}{
+		{
+			desc:        "[failure] accountName is nil",
+			kubeClient:  fakeClient,
+			expectedErr: fmt.Errorf("the account info is not enough, accountName(), accountKey()"),
+		},
+		{
+			desc:        "[failure] accountKey is nil",
+			kubeClient:  fakeClient,
+			accountName: "testName",
+			accountKey:  "",
+			expectedErr: fmt.Errorf("the account info is not enough, accountName(testName), accountKey()"),
+		},
+		{
+			desc:        "[success] kubeClient is nil",
+			kubeClient:  nil,
+			expectedErr: nil,
+		},
+		{
+			desc:         "[success] normal scenario",
+			kubeClient:   fakeClient,
+			accountName:  "testName",
+			accountKey:   "testKey",
+			expectedName: "azure-storage-account-testName-secret",
+			expectedErr:  nil,
+		},
+		{
+			desc:         "[success] already exist",
+			kubeClient:   fakeClient,
+			accountName:  "testName",
+			accountKey:   "testKey",
+			expectedName: "azure-storage-account-testName-secret",
+			expectedErr:  nil,
+		},
+		{
+			desc:            "[success] normal scenario using secretName",
+			kubeClient:      fakeClient,
+			accountName:     "testName",
+			accountKey:      "testKey",
+			secretName:      "secretName",
+			secretNamespace: "secretNamespace",
+			expectedName:    "secretName",
+			expectedErr:     nil,
+		},
+	}
+
+	for _, test := range tests {
+		d.cloud.KubeClient = test.kubeClient
+		result, err := d.SetAzureCredentials(context.TODO(), test.accountName, test.accountKey, test.secretName, test.secretNamespace)
+		if result != test.expectedName || !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("desc: %s,\n input: accountName(%v), accountKey(%v),\n setAzureCredentials result: %v, expectedName: %v err: %v, expectedErr: %v",
+				test.desc, test.accountName, test.accountKey, result, test.expectedName, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGenerateSASToken(t *testing.T) {
+	storageEndpointSuffix := "core.windows.net"
+	tests := []struct {
+		name        string
+		accountName string
+		accountKey  string
+		want        string
+		expectedErr error
+	}{
+		{
+			name:        "accountName nil",
+			accountName: "",
+			accountKey:  "",
+			want:        "se=",
+			expectedErr: nil,
+		},
+		{
+			name:        "account key illegal",
+			accountName: "unit-test",
+			accountKey:  "fakeValue",
+			want:        "",
+			expectedErr: status.Errorf(codes.Internal, fmt.Sprintf("failed to generate sas token in creating new shared key credential, accountName: %s, err: %s", "unit-test", "decode account key: illegal base64 data at input byte 8")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sas, err := generateSASToken(tt.accountName, tt.accountKey, storageEndpointSuffix, 30)
+			if !reflect.DeepEqual(err, tt.expectedErr) {
+				t.Errorf("generateSASToken error = %v, expectedErr %v, sas token = %v, want %v", err, tt.expectedErr, sas, tt.want)
+				return
+			}
+			if !strings.Contains(sas, tt.want) {
+				t.Errorf("sas token = %v, want %v", sas, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeMatchTags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+	newAccount := func(name string, tags map[string]*string) storage.Account {
+		return storage.Account{
+			Name:     pointer.String(name),
+			Sku:      &storage.Sku{Name: storage.SkuNameStandardLRS},
+			Kind:     storage.KindStorageV2,
+			Location: pointer.String("eastus"),
+			Tags:     tags,
+			AccountProperties: &storage.AccountProperties{
+				EnableHTTPSTrafficOnly: pointer.Bool(true),
+				AllowBlobPublicAccess:  pointer.Bool(false),
+			},
+		}
+	}
+	// account with all tags but allowing http traffic is not selected
+	httpAccount := newAccount("accountaa", map[string]*string{"pool": pointer.String("gold"), "env": pointer.String("prod")})
+	httpAccount.AccountProperties.EnableHTTPSTrafficOnly = pointer.Bool(false)
+	accounts := []storage.Account{
+		httpAccount,
+		newAccount("accountc", map[string]*string{"pool": pointer.String("gold"), "env": pointer.String("prod")}),
+		newAccount("accounta", map[string]*string{"pool": pointer.String("silver"), "env": pointer.String("prod")}),
+		newAccount("accountb", map[string]*string{"pool": pointer.String("gold"), azure.SkipMatchingTag: pointer.String("")}),
+		newAccount("accountd", map[string]*string{"pool": pointer.String("gold")}),
+	}
+	newDriver := func() (*Driver, *mockfileclient.MockInterface, *mockstorageaccountclient.MockInterface) {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		return d, mockFileClient, mockStorageAccountsClient
+	}
+	newRequest := func(name, matchTags string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)},
+			Parameters: map[string]string{
+				skuNameField:            "Standard_LRS",
+				resourceGroupField:      "rg",
+				locationField:           "eastus",
+				accountTagSelectorField: matchTags,
+			},
+		}
+	}
+
+	t.Run("select account with all tags and cache the result", func(t *testing.T) {
+		d, mockFileClient, mockStorageAccountsClient := newDriver()
+		// accounts are listed only once, the second volume is created on the cached account
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), "rg").Return(accounts, nil).Times(1)
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "accountc", gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "accountc", gomock.Any(), "").Return(storage.FileShare{}, nil).Times(2)
+
+		for _, name := range []string{"vol-1", "vol-2"} {
+			resp, err := d.CreateVolume(context.Background(), newRequest(name, "pool=gold, env=prod"))
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("rg#accountc#%s###default", name), resp.Volume.VolumeId)
+		}
+	})
+
+	t.Run("no matching account without createaccount", func(t *testing.T) {
+		d, _, mockStorageAccountsClient := newDriver()
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), "rg").Return(accounts, nil).Times(1)
+
+		_, err := d.CreateVolume(context.Background(), newRequest("vol-3", "pool=gold,env=dev"))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Contains(t, err.Error(), "no storage account matches accounttagselector(pool=gold,env=dev) in resource group(rg)")
+	})
+
+	t.Run("list accounts failure", func(t *testing.T) {
+		d, _, mockStorageAccountsClient := newDriver()
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), "rg").Return(nil, retry.NewError(false, fmt.Errorf("test error"))).Times(1)
+
+		_, err := d.CreateVolume(context.Background(), newRequest("vol-4", "pool=gold"))
+		assert.Equal(t, codes.Internal, status.Code(err))
+	})
+
+	t.Run("invalid accountTagSelector", func(t *testing.T) {
+		d, _, _ := newDriver()
+		_, err := d.CreateVolume(context.Background(), newRequest("vol-5", "pool"))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestCreateVolumeAccountLimitExceeded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+	// skipMatchingTag added on the exhausted account is not returned by account list yet
+	accounts := []storage.Account{
+		{
+			Name:              pointer.String("exhausted"),
+			Sku:               &storage.Sku{Name: storage.SkuNameStandardLRS},
+			Kind:              storage.KindStorageV2,
+			Location:          pointer.String("eastus"),
+			Tags:              map[string]*string{"pool": pointer.String("gold")},
+			AccountProperties: &storage.AccountProperties{AllowBlobPublicAccess: pointer.Bool(false), EnableHTTPSTrafficOnly: pointer.Bool(true)},
+		},
+	}
+	newDriver := func() (*Driver, *mockfileclient.MockInterface, *mockstorageaccountclient.MockInterface) {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", gomock.Any(), gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), "rg").Return(accounts, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		return d, mockFileClient, mockStorageAccountsClient
+	}
+	newRequest := func(name string, parameters map[string]string) *csi.CreateVolumeRequest {
+		req := &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)},
+			Parameters: map[string]string{
+				skuNameField:       "Standard_LRS",
+				resourceGroupField: "rg",
+				locationField:      "eastus",
+			},
+		}
+		for k, v := range parameters {
+			req.Parameters[k] = v
+		}
+		return req
+	}
+
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		limitErr   error
+	}{
+		{
+			desc:     "account limit exceeded by management API",
+			limitErr: fmt.Errorf("Code=\"%s\"", accountLimitExceedManagementAPI),
+		},
+		{
+			desc:     "account limit exceeded by data plane API",
+			limitErr: fmt.Errorf("The %s.", accountLimitExceedDataPlaneAPI),
+		},
+		{
+			desc:       "account limit exceeded on account matching tags",
+			parameters: map[string]string{accountTagSelectorField: "pool=gold", createAccountField: "true"},
+			limitErr:   fmt.Errorf("Code=\"%s\"", accountLimitExceedManagementAPI),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			d, mockFileClient, mockStorageAccountsClient := newDriver()
+			// exhausted account is selected first and never selected again
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "exhausted", gomock.Any(), "").Return(storage.FileShare{}, test.limitErr).Times(1)
+			var newAccountName string
+			mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), "rg", gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, _, _, accountName string, _ storage.AccountCreateParameters) *retry.Error {
+					newAccountName = accountName
+					return nil
+				}).Times(1)
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", gomock.Not("exhausted"), gomock.Any(), "").Return(storage.FileShare{}, nil).Times(2)
+
+			for _, name := range []string{"vol-1", "vol-2"} {
+				resp, err := d.CreateVolume(context.Background(), newRequest(name, test.parameters))
+				assert.NoError(t, err)
+				assert.NotEmpty(t, newAccountName)
+				// the new account is selected by following volumes
+				assert.Equal(t, fmt.Sprintf("rg#%s#%s###default", newAccountName, name), resp.Volume.VolumeId)
+			}
+			assert.True(t, d.isAccountLimitExceeded("exhausted"))
+		})
+	}
+
+	t.Run("no new account is created when createaccount is false", func(t *testing.T) {
+		d, mockFileClient, _ := newDriver()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "exhausted", gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("Code=\"%s\"", accountLimitExceedManagementAPI)).Times(1)
+
+		_, err := d.CreateVolume(context.Background(), newRequest("vol-3", map[string]string{createAccountField: "false"}))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Contains(t, err.Error(), "account limit is exceeded")
+	})
+}
+
+func TestCreateVolumeStoreAccountKey(t *testing.T) {
+	tests := []struct {
+		storeAccountKey string
+		expectedSecrets int
+	}{
+		{storeAccountKey: "true", expectedSecrets: 1},
+		{storeAccountKey: "", expectedSecrets: 1},
+		{storeAccountKey: "false", expectedSecrets: 0},
+		{storeAccountKey: "False", expectedSecrets: 0},
+	}
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	fakeShareQuota := int32(100)
+
+	for _, test := range tests {
+		ctrl := gomock.NewController(t)
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+		value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: nil}}, nil).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+		parameters := map[string]string{
+			skuNameField:        "Standard_LRS",
+			storageAccountField: "stoacc",
+			resourceGroupField:  "rg",
+		}
+		if test.storeAccountKey != "" {
+			parameters[storeAccountKeyField] = test.storeAccountKey
+		}
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-store-account-key",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)},
+			Parameters:         parameters,
+		}
+		resp, err := d.CreateVolume(context.Background(), req)
+		assert.NoError(t, err, test.storeAccountKey)
+
+		secrets, err := d.cloud.KubeClient.CoreV1().Secrets("").List(context.Background(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, secrets.Items, test.expectedSecrets, test.storeAccountKey)
+		if test.expectedSecrets == 0 {
+			// node would get account key by cluster identity instead of reading the secret
+			assert.Equal(t, test.storeAccountKey, resp.Volume.VolumeContext[storeAccountKeyField])
+		}
+		ctrl.Finish()
+	}
+}
+
+func TestCreateVolumeRestoreFromSoftDelete(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	shareName := "share"
+	smallQuota, quota := int32(50), int32(100)
+	version := "01D60B2D8A3C1B4F"
+	deletedShare := storage.FileShareItem{Name: &shareName, FileShareProperties: &storage.FileShareProperties{
+		Deleted: pointer.Bool(true), Version: &version, ShareQuota: &smallQuota}}
+	volCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	newRequest := func(restoreFromSoftDelete string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               "pvc-restore",
+			VolumeCapabilities: volCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(int64(quota))},
+			Parameters: map[string]string{
+				skuNameField:               "Standard_LRS",
+				storageAccountField:        "stoacc",
+				resourceGroupField:         "rg",
+				shareNameField:             shareName,
+				restoreFromSoftDeleteField: restoreFromSoftDelete,
+			},
+		}
+	}
+	validKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	newDriver := func(accountKey string) (*Driver, *mockfileclient.MockInterface) {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "stoacc").Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		return d, mockFileClient
+	}
+
+	var restoredVersions []string
+	defer func(f func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName, version string) error) {
+		restoreDeletedFileShare = f
+	}(restoreDeletedFileShare)
+	restoreDeletedFileShare = func(_ context.Context, _, _, _, _, version string) error {
+		restoredVersions = append(restoredVersions, version)
+		return nil
+	}
+	defer func(f func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName, version string) (map[string]string, error)) {
+		getDeletedFileShareMetadata = f
+	}(getDeletedFileShareMetadata)
+	getDeletedFileShareMetadata = func(_ context.Context, _, _, _, _, _ string) (map[string]string, error) {
+		return map[string]string{createdByMetadataKey: fakeDriverName}, nil
+	}
+	var restoredMetadata map[string]*string
+	defer func(f func(ctx context.Context, accountName, accountKey, storageEndpointSuffix, shareName string, metadata map[string]*string) error) {
+		setFileShareMetadataWithKey = f
+	}(setFileShareMetadataWithKey)
+	setFileShareMetadataWithKey = func(_ context.Context, _, _, _, _ string, metadata map[string]*string) error {
+		restoredMetadata = metadata
+		return nil
+	}
+
+	t.Run("soft deleted share is restored and resized instead of creating a new one", func(t *testing.T) {
+		restoredVersions = nil
+		d, mockFileClient := newDriver(validKey)
+		gomock.InOrder(
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", shareName, "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).Times(1),
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", shareName, "").Return(storage.FileShare{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &smallQuota}}, nil).Times(1),
+		)
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "stoacc", "", deletedSharesExpand).Return([]storage.FileShareItem{deletedShare}, nil).Times(1)
+		mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), "rg", "stoacc", shareName, int(quota)).Return(nil).Times(1)
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+		resp, err := d.CreateVolume(context.Background(), newRequest("true"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{version}, restoredVersions)
+		assert.Equal(t, fakeDriverName, pointer.StringDeref(restoredMetadata[createdByMetadataKey], ""))
+		assert.Equal(t, "rg#stoacc#share#", resp.Volume.VolumeId[:len("rg#stoacc#share#")])
+	})
+
+	t.Run("throttled resize of restored share falls back to data plane API", func(t *testing.T) {
+		restoredVersions = nil
+		// invalid base64 key fails data plane client creation without sending any request
+		d, mockFileClient := newDriver("invalid key")
+		d.fileClient = &azureFileClient{env: &azure2.Environment{StorageEndpointSuffix: "core.windows.net"}}
+		gomock.InOrder(
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", shareName, "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).Times(1),
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", shareName, "").Return(storage.FileShare{Name: &shareName, FileShareProperties: &storage.FileShareProperties{ShareQuota: &smallQuota}}, nil).Times(1),
+		)
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "stoacc", "", deletedSharesExpand).Return([]storage.FileShareItem{deletedShare}, nil).Times(1)
+		mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), "rg", "stoacc", shareName, int(quota)).Return(fmt.Errorf("Retriable: true, StatusCode: 429, TooManyRequests")).Times(1)
+
+		_, err := d.CreateVolume(context.Background(), newRequest("true"))
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.Contains(t, err.Error(), "error creating azure client")
+		assert.Equal(t, []string{version}, restoredVersions)
+	})
+
+	t.Run("file share is created if there is no soft deleted share", func(t *testing.T) {
+		restoredVersions = nil
+		d, mockFileClient := newDriver(validKey)
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", shareName, "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).Times(1)
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "stoacc", "", deletedSharesExpand).Return([]storage.FileShareItem{}, nil).Times(1)
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "stoacc", gomock.Any(), "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}}, nil).Times(1)
+
+		_, err := d.CreateVolume(context.Background(), newRequest("true"))
+		assert.NoError(t, err)
+		assert.Empty(t, restoredVersions)
+	})
+
+	t.Run("soft deleted share is not looked up if disabled", func(t *testing.T) {
+		restoredVersions = nil
+		d, mockFileClient := newDriver(validKey)
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", shareName, "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).Times(1)
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "stoacc", gomock.Any(), "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}}, nil).Times(1)
+
+		_, err := d.CreateVolume(context.Background(), newRequest("false"))
+		assert.NoError(t, err)
+		assert.Empty(t, restoredVersions)
+	})
+
+	t.Run("invalid restoreFromSoftDelete", func(t *testing.T) {
+		d, _ := newDriver(validKey)
+		_, err := d.CreateVolume(context.Background(), newRequest("invalid"))
+		assert.Equal(t, status.Errorf(codes.InvalidArgument, "invalid restorefromsoftdelete: invalid in storage class"), err)
+	})
+}
+
+func TestControllerExpandVolumeVHDDisk(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oldSizeBytes := util.GiBToBytes(1)
+	disk := &fakeDiskFile{}
+	assert.NoError(t, writeVHDDisk(context.Background(), disk, "disk.vhd", oldSizeBytes))
+	defer func(f func(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, retryOptions azfile.RetryOptions) (diskFile, error)) {
+		newDiskFile = f
+	}(newDiskFile)
+	newDiskFile = func(accountName, _, storageEndpointSuffix, fileShareName, diskName string, _ azfile.RetryOptions) (diskFile, error) {
+		assert.Equal(t, "account", accountName)
+		assert.Equal(t, "local.azurestack.external", storageEndpointSuffix)
+		assert.Equal(t, "share", fileShareName)
+		assert.Equal(t, "disk.vhd", diskName)
+		return disk, nil
+	}
+
+	d := NewFakeDriver()
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_EXPAND_VOLUME})
+	d.cloud = &azure.Cloud{}
+	d.cloud.KubeClient = fake.NewSimpleClientset()
+	d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "core.windows.net"}
+	mockFileClient := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClient
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+	mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+	shareQuota := int32(1)
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").DoAndReturn(
+		func(_ context.Context, _, _, _, _ string) (storage.FileShare, error) {
+			quota := shareQuota
+			return storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}}, nil
+		}).AnyTimes()
+	mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "account").Return(keys, nil).AnyTimes()
+	mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+	mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	// file share is grown before the vhd disk file
+	mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), "rg", "account", "share", 2).DoAndReturn(
+		func(_ context.Context, _, _, _ string, _ int) error {
+			assert.Equal(t, oldSizeBytes, int64(len(disk.data)), "vhd disk should not be grown before file share")
+			shareQuota = 2
+			return nil
+		}).Times(1)
+
+	req := &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "rg#account#share#disk.vhd#uuid#",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(2)},
+	}
+	// custom storage endpoint suffix recorded from storage class is used by data plane calls
+	d.storageEndpointSuffixVolMap.Store(req.VolumeId, "local.azurestack.external")
+	resp, err := d.ControllerExpandVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, &csi.ControllerExpandVolumeResponse{CapacityBytes: util.GiBToBytes(2), NodeExpansionRequired: true}, resp)
+	assert.Equal(t, util.GiBToBytes(2), int64(len(disk.data)))
+	assert.NoError(t, verifyVHDFooter(disk.data[len(disk.data)-vhd.VHD_HEADER_SIZE:], util.GiBToBytes(2)))
+
+	// retry after file share is resized only grows the vhd disk file
+	resp, err = d.ControllerExpandVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.True(t, resp.NodeExpansionRequired)
+
+	// filesystem is expanded on node, disk file seen through the file share mount is already large enough
+	diskPath := filepath.Join(t.TempDir(), "disk.vhd")
+	assert.NoError(t, os.WriteFile(diskPath, disk.data, 0600))
+	resized, err := resizeDiskFile(diskPath, util.GiBToBytes(2))
+	assert.NoError(t, err)
+	assert.False(t, resized)
+	cmd, args, err := getFsResizeCommand(ext4, "/dev/loop0", "/mnt/staging")
+	assert.NoError(t, err)
+	assert.Equal(t, "resize2fs", cmd)
+	assert.Equal(t, []string{"/dev/loop0"}, args)
+}
+
+func TestControllerExpandVolumeVHDDiskOnPremiumShare(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		desc         string
+		requestGiB   int64
+		expectedErr  error
+		expectedSize int64
+	}{
+		{
+			desc:         "vhd disk is grown without resizing file share with larger quota",
+			requestGiB:   20,
+			expectedSize: util.GiBToBytes(20),
+		},
+		{
+			desc:         "shrink of vhd disk is rejected",
+			requestGiB:   5,
+			expectedErr:  status.Errorf(codes.InvalidArgument, "requested vhd disk size(5 GiB) is smaller than current disk size(%d bytes) of volume(rg#account#share#disk.vhd#uuid#), shrinking vhd disk is not supported", util.GiBToBytes(10)),
+			expectedSize: util.GiBToBytes(10),
+		},
+	}
+
+	defer func(f func(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, retryOptions azfile.RetryOptions) (diskFile, error)) {
+		newDiskFile = f
+	}(newDiskFile)
+
+	for _, test := range tests {
+		disk := &sparseDiskFile{}
+		assert.NoError(t, writeVHDDisk(context.Background(), disk, "disk.vhd", util.GiBToBytes(10)))
+		newDiskFile = func(_, _, _, _, _ string, _ azfile.RetryOptions) (diskFile, error) {
+			return disk, nil
+		}
+
+		d := NewFakeDriver()
+		d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_EXPAND_VOLUME})
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		// minimum quota of premium file share is 100 GiB
+		shareQuota := int32(100)
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}}, nil).AnyTimes()
+		mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "account").Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+		req := &csi.ControllerExpandVolumeRequest{
+			VolumeId:      "rg#account#share#disk.vhd#uuid#",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(test.requestGiB)},
+		}
+		resp, err := d.ControllerExpandVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		if test.expectedErr == nil {
+			assert.Equal(t, &csi.ControllerExpandVolumeResponse{CapacityBytes: util.GiBToBytes(test.requestGiB), NodeExpansionRequired: true}, resp, test.desc)
+			footer, err := disk.DownloadRange(context.Background(), test.expectedSize-vhd.VHD_HEADER_SIZE, vhd.VHD_HEADER_SIZE)
+			assert.NoError(t, err, test.desc)
+			assert.NoError(t, verifyVHDFooter(footer, test.expectedSize), test.desc)
+		}
+		assert.Equal(t, test.expectedSize, disk.size, test.desc)
+	}
+}
+
+// sparseDiskFile only keeps the ranges written to it, so that large vhd disks could be faked
+type sparseDiskFile struct {
+	size   int64
+	ranges map[int64][]byte
+}
+
+func (f *sparseDiskFile) Create(_ context.Context, size int64) error {
+	f.size = size
+	f.ranges = map[int64][]byte{}
+	return nil
+}
+
+func (f *sparseDiskFile) GetSize(_ context.Context) (int64, error) {
+	return f.size, nil
+}
+
+func (f *sparseDiskFile) Resize(_ context.Context, size int64) error {
+	f.size = size
+	return nil
+}
+
+func (f *sparseDiskFile) UploadRange(_ context.Context, offset int64, data []byte) error {
+	f.ranges[offset] = append([]byte{}, data...)
+	return nil
+}
+
+func (f *sparseDiskFile) DownloadRange(_ context.Context, offset, count int64) ([]byte, error) {
+	data := make([]byte, count)
+	copy(data, f.ranges[offset])
+	return data, nil
+}
+
+func (f *sparseDiskFile) Delete(_ context.Context) error {
+	return nil
+}
+
+func TestControllerExpandVolumeCurrentQuota(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		desc           string
+		shareQuota     int32
+		requestGiB     int64
+		expectResize   bool
+		expectedErr    error
+		expectedResult *csi.ControllerExpandVolumeResponse
+	}{
+		{
+			desc:           "grow",
+			shareQuota:     100,
+			requestGiB:     200,
+			expectResize:   true,
+			expectedResult: &csi.ControllerExpandVolumeResponse{CapacityBytes: util.GiBToBytes(200)},
+		},
+		{
+			desc:           "equal size is a no-op",
+			shareQuota:     100,
+			requestGiB:     100,
+			expectedResult: &csi.ControllerExpandVolumeResponse{CapacityBytes: util.GiBToBytes(100)},
+		},
+		{
+			desc:        "shrink is rejected",
+			shareQuota:  100,
+			requestGiB:  50,
+			expectedErr: status.Errorf(codes.InvalidArgument, "requested file share size(50 GiB) is smaller than current quota(100 GiB) of volume(rg#account#share#), shrinking azure file share is not supported"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_EXPAND_VOLUME})
+		d.cloud = &azure.Cloud{}
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		shareQuota := test.shareQuota
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}}, nil).AnyTimes()
+		if test.expectResize {
+			mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), "rg", "account", "share", int(test.requestGiB)).Return(nil).Times(1)
+		}
+
+		req := &csi.ControllerExpandVolumeRequest{
+			VolumeId:      "rg#account#share#",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(test.requestGiB)},
+		}
+		result, err := d.ControllerExpandVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedResult, result, test.desc)
+	}
+}
+
+func TestControllerExpandVolumeShareProtocol(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		desc             string
+		cachedProtocol   storage.EnabledProtocols
+		shareProtocol    storage.EnabledProtocols
+		expectResize     bool
+		expectedErrorMsg string
+	}{
+		{
+			desc:         "protocol is not cached",
+			expectResize: true,
+		},
+		{
+			desc:           "smb protocol matches default protocol of file share",
+			cachedProtocol: storage.EnabledProtocolsSMB,
+			expectResize:   true,
+		},
+		{
+			desc:           "nfs protocol matches",
+			cachedProtocol: storage.EnabledProtocolsNFS,
+			shareProtocol:  storage.EnabledProtocolsNFS,
+			expectResize:   true,
+		},
+		{
+			desc:             "protocol mismatch",
+			cachedProtocol:   storage.EnabledProtocolsNFS,
+			shareProtocol:    storage.EnabledProtocolsSMB,
+			expectedErrorMsg: "protocol(SMB) of file share(share) on account(account) is different from expected protocol(NFS)",
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_EXPAND_VOLUME})
+		d.cloud = &azure.Cloud{}
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		shareQuota := int32(100)
+		// protocol is read from the file share properties fetched for max quota and quota, no extra call is made
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(storage.FileShare{
+			FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota, EnabledProtocols: test.shareProtocol},
+		}, nil).Times(2)
+		if test.expectResize {
+			mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), "rg", "account", "share", 200).Return(nil).Times(1)
+		}
+		if test.cachedProtocol != "" {
+			d.shareProtocolCache.Set(getShareProtocolCacheKey("account", "share"), test.cachedProtocol)
+		}
+
+		req := &csi.ControllerExpandVolumeRequest{
+			VolumeId:      "rg#account#share#",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(200)},
+		}
+		_, err := d.ControllerExpandVolume(context.Background(), req)
+		if test.expectedErrorMsg != "" {
+			assert.Equal(t, codes.Internal, status.Code(err), test.desc)
+			assert.Contains(t, err.Error(), test.expectedErrorMsg, test.desc)
+		} else {
+			assert.NoError(t, err, test.desc)
+		}
+	}
+}
+
+func TestControllerExpandVolumeRateLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	newDriver := func(accountKey string, maxConcurrentResizeOperations int) (*Driver, *mockfileclient.MockInterface) {
+		d := NewFakeDriverCustomOptions(DriverOptions{MaxConcurrentResizeOperations: maxConcurrentResizeOperations})
+		d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_EXPAND_VOLUME})
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		d.fileClient = &azureFileClient{env: &azure2.Environment{StorageEndpointSuffix: "core.windows.net"}}
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		shareQuota := int32(100)
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &shareQuota}}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+		return d, mockFileClient
+	}
+	expandReq := func(volumeID string) *csi.ControllerExpandVolumeRequest {
+		return &csi.ControllerExpandVolumeRequest{
+			VolumeId:      volumeID,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(200)},
+		}
+	}
+
+	t.Run("concurrent resizes are limited", func(t *testing.T) {
+		const volumes, limit = 6, 2
+		d, mockFileClient := newDriver(base64.StdEncoding.EncodeToString([]byte("acc_key")), limit)
+		var inFlight, maxInFlight int32
+		mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), "rg", "account", gomock.Any(), 200).DoAndReturn(
+			func(_ context.Context, _, _, _ string, _ int) error {
+				current := atomic.AddInt32(&inFlight, 1)
+				for {
+					prev := atomic.LoadInt32(&maxInFlight)
+					if current <= prev || atomic.CompareAndSwapInt32(&maxInFlight, prev, current) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+				return nil
+			}).Times(volumes)
+
+		var wg sync.WaitGroup
+		for i := 0; i < volumes; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := d.ControllerExpandVolume(context.Background(), expandReq(fmt.Sprintf("rg#account#share-%d#", i)))
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, int32(limit), atomic.LoadInt32(&maxInFlight))
+	})
+
+	t.Run("wait for resize slot is canceled", func(t *testing.T) {
+		d, _ := newDriver(base64.StdEncoding.EncodeToString([]byte("acc_key")), 1)
+		assert.NoError(t, d.resizeOperationLimiter.Acquire(context.Background()))
+		defer d.resizeOperationLimiter.Release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := d.ControllerExpandVolume(ctx, expandReq("rg#account#share#"))
+		assert.Equal(t, codes.Aborted, status.Code(err))
+	})
+
+	t.Run("throttled resize falls back to data plane API", func(t *testing.T) {
+		// invalid base64 key fails data plane client creation without sending any request
+		d, mockFileClient := newDriver("invalid key", 0)
+		mockFileClient.EXPECT().ResizeFileShare(gomock.Any(), "rg", "account", "share", 200).Return(fmt.Errorf("Retriable: true, StatusCode: 429, TooManyRequests")).Times(1)
+
+		_, err := d.ControllerExpandVolume(context.Background(), expandReq("rg#account#share#"))
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.Contains(t, err.Error(), "error creating azure client")
+		assert.True(t, d.useDataPlaneAPI("rg#account#share#", "account"))
+	})
+}
+
+func TestCreateVolumeCrossSubscription(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
-	errValue := "acc_key"
-	validKey := storage.AccountListKeysResult{
-		Keys: &[]storage.AccountKey{
-			{Value: &value},
-		},
-	}
-	errKey := storage.AccountListKeysResult{
-		Keys: &[]storage.AccountKey{
-			{Value: &errValue},
+
+	stdVolCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
 		},
 	}
-	clientSet := fake.NewSimpleClientset()
+	accountKey := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &accountKey}}}
+	defaultSubsID := "11111111-1111-1111-1111-111111111111"
+	crossSubsID := "22222222-2222-2222-2222-22222222222a"
+
 	tests := []struct {
-		desc           string
-		sourceVolumeID string
-		key            storage.AccountListKeysResult
-		expectedErr    error
+		desc             string
+		subsID           string
+		expectedSubsID   string
+		expectedVolumeID string
+		expectedErr      error
 	}{
 		{
-			desc:           "Invalid volume ID",
-			sourceVolumeID: "vol_1",
-			key:            validKey,
-			expectedErr:    nil,
-		},
-		{
-			desc:           "Invalid Key",
-			sourceVolumeID: "vol_1##",
-			key:            errKey,
-			expectedErr:    nil,
+			desc:             "account in another subscription",
+			subsID:           crossSubsID,
+			expectedSubsID:   crossSubsID,
+			expectedVolumeID: "rg#account#cross-sub-vol###default#" + crossSubsID,
 		},
 		{
-			desc:           "Invalid URL",
-			sourceVolumeID: "vol_1#^f5713de20cde511e8ba4900#",
-			key:            validKey,
-			expectedErr:    &url.Error{Op: "parse", URL: "https://^f5713de20cde511e8ba4900.file.abc", Err: url.InvalidHostError("^")},
+			desc:             "default subscription in different case",
+			subsID:           strings.ToUpper(defaultSubsID),
+			expectedSubsID:   strings.ToUpper(defaultSubsID),
+			expectedVolumeID: "rg#account#cross-sub-vol###default",
 		},
 		{
-			desc:           "Valid call",
-			sourceVolumeID: "vol_1##",
-			key:            validKey,
-			expectedErr:    nil,
+			desc:        "subscription ID is not a GUID",
+			subsID:      "subsID",
+			expectedErr: status.Errorf(codes.InvalidArgument, "invalid subscriptionid(subsID) in storage class, it should be a GUID"),
 		},
 	}
 
 	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.SubscriptionID = defaultSubsID
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
 		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
 		d.cloud.StorageAccountClient = mockStorageAccountsClient
-		d.cloud.KubeClient = clientSet
-		d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
-		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "vol_1", gomock.Any()).Return(test.key, nil).AnyTimes()
+		if test.expectedErr == nil {
+			// all operations of the volume are sent to the subscription of the storage account
+			mockFileClient.EXPECT().WithSubscriptionID(test.expectedSubsID).Return(mockFileClient).AnyTimes()
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "cross-sub-vol", "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+			mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").Return(storage.FileShare{}, nil).Times(1)
+			mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), test.expectedSubsID, "rg", "account").Return(keys, nil).AnyTimes()
+			mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), test.expectedSubsID, "rg", "account").Return(storage.Account{}, nil).AnyTimes()
+			mockStorageAccountsClient.EXPECT().Update(gomock.Any(), test.expectedSubsID, "rg", "account", gomock.Any()).Return(nil).AnyTimes()
+		}
 
-		_, _, err := d.getServiceURL(context.Background(), test.sourceVolumeID, validSecret)
-		if !reflect.DeepEqual(err, test.expectedErr) {
-			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		req := &csi.CreateVolumeRequest{
+			Name:               "cross-sub-vol",
+			VolumeCapabilities: stdVolCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)},
+			Parameters: map[string]string{
+				skuNameField:        "Standard_LRS",
+				subscriptionIDField: test.subsID,
+				storageAccountField: "account",
+				resourceGroupField:  "rg",
+			},
+		}
+		resp, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		if test.expectedErr == nil {
+			assert.Equal(t, test.expectedVolumeID, resp.Volume.VolumeId, test.desc)
 		}
 	}
 }
 
-func TestSnapshotExists(t *testing.T) {
-	d := NewFakeDriver()
-	validSecret := map[string]string{}
-	d.cloud = &azure.Cloud{}
+func TestDeleteAccountWhenEmpty(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	newDriver := func() (*Driver, *mockfileclient.MockInterface, *mockstorageaccountclient.MockInterface) {
+		d := NewFakeDriver()
+		d.cloud = azure.GetTestCloud(ctrl)
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		return d, mockFileClient, mockStorageAccountsClient
+	}
+	volumeID := "rg#account#share###default"
+	fileShare := storage.FileShare{FileShareProperties: &storage.FileShareProperties{Metadata: map[string]*string{deleteAccountWhenEmptyKey: pointer.String(trueValue)}}}
+	createdByDriver := storage.Account{Kind: storage.KindFileStorage, Tags: map[string]*string{accountCreatedByDriverTag: pointer.String(fakeDriverName)}}
+
+	t.Run("invalid deleteAccountWhenEmpty", func(t *testing.T) {
+		d, _, _ := newDriver()
+		_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "share",
+			VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}, AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}},
+			Parameters:         map[string]string{deleteAccountWhenEmptyField: "yes"},
+		})
+		assert.Equal(t, status.Errorf(codes.InvalidArgument, "invalid %s: yes in storage class", deleteAccountWhenEmptyField), err)
+	})
+
+	t.Run("account is deleted with the last file share", func(t *testing.T) {
+		d, mockFileClient, mockStorageAccountsClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(fileShare, nil).Times(1)
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", "share", "").Return(nil).Times(1)
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), "rg", "account").Return(createdByDriver, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), "rg", "account", gomock.Any()).Return(nil).Times(1)
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", snapshotsExpand).Return([]storage.FileShareItem{}, nil).Times(2)
+		mockStorageAccountsClient.EXPECT().Delete(gomock.Any(), gomock.Any(), "rg", "account").Return(nil).Times(1)
+
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+		assert.NoError(t, err)
+	})
+
+	t.Run("account is kept when it's not the last file share", func(t *testing.T) {
+		d, mockFileClient, mockStorageAccountsClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(fileShare, nil).Times(1)
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", "share", "").Return(nil).Times(1)
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), "rg", "account").Return(createdByDriver, nil).AnyTimes()
+		mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", snapshotsExpand).Return([]storage.FileShareItem{{Name: pointer.String("other")}}, nil).Times(1)
+		// no Update or Delete call on the storage account is expected
+
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+		assert.NoError(t, err)
+	})
+
+	t.Run("account is kept without deleteAccountWhenEmpty", func(t *testing.T) {
+		d, mockFileClient, mockStorageAccountsClient := newDriver()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", "share", "").Return(storage.FileShare{}, nil).Times(1)
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", "share", "").Return(nil).Times(1)
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), "rg", "account").Return(createdByDriver, nil).AnyTimes()
+
+		_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+		assert.NoError(t, err)
+	})
+}
 
+func TestCreateVolumeCapacityBytes(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
 
-	validKey := storage.AccountListKeysResult{
-		Keys: &[]storage.AccountKey{
-			{Value: &value},
+	volCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
 		},
 	}
+	existingQuota := int32(200)
 
-	clientSet := fake.NewSimpleClientset()
 	tests := []struct {
-		desc           string
-		sourceVolumeID string
-		key            storage.AccountListKeysResult
-		secret         map[string]string
-		expectedErr    error
+		desc          string
+		existingShare *storage.FileShare
+		expectedBytes int64
 	}{
 		{
-			desc:           "Invalid volume ID with data plane api",
-			sourceVolumeID: "vol_1",
-			key:            validKey,
-			secret:         map[string]string{"accountName": "TestAccountName", "accountKey": base64.StdEncoding.EncodeToString([]byte("TestAccountKey"))},
-			expectedErr:    fmt.Errorf("file share is empty after parsing sourceVolumeID: vol_1"),
+			desc:          "quota unknown after creating file share, rounded requested size is returned",
+			expectedBytes: util.GiBToBytes(11),
 		},
 		{
-			desc:           "Invalid volume ID with management api",
-			sourceVolumeID: "vol_1",
-			key:            validKey,
-			secret:         validSecret,
-			expectedErr:    fmt.Errorf("error parsing volume id: %q, should at least contain two #", "vol_1"),
+			desc:          "quota of existing file share is returned",
+			existingShare: &storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &existingQuota}},
+			expectedBytes: util.GiBToBytes(int64(existingQuota)),
 		},
 	}
 
 	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
 		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
 		d.cloud.StorageAccountClient = mockStorageAccountsClient
-		d.cloud.KubeClient = clientSet
-		d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
-		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "", gomock.Any()).Return(test.key, nil).AnyTimes()
-
-		_, _, _, _, err := d.snapshotExists(context.Background(), test.sourceVolumeID, "sname", test.secret, false)
-		if !reflect.DeepEqual(err, test.expectedErr) {
-			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		if test.existingShare != nil {
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", "share", "").Return(*test.existingShare, nil).Times(1)
+		} else {
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", "share", "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).Times(1)
+		}
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "stoacc", gomock.Any(), "").DoAndReturn(
+			func(_ context.Context, _, _ string, shareOptions *fileclient.ShareOptions, _ string) (storage.FileShare, error) {
+				assert.Equal(t, 11, shareOptions.RequestGiB, test.desc)
+				return storage.FileShare{}, nil
+			}).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "stoacc").Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-capacity",
+			VolumeCapabilities: volCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(10) + util.GiBToBytes(1)/2},
+			Parameters: map[string]string{
+				skuNameField:        "Standard_LRS",
+				storageAccountField: "stoacc",
+				resourceGroupField:  "rg",
+				shareNameField:      "share",
+			},
 		}
+		resp, err := d.CreateVolume(context.Background(), req)
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expectedBytes, resp.GetVolume().GetCapacityBytes(), test.desc)
 	}
 }
 
-func TestGetCapacity(t *testing.T) {
-	d := NewFakeDriver()
-	req := csi.GetCapacityRequest{}
-	resp, err := d.GetCapacity(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
-	}
-}
+func TestCreateVolumeAccountNamePrefix(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
 
-func TestListVolumes(t *testing.T) {
-	d := NewFakeDriver()
-	req := csi.ListVolumesRequest{}
-	resp, err := d.ListVolumes(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	tests := []struct {
+		desc           string
+		prefix         string
+		nfsPrefix      string
+		protocol       string
+		expectedPrefix string
+	}{
+		{desc: "default prefix", expectedPrefix: defaultAccountNamePrefix},
+		{desc: "custom prefix", prefix: "csifile", expectedPrefix: "csifile"},
+		{desc: "nfs prefix is not used by smb account", prefix: "csifile", nfsPrefix: "csinfs", expectedPrefix: "csifile"},
+		{desc: "nfs prefix is used by nfs account", prefix: "csifile", nfsPrefix: "csinfs", protocol: nfs, expectedPrefix: "csinfs"},
+		{desc: "nfs account uses account prefix if nfs prefix is empty", prefix: "csifile", protocol: nfs, expectedPrefix: "csifile"},
 	}
-}
 
-func TestListSnapshots(t *testing.T) {
-	d := NewFakeDriver()
-	req := csi.ListSnapshotsRequest{}
-	resp, err := d.ListSnapshots(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{AccountNamePrefix: test.prefix, NFSAccountNamePrefix: test.nfsPrefix})
+		d.cloud = &azure.Cloud{Config: azure.Config{Location: "eastus", VnetName: "vnet", SubnetName: "subnet"}}
+		mockSubnetClient := mocksubnetclient.NewMockInterface(ctrl)
+		d.cloud.SubnetsClient = mockSubnetClient
+		subnetID := "/subscriptions/subsID/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet"
+		mockSubnetClient.EXPECT().Get(gomock.Any(), gomock.Any(), "vnet", "subnet", gomock.Any()).Return(network.Subnet{ID: &subnetID, SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
+			ServiceEndpoints: &[]network.ServiceEndpointPropertiesFormat{{Service: pointer.String("Microsoft.Storage")}}}}, nil).AnyTimes()
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
+
+		var createdAccount string
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, nil).AnyTimes()
+		mockFileClient.EXPECT().GetServiceProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileServiceProperties{}, nil).AnyTimes()
+		mockFileClient.EXPECT().SetServiceProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileServiceProperties{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any(), "rg").Return([]storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), "rg", gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, _, _, accountName string, _ storage.AccountCreateParameters) *retry.Error {
+				createdAccount = accountName
+				return nil
+			}).Times(1)
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", gomock.Any()).Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+		req := &csi.CreateVolumeRequest{
+			Name: "pvc-prefix",
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(10)},
+			Parameters:    map[string]string{skuNameField: "Standard_LRS", resourceGroupField: "rg", locationField: "eastus"},
+		}
+		if test.protocol == nfs {
+			req.Parameters = map[string]string{skuNameField: "Premium_LRS", resourceGroupField: "rg", locationField: "eastus", protocolField: nfs}
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.NoError(t, err, test.desc)
+		assert.True(t, strings.HasPrefix(createdAccount, test.expectedPrefix), "test[%s]: unexpected account name %s", test.desc, createdAccount)
+		assert.LessOrEqual(t, len(createdAccount), 24, test.desc)
+		assert.Greater(t, len(createdAccount), len(test.expectedPrefix), test.desc)
 	}
 }
 
-func TestSetAzureCredentials(t *testing.T) {
-	d := NewFakeDriver()
-	d.cloud = &azure.Cloud{
-		Config: azure.Config{
-			ResourceGroup: "rg",
-			Location:      "loc",
-			VnetName:      "fake-vnet",
-			SubnetName:    "fake-subnet",
+func TestCreateVolumeContentSourceSize(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sourceQuota, liveSourceQuota := int32(200), int32(50)
+	volCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
 		},
 	}
-	fakeClient := fake.NewSimpleClientset()
 
 	tests := []struct {
 		desc            string
-		kubeClient      kubernetes.Interface
-		accountName     string
-		accountKey      string
-		secretName      string
-		secretNamespace string
-		expectedName    string
-		expectedErr     error
+		requestGiB      int64
+		expectedErrCode codes.Code
 	}{
 		{
-			desc:        "[failure] accountName is nil",
-			kubeClient:  fakeClient,
-			expectedErr: fmt.Errorf("the account info is not enough, accountName(), accountKey()"),
-		},
-		{
-			desc:        "[failure] accountKey is nil",
-			kubeClient:  fakeClient,
-			accountName: "testName",
-			accountKey:  "",
-			expectedErr: fmt.Errorf("the account info is not enough, accountName(testName), accountKey()"),
-		},
-		{
-			desc:        "[success] kubeClient is nil",
-			kubeClient:  nil,
-			expectedErr: nil,
+			desc:            "requested size is smaller than source quota",
+			requestGiB:      100,
+			expectedErrCode: codes.OutOfRange,
 		},
 		{
-			desc:         "[success] normal scenario",
-			kubeClient:   fakeClient,
-			accountName:  "testName",
-			accountKey:   "testKey",
-			expectedName: "azure-storage-account-testName-secret",
-			expectedErr:  nil,
+			desc:            "requested size equals source quota",
+			requestGiB:      200,
+			expectedErrCode: codes.InvalidArgument,
 		},
 		{
-			desc:         "[success] already exist",
-			kubeClient:   fakeClient,
-			accountName:  "testName",
-			accountKey:   "testKey",
-			expectedName: "azure-storage-account-testName-secret",
-			expectedErr:  nil,
+			desc:            "requested size is larger than source quota",
+			requestGiB:      300,
+			expectedErrCode: codes.InvalidArgument,
 		},
 		{
-			desc:            "[success] normal scenario using secretName",
-			kubeClient:      fakeClient,
-			accountName:     "testName",
-			accountKey:      "testKey",
-			secretName:      "secretName",
-			secretNamespace: "secretNamespace",
-			expectedName:    "secretName",
-			expectedErr:     nil,
+			desc:            "source quota is used if no capacity is requested",
+			expectedErrCode: codes.InvalidArgument,
 		},
 	}
 
 	for _, test := range tests {
-		d.cloud.KubeClient = test.kubeClient
-		result, err := d.SetAzureCredentials(context.TODO(), test.accountName, test.accountKey, test.secretName, test.secretNamespace)
-		if result != test.expectedName || !reflect.DeepEqual(err, test.expectedErr) {
-			t.Errorf("desc: %s,\n input: accountName(%v), accountKey(%v),\n setAzureCredentials result: %v, expectedName: %v err: %v, expectedErr: %v",
-				test.desc, test.accountName, test.accountKey, result, test.expectedName, err, test.expectedErr)
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
+
+		var createdShareSize int
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		// source file share is resized after the snapshot is taken
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", "srcshare", "").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &liveSourceQuota}}, nil).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", "srcshare", "2023-01-02T03:04:05.0000000Z").Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &sourceQuota}}, nil).AnyTimes()
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", "share", "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "stoacc", gomock.Any(), "").DoAndReturn(
+			func(_ context.Context, _, _ string, shareOptions *fileclient.ShareOptions, _ string) (storage.FileShare, error) {
+				createdShareSize = shareOptions.RequestGiB
+				return storage.FileShare{}, nil
+			}).AnyTimes()
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "stoacc", "share", "").Return(nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "stoacc").Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-restore",
+			VolumeCapabilities: volCap,
+			Parameters: map[string]string{
+				skuNameField:        "Standard_LRS",
+				storageAccountField: "stoacc",
+				resourceGroupField:  "rg",
+				shareNameField:      "share",
+			},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "rg#stoacc#srcshare#diskname#uuid#namespace#2023-01-02T03:04:05.0000000Z"},
+				},
+			},
 		}
+		if test.requestGiB > 0 {
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: util.GiBToBytes(test.requestGiB)}
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		// copy volume from snapshot is not supported, it fails with InvalidArgument before any file share is created
+		assert.Equal(t, test.expectedErrCode, status.Code(err), "test[%s]: %v", test.desc, err)
+		assert.Equal(t, 0, createdShareSize, test.desc)
 	}
 }
 
-func TestGenerateSASToken(t *testing.T) {
-	storageEndpointSuffix := "core.windows.net"
+func TestCreateVolumeCloneFailureCleanup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	quota := int32(100)
+	volCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+
 	tests := []struct {
-		name        string
-		accountName string
-		accountKey  string
-		want        string
-		expectedErr error
+		desc          string
+		shareExists   bool
+		expectDeleted bool
 	}{
 		{
-			name:        "accountName nil",
-			accountName: "",
-			accountKey:  "",
-			want:        "se=",
-			expectedErr: nil,
+			desc:          "file share created by the failed clone is deleted",
+			expectDeleted: true,
 		},
 		{
-			name:        "account key illegal",
-			accountName: "unit-test",
-			accountKey:  "fakeValue",
-			want:        "",
-			expectedErr: status.Errorf(codes.Internal, fmt.Sprintf("failed to generate sas token in creating new shared key credential, accountName: %s, err: %s", "unit-test", "decode account key: illegal base64 data at input byte 8")),
+			desc:        "existing file share is not deleted",
+			shareExists: true,
 		},
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			sas, err := generateSASToken(tt.accountName, tt.accountKey, storageEndpointSuffix, 30)
-			if !reflect.DeepEqual(err, tt.expectedErr) {
-				t.Errorf("generateSASToken error = %v, expectedErr %v, sas token = %v, want %v", err, tt.expectedErr, sas, tt.want)
-				return
-			}
-			if !strings.Contains(sas, tt.want) {
-				t.Errorf("sas token = %v, want %v", sas, tt.want)
-			}
-		})
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.KubeClient = fake.NewSimpleClientset()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+		keys := storage.AccountListKeysResult{Keys: &[]storage.AccountKey{{Value: &value}}}
+
+		mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+		// copy volume fails since protocol of source file share is different
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", "srcshare", "").
+			Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota, EnabledProtocols: storage.EnabledProtocolsNFS}}, nil).AnyTimes()
+		if test.shareExists {
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", "share", "").
+				Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &quota}}, nil).AnyTimes()
+		} else {
+			mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "stoacc", "share", "").Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+		}
+		mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "stoacc", gomock.Any(), "").Return(storage.FileShare{}, nil).AnyTimes()
+		deleteCalls := 0
+		if test.expectDeleted {
+			deleteCalls = 1
+		}
+		mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "stoacc", "share", "").Return(nil).Times(deleteCalls)
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "rg", "stoacc").Return(keys, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+		mockStorageAccountsClient.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+		req := &csi.CreateVolumeRequest{
+			Name:               "pvc-clone",
+			VolumeCapabilities: volCap,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GiBToBytes(100)},
+			Parameters: map[string]string{
+				skuNameField:        "Standard_LRS",
+				storageAccountField: "stoacc",
+				resourceGroupField:  "rg",
+				shareNameField:      "share",
+			},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "rg#stoacc#srcshare#"},
+				},
+			},
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "test[%s]: %v", test.desc, err)
 	}
 }
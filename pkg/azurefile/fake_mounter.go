@@ -46,6 +46,8 @@ func (f *fakeMounter) MountSensitive(source string, target string, fstype string
 		return fmt.Errorf("fake MountSensitive: source error")
 	} else if strings.Contains(target, "error_mount_sens") {
 		return fmt.Errorf("fake MountSensitive: target error")
+	} else if strings.Contains(target, "error_mount_auth") {
+		return fmt.Errorf("fake MountSensitive: mount error(13): Permission denied")
 	}
 
 	return nil
@@ -0,0 +1,121 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"k8s.io/klog/v2"
+)
+
+const (
+	keyVaultAPIVersion = "7.4"
+)
+
+// keyVaultClient gets secret value from Azure Key Vault
+type keyVaultClient interface {
+	GetSecret(ctx context.Context, vaultURL, secretName string) (string, error)
+}
+
+// azureKeyVaultClient gets secret by Key Vault REST API using managed identity of the driver
+type azureKeyVaultClient struct {
+	credential azcore.TokenCredential
+}
+
+func newAzureKeyVaultClient(userAssignedIdentityID string) (*azureKeyVaultClient, error) {
+	options := &azidentity.ManagedIdentityCredentialOptions{}
+	if userAssignedIdentityID != "" {
+		options.ID = azidentity.ClientID(userAssignedIdentityID)
+	}
+	credential, err := azidentity.NewManagedIdentityCredential(options)
+	if err != nil {
+		return nil, err
+	}
+	return &azureKeyVaultClient{credential: credential}, nil
+}
+
+// GetSecret returns the latest version of secret in key vault
+func (c *azureKeyVaultClient) GetSecret(ctx context.Context, vaultURL, secretName string) (string, error) {
+	scope, err := getKeyVaultScope(vaultURL)
+	if err != nil {
+		return "", err
+	}
+	pipeline := runtime.NewPipeline("azurefile-csi-driver", driverVersion, runtime.PipelineOptions{
+		PerRetry: []policy.Policy{runtime.NewBearerTokenPolicy(c.credential, []string{scope}, nil)},
+	}, nil)
+
+	req, err := runtime.NewRequest(ctx, http.MethodGet, runtime.JoinPaths(vaultURL, "secrets", url.PathEscape(secretName)))
+	if err != nil {
+		return "", err
+	}
+	query := req.Raw().URL.Query()
+	query.Set("api-version", keyVaultAPIVersion)
+	req.Raw().URL.RawQuery = query.Encode()
+	req.Raw().Header.Set("Accept", "application/json")
+
+	resp, err := pipeline.Do(req)
+	if err != nil {
+		return "", err
+	}
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return "", runtime.NewResponseError(resp)
+	}
+	var secret struct {
+		Value *string `json:"value"`
+	}
+	if err := runtime.UnmarshalAsJSON(resp, &secret); err != nil {
+		return "", err
+	}
+	if secret.Value == nil || *secret.Value == "" {
+		return "", fmt.Errorf("value of secret(%s) in key vault(%s) is empty", secretName, vaultURL)
+	}
+	return *secret.Value, nil
+}
+
+// getKeyVaultScope returns the token scope of key vault, e.g. https://vault.azure.net/.default for https://myvault.vault.azure.net
+func getKeyVaultScope(vaultURL string) (string, error) {
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return "", err
+	}
+	segments := strings.SplitN(u.Hostname(), ".", 2)
+	if u.Scheme != "https" || len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+		return "", fmt.Errorf("key vault url(%s) should be in https://<vault-name>.<key-vault-dns-suffix> format", vaultURL)
+	}
+	return fmt.Sprintf("https://%s/.default", segments[1]), nil
+}
+
+// getAccountKeyFromKeyVault gets account key stored as a secret in key vault
+func (d *Driver) getAccountKeyFromKeyVault(ctx context.Context, accountName, vaultURL, secretName string) (string, error) {
+	if d.keyVaultClient == nil {
+		return "", fmt.Errorf("key vault client is not initialized")
+	}
+	klog.V(2).Infof("get account(%s) key from secret(%s) in key vault(%s)", accountName, secretName, vaultURL)
+	accountKey, err := d.keyVaultClient.GetSecret(ctx, vaultURL, secretName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get account(%s) key from secret(%s) in key vault(%s): %v", accountName, secretName, vaultURL, err)
+	}
+	return normalizeAccountKey(accountKey), nil
+}
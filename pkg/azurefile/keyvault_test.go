@@ -0,0 +1,172 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const testKeyVaultURL = "https://testvault.vault.azure.net"
+
+type fakeKeyVaultClient struct {
+	// secrets in key vault <vaultURL/secretName, value>
+	secrets map[string]string
+	calls   int
+}
+
+func (c *fakeKeyVaultClient) GetSecret(_ context.Context, vaultURL, secretName string) (string, error) {
+	c.calls++
+	if value, ok := c.secrets[vaultURL+"/"+secretName]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("SecretNotFound: A secret with (name/id) %s was not found in this key vault", secretName)
+}
+
+func TestGetKeyVaultScope(t *testing.T) {
+	tests := []struct {
+		vaultURL      string
+		expected      string
+		expectedError bool
+	}{
+		{vaultURL: "https://testvault.vault.azure.net", expected: "https://vault.azure.net/.default"},
+		{vaultURL: "https://testvault.vault.azure.cn/", expected: "https://vault.azure.cn/.default"},
+		{vaultURL: "http://testvault.vault.azure.net", expectedError: true},
+		{vaultURL: "https://testvault", expectedError: true},
+		{vaultURL: "testvault.vault.azure.net", expectedError: true},
+		{vaultURL: "", expectedError: true},
+	}
+
+	for _, test := range tests {
+		scope, err := getKeyVaultScope(test.vaultURL)
+		if test.expectedError {
+			assert.Error(t, err, test.vaultURL)
+			continue
+		}
+		assert.NoError(t, err, test.vaultURL)
+		assert.Equal(t, test.expected, scope, test.vaultURL)
+	}
+}
+
+func TestGetStorageAccesskeyFromKeyVault(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := NewFakeDriver()
+	d.cloud = azure.GetTestCloud(ctrl)
+	d.cloud.KubeClient = fake.NewSimpleClientset()
+	// no fallback to cluster identity, unexpected ListKeys call fails the test
+	d.cloud.StorageAccountClient = mockstorageaccountclient.NewMockInterface(ctrl)
+	kvClient := &fakeKeyVaultClient{secrets: map[string]string{testKeyVaultURL + "/accountkey": "key\n"}}
+	d.keyVaultClient = kvClient
+
+	accountOptions := &azure.AccountOptions{Name: "account", ResourceGroup: "rg"}
+	accountKey, err := d.GetStorageAccesskey(context.Background(), accountOptions, nil, "", defaultNamespace, testKeyVaultURL, "accountkey")
+	assert.NoError(t, err)
+	assert.Equal(t, "key", accountKey)
+
+	// account key is cached
+	accountKey, err = d.GetStorageAccesskey(context.Background(), accountOptions, nil, "", defaultNamespace, testKeyVaultURL, "accountkey")
+	assert.NoError(t, err)
+	assert.Equal(t, "key", accountKey)
+	assert.Equal(t, 1, kvClient.calls)
+
+	// secret not found
+	_, err = d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "other", ResourceGroup: "rg"}, nil, "", defaultNamespace, testKeyVaultURL, "notfound")
+	assert.ErrorContains(t, err, "SecretNotFound")
+	cache, err := d.accountCacheMap.Get("other", 0)
+	assert.NoError(t, err)
+	assert.Nil(t, cache)
+
+	// key vault client is not initialized
+	d.keyVaultClient = nil
+	_, err = d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "other", ResourceGroup: "rg"}, nil, "", defaultNamespace, testKeyVaultURL, "accountkey")
+	assert.ErrorContains(t, err, "key vault client is not initialized")
+}
+
+func TestGetAccountInfoFromKeyVault(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := NewFakeDriver()
+	d.cloud = azure.GetTestCloud(ctrl)
+	d.cloud.KubeClient = fake.NewSimpleClientset()
+	d.cloud.StorageAccountClient = mockstorageaccountclient.NewMockInterface(ctrl)
+	d.keyVaultClient = &fakeKeyVaultClient{secrets: map[string]string{testKeyVaultURL + "/accountkey": "key"}}
+
+	reqContext := map[string]string{keyVaultURLField: testKeyVaultURL, keyVaultSecretNameField: "accountkey"}
+	_, accountName, accountKey, fileShareName, _, _, err := d.GetAccountInfo(context.Background(), "rg#account#share###", nil, reqContext)
+	assert.NoError(t, err)
+	assert.Equal(t, "account", accountName)
+	assert.Equal(t, "share", fileShareName)
+	assert.Equal(t, "key", accountKey)
+
+	reqContext[keyVaultSecretNameField] = "notfound"
+	_, _, accountKey, _, _, _, err = d.GetAccountInfo(context.Background(), "rg#otheraccount#share###", nil, reqContext)
+	assert.ErrorContains(t, err, "SecretNotFound")
+	assert.Empty(t, accountKey)
+}
+
+func TestCreateVolumeWithKeyVault(t *testing.T) {
+	tests := []struct {
+		desc        string
+		parameters  map[string]string
+		expectedErr error
+	}{
+		{
+			desc:        "keyVaultSecretName is missing",
+			parameters:  map[string]string{storageAccountField: "account", keyVaultURLField: testKeyVaultURL},
+			expectedErr: status.Errorf(codes.InvalidArgument, "keyVaultURL(%s) and keyVaultSecretName() should be specified together", testKeyVaultURL),
+		},
+		{
+			desc:        "invalid keyVaultURL",
+			parameters:  map[string]string{storageAccountField: "account", keyVaultURLField: "http://testvault", keyVaultSecretNameField: "accountkey"},
+			expectedErr: status.Error(codes.InvalidArgument, "key vault url(http://testvault) should be in https://<vault-name>.<key-vault-dns-suffix> format"),
+		},
+		{
+			desc:        "storageAccount is missing",
+			parameters:  map[string]string{keyVaultURLField: testKeyVaultURL, keyVaultSecretNameField: "accountkey"},
+			expectedErr: status.Errorf(codes.InvalidArgument, "storageAccount should be specified with keyVaultURL(%s)", testKeyVaultURL),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		req := &csi.CreateVolumeRequest{
+			Name: "pvc-keyvault",
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			Parameters: test.parameters,
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+	}
+}
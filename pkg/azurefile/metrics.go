@@ -0,0 +1,92 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	accountLabel   = "account"
+	operationLabel = "operation"
+	resultLabel    = "result"
+	levelLabel     = "level"
+
+	resultSucceeded = "succeeded"
+	resultFailed    = "failed"
+
+	// throttling level is determined by the sleep interval of the throttled operation
+	throttlingLevelAccount = "account"
+	throttlingLevelFile    = "file"
+)
+
+var (
+	// accountKeyFallbackCount counts the times of getting account key with cluster identity
+	// since account key could not be read from k8s secret, which is usually a misconfiguration
+	accountKeyFallbackCount = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      azureFileCSIDriverName,
+			Name:           "account_key_cluster_identity_fallback_total",
+			Help:           "Number of times account key is retrieved with cluster identity since it could not be read from k8s secret",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{accountLabel},
+	)
+	// fileShareOperationDuration records the latency of each file share operation attempt
+	fileShareOperationDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      azureFileCSIDriverName,
+			Name:           "file_share_operation_duration_seconds",
+			Help:           "Latency of file share operations(e.g. create, delete, resize) in seconds",
+			Buckets:        metrics.ExponentialBuckets(0.05, 2, 12),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{operationLabel, resultLabel},
+	)
+	// throttlingCount counts the times of sleeping on throttled storage account or file share operations
+	throttlingCount = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      azureFileCSIDriverName,
+			Name:           "throttling_total",
+			Help:           "Number of times the driver sleeps since storage account or file share operation is throttled",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{levelLabel},
+	)
+	registerDriverMetricsOnce sync.Once
+)
+
+func registerDriverMetrics() {
+	registerDriverMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(accountKeyFallbackCount)
+		legacyregistry.MustRegister(fileShareOperationDuration)
+		legacyregistry.MustRegister(throttlingCount)
+	})
+}
+
+// observeFileShareOperation records the latency of one file share operation attempt started at start
+func observeFileShareOperation(operation string, start time.Time, err error) {
+	result := resultSucceeded
+	if err != nil {
+		result = resultFailed
+	}
+	fileShareOperationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
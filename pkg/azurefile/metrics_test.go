@@ -0,0 +1,115 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/component-base/metrics/testutil"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestAccountKeyFallbackCount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	d.cloud.KubeClient = fake.NewSimpleClientset()
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	key := "key"
+	mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any(), "fallbackaccount").Return(storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{{Value: &key}},
+	}, nil).Times(1)
+
+	before, err := testutil.GetCounterMetricValue(accountKeyFallbackCount.WithLabelValues("fallbackaccount"))
+	assert.NoError(t, err)
+
+	// secret does not exist, fall back to cluster identity
+	accountKey, err := d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "fallbackaccount", ResourceGroup: "rg"}, nil, "", "default", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, key, accountKey)
+
+	after, err := testutil.GetCounterMetricValue(accountKeyFallbackCount.WithLabelValues("fallbackaccount"))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), after-before)
+
+	// account key is cached, no more fallback
+	_, err = d.GetStorageAccesskey(context.Background(), &azure.AccountOptions{Name: "fallbackaccount", ResourceGroup: "rg"}, nil, "", "default", "", "")
+	assert.NoError(t, err)
+	final, err := testutil.GetCounterMetricValue(accountKeyFallbackCount.WithLabelValues("fallbackaccount"))
+	assert.NoError(t, err)
+	assert.Equal(t, after, final)
+}
+
+func TestThrottlingCount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sleptDuration time.Duration
+	throttlingSleep = func(d time.Duration) { sleptDuration += d }
+	defer func() { throttlingSleep = time.Sleep }()
+
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	mockFileClient := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClient
+	mockFileClient.EXPECT().WithSubscriptionID(gomock.Any()).Return(mockFileClient).AnyTimes()
+	mockFileClient.EXPECT().CreateFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").Return(storage.FileShare{}, fmt.Errorf("Retriable: true, RetryAfter: 0s, HTTPStatusCode: 429, RawError: TooManyRequests")).Times(1)
+
+	fileBefore, err := testutil.GetCounterMetricValue(throttlingCount.WithLabelValues(throttlingLevelFile))
+	assert.NoError(t, err)
+	accountBefore, err := testutil.GetCounterMetricValue(throttlingCount.WithLabelValues(throttlingLevelAccount))
+	assert.NoError(t, err)
+	countBefore, err := testutil.GetHistogramMetricCount(fileShareOperationDuration.WithLabelValues("create_file_share", resultFailed))
+	assert.NoError(t, err)
+
+	// throttled file share operation
+	err = d.createFileShare(context.Background(), &azure.AccountOptions{Name: "account", ResourceGroup: "rg"}, &fileclient.ShareOptions{Name: "share"}, nil)
+	assert.Error(t, err)
+	assert.InDelta(t, time.Duration(defaultFileOpThrottlingSleepSec)*time.Second, sleptDuration, float64(defaultFileOpThrottlingSleepSec*time.Second)*throttlingSleepJitter)
+
+	fileAfter, err := testutil.GetCounterMetricValue(throttlingCount.WithLabelValues(throttlingLevelFile))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), fileAfter-fileBefore)
+	countAfter, err := testutil.GetHistogramMetricCount(fileShareOperationDuration.WithLabelValues("create_file_share", resultFailed))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), countAfter-countBefore)
+
+	// throttled storage account operation
+	d.sleepIfAccountOpThrottled(fmt.Errorf("TooManyRequests"))
+	accountAfter, err := testutil.GetCounterMetricValue(throttlingCount.WithLabelValues(throttlingLevelAccount))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), accountAfter-accountBefore)
+
+	// not throttled
+	d.sleepIfAccountOpThrottled(fmt.Errorf("internal error"))
+	final, err := testutil.GetCounterMetricValue(throttlingCount.WithLabelValues(throttlingLevelAccount))
+	assert.NoError(t, err)
+	assert.Equal(t, accountAfter, final)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	mountStatsPath = "/proc/self/mountstats"
+	volumeIDLabel  = "volume_id"
+)
+
+var (
+	mountReadBytes = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      azureFileCSIDriverName,
+			Name:           "mount_read_bytes",
+			Help:           "Number of bytes read from a mounted volume, collected from /proc/self/mountstats",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{volumeIDLabel},
+	)
+	mountWriteBytes = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      azureFileCSIDriverName,
+			Name:           "mount_write_bytes",
+			Help:           "Number of bytes written to a mounted volume, collected from /proc/self/mountstats",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{volumeIDLabel},
+	)
+	registerMountStatsMetricsOnce sync.Once
+)
+
+// mountIOStats is the I/O stats of one mount point
+type mountIOStats struct {
+	fsType     string
+	readBytes  uint64
+	writeBytes uint64
+}
+
+func registerMountStatsMetrics() {
+	registerMountStatsMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(mountReadBytes)
+		legacyregistry.MustRegister(mountWriteBytes)
+	})
+}
+
+// parseMountStats parses the content of /proc/self/mountstats and returns I/O stats per mount point,
+// only nfs mounts are returned since cifs does not report I/O stats in mountstats, e.g.
+//
+//	device 10.0.0.4:/account/share mounted on /var/lib/kubelet/globalmount with fstype nfs4 statvers=1.1
+//		bytes:	1024 2048 0 0 1024 2048 1 1
+//
+// the first four fields of "bytes:" are normalreadbytes, normalwritebytes, directreadbytes, directwritebytes
+func parseMountStats(r io.Reader) (map[string]mountIOStats, error) {
+	result := make(map[string]mountIOStats)
+	var mountPoint, fsType string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "device":
+			mountPoint, fsType = "", ""
+			// device <dev> mounted on <mount point> with fstype <fstype>
+			if len(fields) < 8 || fields[2] != "mounted" || fields[3] != "on" || fields[6] != "fstype" {
+				continue
+			}
+			if !isMountStatsSupportedFsType(fields[7]) {
+				continue
+			}
+			mountPoint, fsType = fields[4], fields[7]
+		case "bytes:":
+			if mountPoint == "" {
+				continue
+			}
+			if len(fields) < 5 {
+				return nil, fmt.Errorf("invalid bytes line(%q) of mount point(%s)", scanner.Text(), mountPoint)
+			}
+			var counters [4]uint64
+			for i := range counters {
+				v, err := strconv.ParseUint(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid bytes line(%q) of mount point(%s): %v", scanner.Text(), mountPoint, err)
+				}
+				counters[i] = v
+			}
+			result[mountPoint] = mountIOStats{
+				fsType:     fsType,
+				readBytes:  counters[0] + counters[2],
+				writeBytes: counters[1] + counters[3],
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func isMountStatsSupportedFsType(fsType string) bool {
+	return strings.HasPrefix(fsType, nfs)
+}
+
+// updateMountStatsMetrics refreshes mount I/O metrics of all volumes staged by this driver
+func (d *Driver) updateMountStatsMetrics() {
+	f, err := os.Open(mountStatsPath)
+	if err != nil {
+		klog.V(6).Infof("skip updating mount stats metrics since open %s failed with %v", mountStatsPath, err)
+		return
+	}
+	defer f.Close()
+
+	stats, err := parseMountStats(f)
+	if err != nil {
+		klog.Warningf("parse %s failed with %v", mountStatsPath, err)
+		return
+	}
+
+	d.mountStatsVolMap.Range(func(key, value interface{}) bool {
+		mountPath, volumeID := key.(string), value.(string)
+		stat, ok := stats[mountPath]
+		if !ok {
+			klog.V(6).Infof("no mount stats found for volume(%s) on %s", volumeID, mountPath)
+			return true
+		}
+		mountReadBytes.WithLabelValues(volumeID).Set(float64(stat.readBytes))
+		mountWriteBytes.WithLabelValues(volumeID).Set(float64(stat.writeBytes))
+		return true
+	})
+}
+
+// trackMountStats starts collecting mount I/O metrics of volumeID mounted on mountPath
+func (d *Driver) trackMountStats(mountPath, volumeID string) {
+	d.mountStatsVolMap.Store(mountPath, volumeID)
+}
+
+// untrackMountStats stops collecting mount I/O metrics of the volume mounted on mountPath
+func (d *Driver) untrackMountStats(mountPath string) {
+	if v, ok := d.mountStatsVolMap.LoadAndDelete(mountPath); ok {
+		labels := map[string]string{volumeIDLabel: v.(string)}
+		mountReadBytes.Delete(labels)
+		mountWriteBytes.Delete(labels)
+	}
+}
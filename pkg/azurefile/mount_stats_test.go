@@ -0,0 +1,114 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sampleMountStats = `device proc mounted on /proc with fstype proc
+device /dev/sda1 mounted on / with fstype ext4
+device //account.file.core.windows.net/share mounted on /var/lib/kubelet/plugins/kubernetes.io/csi/file.csi.azure.com/smb/globalmount with fstype cifs
+device account.file.core.windows.net:/account/share mounted on /var/lib/kubelet/plugins/kubernetes.io/csi/file.csi.azure.com/nfs/globalmount with fstype nfs4 statvers=1.1
+	opts:	rw,vers=4.1,rsize=1048576,wsize=1048576,namlen=255,acregmin=3,acregmax=60,acdirmin=30,acdirmax=60,hard,proto=tcp,timeo=600,retrans=2,sec=sys
+	age:	3600
+	caps:	caps=0x3ffbffff,wtmult=512,dtsize=32768,bsize=0,namlen=255
+	events:	1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20 21 22 23 24 25 26 27
+	bytes:	1024 2048 100 200 1124 2248 1 1
+	RPC iostats version: 1.1  p/v: 100003/4 (nfs)
+	xprt:	tcp 0 0 1 0 10 100 100 0 100 0 2 0 0
+`
+
+func TestParseMountStats(t *testing.T) {
+	tests := []struct {
+		desc        string
+		content     string
+		expected    map[string]mountIOStats
+		expectedErr bool
+	}{
+		{
+			desc:     "empty content",
+			content:  "",
+			expected: map[string]mountIOStats{},
+		},
+		{
+			desc:    "sample mountstats with unsupported filesystems",
+			content: sampleMountStats,
+			expected: map[string]mountIOStats{
+				"/var/lib/kubelet/plugins/kubernetes.io/csi/file.csi.azure.com/nfs/globalmount": {
+					fsType:     "nfs4",
+					readBytes:  1124,
+					writeBytes: 2248,
+				},
+			},
+		},
+		{
+			desc: "bytes line of unsupported filesystem is ignored",
+			content: `device /dev/sdb mounted on /mnt with fstype ext4
+	bytes:	1 2 3 4 5 6 7 8
+`,
+			expected: map[string]mountIOStats{},
+		},
+		{
+			desc: "cifs mount is ignored",
+			content: `device //account.file.core.windows.net/share mounted on /mnt with fstype cifs
+	bytes:	1 2 3 4 5 6 7 8
+`,
+			expected: map[string]mountIOStats{},
+		},
+		{
+			desc: "invalid bytes line",
+			content: `device server:/share mounted on /mnt with fstype nfs
+	bytes:	1 2
+`,
+			expectedErr: true,
+		},
+		{
+			desc: "invalid bytes counter",
+			content: `device server:/share mounted on /mnt with fstype nfs
+	bytes:	a 2 3 4 5 6 7 8
+`,
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := parseMountStats(strings.NewReader(test.content))
+		if (err != nil) != test.expectedErr {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+		}
+		if !test.expectedErr && !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestTrackMountStats(t *testing.T) {
+	d := NewFakeDriver()
+	d.trackMountStats("/mnt/staging", "vol-1")
+	if v, ok := d.mountStatsVolMap.Load("/mnt/staging"); !ok || v.(string) != "vol-1" {
+		t.Errorf("unexpected value in mountStatsVolMap: %v", v)
+	}
+	d.untrackMountStats("/mnt/staging")
+	if _, ok := d.mountStatsVolMap.Load("/mnt/staging"); ok {
+		t.Errorf("/mnt/staging should be removed from mountStatsVolMap")
+	}
+	// untrack a path which is not tracked should not panic
+	d.untrackMountStats("/mnt/not-exist")
+}
@@ -23,13 +23,13 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume/util"
+	mount "k8s.io/mount-utils"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -59,7 +59,7 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	mountPermissions := d.mountPermissions
 	context := req.GetVolumeContext()
 	if context != nil {
-		if strings.EqualFold(context[ephemeralField], trueValue) {
+		if isEphemeralVolume(context) {
 			setKeyValueInMap(context, secretNamespaceField, context[podNamespaceField])
 			if !d.allowInlineVolumeKeyAccessWithIdentity {
 				// only get storage account from secret
@@ -67,12 +67,22 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 				setKeyValueInMap(context, storageAccountField, "")
 			}
 			klog.V(2).Infof("NodePublishVolume: ephemeral volume(%s) mount on %s, VolumeContext: %v", volumeID, target, context)
-			_, err := d.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			share, err := d.ensureEphemeralFileShare(ctx, volumeID, context)
+			if err != nil {
+				return nil, err
+			}
+			_, err = d.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
 				StagingTargetPath: target,
 				VolumeContext:     context,
 				VolumeCapability:  volCap,
 				VolumeId:          volumeID,
 			})
+			if err == nil && share != nil && share.owned && !share.retain {
+				// volume attributes are recorded on disk so that the file share could still be deleted after driver restart
+				if err := saveEphemeralVolumeState(target, context); err != nil {
+					klog.Warningf("NodePublishVolume: failed to record state of ephemeral volume %s, file share(%s) would not be deleted: %v", volumeID, share.shareName, err)
+				}
+			}
 			return &csi.NodePublishVolumeResponse{}, err
 		}
 
@@ -136,6 +146,10 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 	}
 	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
 
+	if err := d.deleteEphemeralFileShare(ctx, volumeID, targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete file share of ephemeral volume %s: %v", volumeID, err)
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -144,6 +158,9 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if err := d.validateVolumeID(req.GetVolumeId()); err != nil {
+		return nil, err
+	}
 	targetPath := req.GetStagingTargetPath()
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
@@ -155,14 +172,21 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 
 	volumeID := req.GetVolumeId()
 	context := req.GetVolumeContext()
+	// volume id of ephemeral volume is generated by kubelet
+	if d.validateStaticVolumeID && !isEphemeralVolume(context) {
+		if err := d.ValidateVolumeID(ctx, volumeID, req.GetSecrets(), context); err != nil {
+			return nil, err
+		}
+	}
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 	volumeMountGroup := req.GetVolumeCapability().GetMount().GetVolumeMountGroup()
-	gidPresent := checkGidPresentInMountFlags(mountFlags)
 
 	mc := metrics.NewMetricContext(azureFileCSIDriverName, "node_stage_volume", d.cloud.ResourceGroup, "", d.Name)
+	lifecycle := newVolumeLifecycleEvent("NodeStageVolume", "", volumeID)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
+		lifecycle.finish(isOperationSucceeded)
 	}()
 
 	_, accountName, accountKey, fileShareName, diskName, _, err := d.GetAccountInfo(ctx, volumeID, req.GetSecrets(), context)
@@ -174,7 +198,7 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	}
 	// don't respect fsType from req.GetVolumeCapability().GetMount().GetFsType()
 	// since it's ext4 by default on Linux
-	var fsType, server, protocol, ephemeralVolMountOptions, storageEndpointSuffix, folderName string
+	var fsType, server, protocol, ephemeralVolMountOptions, storageEndpointSuffix, folderName, initMarker, diskMountOptions, proxyMountValue string
 	var ephemeralVol bool
 	fileShareNameReplaceMap := map[string]string{}
 
@@ -200,6 +224,12 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 			ephemeralVolMountOptions = v
 		case storageEndpointSuffixField:
 			storageEndpointSuffix = v
+		case initMarkerField:
+			initMarker = v
+		case diskMountOptionsField:
+			diskMountOptions = v
+		case proxyMountField:
+			proxyMountValue = v
 		case fsGroupChangePolicyField:
 			fsGroupChangePolicy = v
 		case pvcNamespaceKey:
@@ -228,6 +258,9 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("failed to get account name from %s", volumeID))
 	}
 
+	protocol = getEffectiveProtocol(protocol, fsType)
+	lifecycle.setProtocol(protocol, fsType)
+
 	if !isSupportedFsType(fsType) {
 		return nil, status.Errorf(codes.InvalidArgument, "fsType(%s) is not supported, supported fsType list: %v", fsType, supportedFsTypeList)
 	}
@@ -240,21 +273,39 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Errorf(codes.InvalidArgument, "fsGroupChangePolicy(%s) is not supported, supported fsGroupChangePolicy list: %v", fsGroupChangePolicy, supportedFSGroupChangePolicyList)
 	}
 
+	if !isValidInitMarker(initMarker) {
+		return nil, status.Errorf(codes.InvalidArgument, "initMarker(%s) should be a relative path under volume root", initMarker)
+	}
+
+	// diskMountOptions only applies to the loopback mount of vhd disk, not the smb share mount
+	var diskMountOptionList []string
+	if isDiskFsType(fsType) {
+		if diskMountOptionList, err = parseDiskMountOptions(diskMountOptions, fsType); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	useProxy, err := d.useProxyMount(proxyMountValue, fsType)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
 		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
 	}
 	defer d.volumeLocks.Release(volumeID)
 
-	if strings.TrimSpace(storageEndpointSuffix) == "" {
-		if d.cloud.Environment.StorageEndpointSuffix != "" {
-			storageEndpointSuffix = d.cloud.Environment.StorageEndpointSuffix
-		} else {
-			storageEndpointSuffix = defaultStorageEndPointSuffix
-		}
+	limiter := d.getNodeOperationLimiter(isDiskFsType(fsType))
+	if err := limiter.Acquire(ctx); err != nil {
+		return nil, status.Errorf(codes.Aborted, "failed to wait for node operation slot of volume(%s): %v", volumeID, err)
 	}
+	defer limiter.Release()
+
+	storageEndpointSuffix = d.getStorageEndPointSuffix(storageEndpointSuffix)
 
 	// replace pv/pvc name namespace metadata in fileShareName
 	fileShareName = replaceWithMap(fileShareName, fileShareNameReplaceMap)
+	lifecycle.account, lifecycle.share = accountName, fileShareName
 
 	osSeparator := string(os.PathSeparator)
 	if strings.TrimSpace(server) == "" {
@@ -270,17 +321,16 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	}
 
 	cifsMountPath := targetPath
-	cifsMountFlags := mountFlags
-	if !gidPresent && volumeMountGroup != "" {
-		cifsMountFlags = append(cifsMountFlags, fmt.Sprintf("gid=%s", volumeMountGroup))
+	if useProxy {
+		cifsMountPath = filepath.Join(filepath.Dir(targetPath), proxyMount)
 	}
+	cifsMountFlags := mountFlags
 	isDiskMount := isDiskFsType(fsType)
 	if isDiskMount {
 		if !strings.HasSuffix(diskName, vhdSuffix) {
 			return nil, status.Errorf(codes.Internal, "diskname could not be empty, targetPath: %s", targetPath)
 		}
 		cifsMountFlags = []string{"dir_mode=0777,file_mode=0777,cache=strict,actimeo=30", "nostrictsync"}
-		cifsMountPath = filepath.Join(filepath.Dir(targetPath), proxyMount)
 	}
 
 	var mountOptions, sensitiveMountOptions []string
@@ -300,9 +350,21 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 			// parameters suggested by https://azure.microsoft.com/en-us/documentation/articles/storage-how-to-use-files-linux/
 			sensitiveMountOptions = []string{fmt.Sprintf("username=%s,password=%s", accountName, accountKey)}
 			if ephemeralVol {
-				cifsMountFlags = util.JoinMountOptions(cifsMountFlags, strings.Split(ephemeralVolMountOptions, ","))
+				cifsMountFlags = getEphemeralVolumeMountOptions(cifsMountFlags, ephemeralVolMountOptions)
+			}
+			if err := validateSMBVers(cifsMountFlags); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			// gid of nfs and disk volume is set by SetVolumeOwnership
+			fsGroup := volumeMountGroup
+			if isDiskMount {
+				fsGroup = ""
+			}
+			var readOnlyActimeo string
+			if isReadOnlyMount(volumeCapability, mountFlags) {
+				readOnlyActimeo = d.readOnlyActimeo
 			}
-			mountOptions = appendDefaultMountOptions(cifsMountFlags, d.appendNoShareSockOption, d.appendClosetimeoOption)
+			mountOptions = appendDefaultMountOptions(cifsMountFlags, d.appendNoShareSockOption, d.appendClosetimeoOption, d.defaultMountOptions, fsGroup, readOnlyActimeo)
 		}
 	}
 
@@ -312,6 +374,11 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not mount target %s: %v", cifsMountPath, err)
 	}
+	if isDirMounted && !isDiskMount {
+		if isDirMounted, err = d.checkMountOptionsMismatch(volumeID, cifsMountPath, cifsMountFlags); err != nil {
+			return nil, err
+		}
+	}
 	if isDirMounted {
 		klog.V(2).Infof("NodeStageVolume: volume %s is already mounted on %s", volumeID, targetPath)
 	} else {
@@ -322,9 +389,28 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		if err := prepareStagePath(cifsMountPath, d.mounter); err != nil {
 			return nil, status.Errorf(codes.Internal, "prepare stage path failed for %s with error: %v", cifsMountPath, err)
 		}
-		if err := wait.PollImmediate(1*time.Second, 2*time.Minute, func() (bool, error) {
-			return true, SMBMount(d.mounter, source, cifsMountPath, mountFsType, mountOptions, sensitiveMountOptions)
-		}); err != nil {
+		var mountErr error
+		// stop retrying once the request is cancelled, e.g. kubelet times out the NodeStageVolume call
+		if err := wait.PollUntilContextTimeout(ctx, d.transientMountRetryInterval, d.transientMountRetryTimeout, true, wait.ConditionFunc(func() (bool, error) {
+			mountErr = SMBMount(d.mounter, source, cifsMountPath, mountFsType, mountOptions, sensitiveMountOptions)
+			if d.isTransientMountError(mountErr) {
+				klog.Warningf("volume(%s) mount %s on %s failed with transient error: %v, retrying", volumeID, source, cifsMountPath, mountErr)
+				return false, nil
+			}
+			return true, mountErr
+		}).WithContext()); err != nil {
+			if mountErr != nil {
+				// return the last mount error instead of the timeout error of polling
+				err = mountErr
+			}
+			if isMountAuthError(err) && accountName != "" {
+				// account key may be rotated, fetch the key again in next NodeStageVolume call
+				klog.Warningf("volume(%s) mount failed with auth error, invalidate cached key of account(%s)", volumeID, accountName)
+				if err := d.accountCacheMap.Delete(accountName); err != nil {
+					klog.Warningf("failed to delete account(%s) from accountCacheMap: %v", accountName, err)
+				}
+				d.secretKeyCache.deleteAccount(accountName)
+			}
 			var helpLinkMsg string
 			if d.appendMountErrorHelpLink {
 				helpLinkMsg = "\nPlease refer to http://aka.ms/filemounterror for possible causes and solutions for mount errors."
@@ -333,32 +419,55 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		}
 		if protocol == nfs {
 			if performChmodOp {
-				if err := chmodIfPermissionMismatch(targetPath, os.FileMode(mountPermissions)); err != nil {
+				if err := chmodIfPermissionMismatch(cifsMountPath, os.FileMode(mountPermissions)); err != nil {
 					return nil, status.Error(codes.Internal, err.Error())
 				}
 			} else {
-				klog.V(2).Infof("skip chmod on targetPath(%s) since mountPermissions is set as 0", targetPath)
+				klog.V(2).Infof("skip chmod on %s since mountPermissions is set as 0", cifsMountPath)
 			}
 		}
 		klog.V(2).Infof("volume(%s) mount %s on %s succeeded", volumeID, source, cifsMountPath)
 	}
+	if protocol == nfs {
+		// cifs does not report I/O stats in mountstats
+		d.trackMountStats(cifsMountPath, volumeID)
+	}
+
+	if useProxy && !isDiskMount {
+		mnt, err := d.ensureMountPoint(targetPath, os.FileMode(mountPermissions))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not mount target %s: %v", targetPath, err)
+		}
+		if mnt {
+			klog.V(2).Infof("NodeStageVolume: volume %s is already bind mounted on %s", volumeID, targetPath)
+		} else {
+			if err := prepareStagePath(targetPath, d.mounter); err != nil {
+				return nil, status.Errorf(codes.Internal, "prepare stage path failed for %s with error: %v", targetPath, err)
+			}
+			klog.V(2).Infof("NodeStageVolume: bind mounting %s at %s", cifsMountPath, targetPath)
+			if err := d.mounter.Mount(cifsMountPath, targetPath, "", []string{"bind"}); err != nil {
+				return nil, status.Errorf(codes.Internal, "could not bind mount %s at %s: %v", cifsMountPath, targetPath, err)
+			}
+		}
+	}
 
 	if isDiskMount {
 		mnt, err := d.ensureMountPoint(targetPath, os.FileMode(mountPermissions))
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "mount %s on target %s failed with %v", volumeID, targetPath, err)
 		}
+		if mnt {
+			if mnt, err = d.checkMountOptionsMismatch(volumeID, targetPath, mountFlags); err != nil {
+				return nil, err
+			}
+		}
 		if mnt {
 			klog.V(2).Infof("NodeStageVolume: volume %s is already mounted on %s", volumeID, targetPath)
 			return &csi.NodeStageVolumeResponse{}, nil
 		}
 
 		diskPath := filepath.Join(cifsMountPath, diskName)
-		options := util.JoinMountOptions(mountFlags, []string{"loop"})
-		if strings.HasPrefix(fsType, "ext") {
-			// following mount options are only valid for ext2/ext3/ext4 file systems
-			options = util.JoinMountOptions(options, []string{"noatime", "barrier=1", "errors=remount-ro"})
-		}
+		options := getDiskMountOptions(mountFlags, diskMountOptionList, fsType)
 
 		klog.V(2).Infof("NodeStageVolume: volume %s formatting %s and mounting at %s with mount options(%s)", volumeID, targetPath, diskPath, options)
 		// FormatAndMount will format only if needed
@@ -377,6 +486,12 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		}
 	}
 
+	if initMarker != "" {
+		if err := createInitMarker(targetPath, initMarker); err != nil {
+			return nil, status.Errorf(codes.Internal, "create init marker(%s) of volume(%s) on %s failed with %v", initMarker, volumeID, targetPath, err)
+		}
+	}
+
 	isOperationSucceeded = true
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -397,10 +512,20 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	}
 	defer d.volumeLocks.Release(volumeID)
 
+	_, accountName, fileShareName, diskName, _, _, _ := GetFileShareInfo(volumeID)
+	limiter := d.getNodeOperationLimiter(strings.HasSuffix(diskName, vhdSuffix))
+	if err := limiter.Acquire(ctx); err != nil {
+		return nil, status.Errorf(codes.Aborted, "failed to wait for node operation slot of volume(%s): %v", volumeID, err)
+	}
+	defer limiter.Release()
+
 	mc := metrics.NewMetricContext(azureFileCSIDriverName, "node_unstage_volume", d.cloud.ResourceGroup, "", d.Name)
+	lifecycle := newVolumeLifecycleEvent("NodeUnstageVolume", "", volumeID)
+	lifecycle.account, lifecycle.share = accountName, fileShareName
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, volumeID)
+		lifecycle.finish(isOperationSucceeded)
 	}()
 
 	klog.V(2).Infof("NodeUnstageVolume: CleanupMountPoint volume %s on %s", volumeID, stagingTargetPath)
@@ -413,6 +538,8 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	if err := CleanupMountPoint(d.mounter, targetPath, false); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %s: %v", targetPath, err)
 	}
+	d.untrackMountStats(stagingTargetPath)
+	d.untrackMountStats(targetPath)
 	klog.V(2).Infof("NodeUnstageVolume: unmount volume %s on %s successfully", volumeID, stagingTargetPath)
 
 	isOperationSucceeded = true
@@ -456,12 +583,15 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 	// fileShareName in volumeID may contain subPath, e.g. csi-shared-config/ASCP01/certs
 	// get the file share name without subPath from volumeID and check the cache again using new volumeID
 	var newVolID string
-	if _, accountName, fileShareName, _, secretNamespace, _, err := GetFileShareInfo(req.VolumeId); err == nil {
+	var isVHDDisk bool
+	if _, accountName, fileShareName, diskName, secretNamespace, _, err := GetFileShareInfo(req.VolumeId); err == nil {
 		if splitStr := strings.Split(fileShareName, "/"); len(splitStr) > 1 {
 			fileShareName = splitStr[0]
 		}
+		// filesystem in vhd disk is not shared with other volumes on the same file share, stats are only cached per volume
+		isVHDDisk = diskName != ""
 		// get new volumeID
-		if accountName != "" && fileShareName != "" {
+		if accountName != "" && fileShareName != "" && !isVHDDisk {
 			newVolID = fmt.Sprintf(volumeIDTemplate, "", accountName, fileShareName, "", "", secretNamespace)
 		}
 	}
@@ -479,6 +609,12 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "path %s does not exist", req.VolumePath)
 		}
+		if IsCorruptedDir(req.VolumePath) {
+			klog.Warningf("NodeGetVolumeStats: detected corrupted mount on volume %s path %s: %v", req.VolumeId, req.VolumePath, err)
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume path %s is corrupted: %v", req.VolumePath, err)},
+			}, nil
+		}
 		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.VolumePath, err)
 	}
 
@@ -494,8 +630,11 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 		mc.ObserveOperationWithResult(isOperationSucceeded, VolumeID, req.VolumeId)
 	}()
 
-	resp, err := GetVolumeStats(req.VolumePath, d.enableWindowsHostProcess)
+	// volume path of vhd disk volume is bind mounted from the loopback mount on staging path,
+	// so the stats are of the filesystem in vhd disk instead of the file share
+	resp, err := getVolumeStats(req.VolumePath, d.enableWindowsHostProcess)
 	if err == nil && resp != nil {
+		resp.VolumeCondition = &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
 		if d.printVolumeStatsCallLogs {
 			klog.V(2).Infof("NodeGetVolumeStats: volume stats for volume %s path %s is %v", req.VolumeId, req.VolumePath, resp)
 		} else {
@@ -511,10 +650,96 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 	return resp, err
 }
 
+// getVolumeStats returns statfs numbers of the mounted filesystem on path, replaced in unit tests
+var getVolumeStats = GetVolumeStats
+
 // NodeExpandVolume node expand volume
-// N/A for azure file
+// only vhd disk volumes need filesystem expansion on the node, it's a no-op for SMB/NFS volumes
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if err := d.validateVolumeID(volumeID); err != nil {
+		return nil, err
+	}
+	_, _, _, diskName, _, _, err := GetFileShareInfo(volumeID)
+	if err != nil || !strings.HasSuffix(diskName, vhdSuffix) {
+		klog.V(2).Infof("NodeExpandVolume: volume(%s) is not a vhd disk volume, skip filesystem expansion", volumeID)
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+	if runtime.GOOS == "windows" {
+		return nil, status.Errorf(codes.Unimplemented, "NodeExpandVolume of vhd disk volume(%s) is not supported on Windows", volumeID)
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	requestSize := req.GetCapacityRange().GetRequiredBytes()
+	if requestSize <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range missing in request")
+	}
+
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	if err := d.diskNodeOperationLimiter.Acquire(ctx); err != nil {
+		return nil, status.Errorf(codes.Aborted, "failed to wait for node operation slot of volume(%s): %v", volumeID, err)
+	}
+	defer d.diskNodeOperationLimiter.Release()
+
+	devicePath, _, err := mount.GetDeviceNameFromMount(d.mounter, stagingPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get device of volume(%s) on %s: %v", volumeID, stagingPath, err)
+	}
+	if devicePath == "" {
+		return nil, status.Errorf(codes.NotFound, "volume(%s) is not mounted on %s", volumeID, stagingPath)
+	}
+
+	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	if !isDiskFsType(fsType) {
+		if fsType, err = getDiskFormat(d.mounter, devicePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get filesystem type of device(%s): %v", devicePath, err)
+		}
+	}
+	resizeCmd, resizeArgs, err := getFsResizeCommand(fsType, devicePath, stagingPath)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	diskPath := filepath.Join(filepath.Dir(stagingPath), proxyMount, diskName)
+	// disk file is usually resized by ControllerExpandVolume already, resize it here in case it's not
+	if _, err := resizeDiskFile(diskPath, requestSize); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resize disk file(%s) to %d bytes: %v", diskPath, requestSize, err)
+	}
+	if strings.HasPrefix(devicePath, "/dev/loop") {
+		// let the loop device pick up the new size of backing vhd file
+		if output, err := d.mounter.Exec.Command("losetup", "-c", devicePath).CombinedOutput(); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to refresh capacity of loop device(%s): %v, output: %s", devicePath, err, string(output))
+		}
+	}
+
+	klog.V(2).Infof("NodeExpandVolume: expanding %s filesystem of volume(%s) on %s with %s %v", fsType, volumeID, stagingPath, resizeCmd, resizeArgs)
+	if output, err := d.mounter.Exec.Command(resizeCmd, resizeArgs...).CombinedOutput(); err != nil {
+		return nil, status.Errorf(codes.Internal, "%s on volume(%s) failed with %v, output: %s", resizeCmd, volumeID, err, string(output))
+	}
+	klog.V(2).Infof("NodeExpandVolume: volume(%s) on %s expanded to %d bytes successfully", volumeID, stagingPath, requestSize)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: requestSize}, nil
+}
+
+// getFsResizeCommand returns the command to grow a mounted filesystem of fsType,
+// resize2fs works on the device while xfs_growfs works on the mount point
+func getFsResizeCommand(fsType, devicePath, mountPath string) (string, []string, error) {
+	switch fsType {
+	case ext2, ext3, ext4:
+		return "resize2fs", []string{devicePath}, nil
+	case xfs:
+		return "xfs_growfs", []string{mountPath}, nil
+	}
+	return "", nil, fmt.Errorf("filesystem type(%s) is not supported for expansion, supported types: %v", fsType, supportedDiskFsTypeList)
 }
 
 // ensureMountPoint: create mount point if not exists
@@ -574,21 +799,152 @@ func (d *Driver) ensureMountPoint(target string, perm os.FileMode) (bool, error)
 	return !notMnt, nil
 }
 
-func makeDir(pathname string, perm os.FileMode) error {
-	err := os.MkdirAll(pathname, perm)
+// checkMountOptionsMismatch handles an existing mount on target according to mountOptionsMismatchPolicy
+// when any of the requested mount options is not found in the mount options of the existing mount,
+// return <true, nil> if the existing mount should be kept, <false, nil> if target is unmounted and should be mounted again
+func (d *Driver) checkMountOptionsMismatch(volumeID, target string, requestedOptions []string) (bool, error) {
+	if d.mountOptionsMismatchPolicy == mountOptionsMismatchIgnore || runtime.GOOS == "windows" || len(requestedOptions) == 0 {
+		return true, nil
+	}
+	mountList, err := d.mounter.List()
 	if err != nil {
-		if !os.IsExist(err) {
-			return err
+		return true, status.Errorf(codes.Internal, "failed to list mount points: %v", err)
+	}
+	targetAbs, err := filepath.Abs(target)
+	if err != nil {
+		return true, status.Errorf(codes.Internal, "failed to get absolute path of %s: %v", target, err)
+	}
+	var existingOptions []string
+	for _, mountPoint := range mountList {
+		if mountPoint.Path == targetAbs {
+			existingOptions = mountPoint.Opts
+			break
 		}
 	}
-	return nil
+	mismatched := getMismatchedMountOptions(requestedOptions, existingOptions)
+	if len(mismatched) == 0 {
+		return true, nil
+	}
+
+	if d.mountOptionsMismatchPolicy == mountOptionsMismatchError {
+		return true, status.Errorf(codes.FailedPrecondition, "volume(%s) is already mounted on %s with mount options(%v), requested mount options(%v) are not applied", volumeID, target, existingOptions, mismatched)
+	}
+	klog.Warningf("volume(%s) is already mounted on %s with mount options(%v), unmount it to apply requested mount options(%v)", volumeID, target, existingOptions, mismatched)
+	if err := d.mounter.Unmount(target); err != nil {
+		return true, status.Errorf(codes.Internal, "failed to unmount %s to apply requested mount options: %v", target, err)
+	}
+	return false, nil
+}
+
+// getMismatchedMountOptions returns the requested mount options which are not applied on existing mount,
+// existing mount options are normalized by kernel (e.g. in /proc/mounts), so both sides are normalized
+// before comparison, and options not echoed back by kernel or negotiated with server are skipped
+func getMismatchedMountOptions(requested, existing []string) []string {
+	existingFlags := make(map[string]bool)
+	existingValues := make(map[string]string)
+	for _, opts := range existing {
+		for _, opt := range strings.Split(opts, ",") {
+			key, value, hasValue := normalizeMountOption(opt)
+			if hasValue {
+				existingValues[key] = value
+			} else if key != "" {
+				existingFlags[key] = true
+			}
+		}
+	}
+	var mismatched []string
+	for _, opts := range requested {
+		for _, opt := range strings.Split(opts, ",") {
+			key, value, hasValue := normalizeMountOption(opt)
+			if key == "" || isUncomparableMountOption(key, value) {
+				continue
+			}
+			if hasValue {
+				// value of an option not shown in existing mount options could not be compared, e.g. password
+				if existingValue, ok := existingValues[key]; ok && existingValue != value {
+					mismatched = append(mismatched, strings.TrimSpace(opt))
+				}
+			} else if !existingFlags[key] {
+				mismatched = append(mismatched, strings.TrimSpace(opt))
+			}
+		}
+	}
+	return mismatched
+}
+
+// normalizeMountOption returns the mount option in the form shown by kernel,
+// file_mode and dir_mode are shown as 4 digit octal, smb protocol version aliases are resolved
+func normalizeMountOption(opt string) (string, string, bool) {
+	kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+	key := strings.ToLower(strings.TrimSpace(kv[0]))
+	if len(kv) == 1 {
+		return key, "", false
+	}
+	value := strings.TrimSpace(kv[1])
+	switch key {
+	case fileMode, dirMode:
+		if mode, err := strconv.ParseUint(value, 8, 32); err == nil {
+			value = fmt.Sprintf("%04o", mode)
+		}
+	case vers:
+		switch value {
+		case "3.0.2":
+			value = "3.02"
+		case "3.11":
+			value = "3.1.1"
+		}
+	}
+	return key, value, true
+}
+
+// isUncomparableMountOption returns true if the mount option is not shown in existing mount options by kernel,
+// or its value is negotiated with server when mounting
+func isUncomparableMountOption(key, value string) bool {
+	if strings.HasPrefix(key, "x-") {
+		return true
+	}
+	switch key {
+	case "_netdev", "nofail", "defaults", "auto", "noauto", "user", "nouser", "users", "exec", "suid", "dev", "async":
+		return true
+	case "rsize", "wsize", "minorversion":
+		return true
+	case vers:
+		// vers=3, vers=default and nfs vers=4 are shown as the negotiated version
+		return value == "3" || value == "default" || value == "4"
+	}
+	return false
 }
 
-func checkGidPresentInMountFlags(mountFlags []string) bool {
-	for _, mountFlag := range mountFlags {
-		if strings.HasPrefix(mountFlag, "gid") {
+// getDiskMountOptions returns mount options of vhd disk loopback mount
+func getDiskMountOptions(mountFlags, diskMountOptions []string, fsType string) []string {
+	options := util.JoinMountOptions(mountFlags, append([]string{"loop"}, diskMountOptions...))
+	if strings.HasPrefix(fsType, "ext") {
+		// following mount options are only valid for ext2/ext3/ext4 file systems
+		options = util.JoinMountOptions(options, []string{"barrier=1", "errors=remount-ro"})
+	}
+	return options
+}
+
+// isReadOnlyMount returns true if the volume is staged with read-only access mode or ro mount option
+func isReadOnlyMount(volumeCapability *csi.VolumeCapability, mountFlags []string) bool {
+	switch volumeCapability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	for _, flag := range mountFlags {
+		if strings.TrimSpace(flag) == "ro" {
 			return true
 		}
 	}
 	return false
 }
+
+func makeDir(pathname string, perm os.FileMode) error {
+	err := os.MkdirAll(pathname, perm)
+	if err != nil {
+		if !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
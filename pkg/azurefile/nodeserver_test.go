@@ -27,6 +27,7 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"sigs.k8s.io/azurefile-csi-driver/test/utils/testutil"
 
@@ -39,6 +40,7 @@ import (
 	"k8s.io/utils/exec"
 	testingexec "k8s.io/utils/exec/testing"
 
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
 
@@ -310,6 +312,18 @@ func TestNodeUnpublishVolume(t *testing.T) {
 			req:         csi.NodeUnpublishVolumeRequest{TargetPath: targetFile, VolumeId: "vol_1"},
 			expectedErr: testutil.TestError{},
 		},
+		{
+			desc: "[Success] Invalid state file of ephemeral volume is removed",
+			setup: func() {
+				assert.NoError(t, os.WriteFile(getEphemeralVolumeStatePath(targetFile), []byte("invalid"), 0600))
+			},
+			req:         csi.NodeUnpublishVolumeRequest{TargetPath: targetFile, VolumeId: "vol_1"},
+			expectedErr: testutil.TestError{},
+			cleanup: func() {
+				_, err := os.Stat(getEphemeralVolumeStatePath(targetFile))
+				assert.True(t, os.IsNotExist(err))
+			},
+		},
 	}
 
 	// Setup
@@ -695,6 +709,34 @@ func TestNodeStageVolume(t *testing.T) {
 				DefaultError: status.Error(codes.InvalidArgument, fmt.Sprintf("invalid mountPermissions %s", "07ab")),
 			},
 		},
+		{
+			desc: "[Error] invalid proxyMount",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext: map[string]string{
+					shareNameField:  "test_sharename",
+					proxyMountField: "yes",
+				},
+				Secrets: secrets},
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "invalid proxymount: yes, should be true or false"),
+			},
+		},
+		{
+			desc: "[Error] proxyMount is false with vhd disk volume",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext: map[string]string{
+					fsTypeField:     "ext4",
+					diskNameField:   "test_disk.vhd",
+					shareNameField:  "test_sharename",
+					proxyMountField: "false",
+				},
+				Secrets: secrets},
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "proxymount could not be false with vhd disk volume(fsType: ext4)"),
+			},
+		},
 	}
 
 	// Setup
@@ -752,6 +794,262 @@ func TestNodeStageVolume(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNodeStageVolumeInvalidateAccountKey(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("skip on windows and darwin since fake mounter is not used")
+	}
+	stagingTargetPath := testutil.GetWorkDirPath("error_mount_auth_target", t)
+	defer os.RemoveAll(stagingTargetPath)
+
+	d := NewFakeDriver()
+	mounter, err := NewFakeMounter()
+	if err != nil {
+		t.Fatalf("failed to get fake mounter: %v", err)
+	}
+	d.mounter = mounter
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "rg#k8s#share",
+		StagingTargetPath: stagingTargetPath,
+		VolumeCapability:  &stdVolCap,
+		VolumeContext:     map[string]string{shareNameField: "share"},
+		Secrets:           map[string]string{"accountname": "k8s", "accountkey": "oldkey"},
+	}
+	d.secretKeyCache.set(defaultNamespace, "secret", "k8s", "oldkey")
+
+	_, err = d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	// cached key is invalidated since mount failed with auth error
+	cache, err := d.accountCacheMap.Get("k8s", azcache.CacheReadTypeDefault)
+	assert.NoError(t, err)
+	assert.Nil(t, cache)
+	_, _, found := d.secretKeyCache.get(defaultNamespace, "secret")
+	assert.False(t, found)
+}
+
+// recordingMounter records mount options of the last MountSensitive call
+type recordingMounter struct {
+	fakeMounter
+	options []string
+}
+
+func (m *recordingMounter) MountSensitive(_ string, _ string, _ string, options []string, _ []string) error {
+	m.options = options
+	return nil
+}
+
+func TestNodeStageVolumeFSGroupMountOption(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mount options are only assembled on linux")
+	}
+	targetPath := testutil.GetWorkDirPath("fsgroup_target", t)
+	defer os.RemoveAll(targetPath)
+	secrets := map[string]string{
+		defaultSecretAccountName: "accountname",
+		defaultSecretAccountKey:  "accountkey",
+	}
+
+	tests := []struct {
+		desc          string
+		context       map[string]string
+		mountFlags    []string
+		expectedGid   string
+		unexpectedGid string
+	}{
+		{
+			desc:        "gid is appended for smb volume",
+			context:     map[string]string{shareNameField: "share", serverNameField: "server"},
+			expectedGid: "gid=3000",
+		},
+		{
+			desc:          "gid in mount flags is not overridden",
+			context:       map[string]string{shareNameField: "share", serverNameField: "server"},
+			mountFlags:    []string{"gid=2000"},
+			expectedGid:   "gid=2000",
+			unexpectedGid: "gid=3000",
+		},
+		{
+			desc:          "gid is not appended for nfs volume",
+			context:       map[string]string{protocolField: nfs, shareNameField: "share", serverNameField: "server", fsGroupChangePolicyField: FSGroupChangeNone},
+			unexpectedGid: "gid=3000",
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		m := &recordingMounter{}
+		d.mounter = &mount.SafeFormatAndMount{Interface: m}
+		req := &csi.NodeStageVolumeRequest{
+			VolumeId:          "rg#accountname#share",
+			StagingTargetPath: targetPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: test.mountFlags, VolumeMountGroup: "3000"},
+				},
+			},
+			VolumeContext: test.context,
+			Secrets:       secrets,
+		}
+		_, err := d.NodeStageVolume(context.Background(), req)
+		assert.NoError(t, err, test.desc)
+		if test.expectedGid != "" {
+			assert.Contains(t, m.options, test.expectedGid, test.desc)
+		}
+		if test.unexpectedGid != "" {
+			assert.NotContains(t, m.options, test.unexpectedGid, test.desc)
+		}
+	}
+}
+
+// transientErrorMounter fails every MountSensitive call with a transient mount error
+type transientErrorMounter struct {
+	fakeMounter
+	calls int
+}
+
+func (m *transientErrorMounter) MountSensitive(_ string, _ string, _ string, _ []string, _ []string) error {
+	m.calls++
+	return fmt.Errorf("mount error(11): Resource temporarily unavailable")
+}
+
+func TestNodeStageVolumeTransientMountRetry(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mount errors are only classified on linux")
+	}
+	targetPath := testutil.GetWorkDirPath("transient_mount_target", t)
+	defer os.RemoveAll(targetPath)
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		desc          string
+		ctx           context.Context
+		retryTimeout  time.Duration
+		expectedRetry bool
+	}{
+		{
+			desc:          "transient mount error is retried until timeout",
+			ctx:           context.Background(),
+			retryTimeout:  100 * time.Millisecond,
+			expectedRetry: true,
+		},
+		{
+			desc:         "retry stops once request is cancelled",
+			ctx:          cancelledCtx,
+			retryTimeout: time.Hour,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriverCustomOptions(DriverOptions{TransientMountRetryInterval: 10 * time.Millisecond, TransientMountRetryTimeout: test.retryTimeout})
+		m := &transientErrorMounter{}
+		d.mounter = &mount.SafeFormatAndMount{Interface: m}
+		req := &csi.NodeStageVolumeRequest{
+			VolumeId:          "rg#accountname#share",
+			StagingTargetPath: targetPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+			VolumeContext: map[string]string{shareNameField: "share", serverNameField: "server"},
+			Secrets: map[string]string{
+				defaultSecretAccountName: "accountname",
+				defaultSecretAccountKey:  "accountkey",
+			},
+		}
+		_, err := d.NodeStageVolume(test.ctx, req)
+		assert.Equal(t, codes.Internal, status.Code(err), test.desc)
+		// last mount error is returned instead of the timeout error of polling
+		assert.Contains(t, err.Error(), "mount error(11)", test.desc)
+		assert.Equal(t, test.expectedRetry, m.calls > 1, "%s: %d mount calls", test.desc, m.calls)
+	}
+}
+
+func TestNodeStageVolumeSMBVers(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mount options are only assembled on linux")
+	}
+	targetPath := testutil.GetWorkDirPath("smb_vers_target", t)
+	defer os.RemoveAll(targetPath)
+	secrets := map[string]string{
+		defaultSecretAccountName: "accountname",
+		defaultSecretAccountKey:  "accountkey",
+	}
+
+	tests := []struct {
+		desc          string
+		defaultVers   string
+		mountFlags    []string
+		expectedVers  string
+		expectedError bool
+	}{
+		{
+			desc:         "vers is negotiated by mount.cifs by default",
+			expectedVers: "",
+		},
+		{
+			desc:         "driver default vers is appended",
+			defaultVers:  "3.0",
+			expectedVers: "vers=3.0",
+		},
+		{
+			desc:         "supported vers in mount flags",
+			defaultVers:  "3.0",
+			mountFlags:   []string{"vers=3.1.1"},
+			expectedVers: "vers=3.1.1",
+		},
+		{
+			desc:          "unsupported vers in mount flags",
+			defaultVers:   "3.0",
+			mountFlags:    []string{"vers=1.0"},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.defaultMountOptions[vers] = test.defaultVers
+		m := &recordingMounter{}
+		d.mounter = &mount.SafeFormatAndMount{Interface: m}
+		req := &csi.NodeStageVolumeRequest{
+			VolumeId:          "rg#accountname#share",
+			StagingTargetPath: targetPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: test.mountFlags},
+				},
+			},
+			VolumeContext: map[string]string{shareNameField: "share", serverNameField: "server"},
+			Secrets:       secrets,
+		}
+		_, err := d.NodeStageVolume(context.Background(), req)
+		if test.expectedError {
+			assert.Equal(t, codes.InvalidArgument, status.Code(err), test.desc)
+			assert.Empty(t, m.options, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		var smbVers []string
+		for _, option := range m.options {
+			if strings.HasPrefix(option, vers+"=") {
+				smbVers = append(smbVers, option)
+			}
+		}
+		if test.expectedVers == "" {
+			assert.Empty(t, smbVers, test.desc)
+		} else {
+			assert.Equal(t, []string{test.expectedVers}, smbVers, test.desc)
+		}
+	}
+}
+
 func TestNodeUnstageVolume(t *testing.T) {
 	var (
 		errorTarget = testutil.GetWorkDirPath("error_is_likely_target", t)
@@ -892,6 +1190,49 @@ func TestNodeGetVolumeStats(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNodeGetVolumeStatsVHDDisk(t *testing.T) {
+	volumePath := t.TempDir()
+
+	var statsPaths []string
+	defer func(f func(string, bool) (*csi.NodeGetVolumeStatsResponse, error)) { getVolumeStats = f }(getVolumeStats)
+	getVolumeStats = func(path string, _ bool) (*csi.NodeGetVolumeStatsResponse, error) {
+		statsPaths = append(statsPaths, path)
+		return &csi.NodeGetVolumeStatsResponse{Usage: []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 100}}}, nil
+	}
+
+	tests := []struct {
+		desc               string
+		volumeIDs          []string
+		expectedStatsPaths []string
+	}{
+		{
+			desc:               "stats of share are shared by volumes on the same share",
+			volumeIDs:          []string{"rg#account#share/subpath1", "rg#account#share/subpath2"},
+			expectedStatsPaths: []string{volumePath},
+		},
+		{
+			desc:               "stats of vhd disk are cached per volume",
+			volumeIDs:          []string{"rg#account#share#disk1.vhd", "rg#account#share#disk2.vhd"},
+			expectedStatsPaths: []string{volumePath, volumePath},
+		},
+	}
+
+	for _, test := range tests {
+		statsPaths = nil
+		d := NewFakeDriver()
+		for _, volumeID := range test.volumeIDs {
+			resp, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   volumeID,
+				VolumePath: volumePath,
+			})
+			assert.NoError(t, err, test.desc)
+			assert.Equal(t, int64(100), resp.Usage[0].Total, test.desc)
+			assert.False(t, resp.VolumeCondition.Abnormal, test.desc)
+		}
+		assert.Equal(t, test.expectedStatsPaths, statsPaths, test.desc)
+	}
+}
+
 func TestEnsureMountPoint(t *testing.T) {
 	errorTarget := "./error_is_likely_target"
 	alreadyExistTarget := "./false_is_likely_exist_target"
@@ -972,40 +1313,271 @@ func TestMakeDir(t *testing.T) {
 }
 
 func TestNodeExpandVolume(t *testing.T) {
+	tests := []struct {
+		desc         string
+		req          csi.NodeExpandVolumeRequest
+		expectedResp *csi.NodeExpandVolumeResponse
+		expectedErr  error
+	}{
+		{
+			desc:        "[Error] Volume ID missing",
+			req:         csi.NodeExpandVolumeRequest{},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+		},
+		{
+			desc: "[Success] SMB volume is a no-op",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId:          "rg#account#share",
+				StagingTargetPath: "/tmp/staging",
+			},
+			expectedResp: &csi.NodeExpandVolumeResponse{},
+		},
+		{
+			desc: "[Success] invalid volume ID is a no-op",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId: "vol_1",
+			},
+			expectedResp: &csi.NodeExpandVolumeResponse{},
+		},
+		{
+			desc: "[Error] Staging target path missing for vhd volume",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId: "rg#account#share#disk.vhd",
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "Staging target path missing in request"),
+		},
+		{
+			desc: "[Error] Capacity range missing for vhd volume",
+			req: csi.NodeExpandVolumeRequest{
+				VolumeId:          "rg#account#share#disk.vhd",
+				StagingTargetPath: "/tmp/staging",
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "Capacity range missing in request"),
+		},
+	}
+
 	d := NewFakeDriver()
-	req := csi.NodeExpandVolumeRequest{}
-	resp, err := d.NodeExpandVolume(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	for _, test := range tests {
+		if runtime.GOOS == "windows" && strings.HasSuffix(test.req.VolumeId, vhdSuffix) {
+			continue
+		}
+		resp, err := d.NodeExpandVolume(context.Background(), &test.req)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if !reflect.DeepEqual(resp, test.expectedResp) {
+			t.Errorf("test[%s]: unexpected response: %v, expected response: %v", test.desc, resp, test.expectedResp)
+		}
 	}
 }
 
-func TestCheckGidPresentInMountFlags(t *testing.T) {
+func TestGetFsResizeCommand(t *testing.T) {
+	tests := []struct {
+		fsType       string
+		expectedCmd  string
+		expectedArgs []string
+		expectedErr  bool
+	}{
+		{fsType: ext2, expectedCmd: "resize2fs", expectedArgs: []string{"/dev/loop0"}},
+		{fsType: ext3, expectedCmd: "resize2fs", expectedArgs: []string{"/dev/loop0"}},
+		{fsType: ext4, expectedCmd: "resize2fs", expectedArgs: []string{"/dev/loop0"}},
+		{fsType: xfs, expectedCmd: "xfs_growfs", expectedArgs: []string{"/mnt/staging"}},
+		{fsType: "ntfs", expectedErr: true},
+		{fsType: "", expectedErr: true},
+	}
+
+	for _, test := range tests {
+		cmd, args, err := getFsResizeCommand(test.fsType, "/dev/loop0", "/mnt/staging")
+		if (err != nil) != test.expectedErr {
+			t.Errorf("fsType(%s): unexpected error: %v", test.fsType, err)
+		}
+		if cmd != test.expectedCmd || !reflect.DeepEqual(args, test.expectedArgs) {
+			t.Errorf("fsType(%s): unexpected command: %s %v, expected: %s %v", test.fsType, cmd, args, test.expectedCmd, test.expectedArgs)
+		}
+	}
+}
+
+func TestGetDiskMountOptions(t *testing.T) {
+	tests := []struct {
+		desc             string
+		mountFlags       []string
+		diskMountOptions []string
+		fsType           string
+		expected         []string
+	}{
+		{
+			desc:             "default disk mount options on ext4",
+			diskMountOptions: defaultDiskMountOptions,
+			fsType:           ext4,
+			expected:         []string{"barrier=1", "errors=remount-ro", "loop", "noatime"},
+		},
+		{
+			desc:             "default disk mount options on xfs",
+			diskMountOptions: defaultDiskMountOptions,
+			fsType:           xfs,
+			expected:         []string{"loop", "noatime"},
+		},
+		{
+			desc:             "custom disk mount options replace default ones",
+			mountFlags:       []string{"ro"},
+			diskMountOptions: []string{"nodiratime", "relatime", "commit=30"},
+			fsType:           ext4,
+			expected:         []string{"barrier=1", "commit=30", "errors=remount-ro", "loop", "nodiratime", "relatime", "ro"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getDiskMountOptions(test.mountFlags, test.diskMountOptions, test.fsType), test.desc)
+	}
+}
+
+func TestNodeStageVolumeInvalidDiskMountOptions(t *testing.T) {
+	d := NewFakeDriver()
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "rg#accountname#share#disk.vhd",
+		StagingTargetPath: testutil.GetWorkDirPath("disk_mount_options_target", t),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{
+			fsTypeField:           ext4,
+			diskNameField:         "disk.vhd",
+			shareNameField:        "share",
+			diskMountOptionsField: "noatime,dev",
+		},
+		Secrets: map[string]string{
+			defaultSecretAccountName: "accountname",
+			defaultSecretAccountKey:  "accountkey",
+		},
+	}
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, status.Errorf(codes.InvalidArgument, "disk mount option(dev) is not supported, supported options: %v", supportedDiskMountOptionList), err)
+}
+
+func TestIsReadOnlyMount(t *testing.T) {
 	tests := []struct {
 		desc       string
-		MountFlags []string
-		result     bool
+		mode       csi.VolumeCapability_AccessMode_Mode
+		mountFlags []string
+		expected   bool
 	}{
+		{desc: "single node writer", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{desc: "multi node multi writer", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, mountFlags: []string{"rw", "vers=3.0"}},
+		{desc: "single node reader only", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, expected: true},
+		{desc: "multi node reader only", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, expected: true},
+		{desc: "ro mount option", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, mountFlags: []string{"vers=3.0", " ro"}, expected: true},
+		{desc: "option with ro prefix", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, mountFlags: []string{"rootdir=x"}},
+	}
+	for _, test := range tests {
+		volumeCapability := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: test.mode}}
+		assert.Equal(t, test.expected, isReadOnlyMount(volumeCapability, test.mountFlags), test.desc)
+	}
+}
+
+func TestGetMismatchedMountOptions(t *testing.T) {
+	tests := []struct {
+		desc      string
+		requested []string
+		existing  []string
+		expected  []string
+	}{
+		{
+			desc:     "no requested options",
+			existing: []string{"rw", "vers=3.1.1"},
+		},
+		{
+			desc:      "all requested options exist",
+			requested: []string{"dir_mode=0777,file_mode=0777", "mfsymlinks"},
+			existing:  []string{"rw", "vers=3.1.1", "dir_mode=0777", "file_mode=0777", "mfsymlinks"},
+		},
+		{
+			desc:      "requested options are different",
+			requested: []string{"dir_mode=0755", "mfsymlinks", "actimeo=30", "nosharesock"},
+			existing:  []string{"rw", "dir_mode=0777", "mfsymlinks", "actimeo=1"},
+			expected:  []string{"dir_mode=0755", "actimeo=30", "nosharesock"},
+		},
 		{
-			desc:       "[Success] Gid present in mount flags",
-			MountFlags: []string{"gid=3000"},
-			result:     true,
+			desc:      "requested options are normalized by kernel",
+			requested: []string{"dir_mode=777,file_mode=0640", "vers=3.11", "UID=1000"},
+			existing:  []string{"rw", "vers=3.1.1", "uid=1000", "forceuid", "dir_mode=0777", "file_mode=0640"},
 		},
 		{
-			desc:       "[Success] Gid not present in mount flags",
-			MountFlags: []string{},
-			result:     false,
+			desc:      "options not shown by kernel or negotiated are skipped",
+			requested: []string{"vers=default", "_netdev,nofail", "rsize=65536", "username=account,password=key", "x-systemd.automount"},
+			existing:  []string{"rw", "vers=3.1.1", "rsize=1048576", "username=account"},
 		},
+		{
+			desc:      "nfs version is negotiated",
+			requested: []string{"vers=4,minorversion=1,sec=sys", "nconnect=4"},
+			existing:  []string{"rw", "vers=4.1", "sec=sys", "nconnect=8"},
+			expected:  []string{"nconnect=4"},
+		},
+	}
+	for _, test := range tests {
+		result := getMismatchedMountOptions(test.requested, test.existing)
+		assert.Equal(t, test.expected, result, test.desc)
+	}
+}
+
+func TestCheckMountOptionsMismatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
 	}
+	target, err := filepath.Abs(targetTest)
+	assert.NoError(t, err)
 
+	tests := []struct {
+		desc            string
+		policy          string
+		requested       []string
+		expectedMounted bool
+		expectedErr     codes.Code
+	}{
+		{
+			desc:            "matching options is a no-op",
+			policy:          mountOptionsMismatchRemount,
+			requested:       []string{"mfsymlinks"},
+			expectedMounted: true,
+			expectedErr:     codes.OK,
+		},
+		{
+			desc:            "mismatched options are ignored",
+			policy:          mountOptionsMismatchIgnore,
+			requested:       []string{"dir_mode=0755"},
+			expectedMounted: true,
+			expectedErr:     codes.OK,
+		},
+		{
+			desc:            "mismatched options trigger remount",
+			policy:          mountOptionsMismatchRemount,
+			requested:       []string{"dir_mode=0755"},
+			expectedMounted: false,
+			expectedErr:     codes.OK,
+		},
+		{
+			desc:            "mismatched options return error",
+			policy:          mountOptionsMismatchError,
+			requested:       []string{"dir_mode=0755"},
+			expectedMounted: true,
+			expectedErr:     codes.FailedPrecondition,
+		},
+	}
 	for _, test := range tests {
-		gIDPresent := checkGidPresentInMountFlags(test.MountFlags)
-		if gIDPresent != test.result {
-			t.Errorf("[%s]: Expected result : %t, Actual result: %t", test.desc, test.result, gIDPresent)
+		fakeMounter := &mount.FakeMounter{
+			MountPoints: []mount.MountPoint{
+				{Device: "//account.file.core.windows.net/share", Path: target, Type: cifs, Opts: []string{"rw", "dir_mode=0777", "mfsymlinks"}},
+			},
 		}
+		d := NewFakeDriver()
+		d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+		d.mountOptionsMismatchPolicy = test.policy
+
+		mounted, err := d.checkMountOptionsMismatch("vol_1", target, test.requested)
+		assert.Equal(t, test.expectedErr, status.Code(err), test.desc)
+		assert.Equal(t, test.expectedMounted, mounted, test.desc)
+		mountList, _ := fakeMounter.List()
+		assert.Equal(t, test.expectedMounted, len(mountList) == 1, test.desc)
 	}
-
 }
 
 func TestNodePublishVolumeIdempotentMount(t *testing.T) {
@@ -0,0 +1,98 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+)
+
+const (
+	readinessPath = "/readyz"
+	// probe traffic within the ttl is served from the last check result
+	cloudConnectivityCacheTTL     = 10 * time.Second
+	cloudConnectivityCacheKey     = "cloud"
+	cloudConnectivityCheckTimeout = 10 * time.Second
+	// storage account which is not expected to exist, a single GET of it is much cheaper than listing all storage accounts
+	cloudConnectivityProbeAccount = "azurefilecsireadyzprobe"
+)
+
+// cloudConnectivityResult is the result of a cloud connectivity check, nil err means the check succeeded
+type cloudConnectivityResult struct {
+	err error
+}
+
+// serveReadiness serves /readyz on the address in background
+func (d *Driver) serveReadiness(address string) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		klog.Warningf("failed to get listener for readiness endpoint: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(readinessPath, d.readyzHandler)
+	klog.V(2).Infof("set up readiness server on %v", l.Addr().String())
+	go func() {
+		defer l.Close()
+		if err := http.Serve(l, mux); err != nil {
+			klog.Errorf("readiness server on %v failed: %v", l.Addr().String(), err)
+		}
+	}()
+}
+
+// readyzHandler returns 200 if azure resource manager is reachable with the credentials of the driver, otherwise 503
+func (d *Driver) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := d.checkCloudConnectivity(r.Context()); err != nil {
+		klog.Warningf("readiness check failed: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// checkCloudConnectivity gets properties of a probe storage account in the resource group of the driver,
+// NotFound also means azure resource manager is reachable with the credentials of the driver,
+// result is cached for cloudConnectivityCacheTTL so that probe traffic would not hammer azure resource manager
+func (d *Driver) checkCloudConnectivity(ctx context.Context) error {
+	cache, err := d.cloudConnectivityCache.Get(cloudConnectivityCacheKey, azcache.CacheReadTypeDefault)
+	if err != nil {
+		return err
+	}
+	if cache != nil {
+		return cache.(*cloudConnectivityResult).err
+	}
+
+	if d.cloud == nil || d.cloud.StorageAccountClient == nil {
+		return fmt.Errorf("cloud provider is not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cloudConnectivityCheckTimeout)
+	defer cancel()
+	result := &cloudConnectivityResult{}
+	if _, rerr := d.cloud.StorageAccountClient.GetProperties(ctx, d.cloud.SubscriptionID, d.cloud.ResourceGroup, cloudConnectivityProbeAccount); rerr != nil && rerr.HTTPStatusCode != http.StatusNotFound {
+		result.err = fmt.Errorf("failed to get storage account under resource group(%s): %v", d.cloud.ResourceGroup, rerr.Error())
+	}
+	d.cloudConnectivityCache.Set(cloudConnectivityCacheKey, result)
+	return result.err
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	probe := func(d *Driver) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		d.readyzHandler(w, httptest.NewRequest(http.MethodGet, readinessPath, nil))
+		return w
+	}
+
+	// cloud provider is not initialized
+	d := NewFakeDriver()
+	d.cloud = nil
+	w := probe(d)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "cloud provider is not initialized")
+
+	// azure resource manager is reachable, result is cached
+	d = NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	d.cloud.ResourceGroup = "rg"
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), "rg", cloudConnectivityProbeAccount).Return(storage.Account{}, &retry.Error{HTTPStatusCode: http.StatusNotFound, RawError: fmt.Errorf("ResourceNotFound")}).Times(1)
+	for i := 0; i < 3; i++ {
+		w = probe(d)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "ok", w.Body.String())
+	}
+
+	// credentials are invalid, failure is also cached
+	assert.NoError(t, d.cloudConnectivityCache.Delete(cloudConnectivityCacheKey))
+	mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), "rg", cloudConnectivityProbeAccount).Return(storage.Account{}, &retry.Error{HTTPStatusCode: http.StatusForbidden, RawError: fmt.Errorf("AuthorizationFailed")}).Times(1)
+	for i := 0; i < 3; i++ {
+		w = probe(d)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Contains(t, w.Body.String(), "failed to get storage account under resource group(rg)")
+		assert.Contains(t, w.Body.String(), "AuthorizationFailed")
+	}
+
+	// recovered after cache expiry
+	assert.NoError(t, d.cloudConnectivityCache.Delete(cloudConnectivityCacheKey))
+	mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), "rg", cloudConnectivityProbeAccount).Return(storage.Account{}, nil).Times(1)
+	w = probe(d)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
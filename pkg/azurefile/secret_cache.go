@@ -0,0 +1,115 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultSecretKeyCacheTTL  = time.Minute
+	defaultSecretKeyCacheSize = 1024
+)
+
+// secretKeyCacheEntry is the account name and key read from a k8s secret
+type secretKeyCacheEntry struct {
+	accountName string
+	accountKey  string
+	expireAt    time.Time
+}
+
+// secretKeyCache is a size bounded timed cache of account keys read from k8s secrets <secretNamespace/secretName, secretKeyCacheEntry>,
+// expired entries are evicted first when the cache is full, then the entry closest to expiry
+type secretKeyCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	entries map[string]secretKeyCacheEntry
+	// now is replaceable in unit tests
+	now func() time.Time
+}
+
+func newSecretKeyCache(ttl time.Duration, maxSize int) *secretKeyCache {
+	return &secretKeyCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[string]secretKeyCacheEntry),
+		now:     time.Now,
+	}
+}
+
+func getSecretKeyCacheKey(secretNamespace, secretName string) string {
+	return secretNamespace + "/" + secretName
+}
+
+// get returns <accountName, accountKey, found>
+func (c *secretKeyCache) get(secretNamespace, secretName string) (string, string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	key := getSecretKeyCacheKey(secretNamespace, secretName)
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", "", false
+	}
+	if !c.now().Before(entry.expireAt) {
+		delete(c.entries, key)
+		return "", "", false
+	}
+	return entry.accountName, entry.accountKey, true
+}
+
+func (c *secretKeyCache) set(secretNamespace, secretName, accountName, accountKey string) {
+	c.Lock()
+	defer c.Unlock()
+	key := getSecretKeyCacheKey(secretNamespace, secretName)
+	now := c.now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxSize {
+		var oldestKey string
+		var oldestExpireAt time.Time
+		for k, entry := range c.entries {
+			if !now.Before(entry.expireAt) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldestKey == "" || entry.expireAt.Before(oldestExpireAt) {
+				oldestKey, oldestExpireAt = k, entry.expireAt
+			}
+		}
+		if len(c.entries) >= c.maxSize {
+			delete(c.entries, oldestKey)
+		}
+	}
+	c.entries[key] = secretKeyCacheEntry{accountName: accountName, accountKey: accountKey, expireAt: now.Add(c.ttl)}
+}
+
+// deleteAccount removes all cached keys of the account, e.g. account key is rotated
+func (c *secretKeyCache) deleteAccount(accountName string) {
+	c.Lock()
+	defer c.Unlock()
+	for k, entry := range c.entries {
+		if entry.accountName == accountName {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *secretKeyCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretKeyCache(t *testing.T) {
+	now := time.Now()
+	c := newSecretKeyCache(time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	_, _, found := c.get("ns", "secret")
+	assert.False(t, found)
+
+	c.set("ns", "secret", "account", "key")
+	accountName, accountKey, found := c.get("ns", "secret")
+	assert.True(t, found)
+	assert.Equal(t, "account", accountName)
+	assert.Equal(t, "key", accountKey)
+	_, _, found = c.get("otherns", "secret")
+	assert.False(t, found, "cache is keyed by namespace and secret name")
+
+	// ttl expiry
+	now = now.Add(time.Minute)
+	_, _, found = c.get("ns", "secret")
+	assert.False(t, found)
+	assert.Equal(t, 0, c.len())
+
+	// invalidation by account name
+	c.set("ns", "secret1", "account", "key")
+	c.set("ns", "secret2", "otheraccount", "key")
+	c.deleteAccount("account")
+	_, _, found = c.get("ns", "secret1")
+	assert.False(t, found)
+	_, _, found = c.get("ns", "secret2")
+	assert.True(t, found)
+}
+
+func TestSecretKeyCacheBounded(t *testing.T) {
+	now := time.Now()
+	c := newSecretKeyCache(time.Minute, 3)
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		c.set("ns", fmt.Sprintf("secret%d", i), "account", "key")
+		now = now.Add(time.Second)
+		assert.LessOrEqual(t, c.len(), 3)
+	}
+	// entry closest to expiry is evicted
+	for i := 0; i < 7; i++ {
+		_, _, found := c.get("ns", fmt.Sprintf("secret%d", i))
+		assert.False(t, found)
+	}
+	for i := 7; i < 10; i++ {
+		_, _, found := c.get("ns", fmt.Sprintf("secret%d", i))
+		assert.True(t, found)
+	}
+
+	// updating an existing entry does not evict others
+	c.set("ns", "secret9", "account", "newkey")
+	assert.Equal(t, 3, c.len())
+
+	// expired entries are evicted first
+	now = now.Add(time.Minute)
+	c.set("ns", "secret", "account", "key")
+	assert.Equal(t, 1, c.len())
+}
+
+func TestGetStorageAccountFromSecretCache(t *testing.T) {
+	d := NewFakeDriver()
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: defaultNamespace},
+		Data: map[string][]byte{
+			defaultSecretAccountName: []byte("account"),
+			defaultSecretAccountKey:  []byte("key1"),
+		},
+	}
+	if _, err := clientSet.CoreV1().Secrets(defaultNamespace).Create(context.Background(), secret, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create secret failed with %v", err)
+	}
+	countGets := func() int {
+		count := 0
+		for _, action := range clientSet.Actions() {
+			if action.GetVerb() == "get" && action.GetResource().Resource == "secrets" {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i := 0; i < 3; i++ {
+		accountName, accountKey, err := d.GetStorageAccountFromSecret(context.Background(), "secret", defaultNamespace)
+		assert.NoError(t, err)
+		assert.Equal(t, "account", accountName)
+		assert.Equal(t, "key1", accountKey)
+	}
+	assert.Equal(t, 1, countGets(), "secret should be read from cache")
+
+	// rotated key is read from secret after cache is invalidated
+	secret.Data[defaultSecretAccountKey] = []byte("key2")
+	if _, err := clientSet.CoreV1().Secrets(defaultNamespace).Update(context.Background(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update secret failed with %v", err)
+	}
+	d.secretKeyCache.deleteAccount("account")
+	_, accountKey, err := d.GetStorageAccountFromSecret(context.Background(), "secret", defaultNamespace)
+	assert.NoError(t, err)
+	assert.Equal(t, "key2", accountKey)
+	assert.Equal(t, 2, countGets())
+
+	// not found error is not cached
+	_, _, err = d.GetStorageAccountFromSecret(context.Background(), "notfound", defaultNamespace)
+	assert.Error(t, err)
+	_, _, err = d.GetStorageAccountFromSecret(context.Background(), "notfound", defaultNamespace)
+	assert.Error(t, err)
+	assert.Equal(t, 4, countGets())
+}
+
+func TestGetStorageAccountFromSecretCacheWithoutAccountName(t *testing.T) {
+	d := NewFakeDriver()
+	clientSet := fake.NewSimpleClientset()
+	d.cloud.KubeClient = clientSet
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: defaultNamespace},
+		Data:       map[string][]byte{defaultSecretAccountKey: []byte("key")},
+	}
+	if _, err := clientSet.CoreV1().Secrets(defaultNamespace).Create(context.Background(), secret, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create secret failed with %v", err)
+	}
+
+	// account key of unknown account is not cached since it could not be evicted by account name
+	accountName, accountKey, err := d.GetStorageAccountFromSecret(context.Background(), "secret", defaultNamespace)
+	assert.NoError(t, err)
+	assert.Equal(t, "", accountName)
+	assert.Equal(t, "key", accountKey)
+	assert.Equal(t, 0, d.secretKeyCache.len())
+
+	// account name which the secret is read for is cached with the key
+	accountName, accountKey, err = d.getStorageAccountFromSecret(context.Background(), "secret", defaultNamespace, "account")
+	assert.NoError(t, err)
+	assert.Equal(t, "account", accountName)
+	assert.Equal(t, "key", accountKey)
+	assert.Equal(t, 1, d.secretKeyCache.len())
+	d.secretKeyCache.deleteAccount("account")
+	assert.Equal(t, 0, d.secretKeyCache.len())
+}
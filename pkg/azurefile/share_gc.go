@@ -0,0 +1,245 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	// key of the driver name in file share metadata, only file shares with this fingerprint are reclaimed by share gc
+	createdByMetadataKey = "createdby"
+	// key of the cluster id in file share metadata, clusters sharing one storage account only reclaim their own file shares
+	clusterIDMetadataKey = "clusterid"
+	// key of the marker in file share metadata recorded when the volume of a retained file share is deleted
+	retainedMetadataKey = "retained"
+	// namespace whose uid is used as cluster id when cluster-id is not set
+	clusterIDNamespace = "kube-system"
+
+	defaultShareGCInterval    = time.Hour
+	defaultShareGCGracePeriod = 24 * time.Hour
+)
+
+// shareGCAccount is the location of a storage account selected by this driver
+type shareGCAccount struct {
+	subsID        string
+	resourceGroup string
+}
+
+// trackShareGCAccount records the location of a storage account selected by this driver so that share gc could list its file shares
+func (d *Driver) trackShareGCAccount(accountName, subsID, resourceGroup string) {
+	if d.enableShareGC {
+		d.shareGCAccountMap.Store(accountName, shareGCAccount{subsID: subsID, resourceGroup: resourceGroup})
+	}
+}
+
+// resolveShareGCClusterID sets the cluster id used to fingerprint file shares, share gc is disabled if it could not be determined
+func (d *Driver) resolveShareGCClusterID(ctx context.Context) {
+	if !d.enableShareGC || d.clusterID != "" {
+		return
+	}
+	if d.cloud == nil || d.cloud.KubeClient == nil {
+		klog.Warningf("disable share gc since cluster-id is not set and KubeClient is nil")
+		d.enableShareGC = false
+		return
+	}
+	ns, err := d.cloud.KubeClient.CoreV1().Namespaces().Get(ctx, clusterIDNamespace, metav1.GetOptions{})
+	if err != nil || ns.UID == "" {
+		klog.Warningf("disable share gc since cluster-id is not set and getting uid of namespace(%s) failed with %v", clusterIDNamespace, err)
+		d.enableShareGC = false
+		return
+	}
+	d.clusterID = string(ns.UID)
+	klog.V(2).Infof("use uid of namespace(%s) as cluster id: %s", clusterIDNamespace, d.clusterID)
+}
+
+// getLiveShareKey returns the key of a file share in live shares, accountName could be empty if it's unknown
+func getLiveShareKey(accountName, shareName string) string {
+	return strings.ToLower(accountName + "/" + shareName)
+}
+
+// isLiveShare returns true if the file share is referenced by any persistent volume
+func isLiveShare(liveShares map[string]bool, accountName, shareName string) bool {
+	return liveShares[getLiveShareKey(accountName, shareName)] || liveShares[getLiveShareKey("", shareName)]
+}
+
+// getLiveShares returns all file shares <account/share> referenced by persistent volumes of this driver,
+// file share referenced with an unknown account is returned as </share> so that it's regarded as live on any account
+func (d *Driver) getLiveShares(ctx context.Context) (map[string]bool, error) {
+	pvs, err := d.cloud.KubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	liveShares := make(map[string]bool)
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != d.Name {
+			continue
+		}
+		var accountName, fileShareName string
+		for k, v := range pv.Spec.CSI.VolumeAttributes {
+			switch strings.ToLower(k) {
+			case shareNameField:
+				fileShareName = v
+			case storageAccountField:
+				accountName = v
+			}
+		}
+		_, handleAccountName, handleShareName, _, _, _, err := GetFileShareInfo(pv.Spec.CSI.VolumeHandle) //nolint:dogsled
+		if err == nil {
+			liveShares[getLiveShareKey(handleAccountName, handleShareName)] = true
+			if accountName == "" {
+				accountName = handleAccountName
+			}
+		}
+		if fileShareName == "" {
+			if err != nil {
+				// fail closed: the share referenced by this persistent volume is unknown
+				return nil, fmt.Errorf("could not resolve file share of persistent volume(%s): %v", pv.Name, err)
+			}
+			continue
+		}
+		liveShares[getLiveShareKey(accountName, fileShareName)] = true
+	}
+	return liveShares, nil
+}
+
+// isOrphanedShare returns true if the file share is created by this driver in this cluster, not retained,
+// not referenced by any persistent volume and has been observed as orphaned for the grace period
+func (d *Driver) isOrphanedShare(accountName, shareName string, properties *storage.FileShareProperties, liveShares map[string]bool, now time.Time) bool {
+	key := getLiveShareKey(accountName, shareName)
+	if properties == nil || properties.SnapshotTime != nil || pointer.BoolDeref(properties.Deleted, false) {
+		return false
+	}
+	if isLiveShare(liveShares, accountName, shareName) {
+		d.shareGCOrphanedMap.Delete(key)
+		return false
+	}
+	var createdBy, clusterID, retainSharePolicy string
+	for k, v := range properties.Metadata {
+		switch strings.ToLower(k) {
+		case retainedMetadataKey:
+			return false
+		case createdByMetadataKey:
+			createdBy = pointer.StringDeref(v, "")
+		case clusterIDMetadataKey:
+			clusterID = pointer.StringDeref(v, "")
+		case retainSharePolicyKey:
+			retainSharePolicy = pointer.StringDeref(v, "")
+		}
+	}
+	if createdBy != d.Name || d.clusterID == "" || clusterID != d.clusterID || strings.EqualFold(retainSharePolicy, retainSharePolicyRetain) {
+		return false
+	}
+	// grace period starts when the share is first observed as orphaned, last modified time is not updated by file writes
+	v, _ := d.shareGCOrphanedMap.LoadOrStore(key, now)
+	return now.Sub(v.(time.Time)) >= d.shareGCGracePeriod
+}
+
+// markShareRetained removes the share gc fingerprint from the metadata of a retained file share and records the retained marker
+func (d *Driver) markShareRetained(ctx context.Context, volumeID, accountName, fileShareName, secretNamespace string, secrets, metadata map[string]string) error {
+	var accountKey string
+	var err error
+	if len(secrets) > 0 {
+		_, accountKey, err = getStorageAccount(secrets)
+	} else {
+		reqContext := map[string]string{}
+		if secretNamespace != "" {
+			setKeyValueInMap(reqContext, secretNamespaceField, secretNamespace)
+		}
+		_, _, accountKey, _, _, _, err = d.GetAccountInfo(ctx, volumeID, nil, reqContext)
+	}
+	if err != nil {
+		return err
+	}
+	newMetadata := map[string]string{retainedMetadataKey: trueValue}
+	for k, v := range metadata {
+		if k != createdByMetadataKey && k != clusterIDMetadataKey {
+			newMetadata[k] = v
+		}
+	}
+	return d.fileClient.setFileShareMetadata(accountName, accountKey, fileShareName, newMetadata)
+}
+
+// gcOrphanedShares deletes file shares whose persistent volumes no longer exist on storage accounts selected by this driver
+func (d *Driver) gcOrphanedShares() {
+	ctx := context.Background()
+	if d.cloud == nil || d.cloud.KubeClient == nil || d.cloud.FileClient == nil {
+		klog.V(4).Infof("skip share gc since KubeClient or FileClient is nil")
+		return
+	}
+	// list persistent volumes before file shares so that a share created in between would not be regarded as orphaned
+	liveShares, err := d.getLiveShares(ctx)
+	if err != nil {
+		klog.Warningf("skip share gc since listing persistent volumes failed with %v", err)
+		return
+	}
+
+	accounts := make(map[string]bool)
+	d.volMap.Range(func(_, value interface{}) bool {
+		accounts[value.(string)] = true
+		return true
+	})
+	for accountName := range accounts {
+		subsID, resourceGroup := d.cloud.SubscriptionID, d.cloud.ResourceGroup
+		if v, ok := d.shareGCAccountMap.Load(accountName); ok {
+			account := v.(shareGCAccount)
+			subsID, resourceGroup = account.subsID, account.resourceGroup
+		}
+		shares, err := d.cloud.FileClient.WithSubscriptionID(subsID).ListFileShare(ctx, resourceGroup, accountName, "", "")
+		if err != nil {
+			klog.Warningf("share gc: list file shares on account(%s) rg(%s) failed with %v", accountName, resourceGroup, err)
+			d.sleepIfAccountOpThrottled(err)
+			continue
+		}
+		now := time.Now()
+		for _, share := range shares {
+			shareName := pointer.StringDeref(share.Name, "")
+			if shareName == "" {
+				continue
+			}
+			if isLiveShare(liveShares, accountName, shareName) {
+				d.shareGCOrphanedMap.Delete(getLiveShareKey(accountName, shareName))
+				continue
+			}
+			// metadata is not returned by listing file shares
+			fileShare, err := d.cloud.FileClient.WithSubscriptionID(subsID).GetFileShare(ctx, resourceGroup, accountName, shareName, "")
+			if err != nil {
+				klog.Warningf("share gc: get file share(%s) on account(%s) failed with %v", shareName, accountName, err)
+				d.sleepIfFileOpThrottled(err)
+				continue
+			}
+			if !d.isOrphanedShare(accountName, shareName, fileShare.FileShareProperties, liveShares, now) {
+				continue
+			}
+			klog.V(2).Infof("share gc: deleting orphaned file share(%s) on account(%s) rg(%s)", shareName, accountName, resourceGroup)
+			if err := d.DeleteFileShare(ctx, subsID, resourceGroup, accountName, shareName, nil); err != nil {
+				klog.Warningf("share gc: delete file share(%s) on account(%s) failed with %v", shareName, accountName, err)
+				d.sleepIfFileOpThrottled(err)
+				continue
+			}
+			d.shareGCOrphanedMap.Delete(getLiveShareKey(accountName, shareName))
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2021-09-01/storage"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
+)
+
+func newFakePV(name, driver, volumeHandle string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeHandle},
+			},
+		},
+	}
+}
+
+func TestResolveShareGCClusterID(t *testing.T) {
+	d := NewFakeDriverCustomOptions(DriverOptions{EnableShareGC: true, ClusterID: "cluster"})
+	d.resolveShareGCClusterID(context.Background())
+	assert.True(t, d.enableShareGC)
+	assert.Equal(t, "cluster", d.clusterID)
+
+	d = NewFakeDriverCustomOptions(DriverOptions{EnableShareGC: true})
+	d.cloud.KubeClient = fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: clusterIDNamespace, UID: "uid"}})
+	d.resolveShareGCClusterID(context.Background())
+	assert.True(t, d.enableShareGC)
+	assert.Equal(t, "uid", d.clusterID)
+
+	// share gc is disabled if cluster id could not be determined
+	d = NewFakeDriverCustomOptions(DriverOptions{EnableShareGC: true})
+	d.cloud.KubeClient = fake.NewSimpleClientset()
+	d.resolveShareGCClusterID(context.Background())
+	assert.False(t, d.enableShareGC)
+	assert.Equal(t, "", d.clusterID)
+}
+
+func TestGetLiveShares(t *testing.T) {
+	d := NewFakeDriver()
+	staticPV := newFakePV("pv-static", d.Name, "unique-volume-id")
+	staticPV.Spec.CSI.VolumeAttributes = map[string]string{"shareName": "staticshare", "storageAccount": "staticaccount"}
+	secretPV := newFakePV("pv-secret", d.Name, "another-unique-volume-id")
+	secretPV.Spec.CSI.VolumeAttributes = map[string]string{"shareName": "secretshare"}
+	d.cloud.KubeClient = fake.NewSimpleClientset(
+		newFakePV("pv-live", d.Name, "rg#account#liveshare#"),
+		newFakePV("pv-other-driver", "other.csi.azure.com", "invalid"),
+		staticPV,
+		secretPV,
+	)
+	liveShares, err := d.getLiveShares(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, isLiveShare(liveShares, "account", "liveshare"))
+	assert.True(t, isLiveShare(liveShares, "staticaccount", "staticshare"))
+	assert.False(t, isLiveShare(liveShares, "account", "staticshare"))
+	// account of the share is unknown, so the share is live on any account
+	assert.True(t, isLiveShare(liveShares, "account", "secretshare"))
+	assert.False(t, isLiveShare(liveShares, "account", "orphanshare"))
+
+	// persistent volume which could not be resolved fails the whole listing
+	d.cloud.KubeClient = fake.NewSimpleClientset(newFakePV("pv-invalid", d.Name, "invalid"))
+	_, err = d.getLiveShares(context.Background())
+	assert.Error(t, err)
+}
+
+func TestIsOrphanedShare(t *testing.T) {
+	d := NewFakeDriverCustomOptions(DriverOptions{EnableShareGC: true, ShareGCGracePeriod: time.Hour, ClusterID: "cluster"})
+	now := time.Now()
+	oldTime := &date.Time{Time: now.Add(-2 * time.Hour)}
+	fingerprint := map[string]*string{createdByMetadataKey: pointer.String(d.Name), clusterIDMetadataKey: pointer.String("cluster")}
+	liveShares := map[string]bool{"account/liveshare": true}
+	// share observed as orphaned for more than the grace period
+	d.shareGCOrphanedMap.Store("account/share", now.Add(-2*time.Hour))
+
+	tests := []struct {
+		desc       string
+		shareName  string
+		properties *storage.FileShareProperties
+		expected   bool
+	}{
+		{
+			desc:      "nil properties",
+			shareName: "share",
+			expected:  false,
+		},
+		{
+			desc:       "share is referenced by persistent volume",
+			shareName:  "LiveShare",
+			properties: &storage.FileShareProperties{Metadata: fingerprint, LastModifiedTime: oldTime},
+			expected:   false,
+		},
+		{
+			desc:       "share without fingerprint",
+			shareName:  "share",
+			properties: &storage.FileShareProperties{LastModifiedTime: oldTime},
+			expected:   false,
+		},
+		{
+			desc:       "share created by other driver",
+			shareName:  "share",
+			properties: &storage.FileShareProperties{Metadata: map[string]*string{createdByMetadataKey: pointer.String("other.csi.azure.com")}, LastModifiedTime: oldTime},
+			expected:   false,
+		},
+		{
+			desc:       "share created in other cluster",
+			shareName:  "share",
+			properties: &storage.FileShareProperties{Metadata: map[string]*string{createdByMetadataKey: pointer.String(d.Name), clusterIDMetadataKey: pointer.String("other")}, LastModifiedTime: oldTime},
+			expected:   false,
+		},
+		{
+			desc:       "share without cluster id",
+			shareName:  "share",
+			properties: &storage.FileShareProperties{Metadata: map[string]*string{createdByMetadataKey: pointer.String(d.Name)}, LastModifiedTime: oldTime},
+			expected:   false,
+		},
+		{
+			desc:      "retained share",
+			shareName: "share",
+			properties: &storage.FileShareProperties{Metadata: map[string]*string{
+				createdByMetadataKey: pointer.String(d.Name), clusterIDMetadataKey: pointer.String("cluster"), retainSharePolicyKey: pointer.String(retainSharePolicyRetain),
+			}, LastModifiedTime: oldTime},
+			expected: false,
+		},
+		{
+			desc:      "share marked retained",
+			shareName: "share",
+			properties: &storage.FileShareProperties{Metadata: map[string]*string{
+				createdByMetadataKey: pointer.String(d.Name), clusterIDMetadataKey: pointer.String("cluster"), retainedMetadataKey: pointer.String(trueValue),
+			}, LastModifiedTime: oldTime},
+			expected: false,
+		},
+		{
+			desc:       "share first observed as orphaned",
+			shareName:  "newshare",
+			properties: &storage.FileShareProperties{Metadata: fingerprint, LastModifiedTime: oldTime},
+			expected:   false,
+		},
+		{
+			desc:       "share snapshot",
+			shareName:  "share",
+			properties: &storage.FileShareProperties{Metadata: fingerprint, LastModifiedTime: oldTime, SnapshotTime: oldTime},
+			expected:   false,
+		},
+		{
+			desc:       "orphaned share",
+			shareName:  "share",
+			properties: &storage.FileShareProperties{Metadata: map[string]*string{"CreatedBy": pointer.String(d.Name), "ClusterID": pointer.String("cluster")}, LastModifiedTime: oldTime},
+			expected:   true,
+		},
+	}
+
+	for _, test := range tests {
+		result := d.isOrphanedShare("account", test.shareName, test.properties, liveShares, now)
+		assert.Equal(t, test.expected, result, test.desc)
+	}
+}
+
+func TestGCOrphanedShares(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := NewFakeDriverCustomOptions(DriverOptions{EnableShareGC: true, ShareGCGracePeriod: time.Hour, ClusterID: "cluster"})
+	d.cloud.KubeClient = fake.NewSimpleClientset(
+		newFakePV("pv-live", d.Name, "rg#account#liveshare#"),
+		newFakePV("pv-other-driver", "other.csi.azure.com", "rg#account#orphanshare#"),
+	)
+	mockFileClient := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClient
+	d.volMap.Store("vol-1", "account")
+	d.trackShareGCAccount("account", "subsID", "rg")
+
+	oldTime := &date.Time{Time: time.Now().Add(-2 * time.Hour)}
+	fingerprint := map[string]*string{createdByMetadataKey: pointer.String(d.Name), clusterIDMetadataKey: pointer.String("cluster")}
+	shares := map[string]storage.FileShare{
+		"orphanshare": {FileShareProperties: &storage.FileShareProperties{Metadata: fingerprint, LastModifiedTime: oldTime}},
+		"usershare":   {FileShareProperties: &storage.FileShareProperties{LastModifiedTime: oldTime}},
+		"recentshare": {FileShareProperties: &storage.FileShareProperties{Metadata: fingerprint, LastModifiedTime: oldTime}},
+	}
+	d.shareGCOrphanedMap.Store("account/orphanshare", time.Now().Add(-2*time.Hour))
+	d.shareGCOrphanedMap.Store("account/liveshare", time.Now().Add(-2*time.Hour))
+	shareItems := []storage.FileShareItem{{Name: pointer.String("liveshare")}}
+	for name := range shares {
+		shareItems = append(shareItems, storage.FileShareItem{Name: pointer.String(name)})
+	}
+
+	mockFileClient.EXPECT().WithSubscriptionID("subsID").Return(mockFileClient).AnyTimes()
+	mockFileClient.EXPECT().ListFileShare(gomock.Any(), "rg", "account", "", "").Return(shareItems, nil).Times(1)
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), "rg", "account", gomock.Any(), "").DoAndReturn(
+		func(_ context.Context, _, _, name, _ string) (storage.FileShare, error) {
+			return shares[name], nil
+		}).Times(len(shares))
+	// only the orphaned share with fingerprint is deleted
+	mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), "rg", "account", "orphanshare", "").Return(nil).Times(1)
+
+	d.gcOrphanedShares()
+
+	_, ok := d.shareGCOrphanedMap.Load("account/orphanshare")
+	assert.False(t, ok)
+	_, ok = d.shareGCOrphanedMap.Load("account/liveshare")
+	assert.False(t, ok)
+	_, ok = d.shareGCOrphanedMap.Load("account/recentshare")
+	assert.True(t, ok)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultShareSnapshotRateLimitCacheSize = 4096
+
+// shareSnapshotRateLimitCache is a size bounded timed cache of shares with snapshot created recently <account/share, expireAt>,
+// expired entries are evicted first when the cache is full, then the entry closest to expiry,
+// the cache is disabled when ttl is not positive
+type shareSnapshotRateLimitCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	entries map[string]time.Time
+	// now is replaceable in unit tests
+	now func() time.Time
+}
+
+func newShareSnapshotRateLimitCache(ttl time.Duration, maxSize int) *shareSnapshotRateLimitCache {
+	return &shareSnapshotRateLimitCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// limited returns true if a snapshot of the share was created within ttl
+func (c *shareSnapshotRateLimitCache) limited(key string) bool {
+	if c.ttl <= 0 {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	expireAt, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if !c.now().Before(expireAt) {
+		delete(c.entries, key)
+		return false
+	}
+	return true
+}
+
+func (c *shareSnapshotRateLimitCache) set(key string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxSize {
+		var oldestKey string
+		var oldestExpireAt time.Time
+		for k, expireAt := range c.entries {
+			if !now.Before(expireAt) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldestKey == "" || expireAt.Before(oldestExpireAt) {
+				oldestKey, oldestExpireAt = k, expireAt
+			}
+		}
+		if len(c.entries) >= c.maxSize {
+			delete(c.entries, oldestKey)
+		}
+	}
+	c.entries[key] = now.Add(c.ttl)
+}
+
+func (c *shareSnapshotRateLimitCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.entries)
+}
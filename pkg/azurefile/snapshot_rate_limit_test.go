@@ -0,0 +1,72 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareSnapshotRateLimitCache(t *testing.T) {
+	now := time.Now()
+	c := newShareSnapshotRateLimitCache(time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	assert.False(t, c.limited("account/share"))
+	c.set("account/share")
+	assert.True(t, c.limited("account/share"))
+	assert.False(t, c.limited("account/othershare"))
+
+	// ttl expiry
+	now = now.Add(time.Minute)
+	assert.False(t, c.limited("account/share"))
+	assert.Equal(t, 0, c.len())
+}
+
+func TestShareSnapshotRateLimitCacheDisabled(t *testing.T) {
+	c := newShareSnapshotRateLimitCache(0, 2)
+	c.set("account/share")
+	assert.False(t, c.limited("account/share"))
+	assert.Equal(t, 0, c.len())
+}
+
+func TestShareSnapshotRateLimitCacheBounded(t *testing.T) {
+	now := time.Now()
+	c := newShareSnapshotRateLimitCache(time.Minute, 3)
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		c.set(fmt.Sprintf("account/share%d", i))
+		now = now.Add(time.Second)
+		assert.LessOrEqual(t, c.len(), 3)
+	}
+	// entry closest to expiry is evicted
+	for i := 0; i < 7; i++ {
+		assert.False(t, c.limited(fmt.Sprintf("account/share%d", i)))
+	}
+	for i := 7; i < 10; i++ {
+		assert.True(t, c.limited(fmt.Sprintf("account/share%d", i)))
+	}
+
+	// expired entries are evicted first
+	now = now.Add(time.Minute)
+	c.set("account/share")
+	assert.Equal(t, 1, c.len())
+}
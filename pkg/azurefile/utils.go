@@ -17,23 +17,44 @@ limitations under the License.
 package azurefile
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Azure/azure-storage-file-go/azfile"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume"
+	"k8s.io/utils/pointer"
 )
 
 const (
-	tagsDelimiter        = ","
-	tagKeyValueDelimiter = "="
+	tagsDelimiter          = ","
+	tagsSemicolonDelimiter = ";"
+	tagKeyValueDelimiter   = "="
+	// limits of tag on azure resource, see https://learn.microsoft.com/en-us/azure/azure-resource-manager/management/tag-resources#limitations
+	maxTagKeyLength    = 512
+	maxTagValueLength  = 256
+	tagKeyInvalidChars = `<>%&\?/`
 )
 
+// subscription ID must be a GUID, e.g. 00000000-0000-0000-0000-000000000000
+var subscriptionIDRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// share metadata name must be a valid C# identifier
+var shareMetadataKeyRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 // lockMap used to lock on entries
 type lockMap struct {
 	sync.Mutex
@@ -82,6 +103,42 @@ func (lm *lockMap) unlockEntry(entry string) {
 	lm.mutexMap[entry].Unlock()
 }
 
+// operationLimiter limits the number of concurrent operations, nil operationLimiter means no limit
+type operationLimiter struct {
+	slots chan struct{}
+}
+
+// newOperationLimiter returns nil if limit is not positive
+func newOperationLimiter(limit int) *operationLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &operationLimiter{
+		slots: make(chan struct{}, limit),
+	}
+}
+
+// Acquire blocks until an operation slot is available or ctx is done
+func (l *operationLimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release releases an operation slot acquired by Acquire
+func (l *operationLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
 func isDiskFsType(fsType string) bool {
 	for _, v := range supportedDiskFsTypeList {
 		if fsType == v {
@@ -111,6 +168,28 @@ func isSupportedShareNamePrefix(prefix string) bool {
 	return true
 }
 
+// Storage account names can contain only lowercase letters and numbers, a random suffix is appended to the prefix
+// in generated account name, so the prefix length is limited to leave enough random characters
+func isSupportedAccountNamePrefix(prefix string) bool {
+	if prefix == "" || len(prefix) > maxAccountNamePrefixLength {
+		return false
+	}
+	for _, v := range prefix {
+		if (v < '0' || v > '9') && (v < 'a' || v > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// storage endpoint suffix is the host name after "<account>.file.", e.g. core.windows.net, local.azurestack.external
+func isSupportedStorageEndpointSuffix(suffix string) bool {
+	if suffix == "" {
+		return true
+	}
+	return strings.Contains(suffix, ".") && len(validation.IsDNS1123Subdomain(strings.ToLower(suffix))) == 0
+}
+
 func isSupportedFsType(fsType string) bool {
 	if fsType == "" {
 		return true
@@ -123,7 +202,15 @@ func isSupportedFsType(fsType string) bool {
 	return false
 }
 
+func isValidSubscriptionID(subsID string) bool {
+	return subscriptionIDRegex.MatchString(subsID)
+}
+
 func isRetriableError(err error) bool {
+	if isPolicyDeniedError(err) {
+		// retrying would not help until the policy assignment is changed
+		return false
+	}
 	if err != nil {
 		for _, v := range retriableErrors {
 			if strings.Contains(strings.ToLower(err.Error()), strings.ToLower(v)) {
@@ -134,13 +221,80 @@ func isRetriableError(err error) bool {
 	return false
 }
 
-func sleepIfThrottled(err error, sleepSec int) {
-	if strings.Contains(strings.ToLower(err.Error()), strings.ToLower(tooManyRequests)) || strings.Contains(strings.ToLower(err.Error()), clientThrottled) {
-		klog.Warningf("sleep %d more seconds, waiting for throttling complete", sleepSec)
-		time.Sleep(time.Duration(sleepSec) * time.Second)
+// isPolicyDeniedError returns true if the request is denied by Azure Policy
+func isPolicyDeniedError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), strings.ToLower(requestDisallowedByPolicy))
+}
+
+// isShareBeingDeletedError returns true if the share with the same name is being deleted
+func isShareBeingDeletedError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), strings.ToLower(shareBeingDeleted))
+}
+
+// isNotFoundError returns true if the file share or storage account is not found
+func isNotFoundError(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), statusCodeNotFound) ||
+		strings.Contains(err.Error(), httpCodeNotFound) ||
+		strings.Contains(err.Error(), fileShareNotFound))
+}
+
+// isSnapshotRateExceededError returns true if snapshots of a share are created too frequently
+func isSnapshotRateExceededError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), strings.ToLower(snapshotOperationRateExceeded))
+}
+
+// isThrottlingError returns true if the request is throttled by storage account or client side rate limiter
+func isThrottlingError(err error) bool {
+	return err != nil && (strings.Contains(strings.ToLower(err.Error()), strings.ToLower(tooManyRequests)) || strings.Contains(strings.ToLower(err.Error()), clientThrottled))
+}
+
+// isMountAuthError returns true if the mount failure is caused by a wrong account key, e.g. the key is rotated
+func isMountAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, v := range []string{mountPermissionDenied, mountAccessDenied, mountLogonFailure} {
+		if strings.Contains(strings.ToLower(err.Error()), strings.ToLower(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// throttlingSleep is replaceable in unit tests to avoid sleeping on throttled paths
+var throttlingSleep = time.Sleep
+
+// isAccountKeyInvalidError returns true if the account key is malformed or rejected by data plane API
+func isAccountKeyInvalidError(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "error creating azure client") || strings.Contains(err.Error(), authenticationFailed))
+}
+
+// sleepIfThrottled sleeps around sleepSec seconds with random jitter if err is a throttling error,
+// level is the throttling level(account or file) recorded in metrics
+func sleepIfThrottled(err error, level string, sleepSec int) {
+	if isThrottlingError(err) {
+		throttlingCount.WithLabelValues(level).Inc()
+		sleepDuration := getJitteredDuration(time.Duration(sleepSec)*time.Second, throttlingSleepJitter)
+		klog.Warningf("sleep %v more, waiting for throttling complete", sleepDuration)
+		throttlingSleep(sleepDuration)
 	}
 }
 
+// sleepIfAccountOpThrottled sleeps if storage account operation is throttled
+func (d *Driver) sleepIfAccountOpThrottled(err error) {
+	sleepIfThrottled(err, throttlingLevelAccount, d.accountOpThrottlingSleepSec)
+}
+
+// sleepIfFileOpThrottled sleeps if file share operation is throttled
+func (d *Driver) sleepIfFileOpThrottled(err error) {
+	sleepIfThrottled(err, throttlingLevelFile, d.fileOpThrottlingSleepSec)
+}
+
+// getJitteredDuration returns a random duration in [base*(1-jitter), base*(1+jitter)]
+func getJitteredDuration(base time.Duration, jitter float64) time.Duration {
+	return base + time.Duration((rand.Float64()*2-1)*jitter*float64(base))
+}
+
 func useDataPlaneAPI(volContext map[string]string) bool {
 	useDataPlaneAPI := false
 	for k, v := range volContext {
@@ -159,12 +313,30 @@ func createStorageAccountSecret(account, key string) map[string]string {
 	return secret
 }
 
+// ConvertTagsToMap parses tags in 'key1=value1,key2=value2' ('key1=value1;key2=value2') or JSON object('{"key1":"value1"}') format,
+// tags are validated against the limits of azure resource tags so that malformed tags are rejected before any azure call
 func ConvertTagsToMap(tags string) (map[string]string, error) {
 	m := make(map[string]string)
 	if tags == "" {
 		return m, nil
 	}
-	s := strings.Split(tags, tagsDelimiter)
+	if strings.HasPrefix(strings.TrimSpace(tags), "{") {
+		var jsonTags map[string]string
+		if err := json.Unmarshal([]byte(tags), &jsonTags); err != nil {
+			return nil, fmt.Errorf("Tags '%s' are invalid JSON object: %v", tags, err)
+		}
+		for k, v := range jsonTags {
+			key := strings.TrimSpace(k)
+			if key == "" {
+				return nil, fmt.Errorf("Tags '%s' are invalid, tag key should not be empty", tags)
+			}
+			if err := addTag(m, key, strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("Tags '%s' are invalid, %v", tags, err)
+			}
+		}
+		return m, nil
+	}
+	s := strings.Split(strings.ReplaceAll(tags, tagsSemicolonDelimiter, tagsDelimiter), tagsDelimiter)
 	for _, tag := range s {
 		kv := strings.Split(tag, tagKeyValueDelimiter)
 		if len(kv) != 2 {
@@ -174,12 +346,102 @@ func ConvertTagsToMap(tags string) (map[string]string, error) {
 		if key == "" {
 			return nil, fmt.Errorf("Tags '%s' are invalid, the format should like: 'key1=value1,key2=value2'", tags)
 		}
-		value := strings.TrimSpace(kv[1])
-		m[key] = value
+		if err := addTag(m, key, strings.TrimSpace(kv[1])); err != nil {
+			return nil, fmt.Errorf("Tags '%s' are invalid, %v", tags, err)
+		}
 	}
 	return m, nil
 }
 
+// addTag adds a tag to m after validating it, tag keys are case insensitive on azure resources
+func addTag(m map[string]string, key, value string) error {
+	if len(key) > maxTagKeyLength {
+		return fmt.Errorf("length of tag key(%s) should not exceed %d", key, maxTagKeyLength)
+	}
+	if strings.ContainsAny(key, tagKeyInvalidChars) {
+		return fmt.Errorf("tag key(%s) should not contain any of %s", key, tagKeyInvalidChars)
+	}
+	if len(value) > maxTagValueLength {
+		return fmt.Errorf("length of tag(%s) value should not exceed %d", key, maxTagValueLength)
+	}
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			return fmt.Errorf("tag key(%s) is duplicated", key)
+		}
+	}
+	m[key] = value
+	return nil
+}
+
+// reservedShareMetadataKeys are file share metadata keys interpreted by the driver, which could not be set by tags
+var reservedShareMetadataKeys = []string{
+	snapshotNameKey,
+	maxShareQuotaKey,
+	retainSharePolicyKey,
+	retainedMetadataKey,
+	deleteAccountWhenEmptyKey,
+	createdByMetadataKey,
+	clusterIDMetadataKey,
+	ephemeralVolumeMetadataKey,
+	metaDataNode,
+}
+
+// isReservedShareMetadataKey returns true if key is a file share metadata key interpreted by the driver
+func isReservedShareMetadataKey(key string) bool {
+	for _, k := range reservedShareMetadataKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// convertTagsToShareMetadata converts tags to file share metadata,
+// tags which are not valid metadata names or conflict with metadata used by the driver are skipped
+func convertTagsToShareMetadata(tags map[string]string) azfile.Metadata {
+	metadata := azfile.Metadata{}
+	for k, v := range tags {
+		key := strings.ToLower(k)
+		if !shareMetadataKeyRegex.MatchString(key) {
+			klog.Warningf("skip tag(%s) in share metadata since it's not a valid metadata name", k)
+			continue
+		}
+		if isReservedShareMetadataKey(key) {
+			klog.Warningf("skip tag(%s) in share metadata since it's reserved by the driver", k)
+			continue
+		}
+		metadata[key] = v
+	}
+	return metadata
+}
+
+// isTagsMatched returns true if tags contain all key/value pairs in requiredTags, tag keys are case insensitive
+func isTagsMatched(tags map[string]*string, requiredTags map[string]string) bool {
+	for k, v := range requiredTags {
+		matched := false
+		for key, value := range tags {
+			if strings.EqualFold(key, k) && pointer.StringDeref(value, "") == v {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// formatTags returns tags in 'key1=value1,key2=value2' format sorted by key
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+tagKeyValueDelimiter+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, tagsDelimiter)
+}
+
 type VolumeMounter struct {
 	path       string
 	attributes volume.Attributes
@@ -241,6 +503,63 @@ func SetVolumeOwnership(path, gid, policy string) error {
 	return volume.SetVolumeOwnership(&VolumeMounter{path: path}, path, &gidInt64, &fsGroupChangePolicy, nil)
 }
 
+// isValidInitMarker checks whether initMarker is a relative path under volume root,
+// initMarker ending with "/" is a directory, otherwise it's a file
+func isValidInitMarker(marker string) bool {
+	if marker == "" {
+		return true
+	}
+	if strings.HasPrefix(marker, "/") || strings.HasPrefix(marker, "\\") || filepath.IsAbs(marker) || filepath.VolumeName(marker) != "" {
+		return false
+	}
+	for _, elem := range strings.FieldsFunc(marker, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return strings.Trim(marker, "/\\") != ""
+}
+
+// createInitMarker creates initMarker under mountPath only if the volume is empty, e.g. on the first mount of a newly created file share,
+// so the marker is created only once and never recreated after the volume is used
+func createInitMarker(mountPath, marker string) error {
+	// read directory entries one by one instead of listing the whole volume root, which could be huge on a used volume
+	dir, err := os.Open(mountPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		names, err := dir.Readdirnames(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// lost+found is created by mkfs on disk volume
+		if names[0] != "lost+found" {
+			klog.V(4).Infof("skip creating init marker(%s) since %s is not empty", marker, mountPath)
+			return nil
+		}
+	}
+
+	markerPath := filepath.Join(mountPath, filepath.FromSlash(strings.TrimRight(marker, "/")))
+	if strings.HasSuffix(marker, "/") {
+		klog.V(2).Infof("creating init marker directory %s", markerPath)
+		return os.MkdirAll(markerPath, 0777)
+	}
+	if err := os.MkdirAll(filepath.Dir(markerPath), 0777); err != nil {
+		return err
+	}
+	klog.V(2).Infof("creating init marker file %s", markerPath)
+	f, err := os.OpenFile(markerPath, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 // setKeyValueInMap set key/value pair in map
 // key in the map is case insensitive, if key already exists, overwrite existing value
 func setKeyValueInMap(m map[string]string, key, value string) {
@@ -256,6 +575,20 @@ func setKeyValueInMap(m map[string]string, key, value string) {
 	m[key] = value
 }
 
+// getValueInMap get value from map by key
+// key in the map is case insensitive
+func getValueInMap(m map[string]string, key string) string {
+	if m == nil {
+		return ""
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
 // replaceWithMap replace key with value for str
 func replaceWithMap(str string, m map[string]string) string {
 	for k, v := range m {
@@ -265,3 +598,9 @@ func replaceWithMap(str string, m map[string]string) string {
 	}
 	return str
 }
+
+// normalizeAccountKey removes all whitespaces in account key, e.g. trailing newline or line breaks added by secret injectors,
+// whitespace is never part of a base64 encoded account key
+func normalizeAccountKey(key string) string {
+	return strings.Join(strings.Fields(key), "")
+}
@@ -17,15 +17,20 @@ limitations under the License.
 package azurefile
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-storage-file-go/azfile"
+	"github.com/stretchr/testify/assert"
 	utiltesting "k8s.io/client-go/util/testing"
+	"k8s.io/utils/pointer"
 )
 
 func TestSimpleLockEntry(t *testing.T) {
@@ -100,6 +105,45 @@ func TestUnlockEntryNotExists(t *testing.T) {
 	testLockMap.UnlockEntry("entry1")
 }
 
+func TestOperationLimiter(t *testing.T) {
+	// nil limiter means no limit
+	var unlimited *operationLimiter
+	for i := 0; i < 10; i++ {
+		if err := unlimited.Acquire(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	unlimited.Release()
+	if newOperationLimiter(0) != nil || newOperationLimiter(-1) != nil {
+		t.Errorf("limiter should be nil when limit is not positive")
+	}
+
+	limiter := newOperationLimiter(2)
+	for i := 0; i < 2; i++ {
+		if err := limiter.Acquire(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded when all slots are in use, got %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		if err := limiter.Acquire(context.Background()); err == nil {
+			close(acquired)
+		}
+	}()
+	limiter.Release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Errorf("slot is not acquired after release")
+	}
+}
+
 func TestIsDiskFsType(t *testing.T) {
 	tests := []struct {
 		fsType         string
@@ -143,6 +187,31 @@ func TestIsDiskFsType(t *testing.T) {
 	}
 }
 
+func TestIsSupportedStorageEndpointSuffix(t *testing.T) {
+	tests := []struct {
+		suffix         string
+		expectedResult bool
+	}{
+		{suffix: "", expectedResult: true},
+		{suffix: "core.windows.net", expectedResult: true},
+		{suffix: "core.chinacloudapi.cn", expectedResult: true},
+		{suffix: "local.azurestack.external", expectedResult: true},
+		{suffix: "Region.AzureStack.External", expectedResult: true},
+		{suffix: "localhost", expectedResult: false},
+		{suffix: "https://core.windows.net", expectedResult: false},
+		{suffix: "core.windows.net/path", expectedResult: false},
+		{suffix: ".core.windows.net", expectedResult: false},
+		{suffix: "core windows.net", expectedResult: false},
+	}
+
+	for _, test := range tests {
+		result := isSupportedStorageEndpointSuffix(test.suffix)
+		if result != test.expectedResult {
+			t.Errorf("isSupportedStorageEndpointSuffix(%s) returned with %v, not equal to %v", test.suffix, result, test.expectedResult)
+		}
+	}
+}
+
 func TestIsSupportedShareNamePrefix(t *testing.T) {
 	tests := []struct {
 		prefix         string
@@ -307,6 +376,26 @@ func TestIsRetriableError(t *testing.T) {
 			rpcErr:       errors.New("could not list storage accounts for account type : Retriable: true, RetryAfter: 16s, HTTPStatusCode: 0, RawError: azure cloud provider throttled for operation StorageAccountListByResourceGroup with reason \"client throttled\""),
 			expectedBool: true,
 		},
+		{
+			desc:         "shareSnapshotOperationInProgress",
+			rpcErr:       errors.New("storage.FileSharesClient#Create: Failure sending request: StatusCode=409 -- Original Error: autorest/azure: Service returned an error. Status=<nil> Code=\"ShareSnapshotOperationInProgress\" Message=\"Another share snapshot operation is in progress.\""),
+			expectedBool: true,
+		},
+		{
+			desc:         "snapshotOperationRateExceeded",
+			rpcErr:       errors.New("ServiceCode=SnapshotOperationRateExceeded, The rate of snapshot operations is too high."),
+			expectedBool: true,
+		},
+		{
+			desc:         "requestDisallowedByPolicy",
+			rpcErr:       errors.New("failed to create storage account f233333, error: Retriable: false, RetryAfter: 0s, HTTPStatusCode: 403, RawError: {\"error\":{\"code\":\"RequestDisallowedByPolicy\",\"message\":\"Resource 'f233333' was disallowed by policy.\"}}"),
+			expectedBool: false,
+		},
+		{
+			desc:         "requestDisallowedByPolicy with retriable message",
+			rpcErr:       errors.New("Retriable: true, HTTPStatusCode: 429, RawError: TooManyRequests, Code=\"RequestDisallowedByPolicy\""),
+			expectedBool: false,
+		},
 	}
 
 	for _, test := range tests {
@@ -318,14 +407,110 @@ func TestIsRetriableError(t *testing.T) {
 	}
 }
 
+func TestIsPolicyDeniedError(t *testing.T) {
+	tests := []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{
+			desc:     "nil error",
+			err:      nil,
+			expected: false,
+		},
+		{
+			desc:     "non policy error",
+			err:      errors.New("StorageAccountIsNotProvisioned"),
+			expected: false,
+		},
+		{
+			desc:     "policy denied error",
+			err:      errors.New("Code=\"RequestDisallowedByPolicy\" Message=\"Resource 'f233333' was disallowed by policy.\""),
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		result := isPolicyDeniedError(test.err)
+		if result != test.expected {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestIsSnapshotRateExceededError(t *testing.T) {
+	tests := []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{
+			desc:     "nil error",
+			err:      nil,
+			expected: false,
+		},
+		{
+			desc:     "throttling error",
+			err:      errors.New("TooManyRequests"),
+			expected: false,
+		},
+		{
+			desc:     "snapshot rate exceeded error",
+			err:      errors.New("ServiceCode=SnapshotOperationRateExceeded, The rate of snapshot operations is too high."),
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		result := isSnapshotRateExceededError(test.err)
+		if result != test.expected {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
 func TestSleepIfThrottled(t *testing.T) {
-	start := time.Now()
-	sleepIfThrottled(errors.New("tooManyRequests"), 10)
-	elapsed := time.Since(start)
-	if elapsed.Seconds() < 10 {
-		t.Errorf("Expected sleep time(%d), Actual sleep time(%f)", 10, elapsed.Seconds())
+	var sleptDuration time.Duration
+	throttlingSleep = func(d time.Duration) { sleptDuration = d }
+	defer func() { throttlingSleep = time.Sleep }()
+
+	base := 10 * time.Second
+	minDuration := time.Duration(float64(base) * (1 - throttlingSleepJitter))
+	maxDuration := time.Duration(float64(base) * (1 + throttlingSleepJitter))
+	durations := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		sleptDuration = 0
+		sleepIfThrottled(errors.New("tooManyRequests"), throttlingLevelFile, 10)
+		if sleptDuration < minDuration || sleptDuration > maxDuration {
+			t.Fatalf("sleep time(%v) is out of jittered bounds [%v, %v]", sleptDuration, minDuration, maxDuration)
+		}
+		durations[sleptDuration] = true
+	}
+	if len(durations) < 2 {
+		t.Errorf("expected random sleep time, got %v", durations)
 	}
 
+	sleptDuration = 0
+	sleepIfThrottled(errors.New("internal error"), throttlingLevelFile, 10)
+	if sleptDuration != 0 {
+		t.Errorf("unexpected sleep time(%v) without throttling", sleptDuration)
+	}
+}
+
+func TestThrottlingSleepSecOptions(t *testing.T) {
+	d := NewFakeDriver()
+	assert.Equal(t, defaultAccountOpThrottlingSleepSec, d.accountOpThrottlingSleepSec)
+	assert.Equal(t, defaultFileOpThrottlingSleepSec, d.fileOpThrottlingSleepSec)
+
+	d = NewFakeDriverCustomOptions(DriverOptions{AccountOpThrottlingSleepSec: 2, FileOpThrottlingSleepSec: 20})
+	var sleptDuration time.Duration
+	throttlingSleep = func(d time.Duration) { sleptDuration = d }
+	defer func() { throttlingSleep = time.Sleep }()
+
+	d.sleepIfAccountOpThrottled(errors.New("tooManyRequests"))
+	assert.InDelta(t, 2*time.Second, sleptDuration, float64(2*time.Second)*throttlingSleepJitter)
+	d.sleepIfFileOpThrottled(errors.New("tooManyRequests"))
+	assert.InDelta(t, 20*time.Second, sleptDuration, float64(20*time.Second)*throttlingSleepJitter)
 }
 
 func TestUseDataPlaneAPI(t *testing.T) {
@@ -364,6 +549,56 @@ func TestConvertTagsToMap(t *testing.T) {
 			tags:          "testTag=testValue",
 			expectedError: nil,
 		},
+		{
+			desc:          "Valid JSON tags",
+			tags:          `{"testTag": "testValue", "key2": " value2 "}`,
+			expectedError: nil,
+		},
+		{
+			desc:          "Invalid JSON key",
+			tags:          `{" ": "testValue"}`,
+			expectedError: errors.New(`Tags '{" ": "testValue"}' are invalid, tag key should not be empty`),
+		},
+		{
+			desc:          "Valid semicolon separated tags",
+			tags:          "key1=value1;key2=value2",
+			expectedError: nil,
+		},
+		{
+			desc:          "Trailing delimiter",
+			tags:          "key1=value1;",
+			expectedError: errors.New("Tags 'key1=value1;' are invalid, the format should like: 'key1=value1,key2=value2'"),
+		},
+		{
+			desc:          "Missing value delimiter",
+			tags:          "key1=value1,key2",
+			expectedError: errors.New("Tags 'key1=value1,key2' are invalid, the format should like: 'key1=value1,key2=value2'"),
+		},
+		{
+			desc:          "Duplicated key",
+			tags:          "key=value1,Key=value2",
+			expectedError: errors.New("Tags 'key=value1,Key=value2' are invalid, tag key(Key) is duplicated"),
+		},
+		{
+			desc:          "Invalid character in key",
+			tags:          "dept/team=storage",
+			expectedError: errors.New(`Tags 'dept/team=storage' are invalid, tag key(dept/team) should not contain any of <>%&\?/`),
+		},
+		{
+			desc:          "Invalid character in JSON key",
+			tags:          `{"a<b": "value"}`,
+			expectedError: errors.New(`Tags '{"a<b": "value"}' are invalid, tag key(a<b) should not contain any of <>%&\?/`),
+		},
+		{
+			desc:          "Too long key",
+			tags:          strings.Repeat("k", 513) + "=value",
+			expectedError: fmt.Errorf("Tags '%s=value' are invalid, length of tag key(%s) should not exceed 512", strings.Repeat("k", 513), strings.Repeat("k", 513)),
+		},
+		{
+			desc:          "Too long value",
+			tags:          "key=" + strings.Repeat("v", 257),
+			expectedError: fmt.Errorf("Tags 'key=%s' are invalid, length of tag(key) value should not exceed 256", strings.Repeat("v", 257)),
+		},
 	}
 
 	for _, test := range tests {
@@ -372,6 +607,58 @@ func TestConvertTagsToMap(t *testing.T) {
 			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedError)
 		}
 	}
+
+	// both formats are parsed into the same map
+	for _, tags := range []string{"owner=alice, environment = dev", "owner=alice;environment=dev", `{"owner":"alice","environment":"dev"}`} {
+		result, err := ConvertTagsToMap(tags)
+		if err != nil {
+			t.Errorf("ConvertTagsToMap(%s) returned with error: %v", tags, err)
+		}
+		if expected := map[string]string{"owner": "alice", "environment": "dev"}; !reflect.DeepEqual(result, expected) {
+			t.Errorf("ConvertTagsToMap(%s) returned with %v, expected %v", tags, result, expected)
+		}
+	}
+
+	if _, err := ConvertTagsToMap(`{"owner":`); err == nil {
+		t.Errorf("expected error for malformed JSON tags")
+	}
+}
+
+func TestConvertTagsToShareMetadata(t *testing.T) {
+	tests := []struct {
+		desc     string
+		tags     map[string]string
+		expected azfile.Metadata
+	}{
+		{
+			desc:     "empty tags",
+			tags:     map[string]string{},
+			expected: azfile.Metadata{},
+		},
+		{
+			desc:     "nil tags",
+			tags:     nil,
+			expected: azfile.Metadata{},
+		},
+		{
+			desc:     "valid tags",
+			tags:     map[string]string{"Owner": "alice", "cost_center": "1234"},
+			expected: azfile.Metadata{"owner": "alice", "cost_center": "1234"},
+		},
+		{
+			desc: "invalid metadata names and reserved names are skipped",
+			tags: map[string]string{"cost-center": "1234", "1env": "dev", maxShareQuotaKey: "1", snapshotNameKey: "x", "RetainSharePolicy": "delete", retainedMetadataKey: "false",
+				deleteAccountWhenEmptyKey: "true", "CreatedBy": "other", clusterIDMetadataKey: "other", "env": "dev"},
+			expected: azfile.Metadata{"env": "dev"},
+		},
+	}
+
+	for _, test := range tests {
+		result := convertTagsToShareMetadata(test.tags)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: unexpected result: %v, expected: %v", test.desc, result, test.expected)
+		}
+	}
 }
 
 func TestChmodIfPermissionMismatch(t *testing.T) {
@@ -538,6 +825,46 @@ func TestSetKeyValueInMap(t *testing.T) {
 	}
 }
 
+func TestGetValueInMap(t *testing.T) {
+	tests := []struct {
+		desc     string
+		m        map[string]string
+		key      string
+		expected string
+	}{
+		{
+			desc:     "nil map",
+			key:      "key",
+			expected: "",
+		},
+		{
+			desc:     "key not exists",
+			m:        map[string]string{"k": "v"},
+			key:      "key",
+			expected: "",
+		},
+		{
+			desc:     "same key exists",
+			m:        map[string]string{"subDir": "value"},
+			key:      "subDir",
+			expected: "value",
+		},
+		{
+			desc:     "case insensitive key exists",
+			m:        map[string]string{"subDir": "value"},
+			key:      "subdir",
+			expected: "value",
+		},
+	}
+
+	for _, test := range tests {
+		result := getValueInMap(test.m, test.key)
+		if result != test.expected {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
 func TestReplaceWithMap(t *testing.T) {
 	tests := []struct {
 		desc     string
@@ -589,3 +916,175 @@ func TestReplaceWithMap(t *testing.T) {
 		}
 	}
 }
+
+func TestIsTagsMatched(t *testing.T) {
+	tags := map[string]*string{"pool": pointer.String("gold"), "Env": pointer.String("prod"), "empty": nil}
+	tests := []struct {
+		requiredTags map[string]string
+		expected     bool
+	}{
+		{requiredTags: nil, expected: true},
+		{requiredTags: map[string]string{"pool": "gold"}, expected: true},
+		{requiredTags: map[string]string{"pool": "gold", "env": "prod"}, expected: true},
+		{requiredTags: map[string]string{"empty": ""}, expected: true},
+		{requiredTags: map[string]string{"pool": "gold", "env": "dev"}, expected: false},
+		{requiredTags: map[string]string{"pool": "gold", "zone": "1"}, expected: false},
+	}
+	for _, test := range tests {
+		if result := isTagsMatched(tags, test.requiredTags); result != test.expected {
+			t.Errorf("requiredTags: %v, result: %v, expected: %v", test.requiredTags, result, test.expected)
+		}
+	}
+}
+
+func TestIsValidSubscriptionID(t *testing.T) {
+	tests := []struct {
+		subsID   string
+		expected bool
+	}{
+		{subsID: "", expected: false},
+		{subsID: "abc", expected: false},
+		{subsID: "c9d5b1a4-2f0a-4a6e-9c3b-8f1e2d3c4b5a", expected: true},
+		{subsID: "C9D5B1A4-2F0A-4A6E-9C3B-8F1E2D3C4B5A", expected: true},
+		{subsID: "c9d5b1a42f0a4a6e9c3b8f1e2d3c4b5a", expected: false},
+		{subsID: "c9d5b1a4-2f0a-4a6e-9c3b-8f1e2d3c4b5g", expected: false},
+		{subsID: " c9d5b1a4-2f0a-4a6e-9c3b-8f1e2d3c4b5a", expected: false},
+	}
+	for _, test := range tests {
+		if result := isValidSubscriptionID(test.subsID); result != test.expected {
+			t.Errorf("subsID: %q, result: %v, expected: %v", test.subsID, result, test.expected)
+		}
+	}
+}
+
+func TestIsValidInitMarker(t *testing.T) {
+	tests := []struct {
+		marker   string
+		expected bool
+	}{
+		{marker: "", expected: true},
+		{marker: ".initialized", expected: true},
+		{marker: "data/.initialized", expected: true},
+		{marker: "data/", expected: true},
+		{marker: "/", expected: false},
+		{marker: "/data", expected: false},
+		{marker: "\\data", expected: false},
+		{marker: ".", expected: false},
+		{marker: "../data", expected: false},
+		{marker: "data/../../.initialized", expected: false},
+		{marker: "data\\..\\.initialized", expected: false},
+	}
+	for _, test := range tests {
+		if result := isValidInitMarker(test.marker); result != test.expected {
+			t.Errorf("marker: %q, result: %v, expected: %v", test.marker, result, test.expected)
+		}
+	}
+}
+
+func TestCreateInitMarker(t *testing.T) {
+	tests := []struct {
+		desc          string
+		existingFiles []string
+		marker        string
+		expectedPath  string
+		expectedDir   bool
+		expectCreated bool
+	}{
+		{
+			desc:          "marker file is created on empty volume",
+			marker:        ".initialized",
+			expectedPath:  ".initialized",
+			expectCreated: true,
+		},
+		{
+			desc:          "marker file in sub directory is created on empty volume",
+			marker:        "data/.initialized",
+			expectedPath:  filepath.Join("data", ".initialized"),
+			expectCreated: true,
+		},
+		{
+			desc:          "marker directory is created on empty volume",
+			marker:        "data/",
+			expectedPath:  "data",
+			expectedDir:   true,
+			expectCreated: true,
+		},
+		{
+			desc:          "lost+found is ignored",
+			existingFiles: []string{"lost+found"},
+			marker:        ".initialized",
+			expectedPath:  ".initialized",
+			expectCreated: true,
+		},
+		{
+			desc:          "marker is not created on disk volume in use",
+			existingFiles: []string{"lost+found", "app.db"},
+			marker:        ".initialized",
+			expectedPath:  ".initialized",
+			expectCreated: false,
+		},
+		{
+			desc:          "marker is not created on volume in use",
+			existingFiles: []string{"app.db"},
+			marker:        ".initialized",
+			expectedPath:  ".initialized",
+			expectCreated: false,
+		},
+	}
+
+	for _, test := range tests {
+		mountPath := t.TempDir()
+		for _, file := range test.existingFiles {
+			if err := os.Mkdir(filepath.Join(mountPath, file), 0755); err != nil {
+				t.Fatalf("test case: %s, unexpected error: %v", test.desc, err)
+			}
+		}
+		if err := createInitMarker(mountPath, test.marker); err != nil {
+			t.Errorf("test case: %s, unexpected error: %v", test.desc, err)
+		}
+		info, err := os.Stat(filepath.Join(mountPath, test.expectedPath))
+		if test.expectCreated {
+			if err != nil {
+				t.Errorf("test case: %s, marker is not created: %v", test.desc, err)
+			} else if info.IsDir() != test.expectedDir {
+				t.Errorf("test case: %s, marker is directory: %v, expected: %v", test.desc, info.IsDir(), test.expectedDir)
+			}
+		} else if !os.IsNotExist(err) {
+			t.Errorf("test case: %s, marker should not be created, error: %v", test.desc, err)
+		}
+	}
+
+	// marker is created only once
+	mountPath := t.TempDir()
+	assert.NoError(t, createInitMarker(mountPath, ".initialized"))
+	assert.NoError(t, os.Remove(filepath.Join(mountPath, ".initialized")))
+	assert.NoError(t, os.WriteFile(filepath.Join(mountPath, "app.db"), []byte("data"), 0644))
+	assert.NoError(t, createInitMarker(mountPath, ".initialized"))
+	_, err := os.Stat(filepath.Join(mountPath, ".initialized"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIsSupportedAccountNamePrefix(t *testing.T) {
+	tests := []struct {
+		prefix         string
+		expectedResult bool
+	}{
+		{prefix: "f", expectedResult: true},
+		{prefix: "csifile", expectedResult: true},
+		{prefix: "csi2file", expectedResult: true},
+		{prefix: "abcdefghijklmno", expectedResult: true},
+		{prefix: "", expectedResult: false},
+		{prefix: "abcdefghijklmnop", expectedResult: false},
+		{prefix: "CSIfile", expectedResult: false},
+		{prefix: "csi-file", expectedResult: false},
+		{prefix: "csi_file", expectedResult: false},
+		{prefix: " csifile", expectedResult: false},
+	}
+
+	for _, test := range tests {
+		result := isSupportedAccountNamePrefix(test.prefix)
+		if result != test.expectedResult {
+			t.Errorf("isSupportedAccountNamePrefix(%s) returned with %v, not equal to %v", test.prefix, result, test.expectedResult)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"regexp"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	volumeLifecycleStartedMsg  = "volume lifecycle operation started"
+	volumeLifecycleFinishedMsg = "volume lifecycle operation finished"
+	redactedValue              = "<redacted>"
+)
+
+// accountKeyPattern matches account key in mount options (password=xxx) and connection strings (AccountKey=xxx)
+var accountKeyPattern = regexp.MustCompile(`(?i)(password|accountkey|` + defaultSecretAccountKey + `)=[^,;\s]*`)
+
+// volumeLifecycleEvent emits structured logs with consistent keys at the start and the end of
+// CreateVolume, DeleteVolume, NodeStageVolume and NodeUnstageVolume for log ingestion,
+// there is no field for account key, and any account key in the values is redacted
+type volumeLifecycleEvent struct {
+	operation  string
+	volumeName string
+	volumeID   string
+	account    string
+	share      string
+	protocol   string
+	startTime  time.Time
+}
+
+// newVolumeLifecycleEvent logs the start of the operation, volumeName is only available in CreateVolume
+func newVolumeLifecycleEvent(operation, volumeName, volumeID string) *volumeLifecycleEvent {
+	e := &volumeLifecycleEvent{operation: operation, volumeName: volumeName, volumeID: volumeID, startTime: time.Now()}
+	klog.InfoS(volumeLifecycleStartedMsg, e.keysAndValues()...)
+	return e
+}
+
+// finish logs the end of the operation with its result and duration
+func (e *volumeLifecycleEvent) finish(succeeded bool) {
+	klog.InfoS(volumeLifecycleFinishedMsg, append(e.keysAndValues(), "succeeded", succeeded, "duration", time.Since(e.startTime).String())...)
+}
+
+// setProtocol records the effective protocol of the volume, smb by default
+func (e *volumeLifecycleEvent) setProtocol(protocol, fsType string) {
+	e.protocol = getEffectiveProtocol(protocol, fsType)
+	if e.protocol == "" {
+		e.protocol = smb
+	}
+}
+
+func (e *volumeLifecycleEvent) keysAndValues() []interface{} {
+	return []interface{}{
+		"operation", e.operation,
+		"volumeName", redactAccountKey(e.volumeName),
+		"volumeID", redactAccountKey(e.volumeID),
+		"account", redactAccountKey(e.account),
+		"share", redactAccountKey(e.share),
+		"protocol", redactAccountKey(e.protocol),
+	}
+}
+
+func redactAccountKey(value string) string {
+	return accountKeyPattern.ReplaceAllString(value, "${1}="+redactedValue)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2"
+)
+
+func TestVolumeLifecycleEventKeysAndValues(t *testing.T) {
+	e := &volumeLifecycleEvent{operation: "NodeStageVolume", volumeID: "rg#account#share#", account: "account", share: "share"}
+	e.setProtocol("", "")
+	kvs := e.keysAndValues()
+	assert.Equal(t, 0, len(kvs)%2)
+	fields := map[string]interface{}{}
+	for i := 0; i < len(kvs); i += 2 {
+		fields[kvs[i].(string)] = kvs[i+1]
+	}
+	assert.Equal(t, map[string]interface{}{
+		"operation":  "NodeStageVolume",
+		"volumeName": "",
+		"volumeID":   "rg#account#share#",
+		"account":    "account",
+		"share":      "share",
+		"protocol":   smb,
+	}, fields)
+
+	e.setProtocol("", nfs)
+	assert.Equal(t, nfs, e.protocol)
+}
+
+func TestRedactAccountKey(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "", expected: ""},
+		{value: "rg#account#share#", expected: "rg#account#share#"},
+		{value: "username=account,password=secretkey==,vers=3.0", expected: "username=account,password=<redacted>,vers=3.0"},
+		{value: "DefaultEndpointsProtocol=https;AccountName=account;AccountKey=secretkey==;EndpointSuffix=core.windows.net",
+			expected: "DefaultEndpointsProtocol=https;AccountName=account;AccountKey=<redacted>;EndpointSuffix=core.windows.net"},
+		{value: "azurestorageaccountkey=secretkey== ", expected: "azurestorageaccountkey=<redacted> "},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, redactAccountKey(test.value), test.value)
+	}
+}
+
+func TestVolumeLifecycleEventLogs(t *testing.T) {
+	buf := new(bytes.Buffer)
+	klog.LogToStderr(false)
+	klog.SetOutput(buf)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	}()
+
+	e := newVolumeLifecycleEvent("CreateVolume", "pvc-123", "")
+	e.account, e.share = "account", "share"
+	e.setProtocol(nfs, "")
+	e.volumeID = "rg#account#share#AccountKey=secretkey=="
+	e.finish(true)
+	klog.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"`+volumeLifecycleStartedMsg+`"`)
+	assert.Contains(t, lines[0], `operation="CreateVolume" volumeName="pvc-123" volumeID=""`)
+	assert.Contains(t, lines[1], `"`+volumeLifecycleFinishedMsg+`"`)
+	for _, key := range []string{"operation=", "volumeName=", "volumeID=", "account=", "share=", "protocol=", "succeeded=", "duration="} {
+		assert.Contains(t, lines[1], key)
+	}
+	assert.Contains(t, lines[1], `account="account" share="share" protocol="nfs" succeeded=true`)
+	assert.NotContains(t, buf.String(), "secretkey")
+}
@@ -23,11 +23,16 @@ import (
 )
 
 const (
-	volumeOperationAlreadyExistsFmt = "An operation with the given Volume ID %s already exists"
+	volumeOperationAlreadyExistsFmt   = "An operation with the given Volume ID %s already exists"
+	snapshotOperationAlreadyExistsFmt = "An operation to create snapshot of source volume %s already exists"
 )
 
 // VolumeLocks implements a map with atomic operations. It stores a set of all volume IDs
 // with an ongoing operation.
+// The locks only live in memory and are lost on driver restart, while the Azure operation started by
+// the previous process may still be in flight. So every operation guarded by volumeLocks must be safe
+// to re-run and derive its state from Azure (share existence, snapshot metadata, vhd disk metadata)
+// instead of the memory of current process.
 type volumeLocks struct {
 	locks sets.String
 	mux   sync.Mutex
@@ -0,0 +1,119 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+const (
+	storageAccountListKeysAPIVersion = "2021-09-01"
+)
+
+// workloadIdentityClient gets storage account key with the workload identity of the driver
+type workloadIdentityClient interface {
+	GetStorageAccountKey(ctx context.Context, subsID, resourceGroup, accountName string, getLatestAccountKey bool) (string, error)
+}
+
+// azureWorkloadIdentityClient lists account keys by ARM REST API using federated token of the driver pod,
+// client id, tenant id and token file are read from the env variables injected by azure workload identity webhook
+type azureWorkloadIdentityClient struct {
+	credential              azcore.TokenCredential
+	resourceManagerEndpoint string
+}
+
+func newAzureWorkloadIdentityClient(resourceManagerEndpoint string) (*azureWorkloadIdentityClient, error) {
+	credential, err := azidentity.NewWorkloadIdentityCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &azureWorkloadIdentityClient{credential: credential, resourceManagerEndpoint: resourceManagerEndpoint}, nil
+}
+
+// GetStorageAccountKey returns the first key of storage account, or the key with latest creation time if getLatestAccountKey is true
+func (c *azureWorkloadIdentityClient) GetStorageAccountKey(ctx context.Context, subsID, resourceGroup, accountName string, getLatestAccountKey bool) (string, error) {
+	scope := strings.TrimSuffix(c.resourceManagerEndpoint, "/") + "/.default"
+	pipeline := runtime.NewPipeline("azurefile-csi-driver", driverVersion, runtime.PipelineOptions{
+		PerRetry: []policy.Policy{runtime.NewBearerTokenPolicy(c.credential, []string{scope}, nil)},
+	}, nil)
+
+	req, err := runtime.NewRequest(ctx, http.MethodPost, runtime.JoinPaths(c.resourceManagerEndpoint,
+		"subscriptions", subsID, "resourceGroups", resourceGroup, "providers/Microsoft.Storage/storageAccounts", accountName, "listKeys"))
+	if err != nil {
+		return "", err
+	}
+	query := req.Raw().URL.Query()
+	query.Set("api-version", storageAccountListKeysAPIVersion)
+	req.Raw().URL.RawQuery = query.Encode()
+	req.Raw().Header.Set("Accept", "application/json")
+
+	resp, err := pipeline.Do(req)
+	if err != nil {
+		return "", err
+	}
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return "", runtime.NewResponseError(resp)
+	}
+	var result storageAccountListKeysResult
+	if err := runtime.UnmarshalAsJSON(resp, &result); err != nil {
+		return "", err
+	}
+	if key := result.getKey(getLatestAccountKey); key != "" {
+		return key, nil
+	}
+	return "", fmt.Errorf("no valid key found in storage account(%s) under resource group(%s)", accountName, resourceGroup)
+}
+
+// storageAccountListKeysResult is the response of storage account listKeys ARM API
+type storageAccountListKeysResult struct {
+	Keys []storageAccountKey `json:"keys"`
+}
+
+type storageAccountKey struct {
+	Value        *string    `json:"value"`
+	CreationTime *time.Time `json:"creationTime"`
+}
+
+// getKey returns the first valid key, or the valid key with latest creation time if getLatestAccountKey is true
+func (r storageAccountListKeysResult) getKey(getLatestAccountKey bool) string {
+	var key string
+	var creationTime time.Time
+	for _, k := range r.Keys {
+		if k.Value == nil || *k.Value == "" {
+			continue
+		}
+		if !getLatestAccountKey {
+			return *k.Value
+		}
+		if key == "" || (k.CreationTime != nil && creationTime.Before(*k.CreationTime)) {
+			key = *k.Value
+			if k.CreationTime != nil {
+				creationTime = *k.CreationTime
+			}
+		}
+	}
+	return key
+}
@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"sigs.k8s.io/azurefile-csi-driver/pkg/azurefile"
 
@@ -53,6 +54,7 @@ var (
 	allowInlineVolumeKeyAccessWithIdentity = flag.Bool("allow-inline-volume-key-access-with-identity", false, "allow accessing storage account key using cluster identity for inline volume")
 	fsGroupChangePolicy                    = flag.String("fsgroup-change-policy", "", "indicates how the volume's ownership will be changed by the driver, OnRootMismatch is the default value")
 	enableVHDDiskFeature                   = flag.Bool("enable-vhd", true, "enable VHD disk feature (experimental)")
+	enableProxyMount                       = flag.Bool("enable-proxy-mount", false, "mount smb and nfs share on the proxy-mount path and bind mount it onto the staging path by default, could be overridden by proxyMount in volume context, vhd disk volume is always mounted through the proxy-mount path")
 	kubeAPIQPS                             = flag.Float64("kube-api-qps", 25.0, "QPS to use while communicating with the kubernetes apiserver.")
 	kubeAPIBurst                           = flag.Int("kube-api-burst", 50, "Burst to use while communicating with the kubernetes apiserver.")
 	appendMountErrorHelpLink               = flag.Bool("append-mount-error-help-link", true, "Whether to include a link for help with mount errors when a mount error occurs.")
@@ -63,6 +65,48 @@ var (
 	volStatsCacheExpireInMinutes           = flag.Int("vol-stats-cache-expire-in-minutes", 10, "The cache expire time in minutes for volume stats cache")
 	printVolumeStatsCallLogs               = flag.Bool("print-volume-stats-call-logs", false, "Whether to print volume statfs call logs with log level 2")
 	sasTokenExpirationMinutes              = flag.Int("sas-token-expiration-minutes", 1440, "sas token expiration minutes during volume cloning")
+	mountStatsRefreshIntervalInSeconds     = flag.Int("mount-stats-refresh-interval-seconds", 0, "interval in seconds to refresh per volume mount I/O metrics from /proc/self/mountstats, 0 means disabled")
+	defaultFileMode                        = flag.String("default-file-mode", "", "default file_mode of smb mount if not specified in mountOptions, empty means 0777")
+	defaultDirMode                         = flag.String("default-dir-mode", "", "default dir_mode of smb mount if not specified in mountOptions, empty means 0777")
+	defaultVers                            = flag.String("default-vers", "", "default smb protocol version(vers) of smb mount if not specified in mountOptions, supported values: 2.0, 2.1, 3, 3.0, 3.02, 3.0.2, 3.1.1, 3.11, default, empty means negotiated by mount.cifs")
+	defaultActimeo                         = flag.String("default-actimeo", "", "default actimeo of smb mount if not specified in mountOptions, empty means 30")
+	defaultReadOnlyActimeo                 = flag.String("default-readonly-actimeo", "", "default actimeo of read-only smb mount if not specified in mountOptions, empty means 600")
+	secretAccountKeyNames                  = flag.String("secret-account-key-names", "azurestorageaccountkey", "comma separated data key names of account key in k8s secret, the first non-empty value is used")
+	shareBeingDeletedTimeoutInSeconds      = flag.Int("share-being-deleted-timeout-seconds", 300, "max wait time in seconds for the deletion of a file share with the same name before creating the file share")
+	cloneTimeout                           = flag.Duration("clone-timeout", 3*time.Minute, "max wait time for copying the source file share in volume cloning")
+	maxConcurrentDiskNodeOperations        = flag.Int("max-concurrent-disk-node-operations", 0, "maximum number of concurrent node stage/unstage/expand operations on vhd disk volumes, 0 means no limit")
+	maxConcurrentShareNodeOperations       = flag.Int("max-concurrent-share-node-operations", 0, "maximum number of concurrent node stage/unstage operations on smb/nfs file share volumes, 0 means no limit")
+	enableDryRun                           = flag.Bool("enable-dry-run", false, "allow dryrun storage class parameter which validates CreateVolume parameters without provisioning file share")
+	mountOptionsMismatchPolicy             = flag.String("mount-options-mismatch-policy", "ignore", "how to handle a staging path which is already mounted with different mount options in NodeStageVolume: ignore, remount or error")
+	nilShareQuotaPolicy                    = flag.String("nil-share-quota-policy", "error", "how to handle a file share whose quota returned by management API is nil: error, default(use default quota) or dataplane(query quota via data plane API)")
+	maxConcurrentResizeOperations          = flag.Int("max-concurrent-resize-operations", 0, "maximum number of concurrent file share resize operations in ControllerExpandVolume, 0 means no limit")
+	accountKeyTTL                          = flag.Duration("account-key-ttl", 3*time.Minute, "how long an account key is cached in memory before it's fetched again, rotated account keys are picked up after this period")
+	accountKeyCheckIntervalInSeconds       = flag.Int("account-key-check-interval-seconds", 0, "interval in seconds to revalidate cached account keys with data plane API and evict invalid ones, 0 means disabled")
+	enableShareGC                          = flag.Bool("enable-share-gc", false, "periodically delete file shares created by this driver whose persistent volumes no longer exist")
+	shareGCInterval                        = flag.Duration("share-gc-interval", time.Hour, "interval of reclaiming orphaned file shares when enable-share-gc is true")
+	shareGCGracePeriod                     = flag.Duration("share-gc-grace-period", 24*time.Hour, "orphaned file shares are reclaimed only after being observed as orphaned for this period")
+	clusterID                              = flag.String("cluster-id", "", "id of this cluster recorded in file share metadata for share gc, uid of kube-system namespace is used if empty")
+	dataPlaneMaxTries                      = flag.Int("data-plane-max-tries", 3, "maximum number of tries of a data plane file request, e.g. vhd disk creation, zero or negative value means default")
+	dataPlaneTryTimeout                    = flag.Duration("data-plane-try-timeout", 3*time.Second, "maximum time allowed for a single try of data plane file request, zero or negative value means default")
+	dataPlaneRetryDelay                    = flag.Duration("data-plane-retry-delay", time.Second, "exponential backoff delay between retries of data plane file request, zero or negative value means default")
+	dataPlaneMaxRetryDelay                 = flag.Duration("data-plane-max-retry-delay", 3*time.Second, "maximum delay between retries of data plane file request, zero or negative value means default")
+	transientMountErrors                   = flag.String("transient-mount-errors", "", "comma separated mount error codes or messages retried in NodeStageVolume, e.g. \"mount error(11),mount error(112)\", empty means the default list")
+	transientMountRetryInterval            = flag.Duration("transient-mount-retry-interval", time.Second, "interval of retrying mount on transient-mount-errors in NodeStageVolume, zero or negative value means default")
+	transientMountRetryTimeout             = flag.Duration("transient-mount-retry-timeout", 2*time.Minute, "timeout of retrying mount on transient-mount-errors in NodeStageVolume, zero or negative value means default")
+	maxVHDDiskSizeGiB                      = flag.Int64("max-vhd-disk-size-gib", 0, "maximum size in GiB of vhd disk volume created in CreateVolume, zero means no limit")
+	accountOpThrottlingSleepSec            = flag.Int("account-op-throttling-sleep-sec", 16, "base sleep seconds with 25% random jitter when storage account operation is throttled, zero or negative value means default")
+	fileOpThrottlingSleepSec               = flag.Int("file-op-throttling-sleep-sec", 180, "base sleep seconds with 25% random jitter when file share operation is throttled, zero or negative value means default")
+	accountKeySources                      = flag.String("account-key-sources", "secret,workloadidentity,clusteridentity", "comma separated prioritized sources of account key when it is not provided in request secrets, supported sources: secret, workloadidentity, clusteridentity")
+	serializeAccountCreation               = flag.Bool("serialize-account-creation", false, "serialize storage account selection and creation in the whole resource group instead of only among CreateVolume requests with the same account options, concurrent CreateVolume requests with the same account options never create redundant storage accounts")
+	defaultSecretNamespace                 = flag.String("default-secret-namespace", "default", "namespace of account key secret if neither secretNamespace nor pvc namespace is specified")
+	centralSecretNamespace                 = flag.String("central-secret-namespace", "", "namespace of account key secret shared by all pvc namespaces if secretNamespace is not specified in storage class or volume attributes, empty means secret is stored in pvc namespace")
+	accountNamePrefix                      = flag.String("account-name-prefix", "f", "prefix of storage account name created by the driver, can only contain lowercase letters and numbers, and length should be less than 16")
+	nfsAccountNamePrefix                   = flag.String("nfs-account-name-prefix", "", "prefix of storage account name created by the driver for nfs file share, account-name-prefix is used if it's empty")
+	readinessAddress                       = flag.String("readiness-address", "", "address of http server serving /readyz which checks connectivity to azure resource manager, empty means disabled")
+	validateStaticVolumeID                 = flag.Bool("validate-static-volume-id", false, "check the file share in volume handle exists in ControllerPublishVolume and NodeStageVolume, volume handle should be in <rg>#<account>#<share> format")
+	strictVolumeIDParsing                  = flag.Bool("strict-volume-id-parsing", false, "reject malformed volume IDs with InvalidArgument instead of best-effort parsing")
+	allowedAccounts                        = flag.String("allowed-accounts", "", "comma separated storage account names the driver is allowed to operate on, empty means no restriction")
+	shareSnapshotMinIntervalInSeconds      = flag.Int("share-snapshot-min-interval-seconds", 0, "minimum interval in seconds between two snapshots of the same file share, 0 means no limit")
 )
 
 func main() {
@@ -101,6 +145,7 @@ func handle() {
 		AllowInlineVolumeKeyAccessWithIdentity: *allowInlineVolumeKeyAccessWithIdentity,
 		FSGroupChangePolicy:                    *fsGroupChangePolicy,
 		EnableVHDDiskFeature:                   *enableVHDDiskFeature,
+		EnableProxyMount:                       *enableProxyMount,
 		AppendMountErrorHelpLink:               *appendMountErrorHelpLink,
 		KubeAPIQPS:                             *kubeAPIQPS,
 		KubeAPIBurst:                           *kubeAPIBurst,
@@ -111,6 +156,48 @@ func handle() {
 		VolStatsCacheExpireInMinutes:           *volStatsCacheExpireInMinutes,
 		PrintVolumeStatsCallLogs:               *printVolumeStatsCallLogs,
 		SasTokenExpirationMinutes:              *sasTokenExpirationMinutes,
+		MountStatsRefreshIntervalInSeconds:     *mountStatsRefreshIntervalInSeconds,
+		ShareSnapshotMinIntervalInSeconds:      *shareSnapshotMinIntervalInSeconds,
+		DefaultFileMode:                        *defaultFileMode,
+		DefaultDirMode:                         *defaultDirMode,
+		DefaultVers:                            *defaultVers,
+		DefaultActimeo:                         *defaultActimeo,
+		DefaultReadOnlyActimeo:                 *defaultReadOnlyActimeo,
+		SecretAccountKeyNames:                  *secretAccountKeyNames,
+		ShareBeingDeletedTimeoutInSeconds:      *shareBeingDeletedTimeoutInSeconds,
+		CloneTimeout:                           *cloneTimeout,
+		AllowedAccounts:                        *allowedAccounts,
+		StrictVolumeIDParsing:                  *strictVolumeIDParsing,
+		MaxConcurrentDiskNodeOperations:        *maxConcurrentDiskNodeOperations,
+		MaxConcurrentShareNodeOperations:       *maxConcurrentShareNodeOperations,
+		EnableDryRun:                           *enableDryRun,
+		MountOptionsMismatchPolicy:             *mountOptionsMismatchPolicy,
+		NilShareQuotaPolicy:                    *nilShareQuotaPolicy,
+		MaxConcurrentResizeOperations:          *maxConcurrentResizeOperations,
+		AccountKeyTTL:                          *accountKeyTTL,
+		AccountKeyCheckIntervalInSeconds:       *accountKeyCheckIntervalInSeconds,
+		EnableShareGC:                          *enableShareGC,
+		ShareGCInterval:                        *shareGCInterval,
+		ShareGCGracePeriod:                     *shareGCGracePeriod,
+		ClusterID:                              *clusterID,
+		ValidateStaticVolumeID:                 *validateStaticVolumeID,
+		DataPlaneMaxTries:                      *dataPlaneMaxTries,
+		DataPlaneTryTimeout:                    *dataPlaneTryTimeout,
+		DataPlaneRetryDelay:                    *dataPlaneRetryDelay,
+		DataPlaneMaxRetryDelay:                 *dataPlaneMaxRetryDelay,
+		TransientMountErrors:                   *transientMountErrors,
+		TransientMountRetryInterval:            *transientMountRetryInterval,
+		TransientMountRetryTimeout:             *transientMountRetryTimeout,
+		MaxVHDDiskSizeGiB:                      *maxVHDDiskSizeGiB,
+		AccountOpThrottlingSleepSec:            *accountOpThrottlingSleepSec,
+		FileOpThrottlingSleepSec:               *fileOpThrottlingSleepSec,
+		AccountKeySources:                      *accountKeySources,
+		SerializeAccountCreation:               *serializeAccountCreation,
+		DefaultSecretNamespace:                 *defaultSecretNamespace,
+		AccountNamePrefix:                      *accountNamePrefix,
+		NFSAccountNamePrefix:                   *nfsAccountNamePrefix,
+		ReadinessAddress:                       *readinessAddress,
+		CentralSecretNamespace:                 *centralSecretNamespace,
 	}
 	driver := azurefile.NewDriver(&driverOptions)
 	if driver == nil {